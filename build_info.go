@@ -14,7 +14,10 @@
 package main
 
 import (
+	"runtime"
 	"text/template"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Build information. Populated by Makefile.
@@ -36,6 +39,19 @@ var BuildInfo = map[string]string{
 	"date":    buildDate,
 }
 
+func init() {
+	buildInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Name:      "build_info",
+			Help:      "A metric with a constant '1' value labeled by version, revision, branch, and goversion from which the Pushgateway was built.",
+		},
+		[]string{"version", "revision", "branch", "goversion"},
+	)
+	buildInfo.WithLabelValues(buildVersion, buildRev, buildBranch, runtime.Version()).Set(1)
+	prometheus.MustRegister(buildInfo)
+}
+
 var versionInfoTmpl = template.Must(template.New("version").Parse(
 	`pushgateway, version {{.version}} ({{.branch}}, commit {{.commit}})
   build user:       {{.user}}
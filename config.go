@@ -0,0 +1,242 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// config is the content of the configuration file given by -config.file.
+type config struct {
+	// MetricRelabelConfigs are applied to the pushed metrics exposed on
+	// the telemetry path.
+	MetricRelabelConfigs []handler.RelabelConfig `json:"metric_relabel_configs"`
+	// Endpoints are additional endpoints exposing the pushed metrics.
+	Endpoints []endpointConfig `json:"endpoints"`
+	// Limits, if set, override -storage.max-groups and -storage.max-bytes.
+	Limits *limitsConfig `json:"limits"`
+	// Rollups are added to the pushed metrics on all metrics endpoints,
+	// before relabeling.
+	Rollups []handler.RollupConfig `json:"rollups"`
+	// MetricUnits maps metric names to the units announced in the
+	// OpenMetrics format, overriding the inferred units.
+	MetricUnits map[string]string `json:"metric_units"`
+	// Tokens, if not empty, are required for all changing requests,
+	// see handler.TokenAuth.
+	Tokens []handler.TokenConfig `json:"tokens"`
+	// Expiration, if set, overrides -metric.expiration. It is parsed
+	// by time.ParseDuration.
+	Expiration *string `json:"expiration"`
+	// expiration is the parsed Expiration.
+	expiration time.Duration
+}
+
+// limitsConfig contains the limits of the store. Omitted limits are taken from
+// the flags.
+type limitsConfig struct {
+	MaxGroups *int   `json:"max_groups"`
+	MaxBytes  *int64 `json:"max_bytes"`
+}
+
+// limits returns the limits of the store, defaulting to the given values.
+func (c *config) limits(maxGroups int, maxBytes int64) (int, int64) {
+	if c.Limits != nil && c.Limits.MaxGroups != nil {
+		maxGroups = *c.Limits.MaxGroups
+	}
+	if c.Limits != nil && c.Limits.MaxBytes != nil {
+		maxBytes = *c.Limits.MaxBytes
+	}
+	return maxGroups, maxBytes
+}
+
+// storeExpiration returns the default expiration of the store, defaulting to
+// the given value.
+func (c *config) storeExpiration(expiration time.Duration) time.Duration {
+	if c.Expiration != nil {
+		return c.expiration
+	}
+	return expiration
+}
+
+// endpointConfig configures an additional endpoint exposing the pushed metrics
+// (but not the metrics of the Pushgateway itself) with its own relabeling
+// rules.
+type endpointConfig struct {
+	Path                 string                  `json:"path"`
+	MetricRelabelConfigs []handler.RelabelConfig `json:"metric_relabel_configs"`
+}
+
+// loadConfig reads the configuration file. An empty file name results in the
+// empty configuration.
+func loadConfig(file, metricsPath string) (*config, error) {
+	cfg := &config{}
+	if file == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %s", file, err)
+	}
+	seen := map[string]bool{metricsPath: true}
+	for _, ep := range cfg.Endpoints {
+		if !strings.HasPrefix(ep.Path, "/") {
+			return nil, fmt.Errorf("endpoint path %q must start with '/'", ep.Path)
+		}
+		if seen[ep.Path] {
+			return nil, fmt.Errorf("duplicate endpoint path %q", ep.Path)
+		}
+		seen[ep.Path] = true
+	}
+	if cfg.Limits != nil {
+		if l := cfg.Limits.MaxGroups; l != nil && *l < 0 {
+			return nil, fmt.Errorf("negative max_groups %d", *l)
+		}
+		if l := cfg.Limits.MaxBytes; l != nil && *l < 0 {
+			return nil, fmt.Errorf("negative max_bytes %d", *l)
+		}
+	}
+	if cfg.Expiration != nil {
+		d, err := time.ParseDuration(*cfg.Expiration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiration: %s", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("negative expiration %s", d)
+		}
+		cfg.expiration = d
+	}
+	return cfg, nil
+}
+
+// runtimeConfig applies a config to the running Pushgateway. The handlers of
+// the metrics endpoints read the relabeled metrics through the holders, so
+// that they pick up new relabeling rules without being re-created.
+type runtimeConfig struct {
+	exposed   func() []*dto.MetricFamily // Before rollups and relabeling.
+	ms        *storage.DiskMetricStore
+	maxGroups int   // Default from the flags.
+	maxBytes  int64 // Default from the flags.
+	// expiration is the default of the store expiration from the flags.
+	expiration time.Duration
+	relabeled  *handler.MetricFamiliesHolder
+	endpoints  map[string]*handler.MetricFamiliesHolder // By path.
+	units      *handler.MetricUnits
+	tokens     *handler.TokenAuth
+	// tenantStores are the stores of the tenants, limited like ms.
+	tenantStores map[string]*storage.DiskMetricStore
+	// plain is 1 while neither rollups nor relabeling rules apply to the
+	// telemetry path, see plainTelemetry.
+	plain int32
+}
+
+// newRuntimeConfig returns a runtimeConfig with cfg applied, except for the
+// store limits and expiration, which are expected to be set already.
+func newRuntimeConfig(cfg *config, exposed func() []*dto.MetricFamily, ms *storage.DiskMetricStore, maxGroups int, maxBytes int64, expiration time.Duration, units *handler.MetricUnits, tokens *handler.TokenAuth) (*runtimeConfig, error) {
+	rc := &runtimeConfig{
+		exposed:    exposed,
+		ms:         ms,
+		maxGroups:  maxGroups,
+		maxBytes:   maxBytes,
+		expiration: expiration,
+		relabeled:  handler.NewMetricFamiliesHolder(exposed),
+		endpoints:  map[string]*handler.MetricFamiliesHolder{},
+		units:      units,
+		tokens:     tokens,
+	}
+	for _, ep := range cfg.Endpoints {
+		rc.endpoints[ep.Path] = handler.NewMetricFamiliesHolder(exposed)
+	}
+	return rc, rc.apply(cfg, false)
+}
+
+// apply validates cfg completely before applying it. Endpoints cannot be added
+// or removed at runtime as they are mounted in the router at start-up. With
+// setLimits, the limits and the expiration of the store are changed, too.
+func (rc *runtimeConfig) apply(cfg *config, setLimits bool) error {
+	exposed, err := handler.Rollup(cfg.Rollups, rc.exposed)
+	if err != nil {
+		return fmt.Errorf("invalid rollups: %s", err)
+	}
+	relabeled, err := handler.Relabel(cfg.MetricRelabelConfigs, exposed)
+	if err != nil {
+		return fmt.Errorf("invalid relabeling rules: %s", err)
+	}
+	endpoints := make(map[string]func() []*dto.MetricFamily, len(cfg.Endpoints))
+	for _, ep := range cfg.Endpoints {
+		if _, ok := rc.endpoints[ep.Path]; !ok {
+			return fmt.Errorf("endpoint %q cannot be added without a restart", ep.Path)
+		}
+		if endpoints[ep.Path], err = handler.Relabel(ep.MetricRelabelConfigs, exposed); err != nil {
+			return fmt.Errorf("invalid relabeling rules for endpoint %q: %s", ep.Path, err)
+		}
+	}
+	for path := range rc.endpoints {
+		if _, ok := endpoints[path]; !ok {
+			return fmt.Errorf("endpoint %q cannot be removed without a restart", path)
+		}
+	}
+	if err := handler.CheckMetricUnits(cfg.MetricUnits); err != nil {
+		return fmt.Errorf("invalid metric units: %s", err)
+	}
+	tokens, err := handler.ParseTokens(cfg.Tokens)
+	if err != nil {
+		return fmt.Errorf("invalid tokens: %s", err)
+	}
+
+	rc.relabeled.Set(relabeled)
+	if len(cfg.Rollups) == 0 && len(cfg.MetricRelabelConfigs) == 0 {
+		atomic.StoreInt32(&rc.plain, 1)
+	} else {
+		atomic.StoreInt32(&rc.plain, 0)
+	}
+	for path, f := range endpoints {
+		rc.endpoints[path].Set(f)
+	}
+	rc.units.SetOverrides(cfg.MetricUnits)
+	rc.tokens.Set(tokens)
+	if setLimits {
+		if evicted := rc.ms.SetLimits(cfg.limits(rc.maxGroups, rc.maxBytes)); evicted > 0 {
+			logging.Info("Evicted groups to comply with the new size limit.", "count", evicted)
+		}
+		rc.ms.SetExpiration(cfg.storeExpiration(rc.expiration))
+		for name, tms := range rc.tenantStores {
+			if evicted := tms.SetLimits(cfg.limits(rc.maxGroups, rc.maxBytes)); evicted > 0 {
+				logging.Info("Evicted groups to comply with the new size limit.", "tenant", name, "count", evicted)
+			}
+			tms.SetExpiration(cfg.storeExpiration(rc.expiration))
+		}
+	}
+	return nil
+}
+
+// plainTelemetry returns whether the telemetry path exposes the pushed metrics
+// as returned by exposed, i.e. without rollups and relabeling rules applied.
+func (rc *runtimeConfig) plainTelemetry() bool {
+	return atomic.LoadInt32(&rc.plain) == 1
+}
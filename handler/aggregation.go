@@ -0,0 +1,70 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// AggregationHeader is the request header to request a windowed aggregation
+// of the pushed gauges, e.g. "max; window=5m".
+const AggregationHeader = "X-Pushgateway-Aggregation"
+
+// parseAggregation parses the value of the AggregationHeader, which has the
+// form "<func>; window=<duration>" with <func> being "max" or "sum".
+func parseAggregation(s string) (*storage.Aggregation, error) {
+	parts := strings.Split(s, ";")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid aggregation %q, must be of the form '<func>; window=<duration>'", s)
+	}
+	a := &storage.Aggregation{}
+	switch fn := strings.TrimSpace(parts[0]); fn {
+	case "max":
+		a.Func = storage.AggregateMax
+	case "sum":
+		a.Func = storage.AggregateSum
+	default:
+		return nil, fmt.Errorf("unknown aggregation function %q, must be 'max' or 'sum'", fn)
+	}
+	param := strings.TrimSpace(parts[1])
+	if !strings.HasPrefix(param, "window=") {
+		return nil, fmt.Errorf("invalid aggregation %q, must be of the form '<func>; window=<duration>'", s)
+	}
+	window, err := time.ParseDuration(strings.TrimPrefix(param, "window="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid aggregation window: %s", err)
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("aggregation window must be positive, got %s", window)
+	}
+	a.Window = window
+	return a, nil
+}
+
+// checkAggregatable returns an error if any of the MetricFamilies is neither a
+// gauge nor untyped.
+func checkAggregatable(metricFamilies map[string]*dto.MetricFamily) error {
+	for name, mf := range metricFamilies {
+		if t := mf.GetType(); t != dto.MetricType_GAUGE && t != dto.MetricType_UNTYPED {
+			return fmt.Errorf("metric %q is of type %s, only gauges and untyped metrics can be aggregated", name, t)
+		}
+	}
+	return nil
+}
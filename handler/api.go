@@ -0,0 +1,183 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+// apiResponse is the envelope of all JSON responses of the /api/v1 endpoints.
+// It mirrors the envelope used by the Prometheus HTTP API.
+type apiResponse struct {
+	Status   string      `json:"status"`
+	Data     interface{} `json:"data,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+func writeAPIData(w http.ResponseWriter, data interface{}) {
+	writeAPIResponse(w, http.StatusOK, apiResponse{Status: "success", Data: data})
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeAPIResponse(w, code, apiResponse{Status: "error", Error: err.Error()})
+}
+
+func writeAPIResponse(w http.ResponseWriter, code int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logging.Error("Error encoding API response.", "err", err)
+	}
+}
+
+// parseGroup parses a group given in the same form as in the push URL path,
+// i.e. "job/<JOBNAME>/instance/<INSTANCENAME>", optionally followed by further
+// grouping labels ("/<LABELNAME>/<LABELVALUE>"). The order of the grouping
+// labels does not matter, i.e. "instance/<INSTANCENAME>/job/<JOBNAME>" is the
+// same group. Each grouping label may only be given once, and both a job and
+// an instance are required.
+func parseGroup(s string) (map[string]string, error) {
+	parts := strings.Split(strings.Trim(s, "/"), "/")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("odd number of components in group %q", s)
+	}
+	labels := make(map[string]string, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		if _, ok := labels[parts[i]]; ok {
+			return nil, fmt.Errorf("duplicate grouping label %q in group %q", parts[i], s)
+		}
+		if !labelNameRE.MatchString(parts[i]) || strings.HasPrefix(parts[i], "__") {
+			return nil, fmt.Errorf("invalid grouping label %q in group %q", parts[i], s)
+		}
+		labels[parts[i]] = parts[i+1]
+	}
+	if labels["job"] == "" || labels["instance"] == "" {
+		return nil, fmt.Errorf("group %q needs both a job and an instance", s)
+	}
+	return labels, nil
+}
+
+// sample is a single flattened series of a metric, i.e. one line of the text
+// exposition format. Summaries and histograms result in multiple samples.
+type sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// flattenMetric returns the samples of the given metric, which has to be part
+// of a MetricFamily with the given name and type.
+func flattenMetric(name string, t dto.MetricType, m *dto.Metric) []sample {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	withLabel := func(name, value string) map[string]string {
+		result := make(map[string]string, len(labels)+1)
+		for ln, lv := range labels {
+			result[ln] = lv
+		}
+		result[name] = value
+		return result
+	}
+	switch t {
+	case dto.MetricType_COUNTER:
+		return []sample{{name, labels, m.GetCounter().GetValue()}}
+	case dto.MetricType_GAUGE:
+		return []sample{{name, labels, m.GetGauge().GetValue()}}
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		result := []sample{}
+		for _, q := range s.GetQuantile() {
+			result = append(result, sample{
+				name,
+				withLabel("quantile", formatValue(q.GetQuantile())),
+				q.GetValue(),
+			})
+		}
+		return append(
+			result,
+			sample{name + "_sum", labels, s.GetSampleSum()},
+			sample{name + "_count", labels, float64(s.GetSampleCount())},
+		)
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		result := []sample{}
+		for _, b := range h.GetBucket() {
+			result = append(result, sample{
+				name + "_bucket",
+				withLabel("le", formatValue(b.GetUpperBound())),
+				float64(b.GetCumulativeCount()),
+			})
+		}
+		return append(
+			result,
+			sample{name + "_sum", labels, h.GetSampleSum()},
+			sample{name + "_count", labels, float64(h.GetSampleCount())},
+		)
+	default:
+		return []sample{{name, labels, m.GetUntyped().GetValue()}}
+	}
+}
+
+// seriesID returns a string identifying a sample by its name and labels. The
+// labels listed in ignore are not taken into account.
+func seriesID(s sample, ignore ...string) string {
+	names := make([]string, 0, len(s.Labels))
+label:
+	for ln := range s.Labels {
+		for _, ign := range ignore {
+			if ln == ign {
+				continue label
+			}
+		}
+		names = append(names, ln)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, ln := range names {
+		parts[i] = ln + "=" + strconv.Quote(s.Labels[ln])
+	}
+	return s.Name + "{" + strings.Join(parts, ",") + "}"
+}
+
+// parseTime parses a timestamp given either as Unix time in (possibly
+// fractional) seconds or in RFC 3339 format, like the Prometheus HTTP API
+// does.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,118 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// BasicAuth wraps h so that it is only called for requests with the
+// credentials of one of the given users, mapping user names to the
+// hex-encoded SHA-256 hashes of their passwords (see CheckBasicAuthUsers).
+// Otherwise, the request is answered with status code 401. If there are no
+// users, h is returned unchanged.
+func BasicAuth(users map[string]string, h http.Handler) http.Handler {
+	if len(users) == 0 {
+		return h
+	}
+	return NewBasicAuthUsers(users).Wrap(h)
+}
+
+// BasicAuthUsers holds the users for basic authentication like BasicAuth, but
+// they can be replaced at runtime, e.g. upon a reload of the web
+// configuration. It is safe for concurrent use.
+type BasicAuthUsers struct {
+	mtx    sync.RWMutex
+	hashes map[string][]byte
+}
+
+// NewBasicAuthUsers returns BasicAuthUsers holding the given users, see
+// BasicAuth.
+func NewBasicAuthUsers(users map[string]string) *BasicAuthUsers {
+	u := &BasicAuthUsers{}
+	u.Set(users)
+	return u
+}
+
+// Set replaces the users. They have to be checked with CheckBasicAuthUsers
+// before.
+func (u *BasicAuthUsers) Set(users map[string]string) {
+	hashes := make(map[string][]byte, len(users))
+	for user, hash := range users {
+		// The hashes have been checked before.
+		hashes[user], _ = hex.DecodeString(hash)
+	}
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.hashes = hashes
+}
+
+// Wrap wraps h like BasicAuth with the users held at the time of each
+// request. While there are no users, all requests are passed on to h.
+func (u *BasicAuthUsers) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mtx.RLock()
+		hashes := u.hashes
+		u.mtx.RUnlock()
+		if len(hashes) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if ok {
+			want, known := hashes[user]
+			got := sha256.Sum256([]byte(password))
+			// Compare even for unknown users to not reveal which users
+			// exist by the response time.
+			if !known {
+				want = make([]byte, sha256.Size)
+			}
+			if subtle.ConstantTimeCompare(got[:], want) == 1 && known {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="Pushgateway"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// CheckBasicAuthUsers checks the users for BasicAuth. Each user name has to be
+// non-empty and must not contain a colon, and each password hash has to be a
+// hex-encoded SHA-256 hash. In particular, the bcrypt hashes of the web
+// configuration of Prometheus are rejected.
+func CheckBasicAuthUsers(users map[string]string) error {
+	for user, hash := range users {
+		if user == "" {
+			return errors.New("empty user name")
+		}
+		if strings.Contains(user, ":") {
+			return fmt.Errorf("user name %q contains a colon", user)
+		}
+		if strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("password hash of user %q is a bcrypt hash, which is not supported, use a hex-encoded SHA-256 hash", user)
+		}
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("password hash of user %q is not a hex-encoded SHA-256 hash", user)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// BatchDuplicatePolicy decides how Batch handles several valid entries for the
+// same group, i.e. with the same grouping labels.
+type BatchDuplicatePolicy int
+
+// The available BatchDuplicatePolicy values.
+const (
+	// BatchDuplicatesInOrder submits all entries in the order of the
+	// batch, i.e. for metrics pushed by several of them, the last entry
+	// wins.
+	BatchDuplicatesInOrder BatchDuplicatePolicy = iota
+	// BatchDuplicatesMerge merges the entries into one write request,
+	// submitted at the position of the first of them. Series pushed by
+	// several entries get the value of the last one. The merged entry
+	// replaces the whole group if any of the entries does.
+	BatchDuplicatesMerge
+	// BatchDuplicatesReject rejects the whole batch with status code 400.
+	BatchDuplicatesReject
+)
+
+var batchDuplicatePolicyNames = map[string]BatchDuplicatePolicy{
+	"in-order": BatchDuplicatesInOrder,
+	"merge":    BatchDuplicatesMerge,
+	"reject":   BatchDuplicatesReject,
+}
+
+// ParseBatchDuplicatePolicy returns the BatchDuplicatePolicy with the given
+// name, i.e. one of "in-order", "merge", or "reject".
+func ParseBatchDuplicatePolicy(s string) (BatchDuplicatePolicy, error) {
+	if p, ok := batchDuplicatePolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown batch duplicate policy %q, must be one of in-order, merge, reject", s)
+}
+
+// batchRequest is the JSON envelope accepted by Batch.
+type batchRequest struct {
+	// If Partial is true, the valid entries are submitted even if other
+	// entries are invalid. Otherwise, nothing is submitted unless all
+	// entries are valid.
+	Partial bool         `json:"partial"`
+	Entries []batchEntry `json:"entries"`
+}
+
+// batchEntry is the equivalent of one push. Exactly one of Metrics (in the
+// text format) and Protobuf (varint-delimited MetricFamily messages, base64
+// encoded in the JSON) has to be set. Labels are the grouping labels besides
+// job and instance.
+type batchEntry struct {
+	Job      string            `json:"job"`
+	Instance string            `json:"instance"`
+	Labels   map[string]string `json:"labels"`
+	Replace  bool              `json:"replace"`
+	Metrics  string            `json:"metrics"`
+	Protobuf []byte            `json:"protobuf"`
+}
+
+type batchEntryResult struct {
+	Submitted bool   `json:"submitted"`
+	Error     string `json:"error,omitempty"`
+}
+
+type batchResult struct {
+	Submitted int                `json:"submitted"`
+	Entries   []batchEntryResult `json:"entries"`
+}
+
+// Batch returns a handler that accepts the payload of multiple pushes in one
+// JSON request (see batchRequest). Each valid entry results in its own write
+// request, in the order of the entries. As with a single push, the instance
+// defaults to the remote IP number of the request, unless requireInstance is
+// true, in which case entries without instance are invalid. Metrics with a
+// label named like a grouping label of their entry but with a different value
+// are handled according to conflicts, with GroupingLabelReject making the entry
+// invalid, and metrics with a timestamp according to timestamps, with
+// SampleTimestampReject making the entry invalid. Valid entries for the same
+// group are handled according to duplicates. The response contains the result
+// for each entry. Entries for groups the API token of the request is not
+// authorized for (see TokenAuth.Authenticate) are invalid, too. If there are
+// any and partial is not set, the response has status code 403.
+//
+// The returned handler is already instrumented for Prometheus.
+func Batch(ms storage.MetricStore, requireInstance bool, conflicts GroupingLabelConflictPolicy, timestamps SampleTimestampPolicy, normalizer *GroupingLabelNormalizer, duplicates BatchDuplicatePolicy) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
+		"batch",
+		func(w http.ResponseWriter, r *http.Request) {
+			var req batchRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("cannot decode batch: %s", err))
+				return
+			}
+			if len(req.Entries) == 0 {
+				writeAPIError(w, http.StatusBadRequest, errors.New("batch without entries"))
+				return
+			}
+			// labels are the grouping labels of the valid entries,
+			// and reason tells why entries without an error of
+			// their own have not been submitted, both for logging.
+			labels := make([]map[string]string, len(req.Entries))
+			var reason string
+			result := batchResult{Entries: make([]batchEntryResult, len(req.Entries))}
+			defer func() { logBatch(r, req.Entries, labels, result, reason) }()
+
+			defaultInstance := ""
+			if !requireInstance {
+				defaultInstance = remoteInstance(r)
+			}
+			wrs := make([]*storage.WriteRequest, len(req.Entries))
+			invalid, forbidden := 0, 0
+			for i, e := range req.Entries {
+				wr, err := e.writeRequest(defaultInstance, conflicts, timestamps, normalizer)
+				if err == nil {
+					labels[i] = wr.Labels
+					if err = authorizeGroup(r, wr.Labels, true); err != nil {
+						forbidden++
+					}
+				}
+				if err == nil {
+					err = ms.CheckWriteRequest(*wr)
+				}
+				if err != nil {
+					result.Entries[i].Error = err.Error()
+					invalid++
+					continue
+				}
+				wrs[i] = wr
+			}
+
+			// mergedInto[i] is the index of the entry entry i has
+			// been merged into, or i itself.
+			mergedInto := make([]int, len(wrs))
+			for i := range mergedInto {
+				mergedInto[i] = i
+			}
+			if groups := duplicateGroups(wrs); len(groups) > 0 {
+				switch duplicates {
+				case BatchDuplicatesReject:
+					descs := make([]string, len(groups))
+					for i, g := range groups {
+						first := wrs[g[0]]
+						for _, j := range g {
+							result.Entries[j].Error = fmt.Sprintf("duplicate group %s", storage.FormatGroup(first.Labels))
+						}
+						descs[i] = fmt.Sprintf("%s (entries %s)", storage.FormatGroup(first.Labels), joinInts(g))
+					}
+					reason = "duplicate groups in batch, nothing submitted: " + strings.Join(descs, "; ")
+					writeAPIResponse(w, http.StatusBadRequest, apiResponse{
+						Status: "error",
+						Data:   result,
+						Error:  reason,
+					})
+					return
+				case BatchDuplicatesMerge:
+					for _, g := range groups {
+						merged := wrs[g[0]]
+						for _, j := range g[1:] {
+							if err := mergeWriteRequest(merged, wrs[j]); err != nil {
+								result.Entries[j].Error = err.Error()
+								invalid++
+							} else {
+								mergedInto[j] = g[0]
+							}
+							wrs[j] = nil
+						}
+						if err := ms.CheckWriteRequest(*merged); err != nil {
+							for _, j := range g {
+								if mergedInto[j] == g[0] {
+									result.Entries[j].Error = err.Error()
+									mergedInto[j] = j
+									invalid++
+								}
+							}
+							wrs[g[0]] = nil
+						}
+					}
+				}
+			}
+			if invalid > 0 && !req.Partial {
+				code := http.StatusBadRequest
+				if forbidden > 0 {
+					code = http.StatusForbidden
+				}
+				reason = fmt.Sprintf("%d of %d entries invalid, nothing submitted", invalid, len(req.Entries))
+				writeAPIResponse(w, code, apiResponse{
+					Status: "error",
+					Data:   result,
+					Error:  reason,
+				})
+				return
+			}
+
+			now := time.Now()
+			// Once a submission has failed, the following entries
+			// are not submitted either, so that the entries for the
+			// same group keep their order.
+			var submitErr error
+			for i, wr := range wrs {
+				if wr == nil {
+					continue
+				}
+				// The recorded size is the encoded size of the
+				// metrics of the entries submitted with wr, not
+				// the size of the whole batch.
+				var size int64
+				for j, into := range mergedInto {
+					if into == i {
+						size += req.Entries[j].size()
+					}
+				}
+				wr.Timestamp = now
+				wr.Origin = requestOrigin(r)
+				wr.PushInfo = pushInfo(r, size)
+				// All entries have been checked above.
+				wr.SkipValidation = true
+				if submitErr == nil {
+					submitErr = ms.SubmitWriteRequest(*wr)
+				}
+				for j, into := range mergedInto {
+					if into != i {
+						continue
+					}
+					if submitErr != nil {
+						result.Entries[j].Error = submitErr.Error()
+						continue
+					}
+					result.Entries[j].Submitted = true
+					result.Submitted++
+				}
+			}
+			if submitErr != nil {
+				setRetryAfter(w, submitErr)
+				writeAPIResponse(w, writeRequestErrorCode(submitErr), apiResponse{
+					Status: "error",
+					Data:   result,
+					Error:  fmt.Sprintf("%d of %d entries submitted: %s", result.Submitted, len(req.Entries), submitErr),
+				})
+				return
+			}
+			code := http.StatusAccepted
+			if result.Submitted == 0 {
+				code = http.StatusBadRequest
+			}
+			writeAPIResponse(w, code, apiResponse{Status: "success", Data: result})
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+// logBatch logs each entry of a batch with the given grouping labels (nil for
+// invalid entries) and result, see logPush. Entries that have neither been
+// submitted nor have an error of their own are logged with the given reason.
+func logBatch(r *http.Request, entries []batchEntry, labels []map[string]string, result batchResult, reason string) {
+	for i, e := range entries {
+		var err error
+		switch res := result.Entries[i]; {
+		case res.Submitted:
+		case res.Error != "":
+			err = errors.New(res.Error)
+		default:
+			err = errors.New(reason)
+		}
+		logPush(r, labels[i], e.size(), err)
+	}
+}
+
+// size returns the size of the encoded metrics of the entry in bytes, i.e. of
+// the text format or of the decoded protocol buffer messages.
+func (e batchEntry) size() int64 {
+	return int64(len(e.Metrics) + len(e.Protobuf))
+}
+
+// writeRequest validates the entry and turns it into a WriteRequest without
+// timestamp. An empty defaultInstance means that the instance is required.
+func (e batchEntry) writeRequest(defaultInstance string, conflicts GroupingLabelConflictPolicy, timestamps SampleTimestampPolicy, normalizer *GroupingLabelNormalizer) (*storage.WriteRequest, error) {
+	if e.Job == "" {
+		return nil, errors.New("job name is required")
+	}
+	if e.Instance == "" {
+		if defaultInstance == "" {
+			return nil, errors.New("instance name is required")
+		}
+		e.Instance = defaultInstance
+	}
+	labels := map[string]string{"job": e.Job, "instance": e.Instance}
+	for ln, lv := range e.Labels {
+		if ln == "job" || ln == "instance" {
+			return nil, fmt.Errorf("grouping label %q must not be given in labels", ln)
+		}
+		labels[ln] = lv
+	}
+	normalizer.group(labels)
+	var (
+		metricFamilies map[string]*dto.MetricFamily
+		err            error
+	)
+	switch {
+	case e.Metrics != "" && len(e.Protobuf) > 0:
+		return nil, errors.New("only one of metrics and protobuf may be set")
+	case len(e.Protobuf) > 0:
+		metricFamilies, err = readMetricFamilies(bytes.NewReader(e.Protobuf), formatDelimitedProto)
+	default:
+		metricFamilies, err = readMetricFamilies(strings.NewReader(e.Metrics), formatText)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := applySampleTimestampPolicy(metricFamilies, timestamps); err != nil {
+		return nil, err
+	}
+	normalizer.normalizeMetrics(metricFamilies)
+	if err := setGroupingLabels(metricFamilies, labels, conflicts); err != nil {
+		return nil, err
+	}
+	return &storage.WriteRequest{
+		Labels:         labels,
+		MetricFamilies: metricFamilies,
+		Replace:        e.Replace,
+	}, nil
+}
+
+// duplicateGroups returns the indexes of the non-nil write requests for the
+// same group, for each group with more than one of them, in the order of the
+// first write request of each group.
+func duplicateGroups(wrs []*storage.WriteRequest) [][]int {
+	indexes := map[string][]int{}
+	var order []string
+	for i, wr := range wrs {
+		if wr == nil {
+			continue
+		}
+		g := storage.GroupingKeyFor(wr.Labels)
+		if _, ok := indexes[g]; !ok {
+			order = append(order, g)
+		}
+		indexes[g] = append(indexes[g], i)
+	}
+	var result [][]int
+	for _, g := range order {
+		if len(indexes[g]) > 1 {
+			result = append(result, indexes[g])
+		}
+	}
+	return result
+}
+
+// mergeWriteRequest merges the metrics of src into dst, see
+// BatchDuplicatesMerge. If a metric has a different type in src than in dst,
+// dst is left unchanged and an error is returned.
+func mergeWriteRequest(dst, src *storage.WriteRequest) error {
+	for name, mf := range src.MetricFamilies {
+		if existing, ok := dst.MetricFamilies[name]; ok && existing.GetType() != mf.GetType() {
+			return fmt.Errorf("metric %s is of type %s, but of type %s in an earlier entry for the same group", name, mf.GetType(), existing.GetType())
+		}
+	}
+	for name, mf := range src.MetricFamilies {
+		existing, ok := dst.MetricFamilies[name]
+		if !ok {
+			dst.MetricFamilies[name] = mf
+			continue
+		}
+		series := make(map[string]int, len(existing.Metric))
+		for i, m := range existing.Metric {
+			series[seriesID(sample{Labels: labelMap(m.GetLabel())})] = i
+		}
+		for _, m := range mf.Metric {
+			if i, ok := series[seriesID(sample{Labels: labelMap(m.GetLabel())})]; ok {
+				existing.Metric[i] = m
+				continue
+			}
+			existing.Metric = append(existing.Metric, m)
+		}
+	}
+	dst.Replace = dst.Replace || src.Replace
+	return nil
+}
+
+func joinInts(ints []int) string {
+	s := make([]string, len(ints))
+	for i, n := range ints {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ", ")
+}
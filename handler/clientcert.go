@@ -0,0 +1,70 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RequireClientCert wraps a handler for a mutating request so that it is only
+// called if the client has presented a certificate that has been verified by
+// the TLS server (i.e. the server is configured with tls.VerifyClientCertIfGiven
+// or stricter). Otherwise, the request is answered with status code 403.
+func RequireClientCert(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if ClientIdentity(r) == "" {
+			http.Error(w, "a verified client certificate is required", http.StatusForbidden)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// ClientIdentity returns the identity of the client as given by its verified
+// TLS certificate: the common name of the subject or, if that is empty, the
+// first DNS name, email address, or URI of the subject alternative names. The
+// empty string is returned if the client has not presented a verified
+// certificate.
+func ClientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// requestOrigin describes who sent the request for the audit log: the remote
+// address, preceded by the client identity (see ClientIdentity) or else by
+// the name of the API token (see TokenAuth) if there is one.
+func requestOrigin(r *http.Request) string {
+	if id := ClientIdentity(r); id != "" {
+		return id + "@" + r.RemoteAddr
+	}
+	if name := tokenName(r); name != "" {
+		return "token:" + name + "@" + r.RemoteAddr
+	}
+	return r.RemoteAddr
+}
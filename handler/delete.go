@@ -14,42 +14,68 @@
 package handler
 
 import (
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/prometheus/pushgateway/storage"
 )
 
-// Delete returns a handler that accepts delete requests. If only a job is
-// specified in the query, all metrics for that job are deleted. If a job and an
-// instance is specified, all metrics for that job/instance combination are
-// deleted.
+// Delete returns a handler that accepts delete requests. The grouping labels
+// are taken from the path like for Push (see groupingLabels). If they include
+// an instance, the metrics of that group are deleted. Otherwise, the metrics
+// of all groups having all the given grouping labels are deleted, e.g. of all
+// groups of the job if only a job is specified. With the query parameter
+// "metric" set to the name of a metric family, only that metric family is
+// deleted from those groups (see storage.WriteRequest).
+//
+// A delete the API token of the request is not authorized for (see
+// TokenAuth.Authenticate and tokenScope.allows) is rejected with status code
+// 403.
 //
 // The returned handler is already instrumented for Prometheus.
-func Delete(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+func Delete(ms storage.MetricStore, normalizer *GroupingLabelNormalizer) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	var ps httprouter.Params
 	var mtx sync.Mutex // Protects ps.
 
-	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
 		"delete",
-		func(w http.ResponseWriter, _ *http.Request) {
-			job := ps.ByName("job")
-			instance := ps.ByName("instance")
+		func(w http.ResponseWriter, r *http.Request) {
+			labels, err := groupingLabels(ps)
 			mtx.Unlock()
+			metric := r.FormValue("metric")
 
-			if job == "" {
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if metric != "" && !isValidMetricName(metric) {
+				http.Error(w, fmt.Sprintf("invalid metric name %q", metric), http.StatusBadRequest)
+				return
+			}
+			if labels["job"] == "" {
 				http.Error(w, "job name is required", http.StatusBadRequest)
 				return
 			}
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Job:       job,
-				Instance:  instance,
-				Timestamp: time.Now(),
-			})
+			normalizer.group(labels)
+			// Without an instance, several groups may be deleted.
+			if err := authorizeGroup(r, labels, false); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err := ms.SubmitWriteRequest(storage.WriteRequest{
+				Labels:       labels,
+				Timestamp:    time.Now(),
+				DeleteMetric: metric,
+				Origin:       requestOrigin(r),
+			}); err != nil {
+				setRetryAfter(w, err)
+				http.Error(w, err.Error(), writeRequestErrorCode(err))
+				return
+			}
 			w.WriteHeader(http.StatusAccepted)
 		},
 	)
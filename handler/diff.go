@@ -0,0 +1,197 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+type groupDiff struct {
+	A              string         `json:"a"`
+	B              string         `json:"b"`
+	OnlyInA        []string       `json:"only_in_a"`
+	OnlyInB        []string       `json:"only_in_b"`
+	TypeMismatches []typeMismatch `json:"type_mismatches"`
+	Series         []seriesDiff   `json:"series"`
+}
+
+type typeMismatch struct {
+	Name  string `json:"name"`
+	TypeA string `json:"type_a"`
+	TypeB string `json:"type_b"`
+}
+
+// seriesDiff describes a series that differs between the two groups. A or B is
+// nil if the series only exists in the other group. Delta is B minus A and only
+// set if the series exists in both groups.
+type seriesDiff struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	A      *string           `json:"a"`
+	B      *string           `json:"b"`
+	Delta  *string           `json:"delta"`
+}
+
+// Diff returns a handler that compares the two groups given by the query
+// parameters a and b (in the form "job/<JOBNAME>/instance/<INSTANCENAME>",
+// optionally followed by further grouping labels, see parseGroup) and reports
+// the metrics and series that differ between them. The grouping labels of
+// both groups are ignored when matching up series.
+func Diff(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		specA, specB := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+		labelsA, err := parseGroup(specA)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		labelsB, err := parseGroup(specB)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		groupA, _, ok := ms.GetGroup(labelsA)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("group %q not found", specA))
+			return
+		}
+		groupB, _, ok := ms.GetGroup(labelsB)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, fmt.Errorf("group %q not found", specB))
+			return
+		}
+		ignore := []string{}
+		for ln := range labelsA {
+			ignore = append(ignore, ln)
+		}
+		for ln := range labelsB {
+			if _, ok := labelsA[ln]; !ok {
+				ignore = append(ignore, ln)
+			}
+		}
+		writeAPIData(w, diffGroups(specA, specB, metricFamiliesMap(groupA), metricFamiliesMap(groupB), ignore))
+	}
+}
+
+func metricFamiliesMap(mfs []*dto.MetricFamily) map[string]*dto.MetricFamily {
+	result := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range mfs {
+		result[mf.GetName()] = mf
+	}
+	return result
+}
+
+// diffGroups compares the metric families a and b, ignoring the given labels
+// when matching up series.
+func diffGroups(specA, specB string, a, b map[string]*dto.MetricFamily, ignore []string) groupDiff {
+	d := groupDiff{
+		A:              specA,
+		B:              specB,
+		OnlyInA:        []string{},
+		OnlyInB:        []string{},
+		TypeMismatches: []typeMismatch{},
+		Series:         []seriesDiff{},
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			d.OnlyInB = append(d.OnlyInB, name)
+		}
+	}
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sort.Strings(d.OnlyInB)
+
+	for _, name := range names {
+		mfA := a[name]
+		mfB, ok := b[name]
+		if !ok {
+			d.OnlyInA = append(d.OnlyInA, name)
+			continue
+		}
+		if mfA.GetType() != mfB.GetType() {
+			d.TypeMismatches = append(d.TypeMismatches, typeMismatch{
+				Name:  name,
+				TypeA: mfA.GetType().String(),
+				TypeB: mfB.GetType().String(),
+			})
+			continue
+		}
+		samplesA := map[string]sample{}
+		for _, m := range mfA.GetMetric() {
+			for _, s := range flattenMetric(name, mfA.GetType(), m) {
+				samplesA[seriesID(s, ignore...)] = s
+			}
+		}
+		samplesB := map[string]sample{}
+		for _, m := range mfB.GetMetric() {
+			for _, s := range flattenMetric(name, mfB.GetType(), m) {
+				samplesB[seriesID(s, ignore...)] = s
+			}
+		}
+		ids := []string{}
+		for id := range samplesA {
+			ids = append(ids, id)
+		}
+		for id := range samplesB {
+			if _, ok := samplesA[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			sA, inA := samplesA[id]
+			sB, inB := samplesB[id]
+			switch {
+			case inA && inB:
+				if sA.Value == sB.Value || math.IsNaN(sA.Value) && math.IsNaN(sB.Value) {
+					continue
+				}
+				d.Series = append(d.Series, seriesDiff{
+					Name:   sA.Name,
+					Labels: sA.Labels,
+					A:      stringPtr(formatValue(sA.Value)),
+					B:      stringPtr(formatValue(sB.Value)),
+					Delta:  stringPtr(formatValue(sB.Value - sA.Value)),
+				})
+			case inA:
+				d.Series = append(d.Series, seriesDiff{
+					Name:   sA.Name,
+					Labels: sA.Labels,
+					A:      stringPtr(formatValue(sA.Value)),
+				})
+			default:
+				d.Series = append(d.Series, seriesDiff{
+					Name:   sB.Name,
+					Labels: sB.Labels,
+					B:      stringPtr(formatValue(sB.Value)),
+				})
+			}
+		}
+	}
+	return d
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,102 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Dump returns a handler that serves all groups in the format of the
+// persistence files (see storage.MetricStore.Dump), compressed with gzip if
+// the request accepts it.
+//
+// The returned handler is already instrumented for Prometheus.
+func Dump(ms storage.MetricStore) http.Handler {
+	return InstrumentHandlerFunc(
+		"dump",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="pushgateway.dump"`)
+			var out io.Writer = w
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				defer gz.Close()
+				out = gz
+			}
+			// The response is streamed, so an error cannot change
+			// the status code anymore.
+			if err := ms.Dump(out); err != nil {
+				logging.Error("Error writing dump.", "err", err)
+			}
+		},
+	)
+}
+
+// Restore returns a handler that loads a dump (see Dump) from the request
+// body, which may be compressed with gzip (as given by the Content-Encoding
+// header). If the query parameter replace is true, all groups not part of the
+// dump are deleted. The number of restored groups is returned.
+//
+// The returned handler is already instrumented for Prometheus.
+func Restore(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
+		"restore",
+		func(w http.ResponseWriter, r *http.Request) {
+			var body io.Reader = r.Body
+			switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+			case "", "identity":
+			case "gzip", "x-gzip":
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid gzip body: %s", err))
+					return
+				}
+				defer gz.Close()
+				body = gz
+			default:
+				writeAPIError(w, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding %q", enc))
+				return
+			}
+			replace := r.URL.Query().Get("replace") == "true"
+			restored, err := ms.Restore(body, replace, requestOrigin(r))
+			if _, ok := err.(storage.InvalidDumpError); ok {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err == storage.ErrDumpTooLarge {
+				writeAPIError(w, http.StatusRequestEntityTooLarge, err)
+				return
+			}
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("restored %d groups, but persisting failed: %s", restored, err))
+				return
+			}
+			writeAPIData(w, map[string]int{"restored": restored})
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		instrumentedHandlerFunc(w, r)
+	}
+}
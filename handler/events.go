@@ -0,0 +1,37 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Events returns a handler that serves the events recorded in the given
+// EventLog, oldest first. The optional URL parameter type restricts the
+// response to events of that type ("push" or "delete").
+func Events(el *storage.EventLog) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		typ := r.URL.Query().Get("type")
+		switch typ {
+		case "", storage.EventPush, storage.EventDelete:
+		default:
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("unknown event type %q, must be %q or %q", typ, storage.EventPush, storage.EventDelete))
+			return
+		}
+		writeAPIData(w, map[string][]storage.Event{"events": el.Events(typ)})
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ExpirationHeader is the request header to override the expiration of the
+// pushed group, e.g. "36h", see storage.WriteRequest.Expiration. A value of 0
+// means that the group never expires.
+const ExpirationHeader = "X-Pushgateway-Expiration"
+
+// parseExpiration parses the value of the ExpirationHeader into a
+// storage.WriteRequest.Expiration, i.e. 0 results in a negative duration.
+func parseExpiration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(s))
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s header %q, must be a non-negative duration like 36h", ExpirationHeader, s)
+	}
+	if d == 0 {
+		return -1, nil
+	}
+	return d, nil
+}
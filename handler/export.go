@@ -0,0 +1,142 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// exportRow is one row of the CSV export.
+type exportRow struct {
+	sample
+	pushTime time.Time
+}
+
+// ExportCSV returns a handler that serves all samples in the MetricStore as
+// CSV, one row per sample with the columns metric_name, the labels, value, and
+// push_time (RFC 3339). Summaries and histograms result in a row per component
+// series. The query parameter labels determines how the labels are rendered:
+// "columns" (the default) results in one column per label name (the union of
+// all label names), "serialized" results in a single labels column in the
+// format of the text exposition format, e.g. {job="foo",instance="bar"}. The
+// samples can be filtered with match[] parameters like in the federation
+// endpoint of Prometheus.
+func ExportCSV(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var serialized bool
+		switch mode := r.Form.Get("labels"); mode {
+		case "", "columns":
+		case "serialized":
+			serialized = true
+		default:
+			http.Error(w, fmt.Sprintf("invalid value %q for parameter labels, must be 'columns' or 'serialized'", mode), http.StatusBadRequest)
+			return
+		}
+		sels, err := parseSelectors(r.Form["match[]"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rows := exportRows(ms.GetMetricFamiliesMap(), sels)
+		header := []string{"metric_name"}
+		var labelNames []string
+		if serialized {
+			header = append(header, "labels")
+		} else {
+			seen := map[string]bool{}
+			for _, row := range rows {
+				for ln := range row.Labels {
+					if !seen[ln] {
+						seen[ln] = true
+						labelNames = append(labelNames, ln)
+					}
+				}
+			}
+			sort.Strings(labelNames)
+			header = append(header, labelNames...)
+		}
+		header = append(header, "value", "push_time")
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		cw.Write(header)
+		for _, row := range rows {
+			record := make([]string, 0, len(header))
+			record = append(record, row.Name)
+			if serialized {
+				record = append(record, seriesID(sample{Labels: row.Labels}))
+			} else {
+				for _, ln := range labelNames {
+					record = append(record, row.Labels[ln])
+				}
+			}
+			record = append(record, strconv.FormatFloat(row.Value, 'g', -1, 64), row.pushTime.UTC().Format(time.RFC3339Nano))
+			cw.Write(record)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			logging.Error("Error writing CSV export.", "err", err)
+		}
+	}
+}
+
+// exportRows returns the samples of all groups matching sels (or all samples if
+// sels is empty), ordered by group (see storage.GroupLess) and metric name.
+func exportRows(groups storage.GroupingKeyToMetricGroup, sels selectors) []exportRow {
+	rows := []exportRow{}
+	for _, group := range groups.Sorted() {
+		n2tmf := group.Metrics
+		names := make([]string, 0, len(n2tmf))
+		for name := range n2tmf {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tmf := n2tmf[name]
+			mf := tmf.MetricFamily
+			for _, m := range mf.GetMetric() {
+				for _, s := range flattenMetric(name, mf.GetType(), m) {
+					if len(sels) > 0 && !sels.matches(withName(s)) {
+						continue
+					}
+					rows = append(rows, exportRow{sample: s, pushTime: tmf.Timestamp})
+				}
+			}
+		}
+	}
+	return rows
+}
+
+// withName returns the labels of s together with the "__name__" label.
+func withName(s sample) map[string]string {
+	labels := make(map[string]string, len(s.Labels)+1)
+	for ln, lv := range s.Labels {
+		labels[ln] = lv
+	}
+	labels["__name__"] = s.Name
+	return labels
+}
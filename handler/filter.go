@@ -0,0 +1,263 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/text"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+const textContentType = "text/plain; version=0.0.4"
+
+// FilterByName wraps the given metrics handler so that only metric families
+// whose name matches at least one of the regular expressions given by the
+// name[] query parameters are returned. The regular expressions are anchored.
+// Without name[] parameters, the request is passed on to h unchanged.
+// Otherwise, h is asked for the text format without content encoding, and the
+// response is always in the text format.
+func FilterByName(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		patterns := r.URL.Query()["name[]"]
+		if len(patterns) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		res := make([]*regexp.Regexp, 0, len(patterns))
+		for _, p := range patterns {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid regular expression %q in parameter name[]: %s", p, err), http.StatusBadRequest)
+				return
+			}
+			res = append(res, re)
+		}
+
+		metricFamilies, ok := gatherText(h, w, r)
+		if !ok {
+			return
+		}
+		names := make([]string, 0, len(metricFamilies))
+		for name := range metricFamilies {
+			for _, re := range res {
+				if re.MatchString(name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		sort.Strings(names)
+		buf := &bytes.Buffer{}
+		for _, name := range names {
+			if _, err := text.MetricFamilyToText(buf, metricFamilies[name]); err != nil {
+				logging.Error("Error encoding metric family.", "name", name, "err", err)
+			}
+		}
+		w.Header().Set("Content-Type", textContentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// FilterBySelector wraps the given metrics handler so that only series matching
+// at least one of the series selectors given by the match[] query parameters
+// are returned, like with the federation endpoint of Prometheus. As labels of
+// the form __param_<name> in service discovery can only set parameters whose
+// name is a valid label name, the parameter match is accepted, too. Without
+// any of those parameters, the request is passed on to h unchanged. Otherwise,
+// h is asked for the text format without content encoding, and the response is
+// always in the text format.
+func FilterBySelector(h http.Handler) http.Handler {
+	return FilterBySelectorFrom(h, nil)
+}
+
+// FilterBySelectorFrom works like FilterBySelector, but if match[] parameters
+// are given and gather is not nil, the metric families are taken from gather
+// rather than from h. The function passed to gather tells the groups that may
+// contain matching series by their grouping labels, so that the other groups
+// need not be gathered at all, as with MetricStore.GetMetricFamiliesFiltered.
+// gather has to include the metric families that do not belong to any group,
+// like the metrics about the Pushgateway itself. The series are filtered
+// afterwards as usual. If gather returns false (e.g. because the metric
+// families are changed in ways the groups do not tell, like by relabeling),
+// h is used after all. The metric families returned by gather are not
+// modified.
+func FilterBySelectorFrom(h http.Handler, gather func(keep func(labels map[string]string) bool) ([]*dto.MetricFamily, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		in := append(q["match[]"], q["match"]...)
+		if len(in) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sels, err := parseSelectors(in)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var metricFamilies map[string]*dto.MetricFamily
+		if gather != nil {
+			if mfs, ok := gather(sels.mayMatchGroup); ok {
+				metricFamilies = make(map[string]*dto.MetricFamily, len(mfs))
+				for _, mf := range mfs {
+					metricFamilies[mf.GetName()] = mf
+				}
+			}
+		}
+		if metricFamilies == nil {
+			var ok bool
+			if metricFamilies, ok = gatherText(h, w, r); !ok {
+				return
+			}
+		}
+		names := make([]string, 0, len(metricFamilies))
+		for name := range metricFamilies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buf := &bytes.Buffer{}
+		for _, name := range names {
+			mf := metricFamilies[name]
+			var metrics []*dto.Metric
+			for _, m := range mf.GetMetric() {
+				labels := labelMap(m.GetLabel())
+				labels["__name__"] = name
+				if sels.matches(labels) {
+					metrics = append(metrics, m)
+				}
+			}
+			if len(metrics) == 0 {
+				continue
+			}
+			mf = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: metrics}
+			if _, err := text.MetricFamilyToText(buf, mf); err != nil {
+				logging.Error("Error encoding metric family.", "name", name, "err", err)
+			}
+		}
+		w.Header().Set("Content-Type", textContentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// InjectionHook is the metric family injection hook of the default handler of
+// the Prometheus client library (see prometheus.SetMetricFamilyInjectionHook).
+// It injects the metric families returned by all, except during a Gather,
+// which only injects the metric families returned by filtered. Scrapes of the
+// default handler have to go through Wrap, so that they do not overlap with a
+// Gather. It is safe for concurrent use.
+type InjectionHook struct {
+	all      func() []*dto.MetricFamily
+	filtered func(keep func(labels map[string]string) bool) []*dto.MetricFamily
+
+	// Gather holds mtx for writing, scrapes hold it for reading.
+	mtx  sync.RWMutex
+	keep func(labels map[string]string) bool // Only set during a Gather.
+}
+
+// NewInjectionHook returns an InjectionHook injecting the metric families
+// returned by all, or by filtered during a Gather.
+func NewInjectionHook(all func() []*dto.MetricFamily, filtered func(keep func(labels map[string]string) bool) []*dto.MetricFamily) *InjectionHook {
+	return &InjectionHook{all: all, filtered: filtered}
+}
+
+// MetricFamilies is the function to set as injection hook.
+func (ih *InjectionHook) MetricFamilies() []*dto.MetricFamily {
+	if ih.keep != nil {
+		return ih.filtered(ih.keep)
+	}
+	return ih.all()
+}
+
+// Wrap wraps the default handler for scrapes.
+func (ih *InjectionHook) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ih.mtx.RLock()
+		defer ih.mtx.RUnlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Gather gathers the metric families from the (unwrapped) default handler h
+// with only the groups kept injected, see FilterBySelectorFrom. Gathers are
+// serialized with each other and with the scrapes via Wrap, as the injection
+// hook cannot tell which request it injects for.
+func (ih *InjectionHook) Gather(h http.Handler, keep func(labels map[string]string) bool) ([]*dto.MetricFamily, bool) {
+	ih.mtx.Lock()
+	defer ih.mtx.Unlock()
+	ih.keep = keep
+	defer func() { ih.keep = nil }()
+	r, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		return nil, false
+	}
+	bw := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+	metricFamilies, ok := gatherText(h, bw, r)
+	if !ok {
+		// Let the default handler report the error.
+		return nil, false
+	}
+	mfs := make([]*dto.MetricFamily, 0, len(metricFamilies))
+	for _, mf := range metricFamilies {
+		mfs = append(mfs, mf)
+	}
+	return mfs, true
+}
+
+// gatherText asks the metrics handler h for the text format (without content
+// encoding) and returns the parsed metric families. If h does not respond with
+// status code 200 or the response cannot be parsed, a response has been
+// written to w, and ok is false.
+func gatherText(h http.Handler, w http.ResponseWriter, r *http.Request) (metricFamilies map[string]*dto.MetricFamily, ok bool) {
+	bw := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+	h.ServeHTTP(bw, withAccept(r, textContentType))
+	if bw.code != http.StatusOK {
+		for name, values := range bw.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(bw.code)
+		w.Write(bw.body.Bytes())
+		return nil, false
+	}
+
+	var parser text.Parser
+	metricFamilies, err := parser.TextToMetricFamilies(&bw.body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot parse metrics: %s", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	return metricFamilies, true
+}
+
+// withAccept returns a copy of r that accepts only the given content type,
+// without content encoding.
+func withAccept(r *http.Request, contentType string) *http.Request {
+	inner := &http.Request{}
+	*inner = *r
+	inner.Header = http.Header{}
+	for name, values := range r.Header {
+		inner.Header[name] = values
+	}
+	inner.Header.Set("Accept", contentType)
+	inner.Header.Del("Accept-Encoding")
+	return inner
+}
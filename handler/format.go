@@ -0,0 +1,320 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+const (
+	protobufContentType    = "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	jsonContentType        = "application/json"
+)
+
+// metricsEncoders maps the values of the format query parameter accepted by
+// SelectFormat to the content type and encoder of the format. The text format
+// is passed through and thus has no encoder.
+var metricsEncoders = map[string]struct {
+	contentType string
+	encode      func(io.Writer, []*dto.MetricFamily) error
+}{
+	"text":        {textContentType, nil},
+	"protobuf":    {protobufContentType, writeProtobuf},
+	"openmetrics": {openMetricsContentType, writeOpenMetrics},
+	"json":        {jsonContentType, writeJSON},
+}
+
+// SelectFormat wraps the given metrics handler so that the query parameter
+// format selects the encoding of the response, overriding content
+// negotiation: "text", "protobuf" (varint-delimited MetricFamily messages),
+// "openmetrics", or "json" (in the format of prom2json). An unknown format
+// results in status code 400. For all formats but the text format, h is asked
+// for the text format, and the response is re-encoded, which is why it is
+// never compressed. Without a format parameter, the request is passed on to h
+// unchanged. The OpenMetrics format announces the units determined by units.
+func SelectFormat(h http.Handler, units *MetricUnits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		enc, ok := metricsEncoders[format]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown format %q, must be one of text, protobuf, openmetrics, json", format), http.StatusBadRequest)
+			return
+		}
+		if enc.encode == nil {
+			h.ServeHTTP(w, withAccept(r, enc.contentType))
+			return
+		}
+		encode := enc.encode
+		if format == "openmetrics" {
+			encode = func(w io.Writer, mfs []*dto.MetricFamily) error {
+				return writeOpenMetricsWithUnits(w, mfs, units)
+			}
+		}
+
+		metricFamilies, ok := gatherText(h, w, r)
+		if !ok {
+			return
+		}
+		names := make([]string, 0, len(metricFamilies))
+		for name := range metricFamilies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		mfs := make([]*dto.MetricFamily, len(names))
+		for i, name := range names {
+			mfs[i] = metricFamilies[name]
+		}
+		buf := &bytes.Buffer{}
+		if err := encode(buf, mfs); err != nil {
+			logging.Error("Error encoding metrics.", "format", format, "err", err)
+			http.Error(w, fmt.Sprintf("cannot encode metrics: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", enc.contentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+// acceptsDelimitedProtobuf returns whether the Accept header of the request
+// prefers varint-delimited MetricFamily messages over the text format, i.e.
+// whether their quality value is positive and not lower than that of the text
+// format (text/plain, or */* if text/plain is not listed). Prometheus sends
+// such a header by default.
+func acceptsDelimitedProtobuf(r *http.Request) bool {
+	protobufQ, textQ, anyQ := 0.0, -1.0, 0.0
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, params, err := mime.ParseMediaType(accept)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		switch mediatype {
+		case "application/vnd.google.protobuf":
+			if params["proto"] == "io.prometheus.client.MetricFamily" && params["encoding"] == "delimited" && q > protobufQ {
+				protobufQ = q
+			}
+		case "text/plain":
+			if q > textQ {
+				textQ = q
+			}
+		case "*/*":
+			if q > anyQ {
+				anyQ = q
+			}
+		}
+	}
+	if textQ < 0 {
+		textQ = anyQ
+	}
+	return protobufQ > 0 && protobufQ >= textQ
+}
+
+func writeProtobuf(w io.Writer, mfs []*dto.MetricFamily) error {
+	for _, mf := range mfs {
+		if _, err := pbutil.WriteDelimited(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOpenMetrics encodes the given metric families in the OpenMetrics text
+// format. Untyped metrics are of type unknown, and the family name of a
+// counter is its name without the "_total" suffix, which the sample name then
+// always has. No units are announced.
+func writeOpenMetrics(w io.Writer, mfs []*dto.MetricFamily) error {
+	return writeOpenMetricsWithUnits(w, mfs, nil)
+}
+
+// writeOpenMetricsWithUnits is writeOpenMetrics, but announcing the units
+// determined by units.
+func writeOpenMetricsWithUnits(w io.Writer, mfs []*dto.MetricFamily, units *MetricUnits) error {
+	for _, mf := range mfs {
+		name, sampleName, typ := mf.GetName(), mf.GetName(), "unknown"
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			typ = "counter"
+			name = strings.TrimSuffix(name, "_total")
+			sampleName = name + "_total"
+		case dto.MetricType_GAUGE:
+			typ = "gauge"
+		case dto.MetricType_SUMMARY:
+			typ = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typ = "histogram"
+		}
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, typ); err != nil {
+			return err
+		}
+		if unit := units.unit(mf.GetName(), name); unit != "" {
+			if _, err := fmt.Fprintf(w, "# UNIT %s %s\n", name, unit); err != nil {
+				return err
+			}
+		}
+		if mf.Help != nil {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n", name, escapeOpenMetrics(mf.GetHelp())); err != nil {
+				return err
+			}
+		}
+		for _, m := range mf.GetMetric() {
+			timestamp := ""
+			if m.TimestampMs != nil {
+				timestamp = " " + formatValue(float64(m.GetTimestampMs())/1000)
+			}
+			for _, s := range flattenMetric(sampleName, mf.GetType(), m) {
+				if _, err := fmt.Fprintf(w, "%s%s %s%s\n", s.Name, formatOpenMetricsLabels(s.Labels), formatValue(s.Value), timestamp); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err := io.WriteString(w, "# EOF\n")
+	return err
+}
+
+func formatOpenMetricsLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + escapeOpenMetrics(labels[name]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeOpenMetrics(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
+
+// The following types model the JSON format of prom2json. Values are strings
+// so that NaN and infinity can be represented.
+
+type jsonMetricFamily struct {
+	Name    string        `json:"name"`
+	Help    string        `json:"help"`
+	Type    string        `json:"type"`
+	Metrics []interface{} `json:"metrics"`
+}
+
+type jsonMetric struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	TimestampMs string            `json:"timestamp_ms,omitempty"`
+	Value       string            `json:"value"`
+}
+
+type jsonSummary struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	TimestampMs string            `json:"timestamp_ms,omitempty"`
+	Quantiles   map[string]string `json:"quantiles,omitempty"`
+	Count       string            `json:"count"`
+	Sum         string            `json:"sum"`
+}
+
+type jsonHistogram struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	TimestampMs string            `json:"timestamp_ms,omitempty"`
+	Buckets     map[string]string `json:"buckets,omitempty"`
+	Count       string            `json:"count"`
+	Sum         string            `json:"sum"`
+}
+
+func writeJSON(w io.Writer, mfs []*dto.MetricFamily) error {
+	result := make([]jsonMetricFamily, len(mfs))
+	for i, mf := range mfs {
+		jmf := jsonMetricFamily{
+			Name:    mf.GetName(),
+			Help:    mf.GetHelp(),
+			Type:    mf.GetType().String(),
+			Metrics: make([]interface{}, len(mf.GetMetric())),
+		}
+		for j, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			timestamp := ""
+			if m.TimestampMs != nil {
+				timestamp = strconv.FormatInt(m.GetTimestampMs(), 10)
+			}
+			switch mf.GetType() {
+			case dto.MetricType_SUMMARY:
+				s := jsonSummary{
+					Labels:      labels,
+					TimestampMs: timestamp,
+					Quantiles:   map[string]string{},
+					Count:       strconv.FormatUint(m.GetSummary().GetSampleCount(), 10),
+					Sum:         formatValue(m.GetSummary().GetSampleSum()),
+				}
+				for _, q := range m.GetSummary().GetQuantile() {
+					s.Quantiles[formatValue(q.GetQuantile())] = formatValue(q.GetValue())
+				}
+				jmf.Metrics[j] = s
+			case dto.MetricType_HISTOGRAM:
+				h := jsonHistogram{
+					Labels:      labels,
+					TimestampMs: timestamp,
+					Buckets:     map[string]string{},
+					Count:       strconv.FormatUint(m.GetHistogram().GetSampleCount(), 10),
+					Sum:         formatValue(m.GetHistogram().GetSampleSum()),
+				}
+				for _, b := range m.GetHistogram().GetBucket() {
+					h.Buckets[formatValue(b.GetUpperBound())] = strconv.FormatUint(b.GetCumulativeCount(), 10)
+				}
+				jmf.Metrics[j] = h
+			default:
+				// flattenMetric yields exactly one sample for all
+				// other types.
+				jmf.Metrics[j] = jsonMetric{
+					Labels:      labels,
+					TimestampMs: timestamp,
+					Value:       formatValue(flattenMetric(mf.GetName(), mf.GetType(), m)[0].Value),
+				}
+			}
+		}
+		result[i] = jmf
+	}
+	return json.NewEncoder(w).Encode(result)
+}
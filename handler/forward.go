@@ -0,0 +1,774 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	forwardMaxAttempts = 10
+	forwardMinBackoff  = 100 * time.Millisecond
+	forwardMaxBackoff  = 10 * time.Second
+)
+
+var (
+	forwardRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Name:      "forward_requests_total",
+			Help:      "Total number of remote write requests forwarding pushes, by endpoint and result (success or failure, the latter after all retries).",
+		},
+		[]string{"url", "result"},
+	)
+	forwardRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Name:      "forward_retries_total",
+			Help:      "Total number of retried remote write requests forwarding pushes, by endpoint.",
+		},
+		[]string{"url"},
+	)
+	forwardDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Name:      "forward_dropped_total",
+			Help:      "Total number of pushes not forwarded because the forward queue of the endpoint was full.",
+		},
+		[]string{"url"},
+	)
+	forwardSpilled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Name:      "forward_spilled_total",
+			Help:      "Total number of pushes written to the spill file because the forward queue of the endpoint was full.",
+		},
+		[]string{"url"},
+	)
+	forwardQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Name:      "forward_queue_length",
+			Help:      "Number of pushes waiting to be forwarded, by endpoint.",
+		},
+		[]string{"url"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(forwardRequests)
+	prometheus.MustRegister(forwardRetries)
+	prometheus.MustRegister(forwardDropped)
+	prometheus.MustRegister(forwardSpilled)
+	prometheus.MustRegister(forwardQueueLength)
+}
+
+// Forwarder forwards applied pushes to one or more remote write endpoints of
+// Prometheus (or of anything else accepting the remote write protocol), one
+// remote write request per push, in the order of the pushes. Each endpoint
+// has its own queue, so that a slow endpoint does not hold up the others.
+// Failed requests are retried with exponential backoff if the error is
+// recoverable (network errors, status code 429, and 5xx), up to 10 attempts.
+// With a buffer file, the pushes not forwarded yet on Close are saved to it
+// and forwarded after the next start, and pushes arriving while the queue of
+// an endpoint is full are spilled to a file next to it (named like the buffer
+// file followed by .spill. and the index of the endpoint) until the queue has
+// been worked off. Endpoints are identified in metrics and logs by their URL
+// with the password and the query redacted. A nil *Forwarder forwards nothing.
+type Forwarder struct {
+	queue      chan storage.WriteRequest
+	endpoints  []*forwardEndpoint
+	bufferFile string
+	closing    chan struct{} // Closed once Close is called.
+	stop       chan struct{} // Closed by Close to give up sending, with a buffer file only.
+	done       chan struct{} // Closed once the queue is drained.
+	backoff    time.Duration // Initial backoff, only changed by tests.
+}
+
+// forwardEndpoint is the queue and state of a single remote write endpoint.
+// The queued bodies are remote write requests, already encoded.
+type forwardEndpoint struct {
+	url    string
+	name   string // The redacted URL, for metrics and logs.
+	client *http.Client
+	queue  chan []byte
+	spill  *forwardSpill // Nil without a buffer file.
+	done   chan struct{}
+	// unsent are the bodies given up on because of the stop of the
+	// Forwarder. They are only accessed by the loop of the endpoint and,
+	// once done is closed, by Close.
+	unsent [][]byte
+	// spilled are the bodies dequeued after the stop of the Forwarder.
+	// They are only accessed by the loop of the Forwarder and, once its
+	// done is closed, by Close.
+	spilled [][]byte
+}
+
+// forwardBufferEntry is a body not forwarded yet, as saved in the buffer file.
+type forwardBufferEntry struct {
+	URL  string
+	Body []byte
+}
+
+// NewForwarder returns a Forwarder to the given comma-separated list of remote
+// write URLs that queues up to queueSize pushes per endpoint. If urls is
+// empty, nil is returned, i.e. forwarding is disabled. If bufferFile is not
+// empty, the pushes saved in it by the last Close and those left in spill
+// files (after a crash) are queued first (for the endpoints still listed in
+// urls), and the files are removed.
+func NewForwarder(urls string, queueSize int, timeout time.Duration, bufferFile string) (*Forwarder, error) {
+	f := &Forwarder{
+		queue:      make(chan storage.WriteRequest, queueSize),
+		bufferFile: bufferFile,
+		closing:    make(chan struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		backoff:    forwardMinBackoff,
+	}
+	byURL := map[string]*forwardEndpoint{}
+	for _, u := range strings.Split(urls, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if _, ok := byURL[u]; ok {
+			return nil, fmt.Errorf("duplicate remote write URL %q", redactURL(u))
+		}
+		ep := &forwardEndpoint{
+			url:    u,
+			name:   redactURL(u),
+			client: &http.Client{Timeout: timeout},
+			queue:  make(chan []byte, queueSize),
+			done:   make(chan struct{}),
+		}
+		byURL[u] = ep
+		f.endpoints = append(f.endpoints, ep)
+	}
+	if len(f.endpoints) == 0 {
+		return nil, nil
+	}
+	if bufferFile != "" {
+		entries, err := readForwardBuffer(bufferFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read forward buffer file: %s", err)
+		}
+		spillFiles, err := filepath.Glob(bufferFile + ".spill.*")
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range spillFiles {
+			spilled, err := readForwardSpill(file)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read forward spill file: %s", err)
+			}
+			entries = append(entries, spilled...)
+		}
+		for _, file := range append(spillFiles, bufferFile) {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		for i, ep := range f.endpoints {
+			if ep.spill, err = openForwardSpill(fmt.Sprintf("%s.spill.%d", bufferFile, i), ep.url); err != nil {
+				return nil, fmt.Errorf("cannot create forward spill file: %s", err)
+			}
+		}
+		for _, e := range entries {
+			ep, ok := byURL[e.URL]
+			if !ok {
+				logging.Warn("Not forwarding buffered push to a URL that is no remote write URL anymore.", "url", redactURL(e.URL))
+				continue
+			}
+			ep.enqueue(e.Body)
+		}
+	}
+	for _, ep := range f.endpoints {
+		go f.loopEndpoint(ep)
+	}
+	go f.loop()
+	return f, nil
+}
+
+// Forward queues the given applied push for forwarding (to be used as
+// DiskMetricStoreOptions.Forward). It never blocks. If the queue of an
+// endpoint is full, the push is dropped for that endpoint (and counted).
+func (f *Forwarder) Forward(wr storage.WriteRequest) {
+	if f == nil {
+		return
+	}
+	select {
+	case f.queue <- wr:
+	default:
+		for _, ep := range f.endpoints {
+			forwardDropped.WithLabelValues(ep.name).Inc()
+		}
+	}
+}
+
+// Close stops the Forwarder. Without a buffer file, the queued pushes are
+// forwarded first. With a buffer file, Close gives up on forwarding (after the
+// current attempt of each endpoint) and saves the pushes not forwarded yet to
+// the buffer file instead. Forward must not be called anymore afterwards.
+func (f *Forwarder) Close() error {
+	if f == nil {
+		return nil
+	}
+	if f.bufferFile != "" {
+		close(f.stop)
+	}
+	close(f.closing)
+	close(f.queue)
+	<-f.done
+	var entries []forwardBufferEntry
+	for _, ep := range f.endpoints {
+		<-ep.done
+		bodies := ep.unsent
+		for body := range ep.queue {
+			bodies = append(bodies, body)
+		}
+		spilled, err := ep.spill.drain()
+		if err != nil {
+			logging.Error("Error reading forward spill file.", "url", ep.name, "err", err)
+		}
+		bodies = append(bodies, spilled...)
+		for _, body := range append(bodies, ep.spilled...) {
+			entries = append(entries, forwardBufferEntry{URL: ep.url, Body: body})
+		}
+	}
+	if len(entries) > 0 {
+		logging.Info("Saving pushes not forwarded yet.", "count", len(entries), "file", f.bufferFile)
+		if err := writeForwardBuffer(f.bufferFile, entries); err != nil {
+			return err
+		}
+	}
+	// Only remove the spill files once their pushes are safe in the
+	// buffer file.
+	for _, ep := range f.endpoints {
+		ep.spill.remove()
+	}
+	return nil
+}
+
+// loop encodes the queued pushes and queues them for each endpoint.
+func (f *Forwarder) loop() {
+	defer func() {
+		for _, ep := range f.endpoints {
+			close(ep.queue)
+		}
+		close(f.done)
+	}()
+	for wr := range f.queue {
+		body := snappyEncode(encodeRemoteWrite(remoteWriteSeries(wr)))
+		for _, ep := range f.endpoints {
+			select {
+			case <-f.stop:
+				ep.spilled = append(ep.spilled, body)
+				continue
+			default:
+			}
+			select {
+			case <-f.closing:
+				// Without a buffer file, everything queued is
+				// forwarded on Close, so wait for room.
+				select {
+				case ep.queue <- body:
+					forwardQueueLength.WithLabelValues(ep.name).Set(float64(len(ep.queue)))
+				case <-f.stop:
+					ep.spilled = append(ep.spilled, body)
+				}
+			default:
+				ep.enqueue(body)
+			}
+		}
+	}
+}
+
+// enqueue queues the body without blocking. If the queue is full, the body is
+// spilled to the spill file, if any, or dropped. Once something is spilled,
+// all bodies are spilled until the spill file has been worked off, so that
+// the order is kept.
+func (ep *forwardEndpoint) enqueue(body []byte) {
+	if ep.spill == nil {
+		select {
+		case ep.queue <- body:
+			forwardQueueLength.WithLabelValues(ep.name).Set(float64(len(ep.queue)))
+		default:
+			forwardDropped.WithLabelValues(ep.name).Inc()
+		}
+		return
+	}
+	ep.spill.mtx.Lock()
+	defer ep.spill.mtx.Unlock()
+	if ep.spill.count == 0 {
+		select {
+		case ep.queue <- body:
+			forwardQueueLength.WithLabelValues(ep.name).Set(float64(len(ep.queue)))
+			return
+		default:
+		}
+	}
+	if err := ep.spill.push(body); err != nil {
+		logging.Error("Error writing to forward spill file.", "url", ep.name, "err", err)
+		forwardDropped.WithLabelValues(ep.name).Inc()
+		return
+	}
+	forwardSpilled.WithLabelValues(ep.name).Inc()
+}
+
+// next returns the next body to send, taking it from the spill file once the
+// queue is empty. It returns false once the queue is closed and empty.
+func (ep *forwardEndpoint) next() ([]byte, bool) {
+	select {
+	case body, ok := <-ep.queue:
+		return body, ok
+	default:
+	}
+	if body, err := ep.spill.pop(); err != nil {
+		logging.Error("Error reading forward spill file.", "url", ep.name, "err", err)
+	} else if body != nil {
+		return body, true
+	}
+	body, ok := <-ep.queue
+	return body, ok
+}
+
+func (f *Forwarder) loopEndpoint(ep *forwardEndpoint) {
+	defer close(ep.done)
+	for {
+		body, ok := ep.next()
+		if !ok {
+			return
+		}
+		forwardQueueLength.WithLabelValues(ep.name).Set(float64(len(ep.queue)))
+		if err := f.send(ep, body); err != nil {
+			select {
+			case <-f.stop:
+				ep.unsent = append(ep.unsent, body)
+				return
+			default:
+			}
+			logging.Error("Error forwarding push.", "url", ep.name, "err", err)
+			forwardRequests.WithLabelValues(ep.name, "failure").Inc()
+			continue
+		}
+		forwardRequests.WithLabelValues(ep.name, "success").Inc()
+		select {
+		case <-f.stop:
+			return
+		default:
+		}
+	}
+}
+
+// errForwardStopped is returned by send if the Forwarder is stopped between
+// two attempts.
+var errForwardStopped = errors.New("forwarder stopped")
+
+func (f *Forwarder) send(ep *forwardEndpoint, body []byte) error {
+	backoff := f.backoff
+	for attempt := 1; ; attempt++ {
+		recoverable, err := ep.sendOnce(body)
+		if err == nil || !recoverable || attempt == forwardMaxAttempts {
+			return err
+		}
+		forwardRetries.WithLabelValues(ep.name).Inc()
+		select {
+		case <-time.After(backoff):
+		case <-f.stop:
+			return errForwardStopped
+		}
+		if backoff *= 2; backoff > forwardMaxBackoff {
+			backoff = forwardMaxBackoff
+		}
+	}
+}
+
+func (ep *forwardEndpoint) sendOnce(body []byte) (recoverable bool, err error) {
+	req, err := http.NewRequest("POST", ep.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "Pushgateway")
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			ue.URL = ep.name // Do not leak the password into the logs.
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = fmt.Errorf("unexpected response status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
+
+// readForwardBuffer returns the entries of the given buffer file, or none if
+// the file does not exist.
+func readForwardBuffer(file string) ([]forwardBufferEntry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []forwardBufferEntry
+	d := gob.NewDecoder(f)
+	for {
+		var e forwardBufferEntry
+		if err := d.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+// writeForwardBuffer writes the entries to the given buffer file, replacing it
+// atomically.
+func writeForwardBuffer(file string, entries []forwardBufferEntry) error {
+	f, err := ioutil.TempFile(path.Dir(file), path.Base(file)+".in_progress.")
+	if err != nil {
+		return err
+	}
+	inProgressFileName := f.Name()
+	e := gob.NewEncoder(f)
+	for _, entry := range entries {
+		if err := e.Encode(entry); err != nil {
+			f.Close()
+			os.Remove(inProgressFileName)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(inProgressFileName)
+		return err
+	}
+	return os.Rename(inProgressFileName, file)
+}
+
+// redactURL returns the given URL with the password, if any, and the query
+// replaced by "xxxxx", to be shown in metrics and logs. An unparsable URL is
+// replaced completely.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "xxxxx"
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "xxxxx"
+	}
+	return u.String()
+}
+
+// forwardSpill is a spill file of an endpoint, a queue on disk of the bodies
+// that did not fit into the queue in memory. Each entry is a
+// forwardBufferEntry (so that a spill file left by a crash can be read without
+// knowing the endpoints), encoded as a gob stream of its own and prefixed by
+// its length as a uvarint. The file is truncated whenever it has been worked
+// off. A nil *forwardSpill is always empty.
+type forwardSpill struct {
+	url  string
+	file string
+
+	mtx     sync.Mutex // Protects the fields below.
+	f       *os.File
+	readOff int64
+	endOff  int64
+	count   int // Number of entries not read yet.
+}
+
+// openForwardSpill creates the given spill file for the given endpoint URL,
+// replacing an existing one.
+func openForwardSpill(file, url string) (*forwardSpill, error) {
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &forwardSpill{url: url, file: file, f: f}, nil
+}
+
+// push appends the body. The caller must hold mtx.
+func (s *forwardSpill) push(body []byte) error {
+	entry := &bytes.Buffer{}
+	if err := gob.NewEncoder(entry).Encode(forwardBufferEntry{URL: s.url, Body: body}); err != nil {
+		return err
+	}
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+entry.Len())
+	buf = append(buf[:binary.PutUvarint(buf, uint64(entry.Len()))], entry.Bytes()...)
+	if _, err := s.f.WriteAt(buf, s.endOff); err != nil {
+		return err
+	}
+	s.endOff += int64(len(buf))
+	s.count++
+	return nil
+}
+
+// pop removes and returns the oldest body, or nil if there is none.
+func (s *forwardSpill) pop() ([]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.count == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	read, err := s.f.ReadAt(buf, s.readOff)
+	if err != nil && err != io.EOF {
+		return nil, s.reset(err)
+	}
+	n, header := binary.Uvarint(buf[:read])
+	if header <= 0 {
+		return nil, s.reset(errors.New("corrupted entry length"))
+	}
+	var e forwardBufferEntry
+	entry := io.NewSectionReader(s.f, s.readOff+int64(header), int64(n))
+	if err := gob.NewDecoder(entry).Decode(&e); err != nil {
+		return nil, s.reset(err)
+	}
+	s.readOff += int64(header) + int64(n)
+	if s.count--; s.count == 0 {
+		if err := s.reset(nil); err != nil {
+			return nil, err
+		}
+	}
+	return e.Body, nil
+}
+
+// drain removes and returns all bodies.
+func (s *forwardSpill) drain() ([][]byte, error) {
+	var bodies [][]byte
+	for {
+		body, err := s.pop()
+		if body == nil || err != nil {
+			return bodies, err
+		}
+		bodies = append(bodies, body)
+	}
+}
+
+// reset truncates the file, dropping all entries, and returns err, or the
+// error of truncating if err is nil. The caller must hold mtx.
+func (s *forwardSpill) reset(err error) error {
+	s.readOff, s.endOff, s.count = 0, 0, 0
+	if truncErr := s.f.Truncate(0); err == nil {
+		err = truncErr
+	}
+	return err
+}
+
+// remove closes and removes the file.
+func (s *forwardSpill) remove() {
+	if s == nil {
+		return
+	}
+	s.f.Close()
+	os.Remove(s.file)
+}
+
+// readForwardSpill returns the entries of the given spill file.
+func readForwardSpill(file string) ([]forwardBufferEntry, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []forwardBufferEntry
+	for len(b) > 0 {
+		n, header := binary.Uvarint(b)
+		if header <= 0 || uint64(len(b)-header) < n {
+			return nil, errors.New("corrupted entry length")
+		}
+		var e forwardBufferEntry
+		if err := gob.NewDecoder(bytes.NewReader(b[header : header+int(n)])).Decode(&e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+		b = b[header+int(n):]
+	}
+	return entries, nil
+}
+
+// rwLabel and rwSeries are the label and time series of the remote write
+// protocol, with a single sample per series.
+type rwLabel struct {
+	Name, Value string
+}
+
+type rwSeries struct {
+	Labels      []rwLabel // Sorted by name, including __name__.
+	Value       float64
+	TimestampMs int64
+}
+
+// remoteWriteSeries converts the metrics of the push into remote write series.
+// The timestamp of a sample is the timestamp of the metric if set and the time
+// of the push otherwise. Histograms get a bucket with the upper bound +Inf if
+// they lack one, as required by Prometheus.
+func remoteWriteSeries(wr storage.WriteRequest) []rwSeries {
+	names := make([]string, 0, len(wr.MetricFamilies))
+	for name := range wr.MetricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pushMs := wr.Timestamp.UnixNano() / int64(time.Millisecond)
+	result := []rwSeries{}
+	for _, name := range names {
+		mf := wr.MetricFamilies[name]
+		for _, m := range mf.GetMetric() {
+			ts := pushMs
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			samples := flattenMetric(name, mf.GetType(), m)
+			if h := m.GetHistogram(); h != nil && !hasInfBucket(h) {
+				inf := sample{name + "_bucket", labelMap(m.GetLabel()), float64(h.GetSampleCount())}
+				inf.Labels["le"] = "+Inf"
+				samples = append(samples, inf)
+			}
+			for _, s := range samples {
+				result = append(result, rwSeries{Labels: rwLabels(s), Value: s.Value, TimestampMs: ts})
+			}
+		}
+	}
+	return result
+}
+
+func hasInfBucket(h *dto.Histogram) bool {
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			return true
+		}
+	}
+	return false
+}
+
+func rwLabels(s sample) []rwLabel {
+	labels := make([]rwLabel, 0, len(s.Labels)+1)
+	labels = append(labels, rwLabel{"__name__", s.Name})
+	for ln, lv := range s.Labels {
+		labels = append(labels, rwLabel{ln, lv})
+	}
+	sort.Sort(rwLabelsByName(labels))
+	return labels
+}
+
+type rwLabelsByName []rwLabel
+
+func (s rwLabelsByName) Len() int           { return len(s) }
+func (s rwLabelsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s rwLabelsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
+// encodeRemoteWrite returns the protobuf encoding of a remote write
+// WriteRequest message (prometheus.WriteRequest of the Prometheus remote write
+// protocol) with the given series, each with one sample.
+func encodeRemoteWrite(series []rwSeries) []byte {
+	const (
+		wireVarint  = 0
+		wireFixed64 = 1
+		wireBytes   = 2
+	)
+	key := func(buf *proto.Buffer, field, wire uint64) { buf.EncodeVarint(field<<3 | wire) }
+
+	req := proto.NewBuffer(nil)
+	for _, s := range series {
+		ts := proto.NewBuffer(nil)
+		for _, l := range s.Labels {
+			label := proto.NewBuffer(nil)
+			key(label, 1, wireBytes)
+			label.EncodeStringBytes(l.Name)
+			key(label, 2, wireBytes)
+			label.EncodeStringBytes(l.Value)
+			key(ts, 1, wireBytes)
+			ts.EncodeRawBytes(label.Bytes())
+		}
+		smpl := proto.NewBuffer(nil)
+		key(smpl, 1, wireFixed64)
+		smpl.EncodeFixed64(math.Float64bits(s.Value))
+		key(smpl, 2, wireVarint)
+		smpl.EncodeVarint(uint64(s.TimestampMs))
+		key(ts, 2, wireBytes)
+		ts.EncodeRawBytes(smpl.Bytes())
+
+		key(req, 1, wireBytes)
+		req.EncodeRawBytes(ts.Bytes())
+	}
+	return req.Bytes()
+}
+
+// snappyEncode returns src in the snappy block format as required by the
+// remote write protocol. It only uses literals, i.e. it does not actually
+// compress, which is still a valid encoding that every snappy decoder
+// accepts.
+func snappyEncode(src []byte) []byte {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeVarint(uint64(len(src)))
+	dst := buf.Bytes()
+	for len(src) > 0 {
+		chunk := src
+		if len(chunk) > 1<<16 {
+			chunk = chunk[:1<<16]
+		}
+		src = src[len(chunk):]
+		switch n := len(chunk) - 1; {
+		case n < 60:
+			dst = append(dst, byte(n<<2))
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+		dst = append(dst, chunk...)
+	}
+	return dst
+}
@@ -0,0 +1,256 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// DeleteGroups returns a handler that deletes all groups selected by the query
+// parameters pushed_before and pushed_after (comparing with the time of the
+// last push to a group) and match[] (series selectors evaluated against the
+// grouping labels of a group). All given criteria have to be met for a
+// group to be deleted, but at least one criterion has to be given. The number
+// of deleted groups is returned. If some selector uses a regular expression
+// and more than one group has been deleted, the response carries a warning
+// recommending a dry run. Groups the API token of the request is not
+// authorized for (see TokenAuth.Authenticate) are never selected.
+//
+// With the query parameter dry_run=true, nothing is deleted. Instead, the
+// groups that would be deleted, evaluating the same criteria, are counted and
+// returned (sorted by job, instance, and the other grouping labels, together
+// with the time of their last push).
+//
+// The returned handler is already instrumented for Prometheus.
+func DeleteGroups(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
+		"delete_groups",
+		func(w http.ResponseWriter, r *http.Request) {
+			selected, usesRegexp, err := parseGroupFilter(r)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+			// Groups the token of the request is not authorized for
+			// are left alone.
+			filter := func(labels map[string]string, lastPush time.Time) bool {
+				return selected(labels, lastPush) && authorizeGroup(r, labels, true) == nil
+			}
+			dryRun := false
+			if s := r.Form.Get("dry_run"); s != "" {
+				if dryRun, err = strconv.ParseBool(s); err != nil {
+					writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid parameter dry_run: %s", err))
+					return
+				}
+			}
+			if dryRun {
+				groups := []groupMatch{}
+				for _, group := range ms.GetMetricFamiliesMap() {
+					if lastPush := group.LastPushTime(); filter(group.Labels, lastPush) {
+						groups = append(groups, newGroupMatch(group.Labels, "", lastPush))
+					}
+				}
+				sort.Sort(groupMatchesByGroup(groups))
+				writeAPIData(w, map[string]interface{}{"dry_run": true, "matched": len(groups), "groups": groups})
+				return
+			}
+			deleted := ms.DeleteGroups(filter, requestOrigin(r))
+			resp := apiResponse{Status: "success", Data: map[string]int{"deleted": deleted}}
+			if usesRegexp && deleted > 1 {
+				resp.Warnings = []string{fmt.Sprintf("%d groups deleted by a selector with a regular expression, consider checking the selection with dry_run=true first", deleted)}
+			}
+			writeAPIResponse(w, http.StatusOK, resp)
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+// parseGroupFilter returns the filter selecting the groups according to the
+// parameters of the request, see DeleteGroups, and whether any of the match[]
+// selectors uses a regular expression.
+func parseGroupFilter(r *http.Request) (func(labels map[string]string, lastPush time.Time) bool, bool, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, false, err
+	}
+	var before, after time.Time
+	var err error
+	if s := r.Form.Get("pushed_before"); s != "" {
+		if before, err = parseTime(s); err != nil {
+			return nil, false, fmt.Errorf("invalid parameter pushed_before: %s", err)
+		}
+	}
+	if s := r.Form.Get("pushed_after"); s != "" {
+		if after, err = parseTime(s); err != nil {
+			return nil, false, fmt.Errorf("invalid parameter pushed_after: %s", err)
+		}
+	}
+	sels, err := parseSelectors(r.Form["match[]"])
+	if err != nil {
+		return nil, false, err
+	}
+	if before.IsZero() && after.IsZero() && len(sels) == 0 {
+		return nil, false, errors.New("at least one of the parameters pushed_before, pushed_after, or match[] is required")
+	}
+	usesRegexp := false
+	for _, sel := range sels {
+		for _, m := range sel {
+			if m.typ == matchRegexp || m.typ == matchNotRegexp {
+				usesRegexp = true
+			}
+		}
+	}
+	return func(labels map[string]string, lastPush time.Time) bool {
+		if !before.IsZero() && !lastPush.Before(before) {
+			return false
+		}
+		if !after.IsZero() && !lastPush.After(after) {
+			return false
+		}
+		if len(sels) > 0 && !sels.matches(labels) {
+			return false
+		}
+		return true
+	}, usesRegexp, nil
+}
+
+// groupMatch is a group found by QueryGroups (or by a dry run of
+// DeleteGroups, without value). Labels are the grouping labels besides job and
+// instance.
+type groupMatch struct {
+	Job      string            `json:"job"`
+	Instance string            `json:"instance"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Value    string            `json:"value,omitempty"`
+	LastPush time.Time         `json:"last_push"`
+
+	group map[string]string // All grouping labels, for sorting.
+}
+
+func newGroupMatch(group map[string]string, value string, lastPush time.Time) groupMatch {
+	return groupMatch{
+		Job:      group["job"],
+		Instance: group["instance"],
+		Labels:   otherGroupingLabels(group),
+		Value:    value,
+		LastPush: lastPush,
+		group:    group,
+	}
+}
+
+// otherGroupingLabels returns the given grouping labels without job and
+// instance, or nil if there are none.
+func otherGroupingLabels(group map[string]string) map[string]string {
+	var result map[string]string
+	for ln, lv := range group {
+		if ln == "job" || ln == "instance" {
+			continue
+		}
+		if result == nil {
+			result = map[string]string{}
+		}
+		result[ln] = lv
+	}
+	return result
+}
+
+type groupMatchesByGroup []groupMatch
+
+func (s groupMatchesByGroup) Len() int           { return len(s) }
+func (s groupMatchesByGroup) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s groupMatchesByGroup) Less(i, j int) bool { return storage.GroupLess(s[i].group, s[j].group) }
+
+// QueryGroups returns a handler that lists the groups in which the metric
+// given by the query parameter metric has a value satisfying all the
+// comparisons given by the query parameters gt, lt, and eq (at least one of
+// them is required). Only groups in which the metric consists of exactly one
+// sample are considered, i.e. groups missing the metric, and groups with
+// several series of the metric (or a summary or histogram of that name) are
+// left out. The groups are returned sorted by their grouping labels, together
+// with the value and the time of their last push.
+func QueryGroups(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		name := q.Get("metric")
+		if name == "" {
+			writeAPIError(w, http.StatusBadRequest, errors.New("parameter metric is required"))
+			return
+		}
+		var comparisons []func(float64) bool
+		for _, c := range []struct {
+			param string
+			cmp   func(v, threshold float64) bool
+		}{
+			{"gt", func(v, t float64) bool { return v > t }},
+			{"lt", func(v, t float64) bool { return v < t }},
+			{"eq", func(v, t float64) bool { return v == t }},
+		} {
+			s := q.Get(c.param)
+			if s == "" {
+				continue
+			}
+			threshold, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid parameter %s: %s", c.param, err))
+				return
+			}
+			cmp := c.cmp
+			comparisons = append(comparisons, func(v float64) bool { return cmp(v, threshold) })
+		}
+		if len(comparisons) == 0 {
+			writeAPIError(w, http.StatusBadRequest, errors.New("at least one of the parameters gt, lt, or eq is required"))
+			return
+		}
+
+		matches := []groupMatch{}
+	group:
+		for _, group := range ms.GetMetricFamiliesMap() {
+			tmf, ok := group.Metrics[name]
+			if !ok {
+				continue
+			}
+			var samples []sample
+			for _, m := range tmf.MetricFamily.GetMetric() {
+				for _, s := range flattenMetric(name, tmf.MetricFamily.GetType(), m) {
+					if s.Name == name {
+						samples = append(samples, s)
+					}
+				}
+			}
+			if len(samples) != 1 {
+				continue
+			}
+			v := samples[0].Value
+			for _, cmp := range comparisons {
+				if !cmp(v) {
+					continue group
+				}
+			}
+			matches = append(matches, newGroupMatch(group.Labels, formatValue(v), group.LastPushTime()))
+		}
+		sort.Sort(groupMatchesByGroup(matches))
+		writeAPIData(w, map[string][]groupMatch{"groups": matches})
+	}
+}
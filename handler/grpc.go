@@ -0,0 +1,273 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/julienschmidt/httprouter"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// GRPCPushPath is the path of the PushMetrics RPC of the Pushgateway service
+// defined in push.proto, i.e. the path gRPC clients send it to.
+const GRPCPushPath = "/io.prometheus.pushgateway.Pushgateway/PushMetrics"
+
+// GRPCMaxMessageSize is the maximum size of a request message accepted by
+// GRPCPush, as received and after decompression.
+const GRPCMaxMessageSize = 16 << 20
+
+// The gRPC status codes used by GRPCPush, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+)
+
+// grpcPushRequest is the PushMetricsRequest message of push.proto. Labels are
+// the grouping labels besides job and instance.
+type grpcPushRequest struct {
+	Job            string              `protobuf:"bytes,1,opt,name=job"`
+	Instance       string              `protobuf:"bytes,2,opt,name=instance"`
+	Labels         map[string]string   `protobuf:"bytes,3,rep,name=labels" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Replace        bool                `protobuf:"varint,4,opt,name=replace"`
+	MetricFamilies []*dto.MetricFamily `protobuf:"bytes,5,rep,name=metric_families"`
+}
+
+func (m *grpcPushRequest) Reset()         { *m = grpcPushRequest{} }
+func (m *grpcPushRequest) String() string { return proto.CompactTextString(m) }
+func (*grpcPushRequest) ProtoMessage()    {}
+
+// grpcStatusError is an error answered with the given gRPC status code.
+type grpcStatusError struct {
+	code int
+	msg  string
+}
+
+func (e grpcStatusError) Error() string {
+	return e.msg
+}
+
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return grpcStatusError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// GRPCPush returns a handler serving the PushMetrics RPC (see push.proto) via
+// HTTP/2 as gRPC clients send it. Each request is the equivalent of a push of
+// the given metric families to the group with the given labels (by PUT if
+// replace is set, by POST otherwise), handled like a Batch entry: The instance
+// defaults to the remote IP number of the request unless requireInstance is
+// true, and conflicts, timestamps, and normalizer are applied. If maxBytes is
+// positive, larger request messages (after decompression) are rejected, as
+// are messages larger than GRPCMaxMessageSize in any case.
+// Requests for groups the API token of the request is not authorized for (see
+// TokenAuth.Authenticate) are rejected with the status PERMISSION_DENIED.
+//
+// Request messages may be compressed with gzip. Errors are reported as gRPC
+// status, with INVALID_ARGUMENT for invalid requests and the status codes of
+// the store limits and the full queue mapped to RESOURCE_EXHAUSTED and
+// UNAVAILABLE. Requests that are no gRPC requests at all are rejected with
+// status code 415, like pushes of an unknown format.
+//
+// The returned handler is already instrumented for Prometheus.
+func GRPCPush(ms storage.MetricStore, requireInstance bool, maxBytes int64, conflicts GroupingLabelConflictPolicy, timestamps SampleTimestampPolicy, normalizer *GroupingLabelNormalizer) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
+		"push_grpc",
+		func(w http.ResponseWriter, r *http.Request) {
+			if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") {
+				http.Error(w, fmt.Sprintf("unsupported content type %q, must be application/grpc", ct), http.StatusUnsupportedMediaType)
+				return
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			w.WriteHeader(http.StatusOK)
+
+			wr, bodyBytes, err := grpcWriteRequest(r, requireInstance, maxBytes, conflicts, timestamps, normalizer)
+			var labels map[string]string
+			if err == nil {
+				labels = wr.Labels
+				wr.Timestamp = time.Now()
+				wr.Origin = requestOrigin(r)
+				wr.PushInfo = pushInfo(r, bodyBytes)
+				err = ms.SubmitWriteRequest(*wr)
+			}
+			// As the response has status code 200 in any case, the
+			// push is logged here rather than by LogPushes.
+			logPush(r, labels, bodyBytes, err)
+			if err != nil {
+				writeGRPCStatus(w, err)
+				return
+			}
+			// The empty PushMetricsResponse message.
+			w.Write([]byte{0, 0, 0, 0, 0})
+			writeGRPCStatus(w, nil)
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+// grpcWriteRequest reads the request message of a PushMetrics RPC and turns it
+// into a WriteRequest without timestamp and origin. It also returns the size
+// of the message as received.
+func grpcWriteRequest(r *http.Request, requireInstance bool, maxBytes int64, conflicts GroupingLabelConflictPolicy, timestamps SampleTimestampPolicy, normalizer *GroupingLabelNormalizer) (*storage.WriteRequest, int64, error) {
+	msg, n, err := readGRPCMessage(r, maxBytes)
+	if err != nil {
+		return nil, n, err
+	}
+	var req grpcPushRequest
+	if err := proto.Unmarshal(msg, &req); err != nil {
+		return nil, n, grpcErrorf(grpcInvalidArgument, "cannot decode request: %s", err)
+	}
+	if req.Job == "" {
+		return nil, n, grpcErrorf(grpcInvalidArgument, "job name is required")
+	}
+	if req.Instance == "" {
+		if requireInstance {
+			return nil, n, grpcErrorf(grpcInvalidArgument, "instance name is required")
+		}
+		req.Instance = remoteInstance(r)
+	}
+	labels := map[string]string{"job": req.Job, "instance": req.Instance}
+	for ln, lv := range req.Labels {
+		if ln == "job" || ln == "instance" {
+			return nil, n, grpcErrorf(grpcInvalidArgument, "grouping label %q must not be given in labels", ln)
+		}
+		labels[ln] = lv
+	}
+	normalizer.group(labels)
+	if err := authorizeGroup(r, labels, true); err != nil {
+		return nil, n, grpcErrorf(grpcPermissionDenied, "%s", err)
+	}
+	metricFamilies := make(map[string]*dto.MetricFamily, len(req.MetricFamilies))
+	for _, mf := range req.MetricFamilies {
+		// As in the delimited protobuf format, the last family of
+		// a name wins.
+		metricFamilies[mf.GetName()] = mf
+	}
+	if err := applySampleTimestampPolicy(metricFamilies, timestamps); err != nil {
+		return nil, n, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	normalizer.normalizeMetrics(metricFamilies)
+	if err := setGroupingLabels(metricFamilies, labels, conflicts); err != nil {
+		return nil, n, grpcErrorf(grpcInvalidArgument, "%s", err)
+	}
+	return &storage.WriteRequest{
+		Labels:         labels,
+		MetricFamilies: metricFamilies,
+		Replace:        req.Replace,
+	}, n, nil
+}
+
+// readGRPCMessage reads the single length-prefixed message of a unary gRPC
+// request, decompressing it if necessary. It also returns the number of bytes
+// of the message as received. Messages larger than maxBytes (if positive) or
+// GRPCMaxMessageSize, whichever is smaller, are rejected, both as received
+// and after decompression.
+func readGRPCMessage(r *http.Request, maxBytes int64) ([]byte, int64, error) {
+	limit := int64(GRPCMaxMessageSize)
+	if maxBytes > 0 && maxBytes < limit {
+		limit = maxBytes
+	}
+	var prefix [5]byte
+	if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+		return nil, 0, grpcErrorf(grpcInvalidArgument, "cannot read request message: %s", err)
+	}
+	n := int64(binary.BigEndian.Uint32(prefix[1:]))
+	if n > limit {
+		return nil, n, grpcErrorf(grpcResourceExhausted, "request message exceeds %d bytes", limit)
+	}
+	// Read through a LimitReader rather than into a buffer of the size
+	// announced, so that memory is only allocated for bytes received.
+	msg, err := ioutil.ReadAll(io.LimitReader(r.Body, n))
+	if err == nil && int64(len(msg)) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, n, grpcErrorf(grpcInvalidArgument, "cannot read request message: %s", err)
+	}
+	if extra, _ := r.Body.Read(prefix[:1]); extra > 0 {
+		return nil, n, grpcErrorf(grpcInvalidArgument, "more than one request message")
+	}
+	if prefix[0] == 0 {
+		return msg, n, nil
+	}
+	if enc := r.Header.Get("Grpc-Encoding"); enc != "gzip" {
+		return nil, n, grpcErrorf(grpcUnimplemented, "unsupported message encoding %q, must be gzip", enc)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, n, grpcErrorf(grpcInvalidArgument, "cannot decompress request message: %s", err)
+	}
+	if msg, err = ioutil.ReadAll(io.LimitReader(gz, limit+1)); err != nil {
+		return nil, n, grpcErrorf(grpcInvalidArgument, "cannot decompress request message: %s", err)
+	}
+	if int64(len(msg)) > limit {
+		return nil, n, grpcErrorf(grpcResourceExhausted, "request message exceeds %d bytes", limit)
+	}
+	return msg, n, nil
+}
+
+// writeGRPCStatus sets the trailers with the gRPC status for the given error,
+// which is OK for a nil error.
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code := grpcOK
+	if err != nil {
+		switch err {
+		case storage.ErrTooManyGroups, storage.ErrTooManyMetricFamilies:
+			code = grpcResourceExhausted
+		case storage.ErrQueueFull, storage.ErrShutdown:
+			code = grpcUnavailable
+		default:
+			code = grpcInvalidArgument
+			if se, ok := err.(grpcStatusError); ok {
+				code = se.code
+			}
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcPercentEncode(err.Error()))
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+}
+
+// grpcPercentEncode encodes a status message as required for the
+// Grpc-Message trailer.
+func grpcPercentEncode(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&buf, "%%%02X", c)
+			continue
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
@@ -0,0 +1,44 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Healthy returns a handler that responds with status code 200 if the
+// MetricStore is healthy and with 503 (and the reason) otherwise, see
+// storage.MetricStore.Healthy. It is meant as a liveness probe.
+func Healthy(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return probe(ms.Healthy)
+}
+
+// Ready returns a handler like Healthy, but for storage.MetricStore.Ready. It
+// is meant as a readiness probe.
+func Ready(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return probe(ms.Ready)
+}
+
+func probe(check func() error) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("OK\n"))
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+)
+
+// IdempotencyCache remembers the responses to requests carrying an
+// Idempotency-Key header for a limited time, so that retries of the same
+// request are answered with the original response instead of being applied
+// again. A nil *IdempotencyCache is valid and remembers nothing. It is safe
+// for concurrent use.
+type IdempotencyCache struct {
+	window time.Duration
+
+	mtx       sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	expires  time.Time
+	inFlight bool
+	code     int
+	header   http.Header
+	body     []byte
+}
+
+// NewIdempotencyCache returns an IdempotencyCache that remembers responses for
+// the given window. If window is not positive, nil is returned, i.e.
+// idempotency keys are ignored.
+func NewIdempotencyCache(window time.Duration) *IdempotencyCache {
+	if window <= 0 {
+		return nil
+	}
+	return &IdempotencyCache{
+		window:  window,
+		entries: map[string]*idempotencyEntry{},
+	}
+}
+
+// Dedupe wraps the given handler. A request with an Idempotency-Key header
+// that has been seen before (for the same method and path) within the window
+// is not passed on to h but answered with the response h has given the first
+// time, with the Idempotent-Replayed header set to true. While the first
+// request is still being processed, retries are answered with status code 409.
+// Only successful (2xx) responses are remembered so that failed requests can
+// be retried. Requests without the header are passed on unchanged. If the
+// IdempotencyCache is nil, h is returned unchanged.
+func (c *IdempotencyCache) Dedupe(h httprouter.Handle) httprouter.Handle {
+	if c == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			h(w, r, ps)
+			return
+		}
+		key = tenantScoped(r, r.Method+" "+r.URL.Path+" "+key)
+
+		c.mtx.Lock()
+		now := time.Now()
+		c.sweep(now)
+		if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+			c.mtx.Unlock()
+			if e.inFlight {
+				http.Error(w, "a request with the same idempotency key is still being processed", http.StatusConflict)
+				return
+			}
+			for name, values := range e.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(idempotencyReplayedHeader, "true")
+			w.WriteHeader(e.code)
+			w.Write(e.body)
+			return
+		}
+		e := &idempotencyEntry{expires: now.Add(c.window), inFlight: true}
+		c.entries[key] = e
+		c.mtx.Unlock()
+
+		bw := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+		h(bw, r, ps)
+
+		c.mtx.Lock()
+		if bw.code/100 == 2 {
+			e.inFlight = false
+			e.code, e.header, e.body = bw.code, bw.header, bw.body.Bytes()
+		} else {
+			delete(c.entries, key)
+		}
+		c.mtx.Unlock()
+
+		for name, values := range bw.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(bw.code)
+		w.Write(bw.body.Bytes())
+	}
+}
+
+// sweep removes expired entries, but only once per window to keep the cost
+// amortized. The caller must hold mtx.
+func (c *IdempotencyCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.window {
+		return
+	}
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.lastSweep = now
+}
@@ -0,0 +1,52 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var httpRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "pushgateway",
+		Name:      "http_requests_total",
+		Help:      "Total number of HTTP requests, by handler, method, and status code.",
+	},
+	[]string{"handler", "method", "code"},
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests)
+}
+
+// InstrumentHandler works like prometheus.InstrumentHandler, but also counts
+// the requests in pushgateway_http_requests_total, see InstrumentHandlerFunc.
+func InstrumentHandler(handlerName string, handler http.Handler) http.HandlerFunc {
+	return InstrumentHandlerFunc(handlerName, handler.ServeHTTP)
+}
+
+// InstrumentHandlerFunc works like prometheus.InstrumentHandlerFunc, but also
+// counts the requests in pushgateway_http_requests_total with the given
+// handler name, the lowercase method, and the status code of the response.
+func InstrumentHandlerFunc(handlerName string, handlerFunc func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return prometheus.InstrumentHandlerFunc(handlerName, func(w http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		handlerFunc(sr, r)
+		httpRequests.WithLabelValues(handlerName, strings.ToLower(r.Method), strconv.Itoa(sr.code)).Inc()
+	})
+}
@@ -0,0 +1,226 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type matchType int
+
+const (
+	matchEqual matchType = iota
+	matchNotEqual
+	matchRegexp
+	matchNotRegexp
+)
+
+// labelMatcher matches the value of one label. An absent label has the empty
+// string as its value.
+type labelMatcher struct {
+	name  string
+	typ   matchType
+	value string
+	re    *regexp.Regexp
+}
+
+func (m *labelMatcher) matches(v string) bool {
+	switch m.typ {
+	case matchEqual:
+		return v == m.value
+	case matchNotEqual:
+		return v != m.value
+	case matchRegexp:
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+// selector is a list of labelMatchers that all have to match.
+type selector []*labelMatcher
+
+func (s selector) matches(labels map[string]string) bool {
+	for _, m := range s {
+		if !m.matches(labels[m.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectors is a list of selectors of which at least one has to match, as
+// resulting from multiple match[] parameters.
+type selectors []selector
+
+func (ss selectors) matches(labels map[string]string) bool {
+	for _, s := range ss {
+		if s.matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayMatchGroup returns whether any series of the group with the given
+// grouping labels could match. Matchers for labels that are not grouping
+// labels cannot be decided by the group and are taken as matching, while the
+// grouping labels take precedence over the labels of the pushed metrics. This
+// applies to the synthetic metrics of the group, too.
+func (ss selectors) mayMatchGroup(labels map[string]string) bool {
+	for _, s := range ss {
+		if s.mayMatchGroup(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s selector) mayMatchGroup(labels map[string]string) bool {
+	for _, m := range s {
+		if v, ok := labels[m.name]; ok && !m.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSelectors parses all given series selectors, see parseSelector.
+func parseSelectors(in []string) (selectors, error) {
+	result := make(selectors, 0, len(in))
+	for _, s := range in {
+		sel, err := parseSelector(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sel)
+	}
+	return result, nil
+}
+
+// parseSelector parses a series selector as used in the match[] parameter of
+// the Prometheus federation endpoint, e.g. `some_metric{job="foo",
+// instance=~"bar.*"}`. A metric name is turned into a matcher for the
+// "__name__" label. Regular expressions are anchored.
+func parseSelector(in string) (selector, error) {
+	s := strings.TrimSpace(in)
+	result := selector{}
+	nameEnd := strings.IndexAny(s, "{ ")
+	if nameEnd == -1 {
+		nameEnd = len(s)
+	}
+	if name := s[:nameEnd]; name != "" {
+		if !isValidMetricName(name) {
+			return nil, fmt.Errorf("invalid metric name %q in selector %q", name, in)
+		}
+		result = append(result, &labelMatcher{name: "__name__", typ: matchEqual, value: name})
+	}
+	s = strings.TrimSpace(s[nameEnd:])
+	if s == "" {
+		if len(result) == 0 {
+			return nil, fmt.Errorf("empty selector %q", in)
+		}
+		return result, nil
+	}
+	if s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, fmt.Errorf("label matchers in selector %q must be enclosed in braces", in)
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	for s != "" {
+		// Label name.
+		i := 0
+		for i < len(s) && isLabelNameChar(s[i], i == 0) {
+			i++
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("expected label name at %q in selector %q", s, in)
+		}
+		m := &labelMatcher{name: s[:i]}
+		s = strings.TrimSpace(s[i:])
+		// Operator.
+		switch {
+		case strings.HasPrefix(s, "=~"):
+			m.typ, s = matchRegexp, s[2:]
+		case strings.HasPrefix(s, "!~"):
+			m.typ, s = matchNotRegexp, s[2:]
+		case strings.HasPrefix(s, "!="):
+			m.typ, s = matchNotEqual, s[2:]
+		case strings.HasPrefix(s, "="):
+			m.typ, s = matchEqual, s[1:]
+		default:
+			return nil, fmt.Errorf("expected matching operator at %q in selector %q", s, in)
+		}
+		s = strings.TrimSpace(s)
+		// Quoted label value.
+		end := closingQuote(s)
+		if end == -1 {
+			return nil, fmt.Errorf("expected quoted label value at %q in selector %q", s, in)
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid label value %s in selector %q: %s", s[:end+1], in, err)
+		}
+		m.value = v
+		if m.typ == matchRegexp || m.typ == matchNotRegexp {
+			if m.re, err = regexp.Compile("^(?:" + v + ")$"); err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q in selector %q: %s", v, in, err)
+			}
+		}
+		result = append(result, m)
+		s = strings.TrimSpace(s[end+1:])
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if s != "" {
+			return nil, fmt.Errorf("expected ',' or '}' at %q in selector %q", s, in)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("empty selector %q", in)
+	}
+	return result, nil
+}
+
+// closingQuote returns the index of the closing double quote of the quoted
+// string s starts with, or -1 if s does not start with a complete quoted
+// string.
+func closingQuote(s string) int {
+	if s == "" || s[0] != '"' {
+		return -1
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func isLabelNameChar(b byte, first bool) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b == '_' || !first && b >= '0' && b <= '9'
+}
+
+func isValidMetricName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isLabelNameChar(s[i], i == 0) && s[i] != ':' {
+			return false
+		}
+	}
+	return s != ""
+}
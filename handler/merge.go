@@ -0,0 +1,42 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// MergeHeader is the request header to select how pushed metrics are combined
+// with the stored metrics with the same labels, e.g. "max".
+const MergeHeader = "X-Pushgateway-Merge"
+
+var mergeFuncs = map[string]storage.MergeFunc{
+	"last": storage.MergeLast,
+	"max":  storage.MergeMax,
+	"min":  storage.MergeMin,
+	"sum":  storage.MergeSum,
+}
+
+// parseMerge parses the value of the MergeHeader, which is one of "last",
+// "max", "min", or "sum".
+func parseMerge(s string) (storage.MergeFunc, error) {
+	f, ok := mergeFuncs[strings.ToLower(strings.TrimSpace(s))]
+	if !ok {
+		return storage.MergeLast, fmt.Errorf("unknown merge function %q, must be one of last, max, min, sum", s)
+	}
+	return f, nil
+}
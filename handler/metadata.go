@@ -0,0 +1,78 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+type metadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+}
+
+type metadataSorter []metadata
+
+func (s metadataSorter) Len() int      { return len(s) }
+func (s metadataSorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s metadataSorter) Less(i, j int) bool {
+	if s[i].Type != s[j].Type {
+		return s[i].Type < s[j].Type
+	}
+	return s[i].Help < s[j].Help
+}
+
+// Metadata returns a handler that serves the names of all metrics currently in
+// the MetricStore together with their types and help strings, aggregated over
+// all groups. The response has the same shape as the metadata API of
+// Prometheus, i.e. it maps each metric name to a list of all distinct
+// type/help combinations pushed for that name. Usually, that list has only
+// one element. More elements mean inconsistently pushed metrics.
+func Metadata(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeAPIData(w, collectMetadata(ms.GetMetricFamiliesMap()))
+	}
+}
+
+func collectMetadata(groups storage.GroupingKeyToMetricGroup) map[string][]metadata {
+	seen := map[string]map[metadata]struct{}{}
+	for _, group := range groups {
+		for name, tmf := range group.Metrics {
+			md := metadata{
+				Type: strings.ToLower(tmf.MetricFamily.GetType().String()),
+				Help: tmf.MetricFamily.GetHelp(),
+			}
+			mds, ok := seen[name]
+			if !ok {
+				mds = map[metadata]struct{}{}
+				seen[name] = mds
+			}
+			mds[md] = struct{}{}
+		}
+	}
+	result := make(map[string][]metadata, len(seen))
+	for name, mds := range seen {
+		list := make([]metadata, 0, len(mds))
+		for md := range mds {
+			list = append(list, md)
+		}
+		sort.Sort(metadataSorter(list))
+		result[name] = list
+	}
+	return result
+}
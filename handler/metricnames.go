@@ -0,0 +1,37 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MetricNamesHeader is the request header listing the metric names a push is
+// authoritative for (comma-separated), see storage.WriteRequest.MetricNames.
+const MetricNamesHeader = "X-Pushgateway-Metric-Names"
+
+// parseMetricNames parses the value of the MetricNamesHeader. Whitespace
+// around the names is ignored.
+func parseMetricNames(s string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if !isValidMetricName(name) {
+			return nil, fmt.Errorf("invalid metric name %q in %s header", name, MetricNamesHeader)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// apiGroup is a group as returned by APIMetrics. Labels are the grouping labels
+// besides job and instance. LastPushInfo is nil if the metadata of the last
+// push is unknown, e.g. for groups persisted by an older version.
+type apiGroup struct {
+	Job            string            `json:"job"`
+	Instance       string            `json:"instance"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	LastPush       time.Time         `json:"last_push"`
+	LastPushInfo   *apiPushInfo      `json:"last_push_info,omitempty"`
+	MetricFamilies []apiMetricFamily `json:"metric_families"`
+}
+
+// apiPushInfo is the storage.PushInfo of the last push to an apiGroup.
+type apiPushInfo struct {
+	Remote      string `json:"remote"`
+	ContentType string `json:"content_type"`
+	UserAgent   string `json:"user_agent"`
+	BodyBytes   int64  `json:"body_bytes"`
+}
+
+// apiMetricFamily is a metric family of an apiGroup, with the time of the push
+// that last changed it.
+type apiMetricFamily struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Help     string      `json:"help"`
+	LastPush time.Time   `json:"last_push"`
+	Metrics  []apiMetric `json:"metrics"`
+}
+
+// apiMetric is a metric of an apiMetricFamily. Counters, gauges, and untyped
+// metrics have a Value, summaries have Quantiles, histograms have Buckets
+// (keyed by upper bound, with cumulative counts), and both of the latter have
+// Count and Sum. All numbers are formatted as strings, as JSON cannot
+// represent NaN and infinite values, like the Prometheus HTTP API does.
+type apiMetric struct {
+	Labels      map[string]string `json:"labels"`
+	Value       string            `json:"value,omitempty"`
+	Quantiles   map[string]string `json:"quantiles,omitempty"`
+	Buckets     map[string]string `json:"buckets,omitempty"`
+	Count       string            `json:"count,omitempty"`
+	Sum         string            `json:"sum,omitempty"`
+	TimestampMs int64             `json:"timestamp_ms,omitempty"`
+}
+
+// APIMetrics returns a handler that serves the content of the MetricStore as
+// JSON: all groups (sorted by their grouping labels, see storage.GroupLess)
+// with the time of their last push and their metric families (sorted by name)
+// with all metrics and values. The groups can be filtered with match[]
+// parameters, i.e. series selectors evaluated against the grouping labels of
+// each group, like with DeleteGroups.
+func APIMetrics(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		sels, err := parseSelectors(r.Form["match[]"])
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		groups := []apiGroup{}
+		for _, group := range ms.GetMetricFamiliesMap().Sorted() {
+			if len(sels) > 0 && !sels.matches(group.Labels) {
+				continue
+			}
+			groups = append(groups, newAPIGroup(group))
+		}
+		writeAPIData(w, map[string][]apiGroup{"groups": groups})
+	}
+}
+
+func newAPIGroup(group storage.MetricGroup) apiGroup {
+	result := apiGroup{
+		Job:            group.Labels["job"],
+		Instance:       group.Labels["instance"],
+		Labels:         otherGroupingLabels(group.Labels),
+		LastPush:       group.LastPushTime(),
+		MetricFamilies: make([]apiMetricFamily, 0, len(group.Metrics)),
+	}
+	if group.LastPushInfo != (storage.PushInfo{}) {
+		info := apiPushInfo(group.LastPushInfo)
+		result.LastPushInfo = &info
+	}
+	names := make([]string, 0, len(group.Metrics))
+	for name := range group.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tmf := group.Metrics[name]
+		mf := tmf.MetricFamily
+		amf := apiMetricFamily{
+			Name:     name,
+			Type:     strings.ToLower(mf.GetType().String()),
+			Help:     mf.GetHelp(),
+			LastPush: tmf.Timestamp,
+			Metrics:  make([]apiMetric, 0, len(mf.GetMetric())),
+		}
+		for _, m := range mf.GetMetric() {
+			amf.Metrics = append(amf.Metrics, newAPIMetric(mf.GetType(), m))
+		}
+		result.MetricFamilies = append(result.MetricFamilies, amf)
+	}
+	return result
+}
+
+func newAPIMetric(t dto.MetricType, m *dto.Metric) apiMetric {
+	result := apiMetric{
+		Labels:      make(map[string]string, len(m.GetLabel())),
+		TimestampMs: m.GetTimestampMs(),
+	}
+	for _, lp := range m.GetLabel() {
+		result.Labels[lp.GetName()] = lp.GetValue()
+	}
+	switch t {
+	case dto.MetricType_COUNTER:
+		result.Value = formatValue(m.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		result.Value = formatValue(m.GetGauge().GetValue())
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		result.Quantiles = make(map[string]string, len(s.GetQuantile()))
+		for _, q := range s.GetQuantile() {
+			result.Quantiles[formatValue(q.GetQuantile())] = formatValue(q.GetValue())
+		}
+		result.Count = strconv.FormatUint(s.GetSampleCount(), 10)
+		result.Sum = formatValue(s.GetSampleSum())
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		result.Buckets = make(map[string]string, len(h.GetBucket()))
+		for _, b := range h.GetBucket() {
+			result.Buckets[formatValue(b.GetUpperBound())] = strconv.FormatUint(b.GetCumulativeCount(), 10)
+		}
+		result.Count = strconv.FormatUint(h.GetSampleCount(), 10)
+		result.Sum = formatValue(h.GetSampleSum())
+	default:
+		result.Value = formatValue(m.GetUntyped().GetValue())
+	}
+	return result
+}
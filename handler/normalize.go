@@ -0,0 +1,109 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// GroupingLabelNormalizer normalizes the values of grouping labels on
+// ingestion, so that pushes with differently spelled values end up in the
+// same group. A value is either lowercased or, if a value map is configured,
+// looked up in that map (and left alone if not found). A nil
+// *GroupingLabelNormalizer leaves all values alone.
+type GroupingLabelNormalizer struct {
+	labels map[string]bool
+	values map[string]string // Nil means lowercasing.
+}
+
+// NewGroupingLabelNormalizer returns a GroupingLabelNormalizer for the given
+// comma-separated list of grouping labels (job and/or instance). The values
+// are a comma-separated list of value mappings of the form "old=new", e.g.
+// "Host-A=host-a,HOST-A=host-a". If it is empty, values are lowercased. If
+// labels is empty, nil is returned.
+func NewGroupingLabelNormalizer(labels, values string) (*GroupingLabelNormalizer, error) {
+	if labels == "" {
+		if values != "" {
+			return nil, fmt.Errorf("grouping label value map %q given without labels to normalize", values)
+		}
+		return nil, nil
+	}
+	n := &GroupingLabelNormalizer{labels: map[string]bool{}}
+	for _, ln := range strings.Split(labels, ",") {
+		if ln != "job" && ln != "instance" {
+			return nil, fmt.Errorf("cannot normalize %q, only the grouping labels job and instance", ln)
+		}
+		n.labels[ln] = true
+	}
+	if values == "" {
+		return n, nil
+	}
+	n.values = map[string]string{}
+	for _, m := range strings.Split(values, ",") {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid grouping label value mapping %q, must be of the form 'old=new'", m)
+		}
+		if _, ok := n.values[parts[0]]; ok {
+			return nil, fmt.Errorf("grouping label value %q mapped more than once", parts[0])
+		}
+		n.values[parts[0]] = parts[1]
+	}
+	return n, nil
+}
+
+func (n *GroupingLabelNormalizer) normalize(name, value string) string {
+	if n == nil || !n.labels[name] {
+		return value
+	}
+	if n.values == nil {
+		return strings.ToLower(value)
+	}
+	if v, ok := n.values[value]; ok {
+		return v
+	}
+	return value
+}
+
+// group normalizes the job and instance of the given grouping labels in place.
+func (n *GroupingLabelNormalizer) group(labels map[string]string) {
+	for _, ln := range []string{"job", "instance"} {
+		if v, ok := labels[ln]; ok {
+			labels[ln] = n.normalize(ln, v)
+		}
+	}
+}
+
+// normalizeMetrics normalizes the job and instance labels the pushed metrics
+// have themselves, so that they do not conflict with the normalized grouping
+// labels (see GroupingLabelConflictPolicy).
+func (n *GroupingLabelNormalizer) normalizeMetrics(mfs map[string]*dto.MetricFamily) {
+	if n == nil {
+		return
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if v := n.normalize(lp.GetName(), lp.GetValue()); v != lp.GetValue() {
+					lp.Value = proto.String(v)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,488 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// omSuffixes are the suffixes of the sample names of a metric family in the
+// OpenMetrics text format by the type of the family. The empty string is the
+// type of a family without # TYPE line, which is treated as unknown.
+var omSuffixes = map[string][]string{
+	"":               {""},
+	"unknown":        {""},
+	"gauge":          {""},
+	"counter":        {"_total", "_created"},
+	"histogram":      {"_bucket", "_count", "_sum", "_created"},
+	"gaugehistogram": {"_bucket", "_gcount", "_gsum"},
+	"summary":        {"", "_count", "_sum", "_created"},
+	"info":           {"_info"},
+	"stateset":       {""},
+}
+
+var omUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`)
+
+// omFamily is a metric family while parsing the OpenMetrics text format.
+type omFamily struct {
+	name, typ string
+	help      *string
+	unit      bool // Whether # UNIT has been seen.
+	sampled   bool // Whether samples have been seen.
+}
+
+// omParser parses the OpenMetrics text format, see parseOpenMetrics.
+type omParser struct {
+	line           int
+	eof            bool
+	current        *omFamily
+	done           map[string]bool              // Names of the previous families.
+	metricFamilies map[string]*dto.MetricFamily // By name as converted.
+	owners         map[string]string            // Name of the family a converted family stems from.
+	grouped        map[string]*dto.Metric       // Histograms and summaries by name and labels.
+}
+
+// parseOpenMetrics reads metric families in the OpenMetrics text format from r
+// and converts them to the metric model of the Prometheus text format (as
+// Prometheus does when ingesting the OpenMetrics format): A counter family
+// "foo" becomes the counter "foo_total", an info family "foo" the gauge
+// "foo_info", a state set the gauge of the same name, and a gauge histogram
+// "foo" the gauges "foo_bucket", "foo_gcount", and "foo_gsum". Timestamps are
+// converted from seconds to milliseconds. There is no place to keep created
+// timestamps, units, and exemplars in that model, so _created samples, # UNIT
+// lines, and exemplars are checked for syntax, but then dropped.
+func parseOpenMetrics(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	p := &omParser{
+		done:           map[string]bool{},
+		metricFamilies: map[string]*dto.MetricFamily{},
+		owners:         map[string]string{},
+		grouped:        map[string]*dto.Metric{},
+	}
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line != "" {
+			p.line++
+			if lErr := p.parseLine(strings.TrimSuffix(line, "\n")); lErr != nil {
+				return nil, fmt.Errorf("OpenMetrics parsing error in line %d: %s", p.line, lErr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if !p.eof {
+		return nil, errors.New("OpenMetrics parsing error: missing # EOF")
+	}
+	// The count of a histogram is optional as it equals the +Inf bucket.
+	for _, m := range p.grouped {
+		if h := m.Histogram; h != nil && h.SampleCount == nil {
+			for _, b := range h.Bucket {
+				if math.IsInf(b.GetUpperBound(), 1) {
+					h.SampleCount = proto.Uint64(b.GetCumulativeCount())
+				}
+			}
+		}
+	}
+	return p.metricFamilies, nil
+}
+
+func (p *omParser) parseLine(line string) error {
+	switch {
+	case p.eof:
+		return errors.New("content after # EOF")
+	case line == "# EOF":
+		p.eof = true
+		return nil
+	case strings.HasPrefix(line, "#"):
+		return p.parseMetadata(line)
+	}
+	return p.parseSample(line)
+}
+
+// family returns the family with the given name, which becomes the current
+// one. The samples and metadata of a family have to be contiguous.
+func (p *omParser) family(name string) (*omFamily, error) {
+	if p.current != nil && p.current.name == name {
+		return p.current, nil
+	}
+	if p.done[name] {
+		return nil, fmt.Errorf("metric family %q is not contiguous", name)
+	}
+	if p.current != nil {
+		p.done[p.current.name] = true
+	}
+	p.current = &omFamily{name: name}
+	return p.current, nil
+}
+
+func (p *omParser) parseMetadata(line string) error {
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) < 3 || parts[0] != "#" {
+		return fmt.Errorf("invalid comment %q", line)
+	}
+	keyword, name, rest := parts[1], parts[2], ""
+	if len(parts) == 4 {
+		rest = parts[3]
+	}
+	if !isValidMetricName(name) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	f, err := p.family(name)
+	if err != nil {
+		return err
+	}
+	if f.sampled {
+		return fmt.Errorf("# %s for metric family %q after its samples", keyword, name)
+	}
+	switch keyword {
+	case "TYPE":
+		if _, ok := omSuffixes[rest]; !ok || rest == "" {
+			return fmt.Errorf("unknown type %q of metric family %q", rest, name)
+		}
+		if f.typ != "" {
+			return fmt.Errorf("duplicate # TYPE for metric family %q", name)
+		}
+		f.typ = rest
+	case "HELP":
+		if f.help != nil {
+			return fmt.Errorf("duplicate # HELP for metric family %q", name)
+		}
+		help := omUnescaper.Replace(rest)
+		f.help = &help
+	case "UNIT":
+		if f.unit {
+			return fmt.Errorf("duplicate # UNIT for metric family %q", name)
+		}
+		if rest != "" && !strings.HasSuffix(name, "_"+rest) {
+			return fmt.Errorf("unit %q is not a suffix of metric family name %q", rest, name)
+		}
+		f.unit = true
+	default:
+		return fmt.Errorf("invalid comment %q", line)
+	}
+	return nil
+}
+
+// sampleFamily returns the family the sample with the given name belongs to,
+// and the suffix of the sample name. A sample not belonging to the current
+// family starts a new family without type.
+func (p *omParser) sampleFamily(name string) (*omFamily, string, error) {
+	if f := p.current; f != nil {
+		for _, suffix := range omSuffixes[f.typ] {
+			if name == f.name+suffix {
+				return f, suffix, nil
+			}
+		}
+		if f.name == name {
+			return nil, "", fmt.Errorf("sample name %q is not valid for metric family of type %s", name, f.typ)
+		}
+	}
+	f, err := p.family(name)
+	return f, "", err
+}
+
+func (p *omParser) parseSample(line string) error {
+	end := strings.IndexAny(line, "{ ")
+	if end == -1 {
+		return fmt.Errorf("invalid sample %q", line)
+	}
+	name := line[:end]
+	if !isValidMetricName(name) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	labels, rest, err := parseOMLabels(line[end:])
+	if err != nil {
+		return err
+	}
+	exemplar := ""
+	if i := strings.Index(rest, " # "); i != -1 {
+		rest, exemplar = rest[:i], rest[i+3:]
+	}
+	value, timestampMs, err := parseOMValue(rest)
+	if err != nil {
+		return err
+	}
+	if exemplar != "" {
+		if err := checkOMExemplar(exemplar); err != nil {
+			return err
+		}
+	}
+	f, suffix, err := p.sampleFamily(name)
+	if err != nil {
+		return err
+	}
+	f.sampled = true
+	m := &dto.Metric{Label: labels, TimestampMs: timestampMs}
+
+	switch f.typ {
+	case "", "unknown":
+		m.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+		return p.add(f, name, dto.MetricType_UNTYPED, m)
+	case "gauge", "info", "gaugehistogram":
+		m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+		return p.add(f, name, dto.MetricType_GAUGE, m)
+	case "stateset":
+		if _, _, ok := splitOMLabel(labels, f.name); !ok {
+			return fmt.Errorf("state set sample without label %q", f.name)
+		}
+		m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+		return p.add(f, name, dto.MetricType_GAUGE, m)
+	case "counter":
+		if suffix == "_created" {
+			return nil
+		}
+		m.Counter = &dto.Counter{Value: proto.Float64(value)}
+		return p.add(f, name, dto.MetricType_COUNTER, m)
+	case "histogram":
+		return p.addHistogramSample(f, suffix, labels, value, timestampMs)
+	case "summary":
+		return p.addSummarySample(f, suffix, labels, value, timestampMs)
+	}
+	return nil
+}
+
+// add adds a metric to the converted metric family with the given name and
+// type.
+func (p *omParser) add(f *omFamily, name string, t dto.MetricType, m *dto.Metric) error {
+	mf, err := p.convertedFamily(f, name, t)
+	if err != nil {
+		return err
+	}
+	mf.Metric = append(mf.Metric, m)
+	return nil
+}
+
+func (p *omParser) convertedFamily(f *omFamily, name string, t dto.MetricType) (*dto.MetricFamily, error) {
+	if owner, ok := p.owners[name]; ok && owner != f.name {
+		return nil, fmt.Errorf("metric family %q collides with %q", f.name, owner)
+	}
+	mf, ok := p.metricFamilies[name]
+	if !ok {
+		mf = &dto.MetricFamily{Name: proto.String(name), Help: f.help, Type: t.Enum()}
+		p.metricFamilies[name] = mf
+		p.owners[name] = f.name
+	}
+	return mf, nil
+}
+
+// groupedMetric returns the histogram or summary with the given labels
+// (without le or quantile label) of the converted family with the given name.
+func (p *omParser) groupedMetric(f *omFamily, t dto.MetricType, labels []*dto.LabelPair, timestampMs *int64) (*dto.Metric, error) {
+	key := f.name
+	for _, lp := range labels {
+		key += "\xff" + lp.GetName() + "\xff" + lp.GetValue()
+	}
+	if m, ok := p.grouped[key]; ok {
+		return m, nil
+	}
+	m := &dto.Metric{Label: labels, TimestampMs: timestampMs}
+	if t == dto.MetricType_HISTOGRAM {
+		m.Histogram = &dto.Histogram{}
+	} else {
+		m.Summary = &dto.Summary{}
+	}
+	if err := p.add(f, f.name, t, m); err != nil {
+		return nil, err
+	}
+	p.grouped[key] = m
+	return m, nil
+}
+
+func (p *omParser) addHistogramSample(f *omFamily, suffix string, labels []*dto.LabelPair, value float64, timestampMs *int64) error {
+	if suffix == "_created" {
+		return nil
+	}
+	var le string
+	if suffix == "_bucket" {
+		var ok bool
+		if le, labels, ok = splitOMLabel(labels, "le"); !ok {
+			return errors.New("histogram bucket without label \"le\"")
+		}
+	}
+	m, err := p.groupedMetric(f, dto.MetricType_HISTOGRAM, labels, timestampMs)
+	if err != nil {
+		return err
+	}
+	h := m.Histogram
+	switch suffix {
+	case "_bucket":
+		upperBound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket bound %q", le)
+		}
+		count, err := omCount(value)
+		if err != nil {
+			return err
+		}
+		h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(upperBound), CumulativeCount: proto.Uint64(count)})
+	case "_count":
+		count, err := omCount(value)
+		if err != nil {
+			return err
+		}
+		h.SampleCount = proto.Uint64(count)
+	case "_sum":
+		h.SampleSum = proto.Float64(value)
+	}
+	return nil
+}
+
+func (p *omParser) addSummarySample(f *omFamily, suffix string, labels []*dto.LabelPair, value float64, timestampMs *int64) error {
+	if suffix == "_created" {
+		return nil
+	}
+	var quantile string
+	if suffix == "" {
+		var ok bool
+		if quantile, labels, ok = splitOMLabel(labels, "quantile"); !ok {
+			return errors.New("summary quantile without label \"quantile\"")
+		}
+	}
+	m, err := p.groupedMetric(f, dto.MetricType_SUMMARY, labels, timestampMs)
+	if err != nil {
+		return err
+	}
+	s := m.Summary
+	switch suffix {
+	case "":
+		q, err := strconv.ParseFloat(quantile, 64)
+		if err != nil {
+			return fmt.Errorf("invalid quantile %q", quantile)
+		}
+		s.Quantile = append(s.Quantile, &dto.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(value)})
+	case "_count":
+		count, err := omCount(value)
+		if err != nil {
+			return err
+		}
+		s.SampleCount = proto.Uint64(count)
+	case "_sum":
+		s.SampleSum = proto.Float64(value)
+	}
+	return nil
+}
+
+// parseOMLabels parses the label set s starts with (if any), returning the
+// labels sorted by name and the rest of s.
+func parseOMLabels(s string) ([]*dto.LabelPair, string, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, s, nil
+	}
+	s = s[1:]
+	var labels []*dto.LabelPair
+	seen := map[string]bool{}
+	for !strings.HasPrefix(s, "}") {
+		if len(labels) > 0 {
+			if !strings.HasPrefix(s, ",") {
+				return nil, "", fmt.Errorf("expected ',' or '}' at %q", s)
+			}
+			s = s[1:]
+		}
+		i := 0
+		for i < len(s) && isLabelNameChar(s[i], i == 0) {
+			i++
+		}
+		if i == 0 || i == len(s) || s[i] != '=' {
+			return nil, "", fmt.Errorf("expected label name at %q", s)
+		}
+		name := s[:i]
+		if seen[name] {
+			return nil, "", fmt.Errorf("duplicate label %q", name)
+		}
+		seen[name] = true
+		s = s[i+1:]
+		end := closingQuote(s)
+		if end == -1 {
+			return nil, "", fmt.Errorf("expected quoted label value at %q", s)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(omUnescaper.Replace(s[1:end]))})
+		s = s[end+1:]
+	}
+	sort.Sort(prometheus.LabelPairSorter(labels))
+	return labels, s[1:], nil
+}
+
+// splitOMLabel returns the value of the label with the given name and the
+// remaining labels.
+func splitOMLabel(labels []*dto.LabelPair, name string) (string, []*dto.LabelPair, bool) {
+	for i, lp := range labels {
+		if lp.GetName() == name {
+			rest := make([]*dto.LabelPair, 0, len(labels)-1)
+			rest = append(rest, labels[:i]...)
+			return lp.GetValue(), append(rest, labels[i+1:]...), true
+		}
+	}
+	return "", labels, false
+}
+
+// parseOMValue parses the value and the optional timestamp (in seconds) of a
+// sample, preceded by a space each.
+func parseOMValue(s string) (float64, *int64, error) {
+	fields := strings.Split(s, " ")
+	if len(fields) < 2 || len(fields) > 3 || fields[0] != "" {
+		return 0, nil, fmt.Errorf("expected value and optional timestamp at %q", s)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid value %q", fields[1])
+	}
+	if len(fields) == 2 {
+		return value, nil, nil
+	}
+	ts, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return 0, nil, fmt.Errorf("invalid timestamp %q", fields[2])
+	}
+	return value, proto.Int64(int64(math.Round(ts * 1000))), nil
+}
+
+// checkOMExemplar checks the syntax of an exemplar, i.e. a label set followed
+// by a value and an optional timestamp.
+func checkOMExemplar(s string) error {
+	if !strings.HasPrefix(s, "{") {
+		return fmt.Errorf("invalid exemplar %q", s)
+	}
+	_, rest, err := parseOMLabels(s)
+	if err != nil {
+		return fmt.Errorf("invalid exemplar %q: %s", s, err)
+	}
+	if _, _, err := parseOMValue(rest); err != nil {
+		return fmt.Errorf("invalid exemplar %q: %s", s, err)
+	}
+	return nil
+}
+
+// omCount converts the value of a count or bucket sample.
+func omCount(v float64) (uint64, error) {
+	if v < 0 || v != math.Trunc(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid count %v", v)
+	}
+	return uint64(v), nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// SetPaused returns a handler that pauses (if paused is true) or resumes the
+// processing of write requests by the MetricStore, see
+// storage.MetricStore.SetPaused.
+func SetPaused(ms storage.MetricStore, paused bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		ms.SetPaused(paused)
+		writeAPIData(w, map[string]bool{"paused": paused})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ParseTimestampPrecision parses the precision of exposed timestamps, which is
+// either "ms" (milliseconds, the native precision of the exposition formats)
+// or "s" (seconds).
+func ParseTimestampPrecision(s string) (time.Duration, error) {
+	switch s {
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	default:
+		return 0, fmt.Errorf("invalid timestamp precision %q, must be 's' or 'ms'", s)
+	}
+}
+
+// TruncateTimestamps wraps the given function returning MetricFamilies (as
+// used as a MetricFamilyInjectionHook) so that all sample timestamps in the
+// result are truncated to the given precision. The returned MetricFamilies
+// are copies if anything had to be changed, so that the original ones (in
+// particular those owned by a MetricStore) are never modified. With a
+// precision of a millisecond or less, f is returned unchanged.
+func TruncateTimestamps(precision time.Duration, f func() []*dto.MetricFamily) func() []*dto.MetricFamily {
+	ms := int64(precision / time.Millisecond)
+	if ms <= 1 {
+		return f
+	}
+	return func() []*dto.MetricFamily {
+		mfs := f()
+		for i, mf := range mfs {
+			if !needsTruncation(mf, ms) {
+				continue
+			}
+			mf = proto.Clone(mf).(*dto.MetricFamily)
+			for _, m := range mf.GetMetric() {
+				if m.TimestampMs != nil {
+					m.TimestampMs = proto.Int64(truncateMs(m.GetTimestampMs(), ms))
+				}
+			}
+			mfs[i] = mf
+		}
+		return mfs
+	}
+}
+
+func needsTruncation(mf *dto.MetricFamily, ms int64) bool {
+	for _, m := range mf.GetMetric() {
+		if m.TimestampMs != nil && m.GetTimestampMs()%ms != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateMs truncates t towards the past (also for negative t) to a multiple
+// of ms.
+func truncateMs(t, ms int64) int64 {
+	r := t % ms
+	if r < 0 {
+		r += ms
+	}
+	return t - r
+}
@@ -14,94 +14,396 @@
 package handler
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/julienschmidt/httprouter"
 	"github.com/matttproud/golang_protobuf_extensions/pbutil"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/text"
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/logging"
 	"github.com/prometheus/pushgateway/storage"
 )
 
+// MaxPushTimestampSkew is how far a push timestamp set with the ts query
+// parameter may lie in the future, to allow for clocks of pushers that are
+// slightly ahead. Pushes with a timestamp further in the future are rejected.
+const MaxPushTimestampSkew = 5 * time.Minute
+
+// EmptyPushPolicy decides how Push handles a push without any samples, i.e. an
+// empty body or one with metric families without metrics.
+type EmptyPushPolicy int
+
+// The available EmptyPushPolicy values.
+const (
+	// EmptyPushUpdate processes an empty push like any other: With POST,
+	// the pushed metric families (if any) replace those of the same name,
+	// so that a push with an empty body changes nothing. With PUT, all
+	// metrics of the group are removed, deleting the group (as a group
+	// without metrics does not exist).
+	EmptyPushUpdate EmptyPushPolicy = iota
+	// EmptyPushIgnore accepts an empty push with status code 202 but does
+	// not change anything.
+	EmptyPushIgnore
+	// EmptyPushReject rejects an empty push with status code 400.
+	EmptyPushReject
+	// EmptyPushKeep keeps the group of an empty push, creating it if it
+	// does not exist yet and recording the time of the push (see
+	// storage.WriteRequest.KeepEmpty). With POST, the stored metrics of
+	// the group are left alone. With PUT, they are deleted, leaving the
+	// group without any.
+	EmptyPushKeep
+)
+
+var emptyPushPolicyNames = map[string]EmptyPushPolicy{
+	"update": EmptyPushUpdate,
+	"ignore": EmptyPushIgnore,
+	"reject": EmptyPushReject,
+	"keep":   EmptyPushKeep,
+}
+
+// ParseEmptyPushPolicy returns the EmptyPushPolicy with the given name, i.e.
+// one of "update", "ignore", "reject", or "keep".
+func ParseEmptyPushPolicy(s string) (EmptyPushPolicy, error) {
+	if p, ok := emptyPushPolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown empty push policy %q, must be one of update, ignore, reject, keep", s)
+}
+
+// GroupingLabelConflictPolicy decides how a pushed metric is handled that has a
+// label named like a grouping label (e.g. job or instance) but with a
+// different value than the grouping label.
+type GroupingLabelConflictPolicy int
+
+// The available GroupingLabelConflictPolicy values.
+const (
+	// GroupingLabelOverwrite sets the label of the metric to the value of
+	// the grouping label, i.e. the grouping label wins.
+	GroupingLabelOverwrite GroupingLabelConflictPolicy = iota
+	// GroupingLabelReject rejects the whole push with status code 400.
+	GroupingLabelReject
+	// GroupingLabelDrop drops the metric (i.e. the series) carrying the
+	// conflicting label, while the other metrics of the push are stored.
+	GroupingLabelDrop
+)
+
+var groupingLabelConflictPolicyNames = map[string]GroupingLabelConflictPolicy{
+	"overwrite": GroupingLabelOverwrite,
+	"reject":    GroupingLabelReject,
+	"drop":      GroupingLabelDrop,
+}
+
+// ParseGroupingLabelConflictPolicy returns the GroupingLabelConflictPolicy
+// with the given name, i.e. one of "overwrite", "reject", or "drop".
+func ParseGroupingLabelConflictPolicy(s string) (GroupingLabelConflictPolicy, error) {
+	if p, ok := groupingLabelConflictPolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown grouping label conflict policy %q, must be one of overwrite, reject, drop", s)
+}
+
+// SampleTimestampPolicy decides how pushed metrics with a timestamp (i.e. with
+// timestamp_ms set) are handled. Prometheus drops samples with a timestamp
+// older than the staleness period of five minutes, so a group that is not
+// pushed to regularly silently disappears from the scrapes.
+type SampleTimestampPolicy int
+
+// The available SampleTimestampPolicy values.
+const (
+	// SampleTimestampHonor stores and exposes the timestamps as pushed.
+	SampleTimestampHonor SampleTimestampPolicy = iota
+	// SampleTimestampStrip removes the timestamps, so that Prometheus
+	// attaches the time of the scrape, like for any other pushed metric.
+	SampleTimestampStrip
+	// SampleTimestampReject rejects the whole push with status code 400.
+	SampleTimestampReject
+)
+
+var sampleTimestampPolicyNames = map[string]SampleTimestampPolicy{
+	"honor":  SampleTimestampHonor,
+	"strip":  SampleTimestampStrip,
+	"reject": SampleTimestampReject,
+}
+
+// ParseSampleTimestampPolicy returns the SampleTimestampPolicy with the given
+// name, i.e. one of "honor", "strip", or "reject".
+func ParseSampleTimestampPolicy(s string) (SampleTimestampPolicy, error) {
+	if p, ok := sampleTimestampPolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown sample timestamp policy %q, must be one of honor, strip, reject", s)
+}
+
+// PushOptions are the options of Push. The zero value of each option is its
+// default.
+type PushOptions struct {
+	// If RequireInstance is true, pushes without an instance are rejected
+	// with status code 400 instead of using the remote IP number of the
+	// pusher as the instance.
+	RequireInstance bool
+	// MaxAge, if positive, is the maximum age of the time of a push given
+	// by the query parameter ts.
+	MaxAge time.Duration
+	// EmptyPush decides how a push without any samples is handled.
+	EmptyPush EmptyPushPolicy
+	// MaxBytes, if positive, is the maximum size of the body of a push
+	// (after decompression).
+	MaxBytes int64
+	// Conflicts decides how metrics with a label named like a grouping
+	// label but with a different value are handled.
+	Conflicts GroupingLabelConflictPolicy
+	// Timestamps decides how metrics with a timestamp are handled.
+	Timestamps SampleTimestampPolicy
+	// Normalizer, if not nil, normalizes the grouping labels and metric
+	// names of each push.
+	Normalizer *GroupingLabelNormalizer
+}
+
 // Push returns an http.Handler which accepts samples over HTTP and stores them
-// in the MetricStore. If replace is true, all metrics for the job and instance
-// given by the request are deleted before new ones are stored.
+// in the MetricStore. If replace is true, all metrics for the group given by
+// the request are replaced by the new ones (which is done atomically, see
+// WriteRequest.Replace). Otherwise, only metrics with the same name are
+// replaced. The group is given by the grouping labels in the path, see
+// groupingLabels. If the request does not specify an instance, the remote IP
+// number of the pusher is used as the instance, unless opts.RequireInstance is
+// true, in which case the request is rejected with status code 400.
+//
+// With the AggregationHeader set (only allowed if replace is false), the pushed
+// gauges are aggregated over a time window, see storage.Aggregation.
+//
+// With the MergeHeader set (only allowed if replace is false and without the
+// AggregationHeader), the values of the pushed metrics are combined with the
+// stored values of the same series, see storage.WriteRequest.
+//
+// With the MetricNamesHeader set (only allowed if replace is false and
+// without the AggregationHeader), the push is authoritative for the listed
+// metric names: Stored metrics with a listed name that are not part of the
+// push are deleted, and pushing a metric that is not listed is rejected with
+// status code 400, see storage.WriteRequest.MetricNames.
+//
+// If the MetricStore cannot queue the push (see
+// storage.MetricStore.SubmitWriteRequest), it is rejected with status code
+// 503, with a Retry-After header if the queue is full.
+//
+// With the ExpirationHeader set, the group expires after the given time
+// without pushes instead of after the default expiration of the MetricStore
+// (or never, with a value of 0), see storage.WriteRequest.Expiration.
+//
+// The query parameter ts sets the time of the push (as Unix time in seconds or
+// in RFC 3339 format, see parseTime) instead of the time the request was
+// received, e.g. for batch uploads of results produced earlier. If opts.MaxAge
+// is positive, pushes with a ts older than that are rejected with status code
+// 400, so that late uploads do not overwrite newer data.
+//
+// A push without any samples (and without the MetricNamesHeader) is handled
+// according to opts.EmptyPush. Metrics with a label named like a grouping label
+// but with a different value are handled according to opts.Conflicts, metrics
+// with a timestamp according to opts.Timestamps.
+//
+// The body is in the text format, as varint-delimited protobuf messages, or in
+// the OpenMetrics text format (see parseOpenMetrics), as indicated by the
+// Content-Type header. Unsupported OpenMetrics versions are rejected with
+// status code 415.
+//
+// The body may be compressed with gzip or snappy (in the block format, see
+// snappyDecode), as indicated by the Content-Encoding header, no matter its
+// format. Other content encodings are rejected with
+// status code 415, malformed compressed bodies with status code 400. If
+// opts.MaxBytes is positive, bodies larger than that (after decompression) are
+// rejected with status code 413.
+//
+// A push to a group the API token of the request is not authorized for (see
+// TokenAuth.Authenticate) is rejected with status code 403.
 //
 // The returned handler is already instrumented for Prometheus.
-func Push(ms storage.MetricStore, replace bool) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+func Push(ms storage.MetricStore, replace bool, opts PushOptions) func(http.ResponseWriter, *http.Request, httprouter.Params) {
 	var ps httprouter.Params
 	var mtx sync.Mutex // Protects ps.
 
-	instrumentedHandlerFunc := prometheus.InstrumentHandlerFunc(
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
 		"push",
 		func(w http.ResponseWriter, r *http.Request) {
-			job := ps.ByName("job")
-			instance := ps.ByName("instance")
+			labels, err := groupingLabels(ps)
 			mtx.Unlock()
 
-			var err error
-			if job == "" {
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if labels["job"] == "" {
 				http.Error(w, "job name is required", http.StatusBadRequest)
 				return
 			}
-			if instance == "" {
-				// Remote IP number (without port).
-				instance, _, err = net.SplitHostPort(r.RemoteAddr)
-				if err != nil || instance == "" {
-					instance = "localhost"
+			if labels["instance"] == "" {
+				if opts.RequireInstance {
+					http.Error(w, "instance name is required", http.StatusBadRequest)
+					return
 				}
+				labels["instance"] = remoteInstance(r)
 			}
-			if replace {
-				ms.SubmitWriteRequest(storage.WriteRequest{
-					Job:       job,
-					Instance:  instance,
-					Timestamp: time.Now(),
-				})
+			opts.Normalizer.group(labels)
+			logPushGroup(r, labels)
+			if err := authorizeGroup(r, labels, true); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
 			}
-
-			var metricFamilies map[string]*dto.MetricFamily
-			ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
-			if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
-				ctParams["encoding"] == "delimited" &&
-				ctParams["proto"] == "io.prometheus.client.MetricFamily" {
-				metricFamilies = map[string]*dto.MetricFamily{}
-				for {
-					mf := &dto.MetricFamily{}
-					if _, err = pbutil.ReadDelimited(r.Body, mf); err != nil {
-						if err == io.EOF {
-							err = nil
-						}
-						break
-					}
-					metricFamilies[mf.GetName()] = mf
+			now := time.Now()
+			timestamp := now
+			if s := r.URL.Query().Get("ts"); s != "" {
+				var err error
+				if timestamp, err = parseTime(s); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if opts.MaxAge > 0 && timestamp.Before(now.Add(-opts.MaxAge)) {
+					http.Error(w, fmt.Sprintf("push timestamp %s is older than the maximum age of %s", timestamp.UTC().Format(time.RFC3339), opts.MaxAge), http.StatusBadRequest)
+					return
+				}
+				if timestamp.After(now.Add(MaxPushTimestampSkew)) {
+					http.Error(w, fmt.Sprintf("push timestamp %s is more than %s in the future", timestamp.UTC().Format(time.RFC3339), MaxPushTimestampSkew), http.StatusBadRequest)
+					return
+				}
+			}
+			var aggregation *storage.Aggregation
+			if h := r.Header.Get(AggregationHeader); h != "" {
+				if replace {
+					http.Error(w, "aggregation is only supported for POST", http.StatusBadRequest)
+					return
+				}
+				var err error
+				if aggregation, err = parseAggregation(h); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			merge := storage.MergeLast
+			if h := r.Header.Get(MergeHeader); h != "" {
+				if replace {
+					http.Error(w, "merging is only supported for POST", http.StatusBadRequest)
+					return
 				}
-			} else {
-				// We could do further content-type checks here, but the
-				// fallback for now will anyway be the text format
-				// version 0.0.4, so just go for it and see if it works.
-				var parser text.Parser
-				metricFamilies, err = parser.TextToMetricFamilies(r.Body)
+				if aggregation != nil {
+					http.Error(w, "merging cannot be combined with aggregation", http.StatusBadRequest)
+					return
+				}
+				var err error
+				if merge, err = parseMerge(h); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			var metricNames []string
+			if h := r.Header.Get(MetricNamesHeader); h != "" {
+				if replace {
+					http.Error(w, "metric names are only supported for POST", http.StatusBadRequest)
+					return
+				}
+				if aggregation != nil {
+					http.Error(w, "metric names cannot be combined with aggregation", http.StatusBadRequest)
+					return
+				}
+				var err error
+				if metricNames, err = parseMetricNames(h); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			var expiration time.Duration
+			if h := r.Header.Get(ExpirationHeader); h != "" {
+				var err error
+				if expiration, err = parseExpiration(h); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			format, err := pushFormat(r.Header.Get("Content-Type"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
 			}
+			body, err := pushBody(r, opts.MaxBytes)
 			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				return
+			}
+			metricFamilies, err := readMetricFamilies(body, format)
+			if err := body.Close(); err != nil {
+				logging.Error("Error closing push body.", "err", err)
+			}
+			switch {
+			case body.err == errPushTooLarge:
+				http.Error(w, fmt.Sprintf("push body exceeds %d bytes", opts.MaxBytes), http.StatusRequestEntityTooLarge)
+				return
+			case body.err != nil:
+				http.Error(w, fmt.Sprintf("cannot decode push body: %s", body.err), http.StatusBadRequest)
+				return
+			case err != nil:
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			setJobAndInstance(metricFamilies, job, instance)
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Job:            job,
-				Instance:       instance,
-				Timestamp:      time.Now(),
+			keepEmpty := false
+			if opts.EmptyPush != EmptyPushUpdate && metricNames == nil && !hasSamples(metricFamilies) {
+				switch opts.EmptyPush {
+				case EmptyPushReject:
+					http.Error(w, "push does not contain any samples", http.StatusBadRequest)
+					return
+				case EmptyPushIgnore:
+					w.WriteHeader(http.StatusAccepted)
+					return
+				}
+				// Metric families without metrics do not
+				// change anything.
+				metricFamilies = map[string]*dto.MetricFamily{}
+				keepEmpty = true
+			}
+			if err := applySampleTimestampPolicy(metricFamilies, opts.Timestamps); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if aggregation != nil {
+				if err := checkAggregatable(metricFamilies); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			opts.Normalizer.normalizeMetrics(metricFamilies)
+			if err := setGroupingLabels(metricFamilies, labels, opts.Conflicts); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			wr := storage.WriteRequest{
+				Labels:         labels,
+				Timestamp:      timestamp,
 				MetricFamilies: metricFamilies,
-			})
+				Replace:        replace,
+				Aggregation:    aggregation,
+				Merge:          merge,
+				MetricNames:    metricNames,
+				Expiration:     expiration,
+				Origin:         requestOrigin(r),
+				PushInfo:       pushInfo(r, body.read),
+				KeepEmpty:      keepEmpty,
+			}
+			if err := ms.SubmitWriteRequest(wr); err != nil {
+				setRetryAfter(w, err)
+				http.Error(w, err.Error(), writeRequestErrorCode(err))
+				return
+			}
 			w.WriteHeader(http.StatusAccepted)
 		},
 	)
@@ -113,36 +415,337 @@ func Push(ms storage.MetricStore, replace bool) func(http.ResponseWriter, *http.
 	}
 }
 
-func setJobAndInstance(metricFamilies map[string]*dto.MetricFamily, job, instance string) {
+// writeRequestErrorCode returns the HTTP status code for an error returned by
+// MetricStore.CheckWriteRequest or MetricStore.SubmitWriteRequest.
+func writeRequestErrorCode(err error) int {
+	switch err {
+	case storage.ErrTooManyGroups, storage.ErrTooManyMetricFamilies:
+		return http.StatusTooManyRequests
+	case storage.ErrQueueFull, storage.ErrShutdown:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// queueFullRetryAfter is the number of seconds after which a client is asked
+// to retry a write request rejected because the queue was full.
+const queueFullRetryAfter = "1"
+
+// setRetryAfter sets the Retry-After header if err is the error returned by
+// MetricStore.SubmitWriteRequest for a full queue.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if err == storage.ErrQueueFull {
+		w.Header().Set("Retry-After", queueFullRetryAfter)
+	}
+}
+
+// remoteInstance returns the remote IP number (without port) of the request,
+// to be used as the instance if none is given explicitly.
+func remoteInstance(r *http.Request) string {
+	instance, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || instance == "" {
+		return "localhost"
+	}
+	return instance
+}
+
+// pushInfo returns the storage.PushInfo of the given request with a body of
+// bodyBytes.
+func pushInfo(r *http.Request, bodyBytes int64) storage.PushInfo {
+	return storage.PushInfo{
+		Remote:      remoteInstance(r),
+		ContentType: r.Header.Get("Content-Type"),
+		UserAgent:   r.UserAgent(),
+		BodyBytes:   bodyBytes,
+	}
+}
+
+// base64Suffix marks a label name in the path of a push or delete whose value
+// is encoded in base64url, so that values may contain slashes.
+const base64Suffix = "@base64"
+
+// groupingLabels returns the grouping labels given by the path parameters of
+// a push or delete request: The job, and either the instance (for paths of the
+// form /metrics/jobs/<job>/instances/<instance>) or any number of further
+// label name/value pairs (for paths of the form
+// /metrics/job/<job>/<name>/<value>/..., where a name suffixed by "@base64"
+// marks a base64url encoded value). The job is base64url encoded, too, if
+// given as the path parameter "job@base64" (for paths of the form
+// /metrics/job@base64/<job>/...). The instance is not set if not given.
+func groupingLabels(ps httprouter.Params) (map[string]string, error) {
+	labels := map[string]string{"job": ps.ByName("job")}
+	if encoded := ps.ByName("job" + base64Suffix); encoded != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 encoding of job %q: %s", encoded, err)
+		}
+		labels["job"] = string(decoded)
+	}
+	if instance := ps.ByName("instance"); instance != "" {
+		labels["instance"] = instance
+	}
+	path := strings.Trim(ps.ByName("labels"), "/")
+	if path == "" {
+		return labels, nil
+	}
+	components := strings.Split(path, "/")
+	if len(components)%2 != 0 {
+		return nil, fmt.Errorf("odd number of components in grouping labels %q", path)
+	}
+	for i := 0; i < len(components); i += 2 {
+		name, value := strings.TrimSuffix(components[i], base64Suffix), components[i+1]
+		if name != components[i] {
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 encoding of value %q of grouping label %q: %s", value, name, err)
+			}
+			value = string(decoded)
+		}
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid grouping label name %q", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("grouping label %q given more than once", name)
+		}
+		if value == "" && name == components[i] {
+			// An empty value can only be given base64 encoded,
+			// i.e. as "=".
+			return nil, fmt.Errorf("empty value of grouping label %q", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+var errPushTooLarge = errors.New("push body too large")
+
+// pushReader reads the (decompressed) body of a push. It records the first
+// error other than io.EOF of the decompression or the size limit, so that
+// those can be told apart from errors parsing the metrics. It counts the
+// bytes read.
+type pushReader struct {
+	r         io.Reader
+	closers   []io.Closer
+	remaining int64 // Negative means no limit.
+	read      int64
+	err       error
+}
+
+// pushBody returns the body of the given push request as a pushReader,
+// decompressed according to the Content-Encoding header and limited to
+// maxBytes (if positive). An error is only returned for an unsupported
+// content encoding.
+func pushBody(r *http.Request, maxBytes int64) (*pushReader, error) {
+	pr := &pushReader{r: r.Body, closers: []io.Closer{r.Body}, remaining: -1}
+	if maxBytes > 0 {
+		pr.remaining = maxBytes
+	}
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF // An empty body is not valid gzip.
+		}
+		if err != nil {
+			// Reported by Read like any other decompression error.
+			pr.err = err
+			break
+		}
+		pr.r = gz
+		pr.closers = append(pr.closers, gz)
+	case "snappy":
+		// The block format cannot be decoded as a stream. The limit of
+		// the compressed body follows from maxBytes.
+		var compressed []byte
+		var err error
+		if maxBytes > 0 {
+			limit := snappyMaxEncodedLen(maxBytes)
+			if compressed, err = ioutil.ReadAll(io.LimitReader(r.Body, limit+1)); err == nil && int64(len(compressed)) > limit {
+				err = errPushTooLarge
+			}
+		} else {
+			compressed, err = ioutil.ReadAll(r.Body)
+		}
+		if err == nil {
+			compressed, err = snappyDecode(compressed, maxBytes)
+		}
+		if err != nil {
+			pr.err = err
+			break
+		}
+		pr.r = bytes.NewReader(compressed)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", enc)
+	}
+	return pr, nil
+}
+
+func (pr *pushReader) Read(p []byte) (int, error) {
+	if pr.err != nil {
+		return 0, pr.err
+	}
+	if pr.remaining >= 0 && int64(len(p)) > pr.remaining+1 {
+		// Read one byte beyond the limit to detect exceeding it.
+		p = p[:pr.remaining+1]
+	}
+	n, err := pr.r.Read(p)
+	if pr.remaining >= 0 {
+		if int64(n) > pr.remaining {
+			n = int(pr.remaining)
+			err = errPushTooLarge
+		}
+		pr.remaining -= int64(n)
+	}
+	pr.read += int64(n)
+	if err != nil && err != io.EOF {
+		pr.err = err
+	}
+	return n, err
+}
+
+func (pr *pushReader) Close() error {
+	var err error
+	for i := len(pr.closers) - 1; i >= 0; i-- {
+		if cErr := pr.closers[i].Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// bodyFormat is the format of a push body.
+type bodyFormat int
+
+// The available bodyFormat values.
+const (
+	formatText bodyFormat = iota
+	formatDelimitedProto
+	formatOpenMetrics
+)
+
+// pushFormat returns the format of a push body with the given Content-Type
+// header: varint-delimited protobuf messages, the OpenMetrics text format
+// (version 1.0.0 or 0.0.1, or without version), or otherwise the text format.
+// An error is only returned for an unsupported version of the OpenMetrics text
+// format.
+func pushFormat(contentType string) (bodyFormat, error) {
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// We could do further content-type checks here, but the
+		// fallback for now will anyway be the text format version
+		// 0.0.4, so just go for it and see if it works.
+		return formatText, nil
+	}
+	switch mediatype {
+	case "application/vnd.google.protobuf":
+		if params["encoding"] == "delimited" && params["proto"] == "io.prometheus.client.MetricFamily" {
+			return formatDelimitedProto, nil
+		}
+	case "application/openmetrics-text":
+		switch v := params["version"]; v {
+		case "", "1.0.0", "0.0.1":
+			return formatOpenMetrics, nil
+		default:
+			return 0, fmt.Errorf("unsupported OpenMetrics version %q", v)
+		}
+	}
+	return formatText, nil
+}
+
+// readMetricFamilies reads MetricFamilies from r in the given format.
+func readMetricFamilies(r io.Reader, format bodyFormat) (map[string]*dto.MetricFamily, error) {
+	switch format {
+	case formatText:
+		var parser text.Parser
+		return parser.TextToMetricFamilies(r)
+	case formatOpenMetrics:
+		return parseOpenMetrics(r)
+	}
+	metricFamilies := map[string]*dto.MetricFamily{}
+	for {
+		mf := &dto.MetricFamily{}
+		if _, err := pbutil.ReadDelimited(r, mf); err != nil {
+			if err == io.EOF {
+				return metricFamilies, nil
+			}
+			return nil, err
+		}
+		metricFamilies[mf.GetName()] = mf
+	}
+}
+
+func hasSamples(metricFamilies map[string]*dto.MetricFamily) bool {
 	for _, mf := range metricFamilies {
+		if len(mf.GetMetric()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// applySampleTimestampPolicy handles the metrics with a timestamp according to
+// timestamps: With SampleTimestampReject, an error is returned, with
+// SampleTimestampStrip, the timestamps are removed.
+func applySampleTimestampPolicy(metricFamilies map[string]*dto.MetricFamily, timestamps SampleTimestampPolicy) error {
+	if timestamps == SampleTimestampHonor {
+		return nil
+	}
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			if m.TimestampMs == nil {
+				continue
+			}
+			if timestamps == SampleTimestampReject {
+				return fmt.Errorf("metric %q has a timestamp, which this Pushgateway does not accept", name)
+			}
+			m.TimestampMs = nil
+		}
+	}
+	return nil
+}
+
+// setGroupingLabels sets the grouping labels of all metrics to the given
+// values, adding the labels where missing. Metrics with a grouping label of a
+// different value are handled according to conflicts: With
+// GroupingLabelReject, an error is returned (and the metric families must not
+// be used anymore), with GroupingLabelDrop, the metrics are removed from their
+// metric family.
+func setGroupingLabels(metricFamilies map[string]*dto.MetricFamily, labels map[string]string, conflicts GroupingLabelConflictPolicy) error {
+	names := storage.GroupingLabelNames(labels)
+	for name, mf := range metricFamilies {
+		kept := mf.Metric[:0]
 	metric:
 		for _, m := range mf.GetMetric() {
-			var jobDone, instanceDone bool
+			done := map[string]bool{}
 			for _, lp := range m.GetLabel() {
-				switch lp.GetName() {
-				case "job":
-					lp.Value = proto.String(job)
-					jobDone = true
-				case "instance":
-					lp.Value = proto.String(instance)
-					instanceDone = true
+				value, ok := labels[lp.GetName()]
+				if !ok {
+					continue
 				}
-				if jobDone && instanceDone {
-					continue metric
+				done[lp.GetName()] = true
+				if lp.GetValue() != value {
+					switch conflicts {
+					case GroupingLabelReject:
+						return fmt.Errorf("label %s=%q of metric %q conflicts with grouping label %s=%q", lp.GetName(), lp.GetValue(), name, lp.GetName(), value)
+					case GroupingLabelDrop:
+						logging.Warn("Dropping metric with label conflicting with grouping label.", "metric", name, "label", lp.GetName(), "value", lp.GetValue(), "grouping_value", value)
+						continue metric
+					}
+					lp.Value = proto.String(value)
 				}
 			}
-			if !jobDone {
-				m.Label = append(m.Label, &dto.LabelPair{
-					Name:  proto.String("job"),
-					Value: proto.String(job),
-				})
-			}
-			if !instanceDone {
-				m.Label = append(m.Label, &dto.LabelPair{
-					Name:  proto.String("instance"),
-					Value: proto.String(instance),
-				})
+			for _, ln := range names {
+				if !done[ln] {
+					m.Label = append(m.Label, &dto.LabelPair{
+						Name:  proto.String(ln),
+						Value: proto.String(labels[ln]),
+					})
+				}
 			}
+			kept = append(kept, m)
 		}
+		mf.Metric = kept
 	}
+	return nil
 }
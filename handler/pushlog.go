@@ -0,0 +1,127 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// LogPushes wraps h, the handler of the push endpoint with the given name
+// (e.g. "push" or "batch"), so that at log level debug every push is logged
+// with its group, its size, and whether it has been accepted or rejected (and
+// why). It has to wrap all handlers that might reject the push (like
+// ReadOnlyMode.Guard, RateLimiter.Limit, and Quarantine.Guard) so that their
+// rejections are logged, too.
+//
+// Handlers of requests with several pushes (batches, StatsD requests, and
+// WebSocket connections) and of pushes answered without an HTTP error status
+// (gRPC) log each push themselves (see logPush). For all other requests, one
+// line is logged once the request is answered, with the group set by the
+// handler (see logPushGroup) or given by the path.
+func LogPushes(name string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !logging.Enabled(logging.LevelDebug) {
+			h(w, r, ps)
+			return
+		}
+		l := &pushLog{handler: name, method: r.Method, remote: r.RemoteAddr}
+		if labels, err := groupingLabels(ps); err == nil && labels["job"] != "" {
+			l.group = labels
+		}
+		body := &countingReader{r: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		lr := &pushLogRecorder{statusRecorder: &statusRecorder{ResponseWriter: w, code: http.StatusOK}}
+		h(lr, r.WithContext(context.WithValue(r.Context(), pushLogKey{}, l)), ps)
+		// A WebSocket connection without any message has not pushed
+		// anything.
+		if l.logged || lr.code == http.StatusSwitchingProtocols {
+			return
+		}
+		keyvals := l.keyvals(l.group, body.n)
+		keyvals = append(keyvals, "code", lr.code)
+		if lr.code/100 == 2 {
+			logging.Debug("Push accepted.", keyvals...)
+			return
+		}
+		logging.Debug("Push rejected.", append(keyvals, "err", strings.TrimSpace(lr.msg.String()))...)
+	}
+}
+
+type pushLogKey struct{}
+
+// pushLog is the state of a request logged by LogPushes.
+type pushLog struct {
+	handler, method, remote string
+	group                   map[string]string
+	logged                  bool
+}
+
+func (l *pushLog) keyvals(group map[string]string, size int64) []interface{} {
+	keyvals := []interface{}{"handler", l.handler, "method", l.method}
+	if group != nil {
+		keyvals = append(keyvals, "group", storage.FormatGroup(group))
+	}
+	return append(keyvals, "remote", l.remote, "bytes", size)
+}
+
+// logPushGroup sets the group of the push of the request, once known to the
+// handler, e.g. including the default instance. It is a no-op if the request
+// is not logged by LogPushes.
+func logPushGroup(r *http.Request, labels map[string]string) {
+	if l, ok := r.Context().Value(pushLogKey{}).(*pushLog); ok {
+		l.group = labels
+	}
+}
+
+// logPush logs one of the pushes of the request right away. labels are nil if
+// the group is unknown, e.g. if the push cannot be decoded, and err is nil if
+// the push has been accepted. Once called, LogPushes logs nothing for the
+// request. It is a no-op if the request is not logged by LogPushes.
+func logPush(r *http.Request, labels map[string]string, size int64, err error) {
+	l, ok := r.Context().Value(pushLogKey{}).(*pushLog)
+	if !ok {
+		return
+	}
+	l.logged = true
+	keyvals := l.keyvals(labels, size)
+	if err == nil {
+		logging.Debug("Push accepted.", keyvals...)
+		return
+	}
+	logging.Debug("Push rejected.", append(keyvals, "err", err)...)
+}
+
+// pushLogRecorder records the status code and the error message of the
+// response to a push, so that the push can be logged once it is answered.
+type pushLogRecorder struct {
+	*statusRecorder
+	msg bytes.Buffer
+}
+
+func (l *pushLogRecorder) Write(p []byte) (int, error) {
+	if l.code/100 != 2 && l.msg.Len() < 1024 {
+		l.msg.Write(p)
+	}
+	return l.statusRecorder.Write(p)
+}
@@ -0,0 +1,187 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+var quarantinedGroupsDesc = prometheus.NewDesc(
+	"pushgateway_quarantined_groups",
+	"Number of groups whose pushes are currently rejected after repeated failures.",
+	nil, nil,
+)
+
+// Quarantine counts the consecutive failed pushes to each group. Once a group
+// has reached the threshold, its pushes are rejected with status code 429 for
+// the cooldown, after which the count starts over. A successful push resets
+// the count. Failures that lie more than the cooldown apart do not count as
+// consecutive. A nil *Quarantine is valid and quarantines nothing. It is safe
+// for concurrent use and is a prometheus.Collector exposing the number of
+// quarantined groups.
+type Quarantine struct {
+	threshold int
+	cooldown  time.Duration
+
+	mtx         sync.Mutex
+	failures    map[string]*quarantineFailures // By grouping key.
+	quarantined map[string]time.Time           // Until when.
+	lastSweep   time.Time
+}
+
+type quarantineFailures struct {
+	count int
+	last  time.Time
+}
+
+// NewQuarantine returns a Quarantine with the given threshold and cooldown. If
+// threshold or cooldown is not positive, nil is returned, i.e. no group is
+// ever quarantined.
+func NewQuarantine(threshold int, cooldown time.Duration) *Quarantine {
+	if threshold <= 0 || cooldown <= 0 {
+		return nil
+	}
+	return &Quarantine{
+		threshold:   threshold,
+		cooldown:    cooldown,
+		failures:    map[string]*quarantineFailures{},
+		quarantined: map[string]time.Time{},
+	}
+}
+
+// Guard wraps the given push handler. Pushes to a quarantined group are
+// rejected with status code 429 (and a Retry-After header) without being
+// passed on to h. Otherwise, the response of h decides how the push counts:
+// Status codes 400, 413, and 415 (i.e. malformed or oversized pushes) are
+// failures, and 2xx status codes are successes. Other status codes do not
+// change the count. The group is taken from the path parameters like a push
+// does (see groupingLabels, with the instance defaulting to the remote IP
+// number of the pusher). Requests with invalid grouping labels are passed on
+// to h without counting. If the Quarantine is nil, h is returned unchanged.
+func (q *Quarantine) Guard(h httprouter.Handle) httprouter.Handle {
+	if q == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		labels, err := groupingLabels(ps)
+		if err != nil {
+			h(w, r, ps)
+			return
+		}
+		if labels["instance"] == "" {
+			labels["instance"] = remoteInstance(r)
+		}
+		key := tenantScoped(r, storage.GroupingKeyFor(labels))
+		if remaining := q.remaining(key, time.Now()); remaining > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+			http.Error(w, fmt.Sprintf("group quarantined for %s after %d consecutive failed pushes", q.cooldown, q.threshold), http.StatusTooManyRequests)
+			return
+		}
+		sr := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(sr, r, ps)
+		switch {
+		case sr.code == http.StatusBadRequest, sr.code == http.StatusRequestEntityTooLarge, sr.code == http.StatusUnsupportedMediaType:
+			q.fail(key, time.Now())
+		case sr.code/100 == 2:
+			q.succeed(key)
+		}
+	}
+}
+
+// remaining returns how much longer the given group is quarantined, which is
+// not positive if it is not quarantined.
+func (q *Quarantine) remaining(key string, now time.Time) time.Duration {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	until, ok := q.quarantined[key]
+	if !ok {
+		return 0
+	}
+	if !now.Before(until) {
+		delete(q.quarantined, key)
+		return 0
+	}
+	return until.Sub(now)
+}
+
+func (q *Quarantine) fail(key string, now time.Time) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.sweep(now)
+	f, ok := q.failures[key]
+	if !ok || now.Sub(f.last) > q.cooldown {
+		f = &quarantineFailures{}
+		q.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= q.threshold {
+		delete(q.failures, key)
+		q.quarantined[key] = now.Add(q.cooldown)
+	}
+}
+
+func (q *Quarantine) succeed(key string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	delete(q.failures, key)
+}
+
+// sweep removes the failure counts and quarantines that have expired, but only
+// once per cooldown to keep the cost amortized. The caller must hold mtx.
+func (q *Quarantine) sweep(now time.Time) {
+	if now.Sub(q.lastSweep) < q.cooldown {
+		return
+	}
+	for key, f := range q.failures {
+		if now.Sub(f.last) > q.cooldown {
+			delete(q.failures, key)
+		}
+	}
+	for key, until := range q.quarantined {
+		if !now.Before(until) {
+			delete(q.quarantined, key)
+		}
+	}
+	q.lastSweep = now
+}
+
+// Describe implements prometheus.Collector.
+func (q *Quarantine) Describe(ch chan<- *prometheus.Desc) {
+	ch <- quarantinedGroupsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (q *Quarantine) Collect(ch chan<- prometheus.Metric) {
+	q.mtx.Lock()
+	now := time.Now()
+	n := 0
+	for _, until := range q.quarantined {
+		if now.Before(until) {
+			n++
+		}
+	}
+	q.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(quarantinedGroupsDesc, prometheus.GaugeValue, float64(n))
+}
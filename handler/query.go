@@ -0,0 +1,290 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// queryExpr is a parsed expression of the query language supported by Query,
+// a small subset of PromQL.
+type queryExpr interface {
+	// eval returns the samples resulting from evaluating the expression
+	// against the given samples (all samples currently stored).
+	eval(samples []sample) []sample
+}
+
+// eval returns all samples the selector matches, taking the sample name as the
+// "__name__" label.
+func (s selector) eval(samples []sample) []sample {
+	result := []sample{}
+	for _, smpl := range samples {
+		if s.matches(sampleLabels(smpl)) {
+			result = append(result, smpl)
+		}
+	}
+	return result
+}
+
+// aggregators are the supported aggregation operators. Each is called with the
+// values of one group of samples, of which there is at least one.
+var aggregators = map[string]func(values []float64) float64{
+	"sum": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"count": func(values []float64) float64 { return float64(len(values)) },
+	"min": func(values []float64) float64 {
+		min := values[0]
+		for _, v := range values[1:] {
+			if v < min || math.IsNaN(min) {
+				min = v
+			}
+		}
+		return min
+	},
+	"max": func(values []float64) float64 {
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max || math.IsNaN(max) {
+				max = v
+			}
+		}
+		return max
+	},
+	"avg": func(values []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+}
+
+// aggregation is an aggregation operator applied to an expression, grouping
+// the samples by the labels in by (all samples form one group if by is empty).
+type aggregation struct {
+	op   string
+	by   []string
+	expr queryExpr
+}
+
+func (a *aggregation) eval(samples []sample) []sample {
+	groups := map[string]*sample{}
+	values := map[string][]float64{}
+	for _, s := range a.expr.eval(samples) {
+		labels := map[string]string{}
+		for _, ln := range a.by {
+			if lv, ok := sampleLabels(s)[ln]; ok && lv != "" {
+				labels[ln] = lv
+			}
+		}
+		id := seriesID(sample{Labels: labels})
+		if _, ok := groups[id]; !ok {
+			groups[id] = &sample{Labels: labels}
+		}
+		values[id] = append(values[id], s.Value)
+	}
+	result := make([]sample, 0, len(groups))
+	for id, s := range groups {
+		s.Value = aggregators[a.op](values[id])
+		result = append(result, *s)
+	}
+	return result
+}
+
+// sampleLabels returns the labels of the given sample, including its name as
+// the "__name__" label (unless the sample results from an aggregation and has
+// no name).
+func sampleLabels(s sample) map[string]string {
+	if s.Name == "" {
+		return s.Labels
+	}
+	labels := make(map[string]string, len(s.Labels)+1)
+	for ln, lv := range s.Labels {
+		labels[ln] = lv
+	}
+	labels["__name__"] = s.Name
+	return labels
+}
+
+// parseQuery parses an instant query, which is either a series selector as
+// understood by parseSelector or an aggregation of a query, e.g.
+// `sum by (job) (errors{code="500"})` or `max(count(errors) by (instance))`.
+func parseQuery(in string) (queryExpr, error) {
+	s := strings.TrimSpace(in)
+	i := 0
+	for i < len(s) && isLabelNameChar(s[i], i == 0) {
+		i++
+	}
+	op, rest := s[:i], strings.TrimSpace(s[i:])
+	if _, ok := aggregators[op]; !ok || !(strings.HasPrefix(rest, "(") || strings.HasPrefix(rest, "by")) {
+		return parseSelector(s)
+	}
+	a := &aggregation{op: op}
+	var err error
+	if strings.HasPrefix(rest, "by") {
+		if a.by, rest, err = parseGroupingLabels(rest, in); err != nil {
+			return nil, err
+		}
+	}
+	inner, rest, err := parenthesized(rest, in)
+	if err != nil {
+		return nil, err
+	}
+	if a.expr, err = parseQuery(inner); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(rest, "by") {
+		if a.by != nil {
+			return nil, fmt.Errorf("duplicate by clause in query %q", in)
+		}
+		if a.by, rest, err = parseGroupingLabels(rest, in); err != nil {
+			return nil, err
+		}
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q at the end of query %q", rest, in)
+	}
+	return a, nil
+}
+
+// parseGroupingLabels parses the by clause s starts with, e.g. `by (job,
+// instance)`, and returns the label names and the trimmed remainder of s.
+func parseGroupingLabels(s, in string) ([]string, string, error) {
+	list, rest, err := parenthesized(strings.TrimSpace(s[len("by"):]), in)
+	if err != nil {
+		return nil, "", err
+	}
+	labels := []string{}
+	if list == "" {
+		return labels, rest, nil
+	}
+	for _, ln := range strings.Split(list, ",") {
+		ln = strings.TrimSpace(ln)
+		if !labelNameRE.MatchString(ln) {
+			return nil, "", fmt.Errorf("invalid label name %q in by clause of query %q", ln, in)
+		}
+		labels = append(labels, ln)
+	}
+	return labels, rest, nil
+}
+
+// parenthesized returns the (trimmed) content of the parentheses s starts with
+// and the trimmed remainder of s. Parentheses within quoted label values are
+// ignored.
+func parenthesized(s, in string) (string, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return "", "", fmt.Errorf("expected '(' at %q in query %q", s, in)
+	}
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			end := closingQuote(s[i:])
+			if end == -1 {
+				return "", "", fmt.Errorf("unterminated label value at %q in query %q", s[i:], in)
+			}
+			i += end
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return strings.TrimSpace(s[1:i]), strings.TrimSpace(s[i+1:]), nil
+			}
+		}
+	}
+	return "", "", fmt.Errorf("unbalanced parentheses in query %q", in)
+}
+
+// vectorSample is a sample of an instant vector as returned by the query API
+// of Prometheus.
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"` // Timestamp and value as string.
+}
+
+type vectorSamplesByLabels []vectorSample
+
+func (s vectorSamplesByLabels) Len() int      { return len(s) }
+func (s vectorSamplesByLabels) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s vectorSamplesByLabels) Less(i, j int) bool {
+	return seriesID(sample{Labels: s[i].Metric}) < seriesID(sample{Labels: s[j].Metric})
+}
+
+// Query returns a handler that evaluates the instant query given by the
+// parameter query (in the URL or in a form-encoded body) against the metrics
+// currently stored. It responds like the instant query API of Prometheus, with
+// a result of type vector. As only the latest values are stored, the optional
+// parameter time is merely used as the timestamp of the returned samples
+// (instead of the current time). See parseQuery for the supported subset of
+// PromQL.
+func Query(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		q := r.Form.Get("query")
+		if q == "" {
+			writeAPIError(w, http.StatusBadRequest, errors.New("parameter query is required"))
+			return
+		}
+		ts := time.Now()
+		if s := r.Form.Get("time"); s != "" {
+			var err error
+			if ts, err = parseTime(s); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid parameter time: %s", err))
+				return
+			}
+		}
+		expr, err := parseQuery(q)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		var samples []sample
+		for _, group := range ms.GetMetricFamiliesMap() {
+			for name, tmf := range group.Metrics {
+				for _, m := range tmf.MetricFamily.GetMetric() {
+					samples = append(samples, flattenMetric(name, tmf.MetricFamily.GetType(), m)...)
+				}
+			}
+		}
+		timestamp := json.Number(strconv.FormatFloat(float64(ts.UnixNano()/int64(time.Millisecond))/1000, 'f', -1, 64))
+		result := vectorSamplesByLabels{}
+		for _, s := range expr.eval(samples) {
+			result = append(result, vectorSample{
+				Metric: sampleLabels(s),
+				Value:  [2]interface{}{timestamp, formatValue(s.Value)},
+			})
+		}
+		sort.Sort(result)
+		writeAPIData(w, map[string]interface{}{"resultType": "vector", "result": result})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	defaultQueueLimit = 100
+	maxQueueLimit     = 1000
+)
+
+type apiQueue struct {
+	Total    int                      `json:"total"`
+	Requests []apiPendingWriteRequest `json:"requests"`
+}
+
+// apiPendingWriteRequest is the JSON representation of a
+// storage.PendingWriteRequest. Instance is empty for the deletion of a whole
+// job. Labels are the grouping labels besides job and instance.
+type apiPendingWriteRequest struct {
+	Job            string            `json:"job"`
+	Instance       string            `json:"instance"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Submitted      time.Time         `json:"submitted"`
+	Delete         bool              `json:"delete"`
+	Replace        bool              `json:"replace"`
+	MetricFamilies int               `json:"metric_families"`
+	Series         int               `json:"series"`
+	Bytes          int               `json:"bytes"`
+}
+
+// Queue returns a handler that serves a point-in-time view of the write
+// requests pending in the MetricStore (without their metrics) as JSON, oldest
+// first. The number of returned requests is limited by the query parameter
+// limit (100 by default, at most 1000), while the total number of pending
+// requests is always reported.
+func Queue(ms storage.MetricStore) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultQueueLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > maxQueueLimit {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid value %q for parameter limit, must be between 1 and %d", s, maxQueueLimit))
+				return
+			}
+		}
+		pending, total := ms.PendingWriteRequests(limit)
+		result := apiQueue{Total: total, Requests: make([]apiPendingWriteRequest, len(pending))}
+		for i, p := range pending {
+			result.Requests[i] = apiPendingWriteRequest{
+				Job:            p.Labels["job"],
+				Instance:       p.Labels["instance"],
+				Labels:         otherGroupingLabels(p.Labels),
+				Submitted:      p.Submitted,
+				Delete:         p.Delete,
+				Replace:        p.Replace,
+				MetricFamilies: p.MetricFamilies,
+				Series:         p.Series,
+				Bytes:          p.Bytes,
+			}
+		}
+		writeAPIData(w, result)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Quit returns a handler that shuts the Pushgateway down gracefully, like
+// SIGTERM does, by calling quit once the request has been answered. Only the
+// first request calls quit, later ones are answered in the same way.
+func Quit(quit func()) func(http.ResponseWriter, *http.Request) {
+	var once sync.Once
+	return func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "Requesting termination... Goodbye!")
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		once.Do(quit)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+var rateLimitedRequestsDesc = prometheus.NewDesc(
+	"pushgateway_rate_limited_requests_total",
+	"Total number of write requests rejected by the rate limit.",
+	nil, nil,
+)
+
+// RateLimitKey decides what RateLimiter counts the requests by.
+type RateLimitKey int
+
+// The available RateLimitKey values.
+const (
+	// RateLimitByClient counts the requests by the IP number of the client.
+	RateLimitByClient RateLimitKey = iota
+	// RateLimitByGroup counts the requests by the group given in the path
+	// (see groupingLabels, with the instance defaulting to the IP number of
+	// the client). Requests without a group in the path (like batches) and
+	// requests with invalid grouping labels are counted by client.
+	RateLimitByGroup
+)
+
+var rateLimitKeyNames = map[string]RateLimitKey{
+	"client": RateLimitByClient,
+	"group":  RateLimitByGroup,
+}
+
+// ParseRateLimitKey returns the RateLimitKey with the given name, i.e. one of
+// "client" or "group".
+func ParseRateLimitKey(s string) (RateLimitKey, error) {
+	if k, ok := rateLimitKeyNames[s]; ok {
+		return k, nil
+	}
+	return 0, fmt.Errorf("unknown rate limit key %q, must be one of client, group", s)
+}
+
+// RateLimiter limits the rate of requests per client or per group (see
+// RateLimitKey) with a token bucket for each of them: A bucket holds up to
+// burst tokens and is refilled at the given rate per second. Each request
+// takes a token, and requests finding the bucket empty are rejected with
+// status code 429. A nil *RateLimiter is valid and limits nothing. It is safe
+// for concurrent use and is a prometheus.Collector exposing the number of
+// rejected requests.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	key   RateLimitKey
+
+	mtx       sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	limited   uint64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter with the given rate (in requests per
+// second), burst, and key. If rate is not positive, nil is returned, i.e.
+// nothing is limited. A burst smaller than one is taken as one.
+func NewRateLimiter(rate float64, burst int, key RateLimitKey) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		key:     key,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Limit wraps the given handler. Requests exceeding the rate limit are
+// rejected with status code 429 (and a Retry-After header) without being
+// passed on to h. If the RateLimiter is nil, h is returned unchanged.
+func (l *RateLimiter) Limit(h httprouter.Handle) httprouter.Handle {
+	if l == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if wait := l.take(l.keyFor(r, ps), time.Now()); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("rate limit of %g requests per second exceeded", l.rate), http.StatusTooManyRequests)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// keyFor returns the key of the bucket for the given request.
+func (l *RateLimiter) keyFor(r *http.Request, ps httprouter.Params) string {
+	client := remoteInstance(r)
+	if l.key != RateLimitByGroup || ps.ByName("job") == "" && ps.ByName("job"+base64Suffix) == "" {
+		return "client\xff" + client
+	}
+	labels, err := groupingLabels(ps)
+	if err != nil {
+		return "client\xff" + client
+	}
+	if labels["instance"] == "" {
+		labels["instance"] = client
+	}
+	return tenantScoped(r, "group\xff"+storage.GroupingKeyFor(labels))
+}
+
+// take takes a token from the bucket with the given key. If the bucket is
+// empty, it returns how long it takes until the next token is available, and
+// a non-positive duration otherwise.
+func (l *RateLimiter) take(key string, now time.Time) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		l.limited++
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// sweep removes the buckets that have been refilled completely, as they are
+// the same as new buckets, but only once per refill time to keep the cost
+// amortized. The caller must hold mtx.
+func (l *RateLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < refill {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Describe implements prometheus.Collector.
+func (l *RateLimiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rateLimitedRequestsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (l *RateLimiter) Collect(ch chan<- prometheus.Metric) {
+	l.mtx.Lock()
+	limited := l.limited
+	l.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(rateLimitedRequestsDesc, prometheus.CounterValue, float64(limited))
+}
@@ -0,0 +1,77 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ReadOnlyMode is a switch to reject all requests that would change the
+// MetricStore while still serving reads. It is safe for concurrent use.
+type ReadOnlyMode struct {
+	enabled int32 // Accessed atomically, 1 means enabled.
+}
+
+// NewReadOnlyMode returns a ReadOnlyMode with the given initial state.
+func NewReadOnlyMode(enabled bool) *ReadOnlyMode {
+	m := &ReadOnlyMode{}
+	m.Set(enabled)
+	return m
+}
+
+// Enabled returns whether read-only mode is currently enabled.
+func (m *ReadOnlyMode) Enabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+// Set enables or disables read-only mode.
+func (m *ReadOnlyMode) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+// Guard wraps a handler for a mutating request. While read-only mode is
+// enabled, the wrapped handler is not called, and the request is answered
+// with status code 503.
+func (m *ReadOnlyMode) Guard(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if m.Enabled() {
+			http.Error(w, "pushgateway is in read-only mode", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// Toggle returns a handler to switch read-only mode at runtime. The new state
+// is taken from the query parameter "enabled", which must be a boolean.
+func (m *ReadOnlyMode) Toggle() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid value for parameter enabled: %s", err))
+			return
+		}
+		m.Set(enabled)
+		writeAPIData(w, map[string]bool{"read_only": enabled})
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/text"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// RelabelConfig is a relabeling rule with the same fields and semantics as a
+// metric_relabel_config of Prometheus (in JSON rather than YAML). The
+// supported actions are replace (the default), keep, drop, labelmap,
+// labeldrop, and labelkeep. The metric name is available as the label
+// __name__. Omitted fields have the Prometheus defaults, i.e. separator ";",
+// regex "(.*)", and replacement "$1".
+type RelabelConfig struct {
+	SourceLabels []string `json:"source_labels"`
+	Separator    *string  `json:"separator"`
+	Regex        *string  `json:"regex"`
+	TargetLabel  string   `json:"target_label"`
+	Replacement  *string  `json:"replacement"`
+	Action       string   `json:"action"`
+}
+
+// relabelRule is a validated RelabelConfig with the defaults filled in.
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+func (c RelabelConfig) rule() (relabelRule, error) {
+	r := relabelRule{
+		sourceLabels: c.SourceLabels,
+		separator:    ";",
+		targetLabel:  c.TargetLabel,
+		replacement:  "$1",
+		action:       c.Action,
+	}
+	if c.Separator != nil {
+		r.separator = *c.Separator
+	}
+	if c.Replacement != nil {
+		r.replacement = *c.Replacement
+	}
+	if r.action == "" {
+		r.action = "replace"
+	}
+	regex := "(.*)"
+	if c.Regex != nil {
+		regex = *c.Regex
+	}
+	var err error
+	if r.regex, err = regexp.Compile("^(?:" + regex + ")$"); err != nil {
+		return r, fmt.Errorf("invalid regex %q: %s", regex, err)
+	}
+	switch r.action {
+	case "replace":
+		if r.targetLabel == "" {
+			return r, fmt.Errorf("relabel action %q requires a target_label", r.action)
+		}
+	case "keep", "drop":
+		if len(r.sourceLabels) == 0 {
+			return r, fmt.Errorf("relabel action %q requires source_labels", r.action)
+		}
+	case "labelmap", "labeldrop", "labelkeep":
+	default:
+		return r, fmt.Errorf("unknown relabel action %q", r.action)
+	}
+	return r, nil
+}
+
+// apply applies the rule to the given labels in place and returns false if
+// the metric is to be dropped.
+func (r relabelRule) apply(labels map[string]string) bool {
+	values := make([]string, len(r.sourceLabels))
+	for i, ln := range r.sourceLabels {
+		values[i] = labels[ln]
+	}
+	value := strings.Join(values, r.separator)
+	switch r.action {
+	case "keep":
+		return r.regex.MatchString(value)
+	case "drop":
+		return !r.regex.MatchString(value)
+	case "replace":
+		idx := r.regex.FindStringSubmatchIndex(value)
+		if idx == nil {
+			return true
+		}
+		target := string(r.regex.ExpandString(nil, r.targetLabel, value, idx))
+		if !labelNameRE.MatchString(target) {
+			return true
+		}
+		if res := string(r.regex.ExpandString(nil, r.replacement, value, idx)); res != "" {
+			labels[target] = res
+		} else {
+			delete(labels, target)
+		}
+	case "labelmap":
+		mapped := map[string]string{}
+		for ln, lv := range labels {
+			if r.regex.MatchString(ln) {
+				mapped[r.regex.ReplaceAllString(ln, r.replacement)] = lv
+			}
+		}
+		for ln, lv := range mapped {
+			labels[ln] = lv
+		}
+	case "labeldrop":
+		for ln := range labels {
+			if r.regex.MatchString(ln) {
+				delete(labels, ln)
+			}
+		}
+	case "labelkeep":
+		for ln := range labels {
+			if ln != "__name__" && !r.regex.MatchString(ln) {
+				delete(labels, ln)
+			}
+		}
+	}
+	return true
+}
+
+// Relabel returns a function that returns the result of f with the given
+// relabeling rules applied to each metric, in order, like Prometheus applies
+// metric_relabel_configs. Metrics for which a rule results in dropping them
+// are left out, as are metrics that end up without a valid name. Renamed
+// metrics become part of the metric family of their new name (keeping the
+// type of their original metric family, see below). Labels with empty values
+// and labels starting with "__" are removed after relabeling.
+//
+// The metric families returned by f are not modified. If relabeling results in
+// metrics of different types for the same name, or in the same series more
+// than once, only the first is kept (and the others are logged). If there are
+// no rules, f is returned unchanged.
+func Relabel(configs []RelabelConfig, f func() []*dto.MetricFamily) (func() []*dto.MetricFamily, error) {
+	if len(configs) == 0 {
+		return f, nil
+	}
+	rules := make([]relabelRule, len(configs))
+	for i, c := range configs {
+		var err error
+		if rules[i], err = c.rule(); err != nil {
+			return nil, fmt.Errorf("relabel config %d: %s", i, err)
+		}
+	}
+	return func() []*dto.MetricFamily {
+		return relabelMetricFamilies(rules, f())
+	}, nil
+}
+
+func relabelMetricFamilies(rules []relabelRule, mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	result := []*dto.MetricFamily{}
+	byName := map[string]*dto.MetricFamily{}
+	seen := map[string]bool{}
+	for _, mf := range mfs {
+	metric:
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel())+1)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			labels["__name__"] = mf.GetName()
+			for _, r := range rules {
+				if !r.apply(labels) {
+					continue metric
+				}
+			}
+			name := labels["__name__"]
+			if !metricNameRE.MatchString(name) {
+				continue
+			}
+			names := make([]string, 0, len(labels))
+			for ln, lv := range labels {
+				if lv != "" && !strings.HasPrefix(ln, "__") {
+					names = append(names, ln)
+				}
+			}
+			sort.Strings(names)
+			relabeled := *m
+			relabeled.Label = make([]*dto.LabelPair, len(names))
+			for i, ln := range names {
+				relabeled.Label[i] = &dto.LabelPair{Name: proto.String(ln), Value: proto.String(labels[ln])}
+			}
+
+			target, ok := byName[name]
+			if !ok {
+				target = &dto.MetricFamily{Name: proto.String(name), Help: mf.Help, Type: mf.Type}
+				byName[name] = target
+				result = append(result, target)
+			}
+			if target.GetType() != mf.GetType() {
+				logging.Warn("Dropping relabeled metric as metrics of that name have another type.", "metric", name, "type", mf.GetType(), "existing_type", target.GetType())
+				continue
+			}
+			id := seriesID(sample{Name: name, Labels: labelMap(relabeled.Label)})
+			if seen[id] {
+				logging.Warn("Dropping duplicate series after relabeling.", "series", id)
+				continue
+			}
+			seen[id] = true
+			target.Metric = append(target.Metric, &relabeled)
+		}
+	}
+	filtered := result[:0]
+	for _, mf := range result {
+		if len(mf.Metric) > 0 {
+			filtered = append(filtered, mf)
+		}
+	}
+	return filtered
+}
+
+func labelMap(lps []*dto.LabelPair) map[string]string {
+	result := make(map[string]string, len(lps))
+	for _, lp := range lps {
+		result[lp.GetName()] = lp.GetValue()
+	}
+	return result
+}
+
+// Expose returns a handler that exposes the metric families returned by f,
+// sorted by name, in the text format or, if the client prefers it (see
+// acceptsDelimitedProtobuf), as varint-delimited MetricFamily protocol buffer
+// messages. Unlike the handler of the Prometheus client library, it does not
+// include the metrics of the Pushgateway itself, and it does not support other
+// formats or compression (see SelectFormat for the former).
+func Expose(f func() []*dto.MetricFamily) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs := f()
+		sort.Sort(metricFamiliesByName(mfs))
+		buf := &bytes.Buffer{}
+		if acceptsDelimitedProtobuf(r) {
+			if err := writeProtobuf(buf, mfs); err != nil {
+				logging.Error("Error encoding metric families.", "err", err)
+				http.Error(w, fmt.Sprintf("cannot encode metric families: %s", err), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", protobufContentType)
+			w.Write(buf.Bytes())
+			return
+		}
+		for _, mf := range mfs {
+			if _, err := text.MetricFamilyToText(buf, mf); err != nil {
+				logging.Error("Error encoding metric family.", "name", mf.GetName(), "err", err)
+				http.Error(w, fmt.Sprintf("cannot encode metric family %q: %s", mf.GetName(), err), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", textContentType)
+		w.Write(buf.Bytes())
+	})
+}
+
+type metricFamiliesByName []*dto.MetricFamily
+
+func (s metricFamiliesByName) Len() int           { return len(s) }
+func (s metricFamiliesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s metricFamiliesByName) Less(i, j int) bool { return s[i].GetName() < s[j].GetName() }
@@ -0,0 +1,140 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+var (
+	reloadSuccessGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pushgateway",
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last configuration reload attempt was successful.",
+	})
+	reloadTimeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pushgateway",
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Timestamp of the last successful configuration reload (or of the start-up).",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reloadSuccessGauge)
+	prometheus.MustRegister(reloadTimeGauge)
+}
+
+// Reloader serializes reloads of the configuration and records their outcome.
+// It is safe for concurrent use.
+type Reloader struct {
+	mtx        sync.Mutex
+	reload     func() error
+	lastReload time.Time
+	lastErr    error
+	reloads    uint64
+}
+
+// NewReloader returns a Reloader calling the given function for each reload.
+// The function has to validate the complete new configuration before applying
+// any of it, so that a failed reload leaves the running configuration
+// untouched. The initial configuration counts as successfully loaded now.
+func NewReloader(reload func() error) *Reloader {
+	r := &Reloader{reload: reload, lastReload: time.Now()}
+	reloadSuccessGauge.Set(1)
+	reloadTimeGauge.Set(float64(r.lastReload.UnixNano()) / 1e9)
+	return r
+}
+
+// Reload reloads the configuration and returns the error, if any.
+func (r *Reloader) Reload() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.lastErr = r.reload()
+	if r.lastErr != nil {
+		logging.Error("Error reloading configuration.", "err", r.lastErr)
+		reloadSuccessGauge.Set(0)
+		return r.lastErr
+	}
+	r.lastReload = time.Now()
+	r.reloads++
+	logging.Info("Configuration reloaded.")
+	reloadSuccessGauge.Set(1)
+	reloadTimeGauge.Set(float64(r.lastReload.UnixNano()) / 1e9)
+	return nil
+}
+
+// LastReload returns the time of the last successful reload (or of the
+// creation of the Reloader) and the error of the last reload attempt, if it
+// failed.
+func (r *Reloader) LastReload() (time.Time, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.lastReload, r.lastErr
+}
+
+// Reloads returns the number of successful reloads.
+func (r *Reloader) Reloads() uint64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.reloads
+}
+
+// Handler returns a handler to reload the configuration. A failed reload is
+// answered with status code 500 and the error.
+func (r *Reloader) Handler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := r.Reload(); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		last, _ := r.LastReload()
+		writeAPIData(w, map[string]time.Time{"last_reload": last})
+	}
+}
+
+// MetricFamiliesHolder holds a function returning metric families, like the
+// one returned by Relabel, that can be replaced at runtime. It is safe for
+// concurrent use.
+type MetricFamiliesHolder struct {
+	mtx sync.RWMutex
+	f   func() []*dto.MetricFamily
+}
+
+// NewMetricFamiliesHolder returns a MetricFamiliesHolder holding f.
+func NewMetricFamiliesHolder(f func() []*dto.MetricFamily) *MetricFamiliesHolder {
+	return &MetricFamiliesHolder{f: f}
+}
+
+// Set replaces the held function.
+func (h *MetricFamiliesHolder) Set(f func() []*dto.MetricFamily) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.f = f
+}
+
+// MetricFamilies calls the currently held function.
+func (h *MetricFamiliesHolder) MetricFamilies() []*dto.MetricFamily {
+	h.mtx.RLock()
+	f := h.f
+	h.mtx.RUnlock()
+	return f()
+}
@@ -0,0 +1,90 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ParseJobRenames parses a comma-separated list of job renames of the form
+// "old=new", e.g. "billing=invoicing,batch1=batch". The empty string results
+// in an empty map.
+func ParseJobRenames(s string) (map[string]string, error) {
+	renames := map[string]string{}
+	if s == "" {
+		return renames, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid job rename %q, must be of the form 'old=new'", r)
+		}
+		if _, ok := renames[parts[0]]; ok {
+			return nil, fmt.Errorf("job %q renamed more than once", parts[0])
+		}
+		renames[parts[0]] = parts[1]
+	}
+	return renames, nil
+}
+
+// RenameJobs wraps the given function returning MetricFamilies (as used as a
+// MetricFamilyInjectionHook) so that the job label of all metrics in the
+// result is renamed according to the given map of old to new job names. Like
+// with TruncateTimestamps, the original MetricFamilies are never modified. If
+// renames is empty, f is returned unchanged.
+func RenameJobs(renames map[string]string, f func() []*dto.MetricFamily) func() []*dto.MetricFamily {
+	if len(renames) == 0 {
+		return f
+	}
+	return func() []*dto.MetricFamily {
+		mfs := f()
+		for i, mf := range mfs {
+			if !needsJobRename(mf, renames) {
+				continue
+			}
+			mf = proto.Clone(mf).(*dto.MetricFamily)
+			for _, m := range mf.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() != "job" {
+						continue
+					}
+					if newJob, ok := renames[lp.GetValue()]; ok {
+						lp.Value = proto.String(newJob)
+					}
+				}
+			}
+			mfs[i] = mf
+		}
+		return mfs
+	}
+}
+
+func needsJobRename(mf *dto.MetricFamily, renames map[string]string) bool {
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() != "job" {
+				continue
+			}
+			if _, ok := renames[lp.GetValue()]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,436 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	// replicationPath is where peers accept changes (POST) and hand out
+	// their snapshot (GET), relative to their base URL.
+	replicationPath        = "/api/v1/replicate"
+	replicationContentType = "application/x-pushgateway-replication"
+	// replicationSecretHeader carries the secret shared by the peers. It
+	// is not the Authorization header, which may be taken by basic
+	// authentication of the peer URL.
+	replicationSecretHeader = "X-Pushgateway-Peer-Secret"
+	replicationMaxBatch     = 100
+	replicationMinBackoff   = 100 * time.Millisecond
+	replicationMaxBackoff   = 10 * time.Second
+)
+
+var (
+	replicationRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Name:      "replication_requests_total",
+			Help:      "Total number of requests sending changes to peers, by peer and result (success or failure, the latter being retried).",
+		},
+		[]string{"peer", "result"},
+	)
+	replicationDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Name:      "replication_dropped_total",
+			Help:      "Total number of changes not sent to a peer because its queue was full or the Pushgateway shut down.",
+		},
+		[]string{"peer"},
+	)
+	replicationAntiEntropy = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "pushgateway",
+			Name:      "replication_anti_entropy_total",
+			Help:      "Total number of snapshots fetched from peers and applied to catch up on missed changes, by peer and result (success or failure).",
+		},
+		[]string{"peer", "result"},
+	)
+	replicationQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "pushgateway",
+			Name:      "replication_queue_length",
+			Help:      "Number of changes waiting to be sent, by peer.",
+		},
+		[]string{"peer"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(replicationRequests)
+	prometheus.MustRegister(replicationDropped)
+	prometheus.MustRegister(replicationQueueLength)
+	prometheus.MustRegister(replicationAntiEntropy)
+}
+
+// Replicator sends every change of the MetricStore (see
+// storage.DiskMetricStoreOptions.Replicate) to one or more peers, i.e. other
+// Pushgateways, which apply them with their Replicate handler, so that all of
+// them hold the same groups. Each peer has its own queue, and the changes are
+// sent in order, in batches of up to 100. Failed requests are retried with
+// exponential backoff until they succeed, so that a peer that is down
+// receives the queued changes once it is back. If the queue of a peer is
+// full, further changes are dropped for it (and counted), to be caught up on
+// by anti-entropy (see StartAntiEntropy). All requests carry the secret shared
+// by the peers, see RequirePeerSecret. A nil *Replicator replicates nothing.
+type Replicator struct {
+	peers       []*replicationPeer
+	secret      string
+	stop        chan struct{} // Closed by Close.
+	antiEntropy chan struct{} // Closed once anti-entropy has stopped, nil if not started.
+	backoff     time.Duration // Initial backoff, only changed by tests.
+}
+
+// replicationPeer is the queue of changes of a single peer.
+type replicationPeer struct {
+	url    string // Base URL, as configured.
+	secret string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+}
+
+// NewReplicator returns a Replicator to the given comma-separated list of base
+// URLs of peers (like http://pushgateway-2:9091, including the route prefix,
+// if any) that queues up to queueSize changes per peer and authenticates with
+// the given secret. If peers is empty, nil is returned, i.e. replication is
+// disabled. Otherwise, the secret must not be empty.
+func NewReplicator(peers string, queueSize int, timeout time.Duration, secret string) (*Replicator, error) {
+	r := &Replicator{
+		secret:  secret,
+		stop:    make(chan struct{}),
+		backoff: replicationMinBackoff,
+	}
+	seen := map[string]bool{}
+	for _, url := range strings.Split(peers, ",") {
+		url = strings.TrimSuffix(strings.TrimSpace(url), "/")
+		if url == "" {
+			continue
+		}
+		if seen[url] {
+			return nil, fmt.Errorf("duplicate peer %q", url)
+		}
+		seen[url] = true
+		r.peers = append(r.peers, &replicationPeer{
+			url:    url,
+			secret: secret,
+			client: &http.Client{Timeout: timeout},
+			queue:  make(chan []byte, queueSize),
+			done:   make(chan struct{}),
+		})
+	}
+	if len(r.peers) == 0 {
+		return nil, nil
+	}
+	if secret == "" {
+		return nil, errors.New("no secret to authenticate to the peers with")
+	}
+	for _, p := range r.peers {
+		go r.loopPeer(p)
+	}
+	return r, nil
+}
+
+// Replicate queues the given change for all peers (to be used as
+// storage.DiskMetricStoreOptions.Replicate). It never blocks.
+func (r *Replicator) Replicate(change []byte) {
+	if r == nil {
+		return
+	}
+	for _, p := range r.peers {
+		select {
+		case p.queue <- change:
+			replicationQueueLength.WithLabelValues(p.url).Set(float64(len(p.queue)))
+		default:
+			replicationDropped.WithLabelValues(p.url).Inc()
+		}
+	}
+}
+
+// Bootstrap applies the snapshot of the first peer (in the configured order)
+// that hands it out to the given MetricStore. It is meant to bring a starting
+// Pushgateway up to date before it accepts requests. An error is returned if
+// no peer could be reached, e.g. because all of them are starting, too.
+func (r *Replicator) Bootstrap(ms storage.MetricStore) error {
+	if r == nil {
+		return nil
+	}
+	var errs []string
+	for _, p := range r.peers {
+		changes, err := p.snapshot()
+		if err == nil {
+			err = ms.ApplyReplicated(changes)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", p.url, err))
+			continue
+		}
+		logging.Info("Bootstrapped groups from peer.", "peer", p.url, "count", len(changes))
+		return nil
+	}
+	return fmt.Errorf("no peer to bootstrap from: %s", strings.Join(errs, "; "))
+}
+
+// StartAntiEntropy starts fetching the snapshot of each peer every interval and
+// applying it to the given MetricStore, which catches up on changes the
+// MetricStore has missed, e.g. because they were dropped from a full queue
+// of the peer or while it was down. As ApplyReplicated ignores changes older
+// than the ones applied already, this only changes groups where the peer has
+// seen a later change. It does nothing if interval is not positive.
+func (r *Replicator) StartAntiEntropy(ms storage.MetricStore, interval time.Duration) {
+	if r == nil || interval <= 0 {
+		return
+	}
+	r.antiEntropy = make(chan struct{})
+	go func() {
+		defer close(r.antiEntropy)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+			for _, p := range r.peers {
+				changes, err := p.snapshot()
+				if err == nil {
+					err = ms.ApplyReplicated(changes)
+				}
+				if err != nil {
+					replicationAntiEntropy.WithLabelValues(p.url, "failure").Inc()
+					logging.Warn("Error applying snapshot of peer.", "peer", p.url, "err", err)
+					continue
+				}
+				replicationAntiEntropy.WithLabelValues(p.url, "success").Inc()
+			}
+		}
+	}()
+}
+
+// Close stops the Replicator after the current request to each peer. The
+// changes still queued are dropped (and counted), as the peers catch up by
+// bootstrapping when they restart anyway. Replicate must not be called
+// anymore afterwards.
+func (r *Replicator) Close() {
+	if r == nil {
+		return
+	}
+	close(r.stop)
+	if r.antiEntropy != nil {
+		<-r.antiEntropy
+	}
+	for _, p := range r.peers {
+		<-p.done
+		if n := len(p.queue); n > 0 {
+			logging.Warn("Dropping changes not replicated to peer yet.", "peer", p.url, "count", n)
+			replicationDropped.WithLabelValues(p.url).Add(float64(n))
+		}
+	}
+}
+
+func (r *Replicator) loopPeer(p *replicationPeer) {
+	defer close(p.done)
+	for {
+		var batch [][]byte
+		select {
+		case change := <-p.queue:
+			batch = append(batch, change)
+		case <-r.stop:
+			return
+		}
+	collect:
+		for len(batch) < replicationMaxBatch {
+			select {
+			case change := <-p.queue:
+				batch = append(batch, change)
+			default:
+				break collect
+			}
+		}
+		replicationQueueLength.WithLabelValues(p.url).Set(float64(len(p.queue)))
+		if err := r.send(p, encodeChanges(batch)); err != nil {
+			// Stopped, the batch is lost.
+			replicationDropped.WithLabelValues(p.url).Add(float64(len(batch)))
+			return
+		}
+	}
+}
+
+// errReplicationStopped is returned by send if the Replicator is stopped
+// between two attempts.
+var errReplicationStopped = errors.New("replicator stopped")
+
+func (r *Replicator) send(p *replicationPeer, body []byte) error {
+	backoff := r.backoff
+	for {
+		err := p.sendOnce(body)
+		if err == nil {
+			replicationRequests.WithLabelValues(p.url, "success").Inc()
+			return nil
+		}
+		replicationRequests.WithLabelValues(p.url, "failure").Inc()
+		logging.Error("Error replicating changes to peer.", "peer", p.url, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-r.stop:
+			return errReplicationStopped
+		}
+		if backoff *= 2; backoff > replicationMaxBackoff {
+			backoff = replicationMaxBackoff
+		}
+	}
+}
+
+func (p *replicationPeer) sendOnce(body []byte) error {
+	req, err := http.NewRequest("POST", p.url+replicationPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", replicationContentType)
+	req.Header.Set("User-Agent", "Pushgateway")
+	req.Header.Set(replicationSecretHeader, p.secret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	return fmt.Errorf("unexpected response status %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func (p *replicationPeer) snapshot() ([][]byte, error) {
+	req, err := http.NewRequest("GET", p.url+replicationPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Pushgateway")
+	req.Header.Set(replicationSecretHeader, p.secret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return nil, fmt.Errorf("unexpected response status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return decodeChanges(body)
+}
+
+// encodeChanges concatenates the changes, each prefixed by its length as a
+// varint.
+func encodeChanges(changes [][]byte) []byte {
+	buf := proto.NewBuffer(nil)
+	for _, change := range changes {
+		buf.EncodeRawBytes(change)
+	}
+	return buf.Bytes()
+}
+
+func decodeChanges(body []byte) ([][]byte, error) {
+	var changes [][]byte
+	for len(body) > 0 {
+		n, l := binary.Uvarint(body)
+		if l <= 0 || n > uint64(len(body)-l) {
+			return nil, errors.New("truncated change")
+		}
+		changes = append(changes, body[l:l+int(n)])
+		body = body[l+int(n):]
+	}
+	return changes, nil
+}
+
+// RequirePeerSecret wraps the given handler so that it is only called for
+// requests carrying the given secret (as sent by a Replicator). Other requests
+// are answered with status code 401.
+func RequirePeerSecret(secret string, h httprouter.Handle) httprouter.Handle {
+	want := sha256.Sum256([]byte(secret))
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		got := sha256.Sum256([]byte(r.Header.Get(replicationSecretHeader)))
+		if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// Replicate returns a handler that applies the changes sent by a Replicator
+// of a peer. The number of applied changes is returned.
+//
+// The returned handler is already instrumented for Prometheus.
+func Replicate(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
+		"replicate",
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+			changes, err := decodeChanges(body)
+			if err == nil {
+				err = ms.ApplyReplicated(changes)
+			}
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeAPIData(w, map[string]int{"applied": len(changes)})
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+// ReplicationSnapshot returns a handler that hands out the state of all groups
+// for a starting peer to bootstrap from, see Replicator.Bootstrap.
+//
+// The returned handler is already instrumented for Prometheus.
+func ReplicationSnapshot(ms storage.MetricStore) http.Handler {
+	return InstrumentHandlerFunc(
+		"replication_snapshot",
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", replicationContentType)
+			w.Write(encodeChanges(ms.ReplicationSnapshot()))
+		},
+	)
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Reset returns a handler that deletes all groups from the MetricStore. As a
+// safeguard, the request has to set the query parameter confirm to true. The
+// number of deleted groups is returned.
+//
+// The returned handler is already instrumented for Prometheus.
+func Reset(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return deleteAll(ms, "reset", "resetting")
+}
+
+// Wipe returns a handler that deletes all groups from the MetricStore like
+// Reset, but is instrumented (and traced) separately, so that wipes and resets
+// can be told apart. As with Reset, the request has to set the query parameter
+// confirm to true.
+//
+// The returned handler is already instrumented for Prometheus.
+func Wipe(ms storage.MetricStore) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	return deleteAll(ms, "wipe", "wiping")
+}
+
+// deleteAll returns the handler for Reset and Wipe, instrumented with the
+// given handler name. The verb describes the action in the error returned
+// without confirmation.
+func deleteAll(ms storage.MetricStore, name, verb string) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
+		name,
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("confirm") != "true" {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("%s the store requires the parameter confirm=true", verb))
+				return
+			}
+			deleted, err := ms.Reset(requestOrigin(r))
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, fmt.Errorf("deleted %d groups, but persisting failed: %s", deleted, err))
+				return
+			}
+			writeAPIData(w, map[string]int{"deleted": deleted})
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		instrumentedHandlerFunc(w, r)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+// RollupConfig configures a job-level rollup of a metric, i.e. a derived metric
+// named "job:<metric>:<aggregation>" with only the job label, aggregating all
+// samples of the metric with that job (across instances and all other labels).
+// The supported aggregations are sum, avg, and max. Only gauges, counters, and
+// untyped metrics can be rolled up.
+type RollupConfig struct {
+	Metric      string `json:"metric"`
+	Aggregation string `json:"aggregation"`
+}
+
+func (c RollupConfig) name() string {
+	return "job:" + c.Metric + ":" + c.Aggregation
+}
+
+// Rollup returns a function that returns the result of f plus the rollups
+// configured by configs, computed from the result of f. A rollup is left out
+// if its metric is not returned by f (or has no samples), if the metric has a
+// type that cannot be rolled up, or if f returns a metric family of the same
+// name as the rollup (the latter two are logged). The metric families
+// returned by f are not modified. If there are no rollups, f is returned
+// unchanged.
+func Rollup(configs []RollupConfig, f func() []*dto.MetricFamily) (func() []*dto.MetricFamily, error) {
+	if len(configs) == 0 {
+		return f, nil
+	}
+	seen := map[string]bool{}
+	for i, c := range configs {
+		if !metricNameRE.MatchString(c.Metric) {
+			return nil, fmt.Errorf("rollup %d: invalid metric name %q", i, c.Metric)
+		}
+		switch c.Aggregation {
+		case "sum", "avg", "max":
+		default:
+			return nil, fmt.Errorf("rollup %d: unknown aggregation %q, must be one of sum, avg, max", i, c.Aggregation)
+		}
+		if seen[c.name()] {
+			return nil, fmt.Errorf("rollup %d: duplicate rollup %q", i, c.name())
+		}
+		seen[c.name()] = true
+	}
+	return func() []*dto.MetricFamily {
+		mfs := f()
+		byName := make(map[string]*dto.MetricFamily, len(mfs))
+		for _, mf := range mfs {
+			byName[mf.GetName()] = mf
+		}
+		for _, c := range configs {
+			mf, ok := byName[c.Metric]
+			if !ok {
+				continue
+			}
+			if _, exists := byName[c.name()]; exists {
+				logging.Warn("Not exposing rollup as metrics of the same name have been pushed.", "rollup", c.name())
+				continue
+			}
+			rollup, err := rollupMetricFamily(mf, c)
+			if err != nil {
+				logging.Warn("Not exposing rollup.", "rollup", c.name(), "err", err)
+				continue
+			}
+			if len(rollup.Metric) > 0 {
+				mfs = append(mfs, rollup)
+			}
+		}
+		return mfs
+	}, nil
+}
+
+func rollupMetricFamily(mf *dto.MetricFamily, c RollupConfig) (*dto.MetricFamily, error) {
+	type aggregate struct {
+		value float64
+		count int
+	}
+	byJob := map[string]*aggregate{}
+	for _, m := range mf.GetMetric() {
+		var v float64
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE:
+			v = m.GetGauge().GetValue()
+		case dto.MetricType_COUNTER:
+			v = m.GetCounter().GetValue()
+		case dto.MetricType_UNTYPED:
+			v = m.GetUntyped().GetValue()
+		default:
+			return nil, fmt.Errorf("metric %q is a %s", mf.GetName(), mf.GetType())
+		}
+		job := labelMap(m.GetLabel())["job"]
+		a, ok := byJob[job]
+		if !ok {
+			a = &aggregate{value: v}
+			byJob[job] = a
+		} else if c.Aggregation == "max" {
+			a.value = math.Max(a.value, v)
+		} else {
+			a.value += v
+		}
+		a.count++
+	}
+
+	jobs := make([]string, 0, len(byJob))
+	for job := range byJob {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+	rollup := &dto.MetricFamily{
+		Name: proto.String(c.name()),
+		Help: proto.String(fmt.Sprintf("Rollup (%s) of %s across all instances of the job, derived at scrape time.", c.Aggregation, c.Metric)),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, job := range jobs {
+		a := byJob[job]
+		v := a.value
+		if c.Aggregation == "avg" {
+			v /= float64(a.count)
+		}
+		rollup.Metric = append(rollup.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(job)}},
+			Gauge: &dto.Gauge{Value: proto.Float64(v)},
+		})
+	}
+	return rollup, nil
+}
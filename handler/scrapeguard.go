@@ -0,0 +1,97 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var scrapeCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "pushgateway",
+	Name:      "scrape_cache_hits_total",
+	Help:      "Total number of scrapes answered with a cached response because the same client scraped again within the minimum scrape interval.",
+})
+
+func init() {
+	prometheus.MustRegister(scrapeCacheHits)
+}
+
+// cachedScrape is a response remembered by MinScrapeInterval.
+type cachedScrape struct {
+	time    time.Time
+	version uint64
+	header  http.Header
+	code    int
+	body    []byte
+}
+
+// MinScrapeInterval wraps a metrics handler so that a client scraping again
+// within minInterval of its previous scrape with an identical request (same
+// URL, Accept, and Accept-Encoding header) gets the response of the previous
+// scrape, as long as version still returns the same value as back then. The
+// version has to change whenever the content of the response might change
+// (apart from metrics that change by themselves, like those of the
+// Pushgateway itself, which are then up to minInterval old). Clients are told
+// apart by their IP number. A minInterval of 0 or less returns h unchanged.
+func MinScrapeInterval(minInterval time.Duration, version func() uint64, h http.Handler) http.Handler {
+	if minInterval <= 0 {
+		return h
+	}
+	var (
+		mtx   sync.Mutex
+		cache = map[string]cachedScrape{}
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.Join([]string{
+			remoteInstance(r),
+			r.URL.String(),
+			r.Header.Get("Accept"),
+			r.Header.Get("Accept-Encoding"),
+		}, "\xff")
+		now := time.Now()
+		v := version()
+
+		mtx.Lock()
+		c, ok := cache[key]
+		mtx.Unlock()
+		if !ok || now.Sub(c.time) >= minInterval || c.version != v {
+			bw := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+			h.ServeHTTP(bw, r)
+			c = cachedScrape{time: now, version: v, header: bw.header, code: bw.code, body: bw.body.Bytes()}
+			mtx.Lock()
+			for k, old := range cache {
+				if now.Sub(old.time) >= minInterval {
+					delete(cache, k)
+				}
+			}
+			if c.code == http.StatusOK {
+				cache[key] = c
+			}
+			mtx.Unlock()
+		} else {
+			scrapeCacheHits.Inc()
+		}
+
+		for name, values := range c.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(c.code)
+		w.Write(c.body)
+	})
+}
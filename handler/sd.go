@@ -0,0 +1,104 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// sdTargetGroup is an entry of the HTTP service discovery response of
+// Prometheus.
+type sdTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+
+	group map[string]string // The grouping labels, for sorting.
+}
+
+type sdTargetGroupsByGroup []sdTargetGroup
+
+func (s sdTargetGroupsByGroup) Len() int           { return len(s) }
+func (s sdTargetGroupsByGroup) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sdTargetGroupsByGroup) Less(i, j int) bool { return storage.GroupLess(s[i].group, s[j].group) }
+
+// ServiceDiscovery returns a handler that lists the groups in the MetricStore
+// in the format of the HTTP service discovery of Prometheus, one target group
+// per group. The target is the host the request was sent to, and the labels
+// are the grouping labels (with the job renamed according to renames, as on
+// the metrics endpoint) and the labels __metrics_path__ (set to metricsPath)
+// and __param_match, a series selector for the grouping labels, so that a
+// scrape of the target only returns the metrics of the group (see
+// FilterBySelector). If https is true, the label __scheme__ is set to https.
+// The time of the last push is available as the label
+// __meta_pushgateway_last_push (in RFC 3339 format). If freshness is
+// positive, groups not pushed to within that duration are left out.
+func ServiceDiscovery(ms storage.MetricStore, metricsPath string, https bool, renames map[string]string, freshness time.Duration) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		byGroup := map[string]sdTargetGroup{}
+		lastPushByGroup := map[string]time.Time{}
+		for _, group := range ms.GetMetricFamiliesMap() {
+			lastPush := group.LastPushTime()
+			if freshness > 0 && now.Sub(lastPush) > freshness {
+				continue
+			}
+			labels := make(map[string]string, len(group.Labels))
+			for ln, lv := range group.Labels {
+				labels[ln] = lv
+			}
+			if newJob, ok := renames[labels["job"]]; ok {
+				labels["job"] = newJob
+			}
+			key := storage.GroupingKeyFor(labels)
+			if last, ok := lastPushByGroup[key]; ok && !lastPush.After(last) {
+				// Several jobs renamed to the same one. Keep the
+				// most recent push.
+				continue
+			}
+			lastPushByGroup[key] = lastPush
+			tg := sdTargetGroup{
+				Targets: []string{r.Host},
+				Labels: map[string]string{
+					"__metrics_path__":             metricsPath,
+					"__param_match":                storage.FormatGroup(labels),
+					"__meta_pushgateway_last_push": lastPush.UTC().Format(time.RFC3339Nano),
+				},
+				group: labels,
+			}
+			for ln, lv := range labels {
+				tg.Labels[ln] = lv
+			}
+			if https {
+				tg.Labels["__scheme__"] = "https"
+			}
+			byGroup[key] = tg
+		}
+		result := make([]sdTargetGroup, 0, len(byGroup))
+		for _, tg := range byGroup {
+			result = append(result, tg)
+		}
+		sort.Sort(sdTargetGroupsByGroup(result))
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			logging.Error("Error encoding service discovery response.", "err", err)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Shard returns a handler that exposes (like Expose) only those groups
+// returned by f that belong to the shard given by the last element of the URL
+// path (after pathPrefix). A group, identified by the job and instance labels
+// of its metrics, belongs to the shard if at least one of its metrics has the
+// given label with the shard as value. All metrics of the group are exposed
+// then, including those without the label (like the synthetic metrics of the
+// group). The metric families returned by f are not modified.
+func Shard(label, pathPrefix string, f func() []*dto.MetricFamily) (http.Handler, error) {
+	if !labelNameRE.MatchString(label) {
+		return nil, fmt.Errorf("invalid shard label name %q", label)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shard := strings.TrimPrefix(r.URL.Path, pathPrefix)
+		Expose(func() []*dto.MetricFamily {
+			return shardMetricFamilies(label, shard, f())
+		}).ServeHTTP(w, r)
+	}), nil
+}
+
+func shardMetricFamilies(label, shard string, mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	groupKey := func(m *dto.Metric) string {
+		labels := labelMap(m.GetLabel())
+		return labels["job"] + "\xff" + labels["instance"]
+	}
+	groups := map[string]bool{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == label && lp.GetValue() == shard {
+					groups[groupKey(m)] = true
+				}
+			}
+		}
+	}
+	result := []*dto.MetricFamily{}
+	for _, mf := range mfs {
+		filtered := *mf
+		filtered.Metric = nil
+		for _, m := range mf.GetMetric() {
+			if groups[groupKey(m)] {
+				filtered.Metric = append(filtered.Metric, m)
+			}
+		}
+		if len(filtered.Metric) > 0 {
+			result = append(result, &filtered)
+		}
+	}
+	return result
+}
@@ -0,0 +1,75 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+)
+
+// SignatureHeader is the response header carrying the signature of the
+// response body, see Sign.
+const SignatureHeader = "X-Pushgateway-Signature"
+
+// Sign wraps the given handler so that the response body is signed with
+// HMAC-SHA256 using the given key. The signature is set as the hex-encoded
+// value of the SignatureHeader, prefixed by "sha256=". It covers the body
+// exactly as transmitted, i.e. after any content encoding like gzip. To
+// compute the signature, the whole response is buffered.
+func Sign(key []byte, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bw := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+		h.ServeHTTP(bw, r)
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write(bw.body.Bytes())
+		for name, values := range bw.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		w.Header().Set("Content-Length", strconv.Itoa(bw.body.Len()))
+		w.WriteHeader(bw.code)
+		w.Write(bw.body.Bytes())
+	})
+}
+
+// bufferedResponseWriter is an http.ResponseWriter that keeps everything
+// written to it in memory.
+type bufferedResponseWriter struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) WriteHeader(code int) {
+	if b.wroteHeader {
+		return
+	}
+	b.code = code
+	b.wroteHeader = true
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
@@ -0,0 +1,109 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+// snappyMaxEncodedLen returns the maximum length of a snappy block encoding n
+// bytes, see snappyDecode.
+func snappyMaxEncodedLen(n int64) int64 {
+	return 32 + n + n/6
+}
+
+// snappyDecode decodes src in the snappy block format, i.e. the format
+// produced by snappyEncode and used by the remote write protocol (but not the
+// snappy framing format). If maxLen is positive and the decoded length given
+// in the header exceeds it, errPushTooLarge is returned without decoding
+// anything.
+func snappyDecode(src []byte, maxLen int64) ([]byte, error) {
+	n, hdr := binary.Uvarint(src)
+	if hdr <= 0 || n > 1<<32-1 {
+		return nil, errSnappyCorrupt
+	}
+	if maxLen > 0 && n > uint64(maxLen) {
+		return nil, errPushTooLarge
+	}
+	// A copy expands 3 bytes to at most 64, so without a limit, the
+	// decoded length of a valid block is still bounded by its length.
+	if n > 22*uint64(len(src)) {
+		return nil, errSnappyCorrupt
+	}
+	src = src[hdr:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0: // Literal.
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length <= 0 || length > len(src) || len(dst)+length > cap(dst) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1: // Copy with 1-byte offset.
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2: // Copy with 2-byte offset.
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3: // Copy with 4-byte offset.
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > cap(dst) {
+			return nil, errSnappyCorrupt
+		}
+		// The source and destination of the copy may overlap, so copy
+		// byte by byte.
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
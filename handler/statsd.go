@@ -0,0 +1,443 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/julienschmidt/httprouter"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// StatsDQuantiles are the quantiles of the summaries StatsD timers are
+// converted to if no histogram buckets are configured.
+var StatsDQuantiles = []float64{0.5, 0.9, 0.99}
+
+// statsdResult is the data of the response of StatsD.
+type statsdResult struct {
+	Lines  int `json:"lines"`
+	Groups int `json:"groups"`
+}
+
+// StatsD returns a handler that accepts metrics in the StatsD line format (with
+// DogStatsD tags), one metric per line:
+//
+//	<name>:<value>|<type>[|@<sample rate>][|#<tag>:<value>,...]
+//
+// Counters (type c) are summed up, with each value divided by its sample rate.
+// Gauges (type g) take the last value, or are changed relative to the
+// previous value if the value has a sign (starting from 0 in each request).
+// Timers (type ms, converted from milliseconds to seconds) and histograms
+// (types h and d, taken as is) are converted to histograms with the given
+// bucket upper bounds, or to summaries with the StatsDQuantiles (calculated
+// exactly from the values of the request) if timerBuckets is empty. Each
+// value counts 1/rate times (rounded), without being repeated in memory.
+// Sample rates below 1e-9 are rejected. Tags become labels. Names and tag
+// names are sanitized into valid metric and label names.
+//
+// The group of each line is given by the tags job and instance, defaulting to
+// the query parameters job and instance. As with a regular push, the instance
+// defaults to the remote IP number of the request unless requireInstance is
+// true. Each group results in a write request with the semantics of POST,
+// i.e. the metrics of the request replace stored metrics of the same name.
+// Aggregation happens only within a request. If any line is invalid, nothing
+// is submitted.
+//
+// The returned handler is already instrumented for Prometheus.
+func StatsD(ms storage.MetricStore, requireInstance bool, timerBuckets []float64, normalizer *GroupingLabelNormalizer) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
+		"statsd",
+		func(w http.ResponseWriter, r *http.Request) {
+			defaultJob := r.URL.Query().Get("job")
+			defaultInstance := r.URL.Query().Get("instance")
+			if defaultInstance == "" && !requireInstance {
+				defaultInstance = remoteInstance(r)
+			}
+
+			groups := newStatsDGroups(normalizer)
+			body := &countingReader{r: r.Body}
+			scanner := bufio.NewScanner(body)
+			lines := 0
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" {
+					continue
+				}
+				lines++
+				if err := groups.add(line, defaultJob, defaultInstance); err != nil {
+					writeAPIError(w, http.StatusBadRequest, fmt.Errorf("line %d: %s", lines, err))
+					return
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("cannot read request body: %s", err))
+				return
+			}
+			if lines == 0 {
+				writeAPIError(w, http.StatusBadRequest, errors.New("no StatsD lines in request"))
+				return
+			}
+
+			wrs := groups.writeRequests(timerBuckets)
+			// For logging, the first submitted groups have been
+			// submitted, and the group failed (if any) has caused
+			// the remaining groups not to be submitted.
+			submitted, failed := 0, -1
+			var failure error
+			defer func() {
+				for i, wr := range wrs {
+					var err error
+					switch {
+					case i < submitted:
+					case i == failed:
+						err = failure
+					default:
+						err = fmt.Errorf("not submitted, as group %s has been rejected", storage.FormatGroup(wrs[failed].Labels))
+					}
+					logPush(r, wr.Labels, body.n, err)
+				}
+			}()
+			for i, wr := range wrs {
+				if err := authorizeGroup(r, wr.Labels, true); err != nil {
+					failed, failure = i, err
+					writeAPIError(w, http.StatusForbidden, err)
+					return
+				}
+				if err := ms.CheckWriteRequest(wr); err != nil {
+					failed, failure = i, err
+					writeAPIError(w, writeRequestErrorCode(err), fmt.Errorf("group %s: %s", storage.FormatGroup(wr.Labels), err))
+					return
+				}
+			}
+			now := time.Now()
+			for i, wr := range wrs {
+				wr.Timestamp = now
+				wr.Origin = requestOrigin(r)
+				wr.PushInfo = pushInfo(r, body.n)
+				// All groups have been checked above.
+				wr.SkipValidation = true
+				if err := ms.SubmitWriteRequest(wr); err != nil {
+					failed, failure = i, err
+					setRetryAfter(w, err)
+					writeAPIError(w, writeRequestErrorCode(err), fmt.Errorf("%d of %d groups submitted: %s", i, len(wrs), err))
+					return
+				}
+				submitted++
+			}
+			writeAPIResponse(w, http.StatusAccepted, apiResponse{
+				Status: "success",
+				Data:   statsdResult{Lines: lines, Groups: len(wrs)},
+			})
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+// statsdMinSampleRate is the smallest sample rate accepted. Smaller rates
+// would result in sample counts beyond any sensible range.
+const statsdMinSampleRate = 1e-9
+
+// statsdSeries accumulates the values of one series, identified by name and
+// labels.
+type statsdSeries struct {
+	labels  map[string]string
+	value   float64        // For counters and gauges.
+	samples []statsdSample // For timers and histograms.
+}
+
+// statsdSample is a timer or histogram value that counts weight times (the
+// inverse of its sample rate, rounded).
+type statsdSample struct {
+	value  float64
+	weight uint64
+}
+
+// statsdSamples implements sort.Interface, sorting by value.
+type statsdSamples []statsdSample
+
+func (s statsdSamples) Len() int           { return len(s) }
+func (s statsdSamples) Less(i, j int) bool { return s[i].value < s[j].value }
+func (s statsdSamples) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// statsdFamily accumulates the series of one metric name within a group.
+type statsdFamily struct {
+	typ    dto.MetricType
+	series map[string]*statsdSeries
+	order  []string
+}
+
+type statsdGroup struct {
+	job, instance string
+	families      map[string]*statsdFamily
+}
+
+// statsdGroups accumulates the parsed lines of a request by group, in the
+// order the groups first appear.
+type statsdGroups struct {
+	byKey      map[string]*statsdGroup
+	order      []*statsdGroup
+	normalizer *GroupingLabelNormalizer
+}
+
+func newStatsDGroups(normalizer *GroupingLabelNormalizer) *statsdGroups {
+	return &statsdGroups{byKey: map[string]*statsdGroup{}, normalizer: normalizer}
+}
+
+func (g *statsdGroups) add(line, defaultJob, defaultInstance string) error {
+	colon := strings.LastIndex(strings.SplitN(line, "|", 2)[0], ":")
+	if colon <= 0 {
+		return fmt.Errorf("invalid StatsD line %q, must be of the form '<name>:<value>|<type>'", line)
+	}
+	name := sanitizeStatsDName(line[:colon])
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid StatsD line %q, must be of the form '<name>:<value>|<type>'", line)
+	}
+	rawValue, kind := fields[0], fields[1]
+	rate := 1.0
+	labels := map[string]string{}
+	for _, f := range fields[2:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			var err error
+			rate, err = strconv.ParseFloat(f[1:], 64)
+			if err != nil || rate < statsdMinSampleRate || rate > 1 {
+				return fmt.Errorf("invalid sample rate %q", f[1:])
+			}
+		case strings.HasPrefix(f, "#"):
+			for _, tag := range strings.Split(f[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return fmt.Errorf("invalid tag %q, must be of the form '<name>:<value>'", tag)
+				}
+				labels[sanitizeStatsDName(kv[0])] = kv[1]
+			}
+		default:
+			return fmt.Errorf("invalid field %q", f)
+		}
+	}
+
+	var typ dto.MetricType
+	switch kind {
+	case "c":
+		typ = dto.MetricType_COUNTER
+	case "g":
+		typ = dto.MetricType_GAUGE
+	case "ms", "h", "d":
+		typ = dto.MetricType_HISTOGRAM // Possibly a summary in the end.
+	default:
+		return fmt.Errorf("unsupported StatsD metric type %q", kind)
+	}
+	relative := typ == dto.MetricType_GAUGE && (strings.HasPrefix(rawValue, "+") || strings.HasPrefix(rawValue, "-"))
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %q", rawValue)
+	}
+
+	job, instance := labels["job"], labels["instance"]
+	if job == "" {
+		job = defaultJob
+	}
+	if instance == "" {
+		instance = defaultInstance
+	}
+	grouping := map[string]string{"job": job, "instance": instance}
+	g.normalizer.group(grouping)
+	job, instance = grouping["job"], grouping["instance"]
+	if job == "" {
+		return errors.New("job name is required, either as tag or as query parameter")
+	}
+	if instance == "" {
+		return errors.New("instance name is required, either as tag or as query parameter")
+	}
+	labels["job"], labels["instance"] = job, instance
+
+	groupKey := job + "\xff" + instance
+	group, ok := g.byKey[groupKey]
+	if !ok {
+		group = &statsdGroup{job: job, instance: instance, families: map[string]*statsdFamily{}}
+		g.byKey[groupKey] = group
+		g.order = append(g.order, group)
+	}
+	family, ok := group.families[name]
+	if !ok {
+		family = &statsdFamily{typ: typ, series: map[string]*statsdSeries{}}
+		group.families[name] = family
+	}
+	if family.typ != typ {
+		return fmt.Errorf("metric %q is used with different types", name)
+	}
+	id := seriesID(sample{Name: name, Labels: labels})
+	series, ok := family.series[id]
+	if !ok {
+		series = &statsdSeries{labels: labels}
+		family.series[id] = series
+		family.order = append(family.order, id)
+	}
+	switch {
+	case typ == dto.MetricType_COUNTER:
+		series.value += value / rate
+	case relative:
+		series.value += value
+	case typ == dto.MetricType_GAUGE:
+		series.value = value
+	default:
+		if kind == "ms" {
+			value /= 1000
+		}
+		series.samples = append(series.samples, statsdSample{
+			value:  value,
+			weight: uint64(math.Floor(1/rate + 0.5)),
+		})
+	}
+	return nil
+}
+
+// writeRequests returns a write request (without timestamp) per group.
+func (g *statsdGroups) writeRequests(timerBuckets []float64) []storage.WriteRequest {
+	result := make([]storage.WriteRequest, 0, len(g.order))
+	for _, group := range g.order {
+		mfs := make(map[string]*dto.MetricFamily, len(group.families))
+		for name, family := range group.families {
+			mf := &dto.MetricFamily{Name: proto.String(name), Type: family.typ.Enum()}
+			if family.typ == dto.MetricType_HISTOGRAM && len(timerBuckets) == 0 {
+				mf.Type = dto.MetricType_SUMMARY.Enum()
+			}
+			for _, id := range family.order {
+				mf.Metric = append(mf.Metric, family.series[id].metric(mf.GetType(), timerBuckets))
+			}
+			mfs[name] = mf
+		}
+		result = append(result, storage.WriteRequest{
+			Labels:         map[string]string{"job": group.job, "instance": group.instance},
+			MetricFamilies: mfs,
+		})
+	}
+	return result
+}
+
+func (s *statsdSeries) metric(typ dto.MetricType, timerBuckets []float64) *dto.Metric {
+	names := make([]string, 0, len(s.labels))
+	for ln := range s.labels {
+		names = append(names, ln)
+	}
+	sort.Strings(names)
+	m := &dto.Metric{}
+	for _, ln := range names {
+		m.Label = append(m.Label, &dto.LabelPair{
+			Name:  proto.String(ln),
+			Value: proto.String(s.labels[ln]),
+		})
+	}
+	sum, count := 0., uint64(0)
+	for _, s := range s.samples {
+		sum += s.value * float64(s.weight)
+		count += s.weight
+	}
+	switch typ {
+	case dto.MetricType_COUNTER:
+		m.Counter = &dto.Counter{Value: proto.Float64(s.value)}
+	case dto.MetricType_GAUGE:
+		m.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+	case dto.MetricType_HISTOGRAM:
+		m.Histogram = &dto.Histogram{
+			SampleCount: proto.Uint64(count),
+			SampleSum:   proto.Float64(sum),
+		}
+		for _, upperBound := range timerBuckets {
+			cumulative := uint64(0)
+			for _, s := range s.samples {
+				if s.value <= upperBound {
+					cumulative += s.weight
+				}
+			}
+			m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(upperBound),
+				CumulativeCount: proto.Uint64(cumulative),
+			})
+		}
+	default:
+		sorted := append(statsdSamples(nil), s.samples...)
+		sort.Stable(sorted)
+		m.Summary = &dto.Summary{
+			SampleCount: proto.Uint64(count),
+			SampleSum:   proto.Float64(sum),
+		}
+		for _, q := range StatsDQuantiles {
+			// Nearest rank, counting each sample weight times.
+			rank := uint64(math.Ceil(q * float64(count)))
+			if rank < 1 {
+				rank = 1
+			}
+			i, cumulative := 0, sorted[0].weight
+			for cumulative < rank && i < len(sorted)-1 {
+				i++
+				cumulative += sorted[i].weight
+			}
+			m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(q),
+				Value:    proto.Float64(sorted[i].value),
+			})
+		}
+	}
+	return m
+}
+
+// sanitizeStatsDName replaces all characters not allowed in metric names by
+// underscores, as does a leading digit. Typically, the dots of StatsD names
+// become underscores that way.
+func sanitizeStatsDName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// ParseStatsDTimerBuckets parses a comma-separated list of histogram bucket
+// upper bounds for StatsD. The empty string results in nil, i.e. summaries.
+func ParseStatsDTimerBuckets(s string) ([]float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var result []float64
+	for _, b := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket upper bound %q", b)
+		}
+		if len(result) > 0 && v <= result[len(result)-1] {
+			return nil, fmt.Errorf("bucket upper bounds must be strictly increasing, got %v after %v", v, result[len(result)-1])
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
@@ -14,47 +14,227 @@
 package handler
 
 import (
+	"encoding/base64"
 	"fmt"
 	"html"
 	"html/template"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/pushgateway/storage"
 )
 
+// statusPageSize is the number of groups shown per page of the status page.
+const statusPageSize = 100
+
 type data struct {
-	MetricFamilies storage.JobToInstanceMap
-	Flags          map[string]string
-	BuildInfo      map[string]string
-	Birth          time.Time
-	counter        int
+	// Groups are the groups of the current page, see statusPage.
+	Groups []statusGroup
+	// Matched is the number of groups matching Search, Pages the number
+	// of pages they are shown on.
+	Matched, Page, Pages int
+	Search, Sort, Order  string
+	Flags                map[string]string
+	BuildInfo            map[string]string
+	Birth                time.Time
+	Stats                storage.Stats
+	RoutePrefix          string
+}
+
+// statusGroup is a group as shown on the status page. Labels are the grouping
+// labels in the order of storage.GroupingLabelNames, Group is the description
+// of the group (which is also a selector for the group, see
+// storage.FormatGroup), Path is the path (without route prefix) to delete it,
+// and PushInfo is the metadata of its last push.
+type statusGroup struct {
+	Labels         []statusLabel
+	Group          string
+	Path           string
+	LastPush       time.Time
+	Age            time.Duration // Since LastPush, in full seconds.
+	MetricFamilies int
+	PushInfo       storage.PushInfo
+}
+
+type statusLabel struct {
+	Name, Value string
+}
+
+// statusSorts maps the names of the sort orders of the status page to the
+// functions comparing two groups in ascending order. The default is "group",
+// i.e. the order of storage.GroupLess.
+var statusSorts = map[string]func(a, b *statusGroup) bool{
+	"group":           nil, // Groups are in that order already.
+	"last_push":       func(a, b *statusGroup) bool { return a.LastPush.Before(b.LastPush) },
+	"metric_families": func(a, b *statusGroup) bool { return a.MetricFamilies < b.MetricFamilies },
+}
+
+// statusGroups returns the given groups as shown on the status page, in the
+// order of storage.GroupLess.
+func statusGroups(groups storage.GroupingKeyToMetricGroup, now time.Time) []statusGroup {
+	result := make([]statusGroup, 0, len(groups))
+	for _, group := range groups.Sorted() {
+		job := group.Labels["job"]
+		lastPush := group.LastPushTime()
+		sg := statusGroup{
+			Group:          storage.FormatGroup(group.Labels),
+			Path:           jobPath(job),
+			LastPush:       lastPush,
+			Age:            now.Sub(lastPush) / time.Second * time.Second,
+			MetricFamilies: len(group.Metrics),
+			PushInfo:       group.LastPushInfo,
+		}
+		for _, ln := range storage.GroupingLabelNames(group.Labels) {
+			lv := group.Labels[ln]
+			sg.Labels = append(sg.Labels, statusLabel{ln, lv})
+			if ln == "job" {
+				continue
+			}
+			// Base64 encoding copes with any value, even an empty
+			// one (encoded as "=").
+			encoded := base64.RawURLEncoding.EncodeToString([]byte(lv))
+			if encoded == "" {
+				encoded = "="
+			}
+			sg.Path += "/" + ln + base64Suffix + "/" + encoded
+		}
+		result = append(result, sg)
+	}
+	return result
+}
+
+// statusPage fills in the groups of d according to the query parameters of the
+// status page: Only the groups whose description (see statusGroup) contains
+// all whitespace-separated terms of the parameter search (ignoring case) are
+// shown, sorted as given by the parameters sort (see statusSorts) and order
+// ("asc" or "desc"), statusPageSize groups per page, the page given by the
+// parameter page (starting at 1). Invalid parameters are replaced by their
+// defaults.
+func (d *data) statusPage(groups []statusGroup, query url.Values) {
+	d.Search = strings.TrimSpace(query.Get("search"))
+	terms := strings.Fields(strings.ToLower(d.Search))
+	matched := groups[:0]
+	for _, g := range groups {
+		desc := strings.ToLower(g.Group)
+		ok := true
+		for _, term := range terms {
+			if !strings.Contains(desc, term) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, g)
+		}
+	}
+
+	d.Sort = query.Get("sort")
+	less, ok := statusSorts[d.Sort]
+	if !ok {
+		d.Sort = "group"
+	}
+	d.Order = query.Get("order")
+	if d.Order != "desc" {
+		d.Order = "asc"
+	}
+	if less != nil {
+		sort.Stable(statusGroupsBy{matched, less})
+	}
+	if d.Order == "desc" {
+		for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+			matched[i], matched[j] = matched[j], matched[i]
+		}
+	}
+
+	d.Matched = len(matched)
+	d.Pages = (len(matched) + statusPageSize - 1) / statusPageSize
+	if d.Pages == 0 {
+		d.Pages = 1
+	}
+	d.Page, _ = strconv.Atoi(query.Get("page"))
+	if d.Page < 1 {
+		d.Page = 1
+	}
+	if d.Page > d.Pages {
+		d.Page = d.Pages
+	}
+	from := (d.Page - 1) * statusPageSize
+	to := from + statusPageSize
+	if to > len(matched) {
+		to = len(matched)
+	}
+	d.Groups = matched[from:to]
+}
+
+// statusGroupsBy sorts statusGroups by less.
+type statusGroupsBy struct {
+	groups []statusGroup
+	less   func(a, b *statusGroup) bool
+}
+
+func (s statusGroupsBy) Len() int           { return len(s.groups) }
+func (s statusGroupsBy) Swap(i, j int)      { s.groups[i], s.groups[j] = s.groups[j], s.groups[i] }
+func (s statusGroupsBy) Less(i, j int) bool { return s.less(&s.groups[i], &s.groups[j]) }
+
+// PageQuery returns the query string of the status page showing the given page
+// with the current search and sort order.
+func (d *data) PageQuery(page int) string {
+	return "?" + url.Values{
+		"search": {d.Search},
+		"sort":   {d.Sort},
+		"order":  {d.Order},
+		"page":   {strconv.Itoa(page)},
+	}.Encode()
 }
 
-func (d *data) Count() int {
-	d.counter++
-	return d.counter
+// SortQuery returns the query string of the status page showing the first page
+// of the current search sorted by s, in ascending order unless it is sorted by
+// s in ascending order already.
+func (d *data) SortQuery(s string) string {
+	order := "asc"
+	if d.Sort == s && d.Order == "asc" {
+		order = "desc"
+	}
+	return "?" + url.Values{
+		"search": {d.Search},
+		"sort":   {s},
+		"order":  {order},
+	}.Encode()
 }
 
-func (_ data) FormatTimestamp(ts int64) string {
-	return time.Unix(ts/1000, ts%1000*1000000).String()
+// jobPath returns the path (without route prefix) to delete all groups of the
+// given job. A job containing a slash is base64url encoded.
+func jobPath(job string) string {
+	if strings.Contains(job, "/") {
+		return "/metrics/job" + base64Suffix + "/" + base64.RawURLEncoding.EncodeToString([]byte(job))
+	}
+	return "/metrics/job/" + url.PathEscape(job)
 }
 
-// Status serves the status page.
+// Status serves the status page, see data.statusPage for its query
+// parameters. The metric families of a group are loaded by the page on demand
+// via APIMetrics. All links on the page start with the given routePrefix,
+// which is either empty or starts (but does not end) with a slash.
 func Status(
 	ms storage.MetricStore,
 	assetFunc func(string) ([]byte, error),
 	flags map[string]string,
 	buildInfo map[string]string,
+	routePrefix string,
 ) func(http.ResponseWriter, *http.Request) {
 	birth := time.Now()
-	return func(w http.ResponseWriter, _ *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		t := template.New("status")
 		t.Funcs(template.FuncMap{
-			"value": func(f *float64) string {
-				return strconv.FormatFloat(*f, 'f', -1, 64)
+			"percentile": func(q float64) string {
+				return "p" + strconv.FormatFloat(q*100, 'f', -1, 64)
 			},
+			"inc": func(i int) int { return i + 1 },
+			"dec": func(i int) int { return i - 1 },
 		})
 		tpl, err := assetFunc("resources/template.html")
 		if err != nil {
@@ -67,11 +247,13 @@ func Status(
 			return
 		}
 		d := &data{
-			MetricFamilies: ms.GetMetricFamiliesMap(),
-			Flags:          flags,
-			BuildInfo:      buildInfo,
-			Birth:          birth,
+			Flags:       flags,
+			BuildInfo:   buildInfo,
+			Birth:       birth,
+			Stats:       ms.Stats(),
+			RoutePrefix: routePrefix,
 		}
+		d.statusPage(statusGroups(ms.GetMetricFamiliesMap(), time.Now()), r.URL.Query())
 		err = t.Execute(w, d)
 		if err != nil {
 			// Hack to get a visible error message right at the top.
@@ -80,3 +262,58 @@ func Status(
 		}
 	}
 }
+
+type apiStatus struct {
+	ReadOnly    bool              `json:"read_only"`
+	WritePaused bool              `json:"write_paused"`
+	StartTime   time.Time         `json:"start_time"`
+	BuildInfo   map[string]string `json:"build_info"`
+}
+
+// APIStatus serves the runtime status of the Pushgateway as JSON.
+func APIStatus(
+	ms storage.MetricStore,
+	readOnly *ReadOnlyMode,
+	buildInfo map[string]string,
+) func(http.ResponseWriter, *http.Request) {
+	birth := time.Now()
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeAPIData(w, apiStatus{
+			ReadOnly:    readOnly.Enabled(),
+			WritePaused: ms.Stats().Paused,
+			StartTime:   birth,
+			BuildInfo:   buildInfo,
+		})
+	}
+}
+
+// redactedFlagValue replaces the value of flags considered secret in the
+// output of APIConfig.
+const redactedFlagValue = "<redacted>"
+
+// secretFlag returns whether the flag of the given name refers to a secret,
+// e.g. a key file, whose value is not to be revealed by APIConfig.
+func secretFlag(name string) bool {
+	for _, s := range []string{"key", "token", "secret", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIConfig serves the given flag values as JSON. The values of secret flags
+// (see secretFlag) are redacted unless empty, so that it is still visible
+// whether they are set.
+func APIConfig(flags map[string]string) func(http.ResponseWriter, *http.Request) {
+	redacted := make(map[string]string, len(flags))
+	for name, value := range flags {
+		if value != "" && secretFlag(name) {
+			value = redactedFlagValue
+		}
+		redacted[name] = value
+	}
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeAPIData(w, redacted)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// TenantPathPrefix is the prefix of the paths of the endpoints of a tenant,
+// followed by the name of the tenant, see Tenants.
+const TenantPathPrefix = "/tenant/"
+
+var tenantNameRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ParseTenants parses a comma-separated list of tenant names. Names consist of
+// letters, digits, underscores, and dashes and must be unique.
+func ParseTenants(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var tenants []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		if !tenantNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate tenant name %q", name)
+		}
+		seen[name] = true
+		tenants = append(tenants, name)
+	}
+	return tenants, nil
+}
+
+type tenantKey struct{}
+
+// requestTenant returns the tenant the request has been routed to by Tenants,
+// or the empty string if it is not a request of a tenant.
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantScoped prefixes the given key of per-group state with the tenant of the
+// request, if any, so that the state of groups of different tenants with the
+// same grouping labels is kept apart.
+func tenantScoped(r *http.Request, key string) string {
+	if tenant := requestTenant(r); tenant != "" {
+		return "tenant\xff" + tenant + "\xff" + key
+	}
+	return key
+}
+
+// Tenants routes the requests of tenants to their handlers, keyed by the
+// names of the tenants. A request is a request of a tenant if its path starts
+// with TenantPathPrefix followed by the name of the tenant (which is stripped
+// from the path before passing the request on) or, if header is not empty,
+// if the header is set to the name of the tenant. Requests of unknown tenants
+// are answered with status code 404, requests with a header naming another
+// tenant than the path with status code 400. All other requests are passed on
+// to h.
+func Tenants(h http.Handler, header string, tenants map[string]http.Handler) http.Handler {
+	if len(tenants) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := ""
+		if header != "" {
+			tenant = r.Header.Get(header)
+		}
+		if strings.HasPrefix(r.URL.Path, TenantPathPrefix) {
+			rest := r.URL.Path[len(TenantPathPrefix):]
+			name := rest
+			if i := strings.IndexByte(rest, '/'); i >= 0 {
+				name = rest[:i]
+			}
+			if tenant != "" && tenant != name {
+				http.Error(w, fmt.Sprintf("header %s names tenant %q, but the path tenant %q", header, tenant, name), http.StatusBadRequest)
+				return
+			}
+			tenant = name
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = rest[len(name):]
+			if r2.URL.Path == "" {
+				r2.URL.Path = "/"
+			}
+			// Tenant names need no escaping, so the raw path starts
+			// with the same prefix.
+			r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, TenantPathPrefix+name)
+			r = r2
+		}
+		if tenant == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		th, ok := tenants[tenant]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown tenant %q", tenant), http.StatusNotFound)
+			return
+		}
+		th.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
@@ -0,0 +1,265 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// TokenConfig configures an API token, see TokenAuth. TokenHash is the
+// hex-encoded SHA-256 hash of the token. A token is authorized for the groups
+// of the given Jobs and for the groups whose grouping labels match one of the
+// series selectors in Match. A token with Tenants is authorized for those
+// groups of the given tenants (see Tenants), or for all their groups if it has
+// neither Jobs nor Match, while a token without Tenants is only authorized for
+// groups outside of tenants. An Admin token is authorized for all groups and
+// for the admin endpoints.
+type TokenConfig struct {
+	Name      string   `json:"name"`
+	TokenHash string   `json:"token_hash"`
+	Jobs      []string `json:"jobs"`
+	Match     []string `json:"match"`
+	Tenants   []string `json:"tenants"`
+	Admin     bool     `json:"admin"`
+}
+
+// Tokens are the parsed TokenConfigs, see ParseTokens.
+type Tokens struct {
+	scopes []*tokenScope
+}
+
+// tokenScope is what a token is authorized for.
+type tokenScope struct {
+	name    string
+	hash    []byte
+	jobs    map[string]bool
+	sels    selectors
+	tenants map[string]bool
+	admin   bool
+}
+
+// ParseTokens checks and parses the given token configurations. Each token needs
+// a unique non-empty name, a hex-encoded SHA-256 hash not shared with another
+// token, and at least one of jobs, match, tenants, or admin.
+func ParseTokens(configs []TokenConfig) (Tokens, error) {
+	var tokens Tokens
+	names := map[string]bool{}
+	hashes := map[string]bool{}
+	for _, c := range configs {
+		if c.Name == "" {
+			return Tokens{}, errors.New("token without name")
+		}
+		if names[c.Name] {
+			return Tokens{}, fmt.Errorf("duplicate token name %q", c.Name)
+		}
+		names[c.Name] = true
+		hash, err := hex.DecodeString(c.TokenHash)
+		if err != nil || len(hash) != sha256.Size {
+			return Tokens{}, fmt.Errorf("token_hash of token %q is not a hex-encoded SHA-256 hash", c.Name)
+		}
+		if hashes[string(hash)] {
+			return Tokens{}, fmt.Errorf("token %q has the same token_hash as another token", c.Name)
+		}
+		hashes[string(hash)] = true
+		if len(c.Jobs) == 0 && len(c.Match) == 0 && len(c.Tenants) == 0 && !c.Admin {
+			return Tokens{}, fmt.Errorf("token %q needs at least one of jobs, match, tenants, or admin", c.Name)
+		}
+		sels, err := parseSelectors(c.Match)
+		if err != nil {
+			return Tokens{}, fmt.Errorf("invalid match of token %q: %s", c.Name, err)
+		}
+		scope := &tokenScope{name: c.Name, hash: hash, jobs: map[string]bool{}, sels: sels, tenants: map[string]bool{}, admin: c.Admin}
+		for _, job := range c.Jobs {
+			if job == "" {
+				return Tokens{}, fmt.Errorf("empty job name of token %q", c.Name)
+			}
+			scope.jobs[job] = true
+		}
+		for _, tenant := range c.Tenants {
+			if !tenantNameRE.MatchString(tenant) {
+				return Tokens{}, fmt.Errorf("invalid tenant name %q of token %q", tenant, c.Name)
+			}
+			scope.tenants[tenant] = true
+		}
+		tokens.scopes = append(tokens.scopes, scope)
+	}
+	return tokens, nil
+}
+
+// TokenAuth authorizes changing requests by API tokens, given as bearer tokens
+// in the Authorization header. As long as no tokens are set, all requests are
+// passed on unchanged. It is safe for concurrent use.
+type TokenAuth struct {
+	mtx    sync.RWMutex
+	tokens Tokens
+}
+
+// NewTokenAuth returns a TokenAuth without tokens.
+func NewTokenAuth() *TokenAuth {
+	return &TokenAuth{}
+}
+
+// Set replaces the tokens, e.g. upon a reload of the configuration.
+func (ta *TokenAuth) Set(tokens Tokens) {
+	ta.mtx.Lock()
+	defer ta.mtx.Unlock()
+	ta.tokens = tokens
+}
+
+type tokenScopeKey struct{}
+
+// Authenticate wraps the given handler of a request changing groups. Requests
+// without a known token are answered with status code 401. Otherwise, the
+// scope of the token is attached to the request, so that h only changes the
+// groups the token is authorized for (see authorizeGroup). Without tokens, h
+// is called for all requests.
+func (ta *TokenAuth) Authenticate(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		scope, ok := ta.scope(w, r)
+		if !ok {
+			return
+		}
+		if scope != nil {
+			r = r.WithContext(context.WithValue(r.Context(), tokenScopeKey{}, scope))
+		}
+		h(w, r, ps)
+	}
+}
+
+// RequireAdmin wraps the given handler of an admin endpoint. Requests without
+// a known token are answered with status code 401, requests with a token that
+// is not an admin token with status code 403. Without tokens, h is called for
+// all requests.
+func (ta *TokenAuth) RequireAdmin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		scope, ok := ta.scope(w, r)
+		if !ok {
+			return
+		}
+		if scope != nil && !scope.admin {
+			http.Error(w, fmt.Sprintf("token %q is not an admin token", scope.name), http.StatusForbidden)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// scope returns the scope of the token of the request, or nil if there are no
+// tokens. If the token is missing or unknown, the request is answered with
+// status code 401 and false is returned.
+func (ta *TokenAuth) scope(w http.ResponseWriter, r *http.Request) (*tokenScope, bool) {
+	ta.mtx.RLock()
+	scopes := ta.tokens.scopes
+	ta.mtx.RUnlock()
+	if len(scopes) == 0 {
+		return nil, true
+	}
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		got := sha256.Sum256([]byte(strings.TrimSpace(auth[len("Bearer "):])))
+		// Compare with all tokens to not reveal anything by the
+		// response time.
+		var found *tokenScope
+		for _, scope := range scopes {
+			if subtle.ConstantTimeCompare(got[:], scope.hash) == 1 {
+				found = scope
+			}
+		}
+		if found != nil {
+			return found, true
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="Pushgateway"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return nil, false
+}
+
+// allows returns whether the scope covers the groups with the given grouping
+// labels of the given tenant (empty outside of tenants). If complete is
+// false, the labels may be shared by several groups (like the labels of a
+// DELETE of a whole job). Then a selector only covers them if it exclusively
+// matches labels given, as the other labels of the groups are unknown.
+func (s *tokenScope) allows(tenant string, labels map[string]string, complete bool) bool {
+	if s.admin {
+		return true
+	}
+	if tenant != "" || len(s.tenants) > 0 {
+		if !s.tenants[tenant] {
+			return false
+		}
+		if len(s.jobs) == 0 && len(s.sels) == 0 {
+			return true
+		}
+	}
+	if s.jobs[labels["job"]] {
+		return true
+	}
+	for _, sel := range s.sels {
+		if !complete && !sel.onlyMatches(labels) {
+			continue
+		}
+		if sel.matches(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyMatches returns whether all matchers of the selector match labels that
+// are present in the given labels.
+func (s selector) onlyMatches(labels map[string]string) bool {
+	for _, m := range s {
+		if _, ok := labels[m.name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// authorizeGroup returns an error if the request carries the scope of a token
+// (see TokenAuth.Authenticate) that does not cover the groups with the given
+// grouping labels, see tokenScope.allows. The error is to be answered with
+// status code 403.
+func authorizeGroup(r *http.Request, labels map[string]string, complete bool) error {
+	scope, ok := r.Context().Value(tokenScopeKey{}).(*tokenScope)
+	tenant := requestTenant(r)
+	if !ok || scope.allows(tenant, labels, complete) {
+		return nil
+	}
+	if tenant != "" {
+		return fmt.Errorf("token %q is not authorized for group %s of tenant %q", scope.name, storage.FormatGroup(labels), tenant)
+	}
+	return fmt.Errorf("token %q is not authorized for group %s", scope.name, storage.FormatGroup(labels))
+}
+
+// tokenName returns the name of the token of the request, or the empty string
+// if it has none.
+func tokenName(r *http.Request) string {
+	if scope, ok := r.Context().Value(tokenScopeKey{}).(*tokenScope); ok {
+		return scope.name
+	}
+	return ""
+}
@@ -0,0 +1,336 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	spanQueueCapacity = 1000
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+
+	// See the OTLP specification for the numerical values.
+	spanKindServer   = 2
+	spanStatusError  = 2
+	traceparentField = "Traceparent"
+)
+
+// Tracer records a span for each traced HTTP request and exports the spans
+// in batches to an OTLP/HTTP endpoint (using the JSON encoding). Incoming W3C
+// trace context (the traceparent header) is honored, so that the spans become
+// part of the caller's trace. A nil *Tracer is valid and traces nothing.
+type Tracer struct {
+	endpoint string
+	client   *http.Client
+	spans    chan *otlpSpan
+}
+
+// NewTracer returns a Tracer that exports to the given OTLP/HTTP traces
+// endpoint, e.g. "http://localhost:4318/v1/traces". If endpoint is the empty
+// string, nil is returned, i.e. tracing is disabled.
+func NewTracer(endpoint string) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &Tracer{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *otlpSpan, spanQueueCapacity),
+	}
+	go t.loop()
+	return t
+}
+
+// Trace wraps the given handler so that each request results in a span of the
+// given name. The span carries the grouping labels (if part of the route, as
+// pushgateway.<label name>), the size of the request payload, and the response
+// code as attributes. If the Tracer is nil, h is returned unchanged.
+func (t *Tracer) Trace(name string, h httprouter.Handle) httprouter.Handle {
+	if t == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		span := &otlpSpan{
+			Name:              name,
+			Kind:              spanKindServer,
+			StartTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		}
+		if traceID, parentID, ok := parseTraceparent(r.Header.Get(traceparentField)); ok {
+			span.TraceID, span.ParentSpanID = traceID, parentID
+		} else {
+			span.TraceID = randomHex(16)
+		}
+		span.SpanID = randomHex(8)
+
+		body := &countingReader{r: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		rw := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rw, r, ps)
+
+		span.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+		span.addAttribute("http.method", r.Method)
+		span.addAttribute("http.route", name)
+		span.addAttribute("http.status_code", strconv.Itoa(rw.code))
+		span.addAttribute("pushgateway.payload_bytes", strconv.FormatInt(body.n, 10))
+		if labels, err := groupingLabels(ps); err == nil {
+			for _, ln := range storage.GroupingLabelNames(labels) {
+				if labels[ln] != "" {
+					span.addAttribute("pushgateway."+ln, labels[ln])
+				}
+			}
+		}
+		if client := ClientIdentity(r); client != "" {
+			span.addAttribute("pushgateway.client", client)
+		}
+		if rw.code >= 500 {
+			span.Status.Code = spanStatusError
+		}
+		select {
+		case t.spans <- span:
+		default:
+			// Never block a request for tracing.
+			logging.Warn("Span queue full, dropping span.")
+		}
+	}
+}
+
+// TraceHandler is like Trace, but for an http.Handler.
+func (t *Tracer) TraceHandler(name string, h http.Handler) http.Handler {
+	if t == nil {
+		return h
+	}
+	traced := t.Trace(name, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		h.ServeHTTP(w, r)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traced(w, r, nil)
+	})
+}
+
+func (t *Tracer) loop() {
+	batch := make([]*otlpSpan, 0, spanBatchSize)
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			logging.Error("Error exporting spans.", "count", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) export(spans []*otlpSpan) error {
+	req := otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{stringAttribute("service.name", "pushgateway")},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/prometheus/pushgateway/handler"},
+				Spans: spans,
+			}},
+		}},
+	}
+	buf := &bytes.Buffer{}
+	if err := json.NewEncoder(buf).Encode(req); err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
+
+// parseTraceparent parses a W3C traceparent header value of the form
+// "00-<trace-id>-<parent-id>-<flags>".
+func parseTraceparent(s string) (traceID, parentID string, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	for _, p := range parts {
+		if _, err := hex.DecodeString(p); err != nil {
+			return "", "", false
+		}
+	}
+	if parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		logging.Error("Error generating random ID.", "err", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.code = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// The following methods pass the optional interfaces of the wrapped
+// ResponseWriter through, so that e.g. the WebSocket handler can hijack a
+// traced connection. The wrapped ResponseWriter does not necessarily implement
+// them, e.g. the one of prometheus.InstrumentHandlerFunc wrapped by
+// InstrumentHandlerFunc does not implement http.Flusher, so they fall back to
+// doing nothing or returning an error. CloseNotify still panics, as there is
+// nothing sensible to fall back to.
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err == nil {
+		s.code = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) CloseNotify() <-chan bool {
+	return s.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (s *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := s.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{s.ResponseWriter}, r)
+}
+
+// The following types model the subset of the OTLP JSON encoding needed here.
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope   `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func (s *otlpSpan) addAttribute(key, value string) {
+	s.Attributes = append(s.Attributes, stringAttribute(key, value))
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
@@ -0,0 +1,103 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// inferredUnits are the units MetricUnits infers from the suffix of a metric
+// family name, i.e. "_seconds" results in the unit "seconds". They are the
+// base units recommended by the Prometheus naming conventions.
+var inferredUnits = []string{
+	"seconds", "bytes", "meters", "volts", "amperes", "joules", "grams", "celsius", "ratio",
+}
+
+// MetricUnits determines the units announced by "# UNIT" lines in the
+// OpenMetrics format (see SelectFormat). A per-metric override (by the name of
+// the metric as pushed) takes precedence. Otherwise, if inference is enabled,
+// the unit is inferred from the suffix of the metric family name (which is
+// the metric name without "_total" for counters). In either case, OpenMetrics
+// requires the family name to end with the unit (separated by an underscore),
+// so a unit not matching the name is not announced. A nil *MetricUnits
+// announces no units.
+type MetricUnits struct {
+	infer bool
+
+	mtx       sync.RWMutex
+	overrides map[string]string
+}
+
+// NewMetricUnits returns a MetricUnits without overrides that infers units
+// from the metric family names if infer is true.
+func NewMetricUnits(infer bool) *MetricUnits {
+	return &MetricUnits{infer: infer}
+}
+
+// SetOverrides replaces the per-metric overrides, mapping metric names to
+// units. An empty unit means that the metric has no unit, even if one could
+// be inferred. The overrides have to be checked with CheckMetricUnits before.
+func (u *MetricUnits) SetOverrides(overrides map[string]string) {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	u.overrides = overrides
+}
+
+// unit returns the unit of the metric family with the given name as pushed
+// and as exposed in the OpenMetrics format, or the empty string if there is
+// none.
+func (u *MetricUnits) unit(name, familyName string) string {
+	if u == nil {
+		return ""
+	}
+	u.mtx.RLock()
+	unit, ok := u.overrides[name]
+	u.mtx.RUnlock()
+	if !ok && u.infer {
+		for _, inferred := range inferredUnits {
+			if strings.HasSuffix(familyName, "_"+inferred) {
+				unit = inferred
+				break
+			}
+		}
+	}
+	if unit == "" || !strings.HasSuffix(familyName, "_"+unit) {
+		return ""
+	}
+	return unit
+}
+
+// CheckMetricUnits checks per-metric unit overrides, see
+// MetricUnits.SetOverrides. Each unit has to be empty or a suffix of the
+// metric name (separated by an underscore, ignoring a "_total" suffix of the
+// metric name).
+func CheckMetricUnits(overrides map[string]string) error {
+	for name, unit := range overrides {
+		if !isValidMetricName(name) {
+			return fmt.Errorf("invalid metric name %q", name)
+		}
+		if unit == "" {
+			continue
+		}
+		if !isValidMetricName(unit) {
+			return fmt.Errorf("invalid unit %q of metric %q", unit, name)
+		}
+		if !strings.HasSuffix(strings.TrimSuffix(name, "_total"), "_"+unit) {
+			return fmt.Errorf("unit %q is not a suffix of metric name %q", unit, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/prometheus/pushgateway/logging"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	// WebSocketMaxMessageSize is the maximum size of a single (possibly
+	// fragmented) message accepted by PushWebSocket.
+	WebSocketMaxMessageSize = 16 << 20
+
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// See RFC 6455 for the numerical values.
+	wsOpContinuation     = 0x0
+	wsOpText             = 0x1
+	wsOpBinary           = 0x2
+	wsOpClose            = 0x8
+	wsOpPing             = 0x9
+	wsOpPong             = 0xa
+	wsCloseProtocolError = 1002
+	wsCloseUnsupported   = 1003
+	wsCloseTooBig        = 1009
+)
+
+// wsAck is the response frame sent for each message received by
+// PushWebSocket. Seq is the number of the message on the connection, starting
+// at 1.
+type wsAck struct {
+	Seq    int    `json:"seq"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PushWebSocket returns a handler that upgrades the request to a WebSocket
+// connection. Each text message received on the connection is the JSON
+// equivalent of one push, in the same format as an entry of a batch (see
+// batchEntry), and results in one write request, subject to the same
+// validation as a push via HTTP (with conflicting job and instance labels
+// handled according to conflicts and timestamps set on metrics according to
+// timestamps). For each message, a wsAck is sent back, in
+// the order of the messages.
+//
+// Messages are processed one at a time. The next message is only read after
+// the previous one has been submitted to the MetricStore, so that a producer
+// faster than the MetricStore is pushed back via TCP flow control.
+//
+// The returned handler is already instrumented for Prometheus. The
+// instrumentation covers the whole lifetime of the connection.
+func PushWebSocket(ms storage.MetricStore, ro *ReadOnlyMode, requireInstance bool, conflicts GroupingLabelConflictPolicy, timestamps SampleTimestampPolicy, normalizer *GroupingLabelNormalizer) func(http.ResponseWriter, *http.Request, httprouter.Params) {
+	instrumentedHandlerFunc := InstrumentHandlerFunc(
+		"push_websocket",
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgradeWebSocket(w, r)
+			if err != nil {
+				logging.Warn("WebSocket upgrade failed.", "err", err)
+				return
+			}
+			defer conn.Close()
+
+			defaultInstance := ""
+			if !requireInstance {
+				defaultInstance = remoteInstance(r)
+			}
+			for seq := 1; ; seq++ {
+				msg, err := conn.readMessage()
+				if err != nil {
+					if err != io.EOF {
+						logging.Error("Error reading WebSocket message.", "err", err)
+					}
+					return
+				}
+				ack := wsAck{Seq: seq, Status: "success"}
+				if err := submitWebSocketMessage(ms, ro, r, msg, defaultInstance, conflicts, timestamps, normalizer); err != nil {
+					ack.Status, ack.Error = "error", err.Error()
+				}
+				buf, err := json.Marshal(ack)
+				if err == nil {
+					err = conn.writeFrame(wsOpText, buf)
+				}
+				if err != nil {
+					logging.Error("Error writing WebSocket ack.", "err", err)
+					return
+				}
+			}
+		},
+	)
+
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		instrumentedHandlerFunc(w, r)
+	}
+}
+
+// submitWebSocketMessage submits the push in msg and logs it (see logPush).
+func submitWebSocketMessage(ms storage.MetricStore, ro *ReadOnlyMode, r *http.Request, msg []byte, defaultInstance string, conflicts GroupingLabelConflictPolicy, timestamps SampleTimestampPolicy, normalizer *GroupingLabelNormalizer) (err error) {
+	var labels map[string]string
+	defer func() { logPush(r, labels, int64(len(msg)), err) }()
+	// Read-only mode might have been enabled after the connection was
+	// established.
+	if ro.Enabled() {
+		return errors.New("pushgateway is in read-only mode")
+	}
+	var e batchEntry
+	if err := json.Unmarshal(msg, &e); err != nil {
+		return fmt.Errorf("cannot decode message: %s", err)
+	}
+	wr, err := e.writeRequest(defaultInstance, conflicts, timestamps, normalizer)
+	if err != nil {
+		return err
+	}
+	labels = wr.Labels
+	if err := authorizeGroup(r, wr.Labels, true); err != nil {
+		return err
+	}
+	wr.Timestamp = time.Now()
+	wr.Origin = requestOrigin(r)
+	wr.PushInfo = pushInfo(r, int64(len(msg)))
+	return ms.SubmitWriteRequest(*wr)
+}
+
+// wsConn is the server side of a WebSocket connection, implementing the
+// subset of RFC 6455 needed by PushWebSocket (no extensions or subprotocols).
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// upgradeWebSocket performs the opening handshake. If it fails, the request
+// has already been answered with an appropriate status code.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "expected a WebSocket upgrade request", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket upgrade request")
+	}
+	if v := r.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported WebSocket version %q", v)
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key header", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key header")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("response writer does not support hijacking")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
+	// Deadlines set by the HTTP server must not apply to the long-lived
+	// connection.
+	conn.SetDeadline(time.Time{})
+	accept := sha1.Sum([]byte(key + wsAcceptGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// readMessage returns the payload of the next text message, reassembled from
+// its fragments. Control frames are handled on the fly. If the client closes
+// the connection, io.EOF is returned. Protocol violations result in a close
+// frame sent to the client and an error.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var (
+		msg     []byte
+		started bool
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the status code, if any, as required by RFC 6455.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsOpClose, payload)
+			return nil, io.EOF
+		case wsOpText:
+			if started {
+				return nil, c.fail(wsCloseProtocolError, "new message before the previous one was complete")
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				return nil, c.fail(wsCloseProtocolError, "continuation frame without message")
+			}
+		case wsOpBinary:
+			return nil, c.fail(wsCloseUnsupported, "only text messages are supported")
+		default:
+			return nil, c.fail(wsCloseProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+		if len(msg)+len(payload) > WebSocketMaxMessageSize {
+			return nil, c.fail(wsCloseTooBig, "message too big")
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, op = header[0]&0x80 != 0, header[0]&0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "reserved bits set")
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "frame from client not masked")
+	}
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && (n > 125 || !fin) {
+		return false, 0, nil, c.fail(wsCloseProtocolError, "invalid control frame")
+	}
+	if n > WebSocketMaxMessageSize {
+		return false, 0, nil, c.fail(wsCloseTooBig, "message too big")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// writeFrame writes a single unfragmented, unmasked frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	buf := make([]byte, 0, len(payload)+10)
+	buf = append(buf, 0x80|op)
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 126, 0, 0)
+		binary.BigEndian.PutUint16(buf[2:], uint16(n))
+	default:
+		buf = append(buf, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[2:], uint64(n))
+	}
+	_, err := c.conn.Write(append(buf, payload...))
+	return err
+}
+
+// fail sends a close frame with the given status code and reason and returns
+// the reason as an error.
+func (c *wsConn) fail(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	c.writeFrame(wsOpClose, append(payload, reason...))
+	return errors.New(reason)
+}
+
+// headerHasToken returns whether the comma-separated list in the given header
+// contains the given token (case-insensitive).
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
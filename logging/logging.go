@@ -0,0 +1,273 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging provides the leveled, structured logger of the Pushgateway.
+// Each log line has a time, a level, a message, and further key/value pairs,
+// formatted in logfmt or as a JSON object.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+// The levels, from the lowest to the highest severity.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a Level.
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if s == name {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of debug, info, warn, error", s)
+}
+
+// Format is the format of the log lines.
+type Format int
+
+// The formats.
+const (
+	// FormatLogfmt formats the key/value pairs as key=value, separated by
+	// spaces, quoting values where necessary.
+	FormatLogfmt Format = iota
+	// FormatJSON formats the key/value pairs as a JSON object.
+	FormatJSON
+)
+
+var formatNames = map[Format]string{
+	FormatLogfmt: "logfmt",
+	FormatJSON:   "json",
+}
+
+func (f Format) String() string {
+	return formatNames[f]
+}
+
+// ParseFormat parses the name of a Format.
+func ParseFormat(s string) (Format, error) {
+	for f, name := range formatNames {
+		if s == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log format %q, must be one of logfmt, json", s)
+}
+
+// Logger writes the log lines of at least its level to its writer. It is safe
+// for concurrent use.
+type Logger struct {
+	mtx    sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+	now    func() time.Time
+}
+
+// New returns a Logger writing lines of at least the given level to w in the
+// given format.
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{w: w, level: level, format: format, now: time.Now}
+}
+
+// Enabled returns whether lines of the given level are written, e.g. to avoid
+// computing expensive values for lines not written anyway.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Log writes a line with the given level, message, and key/value pairs. Keys
+// have to be strings. Errors and fmt.Stringers are logged as their strings,
+// time.Time in RFC 3339 format. A missing last value is logged as "(MISSING)".
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	kvs := make([]interface{}, 0, len(keyvals)+6)
+	kvs = append(kvs, "ts", l.now(), "level", level.String(), "msg", msg)
+	kvs = append(kvs, keyvals...)
+	if len(kvs)%2 != 0 {
+		kvs = append(kvs, "(MISSING)")
+	}
+	var buf bytes.Buffer
+	switch l.format {
+	case FormatJSON:
+		buf.WriteByte('{')
+		for i := 0; i < len(kvs); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSON(&buf, fmt.Sprint(kvs[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, jsonValue(kvs[i+1]))
+		}
+		buf.WriteByte('}')
+	default:
+		for i := 0; i < len(kvs); i += 2 {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(logfmtKey(fmt.Sprint(kvs[i])))
+			buf.WriteByte('=')
+			buf.WriteString(logfmtValue(stringValue(kvs[i+1])))
+		}
+	}
+	buf.WriteByte('\n')
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// stringValue returns v as logged in logfmt.
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// jsonValue returns v as logged in JSON: numbers and booleans as such,
+// everything else as strings (see stringValue).
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	default:
+		return stringValue(v)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		// Only for non-finite floats.
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// logfmtKey replaces the characters a logfmt key must not contain.
+func logfmtKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, k)
+}
+
+// logfmtValue quotes the value if necessary.
+func logfmtValue(v string) string {
+	if v == "" || strings.IndexFunc(v, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || r >= 0x7f
+	}) != -1 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+var (
+	defaultMtx    sync.RWMutex
+	defaultLogger = New(os.Stderr, LevelInfo, FormatLogfmt)
+)
+
+// SetDefault replaces the Logger used by the package-level functions,
+// which initially writes lines of level info and above to stderr in
+// logfmt.
+func SetDefault(l *Logger) {
+	defaultMtx.Lock()
+	defer defaultMtx.Unlock()
+	defaultLogger = l
+}
+
+// Default returns the Logger used by the package-level functions.
+func Default() *Logger {
+	defaultMtx.RLock()
+	defer defaultMtx.RUnlock()
+	return defaultLogger
+}
+
+// Enabled calls Enabled of the default Logger.
+func Enabled(level Level) bool { return Default().Enabled(level) }
+
+// Debug logs a line of level debug with the default Logger, see Logger.Log.
+func Debug(msg string, keyvals ...interface{}) { Default().Log(LevelDebug, msg, keyvals...) }
+
+// Info logs a line of level info with the default Logger, see Logger.Log.
+func Info(msg string, keyvals ...interface{}) { Default().Log(LevelInfo, msg, keyvals...) }
+
+// Warn logs a line of level warn with the default Logger, see Logger.Log.
+func Warn(msg string, keyvals ...interface{}) { Default().Log(LevelWarn, msg, keyvals...) }
+
+// Error logs a line of level error with the default Logger, see Logger.Log.
+func Error(msg string, keyvals ...interface{}) { Default().Log(LevelError, msg, keyvals...) }
+
+// Fatal logs a line of level error with the default Logger and exits with
+// status code 1.
+func Fatal(msg string, keyvals ...interface{}) {
+	Default().Log(LevelError, msg, keyvals...)
+	os.Exit(1)
+}
+
+// Writer returns an io.Writer logging each line written to it as the message
+// of a line of the given level with the default Logger, e.g. to redirect the
+// standard library's log package (with its flags set to 0).
+func Writer(level Level) io.Writer {
+	return writer(level)
+}
+
+type writer Level
+
+func (w writer) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		Default().Log(Level(w), line)
+	}
+	return len(p), nil
+}
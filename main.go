@@ -14,50 +14,536 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 
 	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/logging"
 	"github.com/prometheus/pushgateway/storage"
 )
 
 var (
+	configFile          = flag.String("config.file", "", "JSON file with scrape-time relabeling rules, store limits, and API tokens, see the README. Reloaded on SIGHUP and, with -web.enable-lifecycle, on POST /-/reload. If empty, metrics are exposed as pushed.")
 	listenAddress       = flag.String("web.listen-address", ":9091", "Address to listen on for the web interface, API, and telemetry.")
-	metricsPath         = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	grpcListenAddress   = flag.String("grpc.listen-address", "", "Address to serve the gRPC push API on (see the README), using the TLS configuration of the web interface, if any. If empty, no gRPC API is served.")
+	metricsPath         = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics (below -web.route-prefix).")
+	routePrefix         = flag.String("web.route-prefix", "", "Prefix of the paths of all HTTP endpoints, including the web UI, the API, and the telemetry path, e.g. '/pushgateway'. Links in the web UI include the prefix.")
+	readTimeout         = flag.Duration("web.read-timeout", 30*time.Second, "Maximum duration for reading an entire request, including the body (e.g. of a push). 0 means no timeout.")
+	writeTimeout        = flag.Duration("web.write-timeout", 30*time.Second, "Maximum duration from the end of reading the request headers to the end of writing the response, e.g. of a scrape. 0 means no timeout.")
+	idleTimeout         = flag.Duration("web.idle-timeout", 2*time.Minute, "Maximum duration to wait for the next request on a keep-alive connection. 0 means -web.read-timeout is used.")
 	persistenceFile     = flag.String("persistence.file", "", "File to persist metrics. If empty, metrics are only kept in memory.")
+	persistenceRouting  = flag.String("persistence.routing", "", "Persist groups to separate files by the value of a grouping label, in the form '<label>:<value>=<file>,<value>=<file>,...' with <label> being 'job' or 'instance'. Groups with other values are persisted to -persistence.file (if set).")
+	persistenceOnError  = flag.String("persistence.on-error", "empty", "What to do if a persistence file exists but cannot be restored: 'fail' (exit), 'empty' (start without its groups and overwrite it with the next persist), or 'backup-and-empty' (like 'empty', but rename the file first by appending '.corrupt-<unix time>').")
 	persistenceInterval = flag.Duration("persistence.interval", 5*time.Minute, "The minimum interval at which to write out the persistence file.")
+	walPrefix           = flag.String("persistence.wal", "", "Prefix of the segment files of a write-ahead log recording every change of a persisted group, e.g. '/data/pushgateway.wal', so that changes since the last persist survive a crash. It is replayed on start-up and truncated with every persist. Requires -persistence.file or -persistence.routing.")
+	enableAdminAPI      = flag.Bool("web.enable-admin-api", false, "Enable API endpoints for admin control actions, like resetting the whole store.")
+	enableLifecycle     = flag.Bool("web.enable-lifecycle", false, "Enable POST /-/reload to reload the configuration (see -config.file) and POST /-/quit to shut down gracefully.")
+	enableHTTPSD        = flag.Bool("web.enable-http-sd", false, "Serve the groups as scrape targets for the HTTP service discovery of Prometheus at /api/v1/sd. Groups not pushed to within -storage.synthetic.up-freshness (if positive) are left out.")
+	readOnly            = flag.Bool("web.read-only", false, "Start in read-only mode, i.e. reject all pushes and deletes with status code 503. Can be changed at runtime via the API.")
+	tlsCertFile         = flag.String("web.tls-cert-file", "", "File containing the certificate (chain) to serve HTTPS with. If empty, plain HTTP is served.")
+	tlsKeyFile          = flag.String("web.tls-key-file", "", "File containing the private key for -web.tls-cert-file.")
+	tlsMinVersion       = flag.String("web.tls-min-version", "TLS12", "The minimum TLS version the HTTPS server accepts, one of TLS10, TLS11, TLS12, and TLS13.")
+	tlsCipherSuites     = flag.String("web.tls-cipher-suites", "", "Comma-separated list of the cipher suites the HTTPS server accepts for TLS 1.2 and older, by their IANA names, e.g. 'TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256'. Only suites without known security issues are allowed. If empty, the Go default suites are used. (The TLS 1.3 suites are not configurable.)")
+	tlsClientCAFile     = flag.String("web.tls-client-ca-file", "", "File containing the CA certificates to verify client certificates with. If set, pushes, deletes, and all other changing requests require a verified client certificate (and are rejected with status code 403 otherwise). Requires -web.tls-cert-file.")
+	webConfigFile       = flag.String("web.config.file", "", "JSON file configuring TLS and basic authentication for all endpoints, see the README. Its tls_server_config cannot be combined with the -web.tls-* flags.")
+	requireInstance     = flag.Bool("web.require-instance", false, "Reject pushes that do not specify an instance with status code 400. Otherwise, the IP number of the pusher is used as the instance.")
+	maxPushAge          = flag.Duration("web.max-push-age", 0, "Reject pushes whose 'ts' query parameter is older than this with status code 400. 0 means no limit.")
+	maxPushBytes        = flag.Int64("web.max-push-bytes", 0, "Reject pushes whose body is larger than this number of bytes (after decompression, see the README) with status code 413. 0 means no limit.")
+	emptyPushPolicy     = flag.String("web.empty-push", "update", "How to handle pushes without any samples: 'update' (like any other push, i.e. a POST changes nothing and a PUT deletes the group), 'ignore' (accept without changing anything), 'reject' (status code 400), or 'keep' (create or keep the group, recording the push time, while a PUT still deletes its metrics).")
+	normalizeLabels     = flag.String("web.normalize-grouping-labels", "", "Comma-separated list of grouping labels (job and/or instance) whose values are normalized on pushes and deletes, so that e.g. 'Host-A' and 'host-a' end up in the same group. Values are lowercased unless -web.grouping-label-value-map is set. If empty, values are taken as is.")
+	labelValueMap       = flag.String("web.grouping-label-value-map", "", "Comma-separated list of value mappings of the form 'old=new' to normalize the labels given by -web.normalize-grouping-labels with instead of lowercasing. Values not in the list are taken as is.")
+	labelConflicts      = flag.String("web.grouping-label-conflict", "overwrite", "How to handle pushed metrics with a job or instance label different from the grouping labels: 'overwrite' (the grouping label wins), 'reject' (reject the push with status code 400), or 'drop' (drop the metric, keeping the rest of the push).")
+	sampleTimestamps    = flag.String("web.sample-timestamps", "honor", "How to handle pushed metrics with a timestamp: 'honor' (store and expose the timestamp as pushed), 'strip' (remove the timestamp), or 'reject' (reject the push with status code 400).")
+	batchDuplicates     = flag.String("web.batch-duplicate-groups", "in-order", "How to handle several entries of a batch push for the same group: 'in-order' (submit them in order, the last one wins), 'merge' (merge them into one push), or 'reject' (reject the whole batch with status code 400).")
+	statsdTimerBuckets  = flag.String("web.statsd-timer-buckets", "", "Comma-separated upper bounds of the histogram buckets StatsD timers pushed to /api/v1/statsd are converted to, e.g. '0.01,0.1,1,10'. If empty, timers are converted to summaries.")
+	quarantineThreshold = flag.Int("web.quarantine-threshold", 0, "The number of consecutive failed pushes (status code 400, 413, or 415) to a group after which its pushes are rejected with status code 429 for -web.quarantine-cooldown. 0 disables the quarantine.")
+	quarantineCooldown  = flag.Duration("web.quarantine-cooldown", 5*time.Minute, "How long pushes to a quarantined group are rejected.")
+	pushRateLimit       = flag.Float64("web.push-rate-limit", 0, "Maximum rate of pushes, batches, and StatsD requests per second per client (or per group, see -web.push-rate-limit-by). Requests exceeding the limit are rejected with status code 429. 0 means no limit.")
+	pushRateBurst       = flag.Int("web.push-rate-burst", 10, "Number of requests a client (or group) may send at once in excess of -web.push-rate-limit.")
+	pushRateLimitBy     = flag.String("web.push-rate-limit-by", "client", "What -web.push-rate-limit applies to: 'client' (the IP number of the client) or 'group' (the group given in the push URL, requests without a group count by client).")
+	idempotencyWindow   = flag.Duration("web.idempotency-window", 0, "How long to remember the response to a POST push carrying an Idempotency-Key header, so that retries are not applied twice. 0 disables idempotency keys.")
+	inferUnits          = flag.Bool("web.openmetrics-infer-units", false, "Announce units in the OpenMetrics format (# UNIT) as inferred from metric name suffixes like '_seconds' or '_bytes'. Per-metric units can be set in the metric_units section of the configuration file either way.")
+	signingKeyFile      = flag.String("web.signing-key-file", "", "File containing a key to sign scrape responses with (HMAC-SHA256). Leading and trailing whitespace is ignored. If empty, responses are not signed.")
+	shardLabel          = flag.String("web.shard-label", "", "If not empty, the name of a label to split the pushed metrics into shards by. The groups with a metric with the label set to <value> are then exposed on <web.telemetry-path>/<label>/<value>, e.g. /metrics/shard/0.")
+	jobRenames          = flag.String("web.job-rename", "", "Comma-separated list of job renames of the form 'old=new'. Metrics pushed with job 'old' are exposed with job 'new' on the metrics endpoint, while they are still stored (and have to be deleted) under job 'old'.")
+	timestampPrecision  = flag.String("web.timestamp-precision", "ms", "Precision of the sample timestamps exposed on the metrics endpoint, either 's' (seconds) or 'ms' (milliseconds). Timestamps are truncated accordingly.")
+	maxLabelsPerMetric  = flag.Int("push.max-labels-per-metric", 0, "The maximum number of labels (with a non-empty value) of a pushed metric. Pushes with a metric exceeding it are rejected with status code 400. 0 means no limit.")
+	countGroupingLabels = flag.Bool("push.max-labels-count-grouping-labels", true, "Whether the job and instance label count towards -push.max-labels-per-metric.")
+	checkConsistency    = flag.Bool("push.check-consistency", true, "Reject pushes with status code 400 that would make the scrape of all metrics fail, e.g. because of duplicate series or because a metric has a different type or different label names than a metric of the same name pushed by another group. Use -push.check-consistency=false to accept them.")
+	queueLength         = flag.Int("push.queue-length", 1000, "The number of pushes and deletes that can wait for processing. Further requests are rejected with status code 503 (and a Retry-After header) until there is room again.")
+	forwardURL          = flag.String("forward.remote-write-url", "", "Comma-separated list of remote write endpoints to forward every applied push to, e.g. 'http://prometheus:9090/api/v1/write'. Pushed metrics are still served locally. If empty, pushes are not forwarded.")
+	forwardQueueSize    = flag.Int("forward.queue-size", 10000, "The number of pushes waiting in memory to be forwarded to each endpoint at most. Further pushes are spilled to disk with -forward.buffer-file, otherwise not forwarded to the endpoint until there is room again.")
+	forwardBufferFile   = flag.String("forward.buffer-file", "", "File to save the pushes not forwarded yet to on shutdown, to be forwarded after the next start. Pushes not fitting into the queue of an endpoint are spilled to files next to it. If empty, the queued pushes are forwarded before the Pushgateway exits.")
+	forwardTimeout      = flag.Duration("forward.timeout", 30*time.Second, "Timeout of each remote write request forwarding a push.")
+	clusterPeers        = flag.String("cluster.peer", "", "Comma-separated list of base URLs of other Pushgateways (e.g. 'http://pushgateway-2:9091') to replicate every change of the stored metrics to, and to bootstrap from on start-up. All of them have to list each other. If empty, nothing is replicated.")
+	clusterQueueSize    = flag.Int("cluster.queue-size", 10000, "The number of changes waiting to be replicated to each peer at most. Further changes are not replicated to the peer until there is room again.")
+	clusterTimeout      = flag.Duration("cluster.timeout", 30*time.Second, "Timeout of each request to a peer.")
+	clusterSecretFile   = flag.String("cluster.secret-file", "", "File containing the secret shared by all peers, required with -cluster.peer. Replication requests without it are rejected. Leading and trailing whitespace is ignored.")
+	clusterAntiEntropy  = flag.Duration("cluster.anti-entropy-interval", time.Minute, "How often to fetch the state of all groups from each peer to catch up on missed changes. 0 disables it.")
+	otlpEndpoint        = flag.String("tracing.otlp-endpoint", "", "OTLP/HTTP endpoint to export request traces to, e.g. 'http://localhost:4318/v1/traces'. If empty, tracing is disabled.")
+	ingestionTimeLabel  = flag.String("storage.ingestion-time-label", "", "If not empty, the name of a label that is set on all pushed metrics to the time of the push (RFC 3339, UTC).")
+	maxGroups           = flag.Int("storage.max-groups", 0, "The maximum number of groups (job/instance combinations) to store. Pushes creating new groups beyond that number are rejected with status code 429. 0 means no limit.")
+	maxFamilies         = flag.Int("storage.max-metric-families", 0, "The maximum number of metric families to store, summed over all groups. Pushes adding metric families beyond that number are rejected with status code 429. 0 means no limit.")
+	limitPolicy         = flag.String("storage.limit-policy", "reject", "What to do with a push exceeding -storage.max-groups or -storage.max-metric-families: 'reject' it with status code 429, or 'evict' the groups pushed to least recently until the store is within the limits again.")
+	maxBytes            = flag.Int64("storage.max-bytes", 0, "If the estimated size of the stored metrics (the sum of the serialized sizes of all metric families) exceeds this number of bytes, the groups pushed to least recently are evicted until it does not anymore. 0 means no limit.")
+	dedupeContent       = flag.Bool("storage.dedupe-content", false, "Share identical parts of the stored metrics (help strings, label pairs, values) in memory. Saves memory if many groups push similar content, at the cost of hashing all pushed metrics.")
+	nonFinitePolicy     = flag.String("storage.non-finite-values", "keep", "What to do with pushed NaN, +Inf, and -Inf values of gauges, counters, and untyped metrics and of the sums of summaries and histograms: 'keep' them, 'reject' the push with status code 400, or 'replace' them by -storage.non-finite-replacement.")
+	nonFiniteValue      = flag.Float64("storage.non-finite-replacement", 0, "The value replacing non-finite values with -storage.non-finite-values=replace.")
+	typeChangePolicy    = flag.String("storage.type-change", "reject", "What to do with a push changing the type of a metric already stored in the group (e.g. from counter to gauge): 'reject' it with status code 400, or 'allow' it (and log it).")
+	helpConflictPolicy  = flag.String("storage.help-conflict-policy", "first-wins", "How to resolve different help strings of metrics with the same name pushed by different groups: 'first-wins' or 'last-wins' (with groups sorted by job and instance), 'longest', or 'error' (do not expose the metric at all).")
+	groupSeriesCount    = flag.Bool("storage.synthetic.group-series-count", false, "Expose a gauge 'group_series_count' with the number of metrics in each group. Pushing metrics of that name is rejected.")
+	groupContentHash    = flag.Bool("storage.synthetic.group-content-hash", false, "Expose a gauge 'group_content_hash' with a hash of the content of each group, changing whenever the content changes (for change detection, not for security). Pushing metrics of that name is rejected.")
+	groupUpFreshness    = flag.Duration("storage.synthetic.up-freshness", 0, "If positive, expose a gauge 'up' for each group that is 1 if the group has been pushed to within this duration and 0 otherwise. Pushing metrics of that name is then rejected. 0 disables the metric.")
+	pushTimeMetrics     = flag.Bool("storage.synthetic.push-time", false, "Expose gauges 'push_time_seconds' and 'push_failure_time_seconds' with the time of the last successful and the last failed push to each group. Pushing metrics of these names is rejected.")
+	hostnameLabel       = flag.String("storage.synthetic.hostname-label", "", "If not empty, the name of a label that is set to the hostname of the Pushgateway on all synthetic metrics (but not on pushed metrics), e.g. to tell apart the Pushgateways of an HA pair.")
+	minScrapeInterval   = flag.Duration("web.min-scrape-interval", 0, "If positive, a client scraping the metrics endpoints again within this interval gets the previous response (if the stored metrics have not changed in the meantime) instead of a freshly encoded one. 0 disables the cache.")
+	scrapeQuietPeriod   = flag.Duration("storage.scrape-quiet-period", 0, "How long a group has to go without pushes before it is exposed on the metrics endpoint. Useful for groups updated by a sequence of pushes, at the cost of exposing every update later by that period. 0 exposes groups immediately.")
+	auditLogFile        = flag.String("storage.audit-log.file", "", "File to append a record of every deletion of a group to (by delete requests, the API, or eviction). If empty, deletions are not recorded.")
+	auditLogFormat      = flag.String("storage.audit-log.format", "text", "Format of the records in -storage.audit-log.file, either 'text' (key=value pairs) or 'json' (one object per line).")
+	auditLogMaxBytes    = flag.Int64("storage.audit-log.max-bytes", 100<<20, "Size beyond which -storage.audit-log.file is renamed by appending '.1' (replacing the previous one) and a new file is started. 0 means no rotation.")
+	eventLogSize        = flag.Int("storage.events.size", 0, "The number of most recent push and delete requests to keep in memory and expose via /api/v1/events. 0 disables the API.")
+	eventLogMaxBytes    = flag.Int("storage.events.max-bytes", 1<<20, "The estimated memory the events kept for /api/v1/events may use at most. Older events are dropped beyond it. 0 means no limit besides -storage.events.size.")
+	metricExpiration    = flag.Duration("metric.expiration", 0, "If positive, groups not pushed to for this long are deleted, so that the metrics of jobs that have stopped pushing do not live forever. A push may override it for its group with the X-Pushgateway-Expiration header. 0 means that groups only expire with that header.")
+	storageBackend      = flag.String("storage.backend", "disk", "Where to keep the pushed metrics besides memory: 'disk' (see -persistence.file) or 'redis' (see -storage.redis.address), the latter shared by all Pushgateways using the same Redis keys.")
+	redisAddress        = flag.String("storage.redis.address", "", "Address (host:port) of the Redis server to keep the pushed metrics in with -storage.backend=redis.")
+	redisPassword       = flag.String("storage.redis.password", "", "Password to authenticate to Redis with. If empty, no authentication is done.")
+	redisKeyPrefix      = flag.String("storage.redis.key-prefix", "pushgateway:", "Prefix of the Redis keys the pushed metrics are kept under. Pushgateways sharing the prefix share the pushed metrics.")
+	redisSyncInterval   = flag.Duration("storage.redis.sync-interval", 5*time.Second, "How often to check Redis for changes by other Pushgateways (at least 1s). Only the changed groups are fetched.")
+	writeConcurrency    = flag.Int("storage.write-concurrency", 1, "The number of goroutines processing write requests in parallel. Requests for the same job are always processed in order.")
+	logLevel            = flag.String("log.level", "info", "Only log lines of this level or above: 'debug', 'info', 'warn', or 'error'. At level debug, every accepted and rejected push is logged.")
+	tenants             = flag.String("tenancy.tenants", "", "Comma-separated names of tenants, each with its own isolated groups, persistence file, and endpoints below /tenant/<name>/ (see the README). If empty, there are no tenants.")
+	tenantHeader        = flag.String("tenancy.header", "", "Request header that selects the tenant of requests to the usual paths, e.g. 'X-Pushgateway-Tenant'. If empty, tenants are only selected by path.")
+	logFormat           = flag.String("log.format", "logfmt", "Format of the log lines: 'logfmt' or 'json'.")
 )
 
 func main() {
 	flag.Parse()
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	logging.SetDefault(logging.New(os.Stderr, level, format))
+	// Lines logged by libraries, e.g. errors of the HTTP server.
+	log.SetFlags(0)
+	log.SetOutput(logging.Writer(logging.LevelInfo))
 	versionInfoTmpl.Execute(os.Stdout, BuildInfo)
 	flags := map[string]string{}
 	flag.VisitAll(func(f *flag.Flag) {
 		flags[f.Name] = f.Value.String()
 	})
 
-	ms := storage.NewDiskMetricStore(*persistenceFile, *persistenceInterval)
-	prometheus.SetMetricFamilyInjectionHook(ms.GetMetricFamilies)
+	switch *ingestionTimeLabel {
+	case "job", "instance":
+		logging.Fatal("Label cannot be used as ingestion time label.", "label", *ingestionTimeLabel)
+	}
+	var hostname string
+	switch *hostnameLabel {
+	case "":
+	case "job", "instance":
+		logging.Fatal("Label cannot be used as hostname label.", "label", *hostnameLabel)
+	default:
+		h, err := os.Hostname()
+		if err != nil {
+			logging.Fatal("Could not determine hostname.", "err", err)
+		}
+		hostname = h
+	}
+	helpPolicy, err := storage.ParseHelpConflictPolicy(*helpConflictPolicy)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	nonFinite, err := storage.ParseNonFiniteValuePolicy(*nonFinitePolicy)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	typeChange, err := storage.ParseTypeChangePolicy(*typeChangePolicy)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	routing, err := storage.ParsePersistenceRouting(*persistenceRouting)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	restorePolicy, err := storage.ParseRestoreErrorPolicy(*persistenceOnError)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	var audit *storage.AuditLog
+	if *auditLogFile != "" {
+		format, err := storage.ParseAuditFormat(*auditLogFormat)
+		if err != nil {
+			logging.Fatal("Invalid flag value.", "err", err)
+		}
+		if audit, err = storage.OpenAuditLog(*auditLogFile, format, *auditLogMaxBytes); err != nil {
+			logging.Fatal("Could not open audit log.", "file", *auditLogFile, "err", err)
+		}
+	}
+	var events *storage.EventLog
+	if *eventLogSize > 0 {
+		events = storage.NewEventLog(*eventLogSize, *eventLogMaxBytes)
+	}
+	forwarder, err := handler.NewForwarder(*forwardURL, *forwardQueueSize, *forwardTimeout, *forwardBufferFile)
+	if err != nil {
+		logging.Fatal("Could not set up forwarding.", "err", err)
+	}
+	var clusterSecret string
+	if *clusterSecretFile != "" {
+		secret, err := ioutil.ReadFile(*clusterSecretFile)
+		if err != nil {
+			logging.Fatal("Could not read cluster secret.", "file", *clusterSecretFile, "err", err)
+		}
+		clusterSecret = string(bytes.TrimSpace(secret))
+	}
+	replicator, err := handler.NewReplicator(*clusterPeers, *clusterQueueSize, *clusterTimeout, clusterSecret)
+	if err != nil {
+		logging.Fatal("Could not set up replication.", "err", err)
+	}
+	cfg, err := loadConfig(*configFile, *metricsPath)
+	if err != nil {
+		logging.Fatal("Could not load configuration.", "file", *configFile, "err", err)
+	}
+	if *walPrefix != "" && *persistenceFile == "" && *persistenceRouting == "" {
+		logging.Fatal("A write-ahead log requires -persistence.file or -persistence.routing.")
+	}
+	var redis *storage.Redis
+	switch *storageBackend {
+	case "disk":
+	case "redis":
+		if *redisAddress == "" {
+			logging.Fatal("-storage.backend=redis requires -storage.redis.address.")
+		}
+		if *persistenceFile != "" || *persistenceRouting != "" {
+			logging.Fatal("-storage.backend=redis cannot be combined with -persistence.file or -persistence.routing.")
+		}
+		if replicator != nil {
+			logging.Fatal("-storage.backend=redis cannot be combined with -cluster.peer, as Redis is shared already.")
+		}
+		redis = storage.NewRedis(*redisAddress, *redisPassword, *redisKeyPrefix, *redisSyncInterval)
+	default:
+		logging.Fatal("Unknown storage backend, must be one of disk, redis.", "backend", *storageBackend)
+	}
+	tenantNames, err := handler.ParseTenants(*tenants)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	if len(tenantNames) > 0 && (redis != nil || replicator != nil) {
+		logging.Fatal("-tenancy.tenants cannot be combined with -storage.backend=redis or -cluster.peer.")
+	}
+	cfgMaxGroups, cfgMaxBytes := cfg.limits(*maxGroups, *maxBytes)
+	limits, err := storage.ParseLimitPolicy(*limitPolicy)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	storeOpts := storage.DiskMetricStoreOptions{
+		WriteConcurrency:     *writeConcurrency,
+		QueueLength:          *queueLength,
+		IngestionTimeLabel:   *ingestionTimeLabel,
+		MaxGroups:            cfgMaxGroups,
+		MaxMetricFamilies:    *maxFamilies,
+		LimitPolicy:          limits,
+		MaxBytes:             cfgMaxBytes,
+		HelpConflictPolicy:   helpPolicy,
+		GroupSeriesCount:     *groupSeriesCount,
+		GroupContentHash:     *groupContentHash,
+		ScrapeQuietPeriod:    *scrapeQuietPeriod,
+		PersistenceRouting:   routing,
+		GroupUpFreshness:     *groupUpFreshness,
+		PushTime:             *pushTimeMetrics,
+		SyntheticLabelName:   *hostnameLabel,
+		SyntheticLabelValue:  hostname,
+		DeduplicateContent:   *dedupeContent,
+		RestoreErrorPolicy:   restorePolicy,
+		AuditLog:             audit,
+		EventLog:             events,
+		NonFiniteValuePolicy: nonFinite,
+		NonFiniteReplacement: *nonFiniteValue,
+		TypeChangePolicy:     typeChange,
+		MaxLabelsPerMetric:   *maxLabelsPerMetric,
+		CountGroupingLabels:  *countGroupingLabels,
+		CheckConsistency:     *checkConsistency,
+		Expiration:           cfg.storeExpiration(*metricExpiration),
+		WriteAheadLog:        *walPrefix,
+		Redis:                redis,
+	}
+	setPeerOptions(&storeOpts, forwarder, replicator)
+	ms, err := storage.OpenDiskMetricStore(*persistenceFile, *persistenceInterval, storeOpts)
+	if err != nil {
+		logging.Fatal("Could not open metric store.", "err", err)
+	}
+	tenantStores := make(map[string]*storage.DiskMetricStore, len(tenantNames))
+	for _, name := range tenantNames {
+		file, opts := tenantStoreOptions(*persistenceFile, storeOpts, name)
+		if tenantStores[name], err = storage.OpenDiskMetricStore(file, *persistenceInterval, opts); err != nil {
+			logging.Fatal("Could not open metric store.", "tenant", name, "err", err)
+		}
+		prometheus.MustRegister(tenantStores[name])
+	}
+	prometheus.MustRegister(ms)
+	if err := replicator.Bootstrap(ms); err != nil {
+		logging.Warn("Starting without bootstrapping.", "err", err)
+	}
+	replicator.StartAntiEntropy(ms, *clusterAntiEntropy)
+	emptyPush, err := handler.ParseEmptyPushPolicy(*emptyPushPolicy)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	conflicts, err := handler.ParseGroupingLabelConflictPolicy(*labelConflicts)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	timestamps, err := handler.ParseSampleTimestampPolicy(*sampleTimestamps)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	duplicates, err := handler.ParseBatchDuplicatePolicy(*batchDuplicates)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	normalizer, err := handler.NewGroupingLabelNormalizer(*normalizeLabels, *labelValueMap)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	timerBuckets, err := handler.ParseStatsDTimerBuckets(*statsdTimerBuckets)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	pushOpts := handler.PushOptions{
+		RequireInstance: *requireInstance,
+		MaxAge:          *maxPushAge,
+		EmptyPush:       emptyPush,
+		MaxBytes:        *maxPushBytes,
+		Conflicts:       conflicts,
+		Timestamps:      timestamps,
+		Normalizer:      normalizer,
+	}
+	precision, err := handler.ParseTimestampPrecision(*timestampPrecision)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	renames, err := handler.ParseJobRenames(*jobRenames)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	exposed := handler.RenameJobs(renames, handler.TruncateTimestamps(precision, ms.GetMetricFamilies))
+	units := handler.NewMetricUnits(*inferUnits)
+	tokens := handler.NewTokenAuth()
+	rc, err := newRuntimeConfig(cfg, exposed, ms, *maxGroups, *maxBytes, *metricExpiration, units, tokens)
+	if err != nil {
+		logging.Fatal("Invalid configuration.", "err", err)
+	}
+	rc.tenantStores = tenantStores
+	// The injection hook injects only the groups kept for filtered
+	// gathering, see gatherGroups.
+	injection := handler.NewInjectionHook(rc.relabeled.MetricFamilies, func(keep func(map[string]string) bool) []*dto.MetricFamily {
+		return handler.TruncateTimestamps(precision, func() []*dto.MetricFamily {
+			return ms.GetMetricFamiliesFiltered(keep)
+		})()
+	})
+	prometheus.SetMetricFamilyInjectionHook(injection.MetricFamilies)
+	basicAuth := handler.NewBasicAuthUsers(nil)
+	reloader := handler.NewReloader(func() error {
+		cfg, err := loadConfig(*configFile, *metricsPath)
+		if err != nil {
+			return err
+		}
+		// Of the web configuration, only the basic authentication
+		// users can be changed at runtime.
+		webCfg, err := loadWebConfig(*webConfigFile)
+		if err != nil {
+			return fmt.Errorf("cannot load web configuration: %s", err)
+		}
+		if err := checkAuthentication(webCfg, cfg); err != nil {
+			return err
+		}
+		if err := rc.apply(cfg, true); err != nil {
+			return err
+		}
+		basicAuth.Set(webCfg.BasicAuthUsers)
+		return nil
+	})
+
+	prefix := normalizeRoutePrefix(*routePrefix)
+
+	tracer := handler.NewTracer(*otlpEndpoint)
+	ro := handler.NewReadOnlyMode(*readOnly)
+	idem := handler.NewIdempotencyCache(*idempotencyWindow)
+	rateLimitKey, err := handler.ParseRateLimitKey(*pushRateLimitBy)
+	if err != nil {
+		logging.Fatal("Invalid flag value.", "err", err)
+	}
+	limiter := handler.NewRateLimiter(*pushRateLimit, *pushRateBurst, rateLimitKey)
+	if limiter != nil {
+		prometheus.MustRegister(limiter)
+	}
+	quarantine := handler.NewQuarantine(*quarantineThreshold, *quarantineCooldown)
+	if quarantine != nil {
+		prometheus.MustRegister(quarantine)
+	}
+
+	// wrapMetrics adds the features common to all metrics endpoints, see
+	// handler.FilterBySelectorFrom for gather.
+	wrapMetrics := func(h http.Handler, gather func(func(map[string]string) bool) ([]*dto.MetricFamily, bool)) http.Handler {
+		return handler.SelectFormat(handler.FilterByName(handler.FilterBySelectorFrom(h, gather)), units)
+	}
+	// The version changes with the stored metrics and with the relabeling
+	// rules.
+	scrapeVersion := func() uint64 { return ms.Version() + reloader.Reloads() }
+	if *signingKeyFile != "" {
+		key, err := ioutil.ReadFile(*signingKeyFile)
+		if err != nil {
+			logging.Fatal("Could not read signing key.", "file", *signingKeyFile, "err", err)
+		}
+		key = bytes.TrimSpace(key)
+		if len(key) == 0 {
+			logging.Fatal("Signing key file is empty.", "file", *signingKeyFile)
+		}
+		wrapMetrics = func(h http.Handler, gather func(func(map[string]string) bool) ([]*dto.MetricFamily, bool)) http.Handler {
+			return handler.Sign(key, handler.SelectFormat(handler.FilterByName(handler.FilterBySelectorFrom(h, gather)), units))
+		}
+	}
+	// gatherGroups gathers from the default handler, but only the groups
+	// kept, so that scrapes with match[] parameters do not have to copy
+	// all groups. Job renames, rollups, and relabeling rules change the
+	// labels the groups are kept by.
+	gatherGroups := func(keep func(map[string]string) bool) ([]*dto.MetricFamily, bool) {
+		if len(renames) > 0 || !rc.plainTelemetry() {
+			return nil, false
+		}
+		return injection.Gather(prometheus.UninstrumentedHandler(), keep)
+	}
+	// The instrumentation is outermost as the filtered gathering calls the
+	// default handler itself.
+	metricsHandler := handler.InstrumentHandler("prometheus", handler.MinScrapeInterval(*minScrapeInterval, scrapeVersion, wrapMetrics(injection.Wrap(prometheus.UninstrumentedHandler()), gatherGroups)))
+
+	webCfg, err := loadWebConfig(*webConfigFile)
+	if err != nil {
+		logging.Fatal("Could not load web configuration.", "file", *webConfigFile, "err", err)
+	}
+	var tlsConfig *tls.Config
+	if webCfg.TLSServerConfig != nil {
+		if *tlsCertFile != "" || *tlsKeyFile != "" || *tlsClientCAFile != "" || *tlsCipherSuites != "" {
+			logging.Fatal("The -web.tls-* flags cannot be combined with tls_server_config in -web.config.file.")
+		}
+		tlsConfig, err = webCfg.TLSServerConfig.tlsConfig()
+	} else {
+		tlsConfig, err = loadTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCAFile, *tlsMinVersion, *tlsCipherSuites, tls.VerifyClientCertIfGiven)
+	}
+	if err != nil {
+		logging.Fatal("Could not load TLS configuration.", "err", err)
+	}
+	// auth protects the handlers of all changing requests, groups
+	// additionally the handlers changing groups, and admin the handlers of
+	// the other changing requests and of the dump of all groups.
+	auth := func(h httprouter.Handle) httprouter.Handle { return h }
+	if tlsConfig != nil && tlsConfig.ClientAuth != tls.NoClientCert {
+		auth = handler.RequireClientCert
+	}
+	groups := func(h httprouter.Handle) httprouter.Handle { return auth(tokens.Authenticate(h)) }
+	admin := func(h httprouter.Handle) httprouter.Handle { return auth(tokens.RequireAdmin(h)) }
+	if err := checkAuthentication(webCfg, cfg); err != nil {
+		logging.Fatal("Invalid configuration.", "err", err)
+	}
+	basicAuth.Set(webCfg.BasicAuthUsers)
 
 	r := httprouter.New()
-	r.Handler("GET", *metricsPath, prometheus.Handler())
-	r.PUT("/metrics/jobs/:job/instances/:instance", handler.Push(ms, true))
-	r.POST("/metrics/jobs/:job/instances/:instance", handler.Push(ms, false))
-	r.DELETE("/metrics/jobs/:job/instances/:instance", handler.Delete(ms))
-	r.PUT("/metrics/jobs/:job", handler.Push(ms, true))
-	r.POST("/metrics/jobs/:job", handler.Push(ms, false))
-	r.DELETE("/metrics/jobs/:job", handler.Delete(ms))
-	r.Handler("GET", "/functions.js", prometheus.InstrumentHandlerFunc(
+	r.Handler("GET", *metricsPath, tracer.TraceHandler("metrics", metricsHandler))
+	for i, ep := range cfg.Endpoints {
+		r.Handler("GET", ep.Path, tracer.TraceHandler(
+			"metrics_endpoint",
+			handler.InstrumentHandler(fmt.Sprintf("metrics_endpoint_%d", i), handler.MinScrapeInterval(*minScrapeInterval, scrapeVersion, wrapMetrics(handler.Expose(rc.endpoints[ep.Path].MetricFamilies), nil))),
+		))
+	}
+	if *shardLabel != "" {
+		shardPath := *metricsPath + "/" + *shardLabel + "/"
+		shardHandler, err := handler.Shard(*shardLabel, shardPath, rc.relabeled.MetricFamilies)
+		if err != nil {
+			logging.Fatal("Invalid flag value.", "err", err)
+		}
+		r.Handler("GET", shardPath+":shard", tracer.TraceHandler(
+			"metrics_shard",
+			handler.InstrumentHandler("metrics_shard", handler.MinScrapeInterval(*minScrapeInterval, scrapeVersion, wrapMetrics(shardHandler, nil))),
+		))
+	}
+	// The legacy paths only know job and instance, the others take any
+	// grouping labels as name/value pairs after the (possibly base64url
+	// encoded) job.
+	pushPaths := []string{
+		"/metrics/jobs/:job/instances/:instance",
+		"/metrics/jobs/:job",
+		"/metrics/job/:job/*labels",
+		"/metrics/job/:job",
+		"/metrics/job@base64/:job@base64/*labels",
+		"/metrics/job@base64/:job@base64",
+	}
+	for _, path := range pushPaths {
+		r.PUT(path, tracer.Trace("push", handler.LogPushes("push", groups(ro.Guard(limiter.Limit(quarantine.Guard(handler.Push(ms, true, pushOpts))))))))
+		r.POST(path, tracer.Trace("push", handler.LogPushes("push", groups(ro.Guard(limiter.Limit(quarantine.Guard(idem.Dedupe(handler.Push(ms, false, pushOpts)))))))))
+		r.DELETE(path, tracer.Trace("delete", groups(ro.Guard(handler.Delete(ms, normalizer)))))
+	}
+	r.POST("/api/v1/batch", tracer.Trace("batch", handler.LogPushes("batch", groups(ro.Guard(limiter.Limit(idem.Dedupe(handler.Batch(ms, *requireInstance, conflicts, timestamps, normalizer, duplicates))))))))
+	r.POST("/api/v1/statsd", tracer.Trace("statsd", handler.LogPushes("statsd", groups(ro.Guard(limiter.Limit(idem.Dedupe(handler.StatsD(ms, *requireInstance, timerBuckets, normalizer))))))))
+	r.GET("/api/v1/push/ws", tracer.Trace("push_websocket", handler.LogPushes("push_websocket", groups(ro.Guard(handler.PushWebSocket(ms, ro, *requireInstance, conflicts, timestamps, normalizer))))))
+	if replicator != nil {
+		// Not guarded by read-only mode, which only concerns clients.
+		r.POST("/api/v1/replicate", tracer.Trace("replicate", auth(handler.RequirePeerSecret(clusterSecret, handler.Replicate(ms)))))
+		r.GET("/api/v1/replicate", handler.RequirePeerSecret(clusterSecret, routerHandle(handler.ReplicationSnapshot(ms))))
+	}
+	r.DELETE("/api/v1/groups", tracer.Trace("delete_groups", groups(ro.Guard(handler.DeleteGroups(ms)))))
+	r.Handler("GET", "/api/v1/groups", handler.InstrumentHandlerFunc("query_groups", handler.QueryGroups(ms)))
+	r.Handler("GET", "/api/v1/diff", handler.InstrumentHandlerFunc("diff", handler.Diff(ms)))
+	r.Handler("GET", "/api/v1/query", handler.InstrumentHandlerFunc("query", handler.Query(ms)))
+	r.Handler("POST", "/api/v1/query", handler.InstrumentHandlerFunc("query", handler.Query(ms)))
+	r.Handler("GET", "/api/v1/export.csv", handler.InstrumentHandlerFunc("export_csv", handler.ExportCSV(ms)))
+	r.Handler("GET", "/api/v1/metadata", handler.InstrumentHandlerFunc("metadata", handler.Metadata(ms)))
+	r.Handler("GET", "/api/v1/metrics", handler.InstrumentHandlerFunc("api_metrics", handler.APIMetrics(ms)))
+	r.Handler("GET", "/api/v1/config", handler.InstrumentHandlerFunc("api_config", handler.APIConfig(flags)))
+	r.Handler("GET", "/api/v1/status", handler.InstrumentHandlerFunc("api_status", handler.APIStatus(ms, ro, BuildInfo)))
+	for _, method := range []string{"GET", "HEAD"} {
+		r.Handler(method, "/-/healthy", handler.InstrumentHandlerFunc("healthy", handler.Healthy(ms)))
+		r.Handler(method, "/-/ready", handler.InstrumentHandlerFunc("ready", handler.Ready(ms)))
+	}
+	// quit is closed by POST /-/quit, see interruptHandler.
+	quit := make(chan struct{})
+	registerLifecycle(r, *enableLifecycle, admin, reloader, quit)
+	r.PUT("/api/v1/read-only", admin(routerHandle(handler.InstrumentHandlerFunc("read_only", ro.Toggle()))))
+	if events != nil {
+		r.Handler("GET", "/api/v1/events", handler.InstrumentHandlerFunc("events", handler.Events(events)))
+	}
+	if *enableHTTPSD {
+		r.Handler("GET", "/api/v1/sd", handler.InstrumentHandlerFunc("http_sd", handler.ServiceDiscovery(ms, prefix+*metricsPath, tlsConfig != nil, renames, *groupUpFreshness)))
+	}
+	if *enableAdminAPI {
+		r.POST("/api/v1/reset", tracer.Trace("reset", admin(ro.Guard(handler.Reset(ms)))))
+		r.PUT("/api/v1/admin/wipe", tracer.Trace("wipe", admin(ro.Guard(handler.Wipe(ms)))))
+		r.GET("/api/v1/dump", tracer.Trace("dump", admin(routerHandle(handler.Dump(ms)))))
+		r.POST("/api/v1/restore", tracer.Trace("restore", admin(ro.Guard(handler.Restore(ms)))))
+		r.POST("/api/v1/pause", admin(routerHandle(handler.InstrumentHandlerFunc("pause", handler.SetPaused(ms, true)))))
+		r.GET("/api/v1/queue", admin(routerHandle(handler.InstrumentHandlerFunc("queue", handler.Queue(ms)))))
+		r.POST("/api/v1/resume", admin(routerHandle(handler.InstrumentHandlerFunc("resume", handler.SetPaused(ms, false)))))
+	}
+	r.Handler("GET", "/functions.js", handler.InstrumentHandlerFunc(
 		"static",
 		func(w http.ResponseWriter, _ *http.Request) {
 			if b, err := Asset("resources/functions.js"); err == nil {
@@ -67,27 +553,276 @@ func main() {
 			}
 		},
 	))
-	statusHandler := prometheus.InstrumentHandlerFunc("status", handler.Status(ms, Asset, flags, BuildInfo))
+	statusHandler := handler.InstrumentHandlerFunc("status", handler.Status(ms, Asset, flags, BuildInfo, prefix))
 	r.Handler("GET", "/status", statusHandler)
 	r.Handler("GET", "/", statusHandler)
 
 	// Re-enable pprof.
 	r.GET("/debug/pprof/*pprof", handlePprof)
 
-	log.Printf("Listening on %s.\n", *listenAddress)
+	// Each tenant has the push endpoints, its own telemetry path, and the
+	// read-only metrics API, see handler.Tenants.
+	tenantHandlers := make(map[string]http.Handler, len(tenantStores))
+	for name, tms := range tenantStores {
+		tr := httprouter.New()
+		tenantExposed := handler.RenameJobs(renames, handler.TruncateTimestamps(precision, tms.GetMetricFamilies))
+		tr.Handler("GET", *metricsPath, tracer.TraceHandler(
+			"tenant_metrics",
+			handler.InstrumentHandler("tenant_metrics", handler.MinScrapeInterval(*minScrapeInterval, tms.Version, wrapMetrics(handler.Expose(tenantExposed), nil))),
+		))
+		for _, path := range pushPaths {
+			tr.PUT(path, tracer.Trace("push", handler.LogPushes("push", groups(ro.Guard(limiter.Limit(quarantine.Guard(handler.Push(tms, true, pushOpts))))))))
+			tr.POST(path, tracer.Trace("push", handler.LogPushes("push", groups(ro.Guard(limiter.Limit(quarantine.Guard(idem.Dedupe(handler.Push(tms, false, pushOpts)))))))))
+			tr.DELETE(path, tracer.Trace("delete", groups(ro.Guard(handler.Delete(tms, normalizer)))))
+		}
+		tr.Handler("GET", "/api/v1/metrics", handler.InstrumentHandlerFunc("tenant_api_metrics", handler.APIMetrics(tms)))
+		tenantHandlers[name] = tr
+	}
+
+	var grpcListener net.Listener
+	if *grpcListenAddress != "" {
+		g := httprouter.New()
+		g.POST(handler.GRPCPushPath, tracer.Trace("push_grpc", handler.LogPushes("push_grpc", groups(ro.Guard(limiter.Limit(handler.GRPCPush(ms, *requireInstance, *maxPushBytes, conflicts, timestamps, normalizer)))))))
+		// Like on the HTTP listener, pushes with the tenant header (or
+		// path) go to the store of the tenant.
+		grpcTenantHandlers := make(map[string]http.Handler, len(tenantStores))
+		for name, tms := range tenantStores {
+			tg := httprouter.New()
+			tg.POST(handler.GRPCPushPath, tracer.Trace("push_grpc", handler.LogPushes("push_grpc", groups(ro.Guard(limiter.Limit(handler.GRPCPush(tms, *requireInstance, *maxPushBytes, conflicts, timestamps, normalizer)))))))
+			grpcTenantHandlers[name] = tg
+		}
+		grpcServer := &http.Server{
+			Addr:         *grpcListenAddress,
+			Handler:      basicAuth.Wrap(handler.Tenants(g, *tenantHeader, grpcTenantHandlers)),
+			ReadTimeout:  *readTimeout,
+			WriteTimeout: *writeTimeout,
+			IdleTimeout:  *idleTimeout,
+			Protocols:    new(http.Protocols),
+		}
+		// gRPC clients speak HTTP/2 only, without TLS also with prior
+		// knowledge.
+		grpcServer.Protocols.SetHTTP2(true)
+		grpcServer.Protocols.SetUnencryptedHTTP2(true)
+		logging.Info("Listening for gRPC.", "address", *grpcListenAddress)
+		if grpcListener, err = net.Listen("tcp", *grpcListenAddress); err != nil {
+			logging.Fatal("Could not listen.", "address", *grpcListenAddress, "err", err)
+		}
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				grpcServer.TLSConfig = tlsConfig.Clone()
+				err = grpcServer.ServeTLS(grpcListener, "", "")
+			} else {
+				err = grpcServer.Serve(grpcListener)
+			}
+			logging.Info("gRPC server stopped.", "err", err)
+		}()
+	}
+	logging.Info("Listening.", "address", *listenAddress)
 	l, err := net.Listen("tcp", *listenAddress)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal("Could not listen.", "address", *listenAddress, "err", err)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	go interruptHandler(l, quit)
+	go hupHandler(reloader)
+	h := withRoutePrefix(handler.Tenants(r, *tenantHeader, tenantHandlers), prefix)
+	h = basicAuth.Wrap(h)
+	err = newServer(*listenAddress, h, *readTimeout, *writeTimeout, *idleTimeout).Serve(l)
+	logging.Info("HTTP server stopped.", "err", err)
+	if grpcListener != nil {
+		grpcListener.Close()
 	}
-	go interruptHandler(l)
-	err = (&http.Server{Addr: *listenAddress, Handler: r}).Serve(l)
-	log.Print("HTTP server stopped: ", err)
 	// To give running connections a chance to submit their payload, we wait
 	// for 1sec, but we don't want to wait long (e.g. until all connections
 	// are done) to not delay the shutdown.
 	time.Sleep(time.Second)
 	if err := ms.Shutdown(); err != nil {
-		log.Print("Problem shutting down metric storage: ", err)
+		logging.Error("Problem shutting down metric storage.", "err", err)
+	}
+	for name, tms := range tenantStores {
+		if err := tms.Shutdown(); err != nil {
+			logging.Error("Problem shutting down metric storage.", "tenant", name, "err", err)
+		}
+	}
+	replicator.Close()
+	if err := forwarder.Close(); err != nil {
+		logging.Error("Problem saving pushes not forwarded yet.", "err", err)
+	}
+	if err := audit.Close(); err != nil {
+		logging.Error("Problem closing audit log.", "err", err)
+	}
+}
+
+// setPeerOptions sets the Forward and Replicate options of the store to the
+// given forwarder and replicator, unless they are nil (i.e. not configured).
+// Their method values would not be nil even then, so that the store would
+// encode and record every change for replication in vain.
+func setPeerOptions(opts *storage.DiskMetricStoreOptions, forwarder *handler.Forwarder, replicator *handler.Replicator) {
+	if forwarder != nil {
+		opts.Forward = forwarder.Forward
+	}
+	if replicator != nil {
+		opts.Replicate = replicator.Replicate
+	}
+}
+
+// tenantStoreOptions returns the persistence file and the options of the store
+// of the given tenant, derived from the persistence file and the options of
+// the default store. The persistence file and the write-ahead log of the
+// tenant are the ones of the default store with the tenant name appended, or
+// none if the default store has no persistence file. Deletions of the tenant
+// are not recorded in the audit log, and its writes are neither recorded in
+// the event log nor forwarded.
+func tenantStoreOptions(file string, opts storage.DiskMetricStoreOptions, tenant string) (string, storage.DiskMetricStoreOptions) {
+	opts.Tenant = tenant
+	opts.PersistenceRouting = nil
+	opts.AuditLog = nil
+	opts.EventLog = nil
+	opts.Forward = nil
+	if file == "" {
+		opts.WriteAheadLog = ""
+		return "", opts
+	}
+	if opts.WriteAheadLog != "" {
+		opts.WriteAheadLog += ".tenant-" + tenant
+	}
+	return file + ".tenant-" + tenant, opts
+}
+
+// normalizeRoutePrefix returns the given -web.route-prefix either empty or
+// starting (but not ending) with a slash.
+func normalizeRoutePrefix(prefix string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// withRoutePrefix returns a handler serving h below the given normalized
+// prefix (see normalizeRoutePrefix), with the prefix stripped from the paths
+// h sees, and 404 for paths outside of it. With an empty prefix, h is
+// returned.
+func withRoutePrefix(h http.Handler, prefix string) http.Handler {
+	if prefix == "" {
+		return h
+	}
+	mux := http.NewServeMux()
+	mux.Handle(prefix+"/", http.StripPrefix(prefix, h))
+	return mux
+}
+
+// newServer returns the HTTP server for h with the given read, write, and idle
+// timeouts (see the -web.read-timeout, -web.write-timeout, and
+// -web.idle-timeout flags), each 0 for none.
+func newServer(addr string, h http.Handler, readTimeout, writeTimeout, idleTimeout time.Duration) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      h,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+}
+
+// tlsVersions maps the names of the TLS versions as used by the web
+// configuration of Prometheus to their values.
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// parseCipherSuites returns the IDs of the comma-separated cipher suites, which
+// must not have known security issues. An empty list results in nil, i.e. the
+// default suites.
+func parseCipherSuites(list string) ([]uint16, error) {
+	if list == "" {
+		return nil, nil
+	}
+	byName := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		byName[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// loadTLSConfig returns the TLS configuration for the server, or nil if no
+// certificate is configured. With a client CA file, client certificates are
+// verified as given by clientAuth. (With tls.VerifyClientCertIfGiven,
+// requiring them is left to the handlers, so that reads still work without a
+// certificate.) The minimum version and the cipher
+// suites are validated even without a certificate, so that a typo is not only
+// noticed once HTTPS is enabled.
+func loadTLSConfig(certFile, keyFile, clientCAFile, minVersion, cipherSuites string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q, must be one of TLS10, TLS11, TLS12, TLS13", minVersion)
+	}
+	suites, err := parseCipherSuites(cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("a client CA file requires a server certificate and key")
+		}
+		return nil, nil
+	}
+	if version == tls.VersionTLS13 && suites != nil {
+		return nil, errors.New("cipher suites cannot be configured with a minimum TLS version of TLS13")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		CipherSuites: suites,
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", clientCAFile)
+		}
+		cfg.ClientAuth = clientAuth
+	}
+	return cfg, nil
+}
+
+// registerLifecycle registers the lifecycle endpoints on r if enabled (by
+// -web.enable-lifecycle), wrapped by admin: POST /-/reload, reloading the
+// configuration with reloader, and POST /-/quit, closing quit.
+func registerLifecycle(r *httprouter.Router, enabled bool, admin func(httprouter.Handle) httprouter.Handle, reloader *handler.Reloader, quit chan struct{}) {
+	if !enabled {
+		return
+	}
+	r.POST("/-/reload", admin(routerHandle(handler.InstrumentHandlerFunc("reload", reloader.Handler()))))
+	r.POST("/-/quit", admin(routerHandle(handler.InstrumentHandlerFunc("quit", handler.Quit(func() { close(quit) })))))
+}
+
+// routerHandle turns an http.Handler into an httprouter.Handle.
+func routerHandle(h http.Handler) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		h.ServeHTTP(w, r)
 	}
 }
 
@@ -104,10 +839,25 @@ func handlePprof(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	}
 }
 
-func interruptHandler(l net.Listener) {
-	notifier := make(chan os.Signal)
+// interruptHandler closes the listener upon SIGINT, SIGTERM, or the closing of
+// quit, which lets main shut down gracefully.
+func interruptHandler(l net.Listener, quit <-chan struct{}) {
+	notifier := make(chan os.Signal, 1)
 	signal.Notify(notifier, os.Interrupt, syscall.SIGTERM)
-	<-notifier
-	log.Print("Received SIGINT/SIGTERM; exiting gracefully...")
+	select {
+	case <-notifier:
+		logging.Info("Received SIGINT/SIGTERM; exiting gracefully...")
+	case <-quit:
+		logging.Info("Received POST /-/quit; exiting gracefully...")
+	}
 	l.Close()
 }
+
+func hupHandler(reloader *handler.Reloader) {
+	notifier := make(chan os.Signal, 1)
+	signal.Notify(notifier, syscall.SIGHUP)
+	for range notifier {
+		logging.Info("Received SIGHUP; reloading configuration...")
+		reloader.Reload()
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/julienschmidt/httprouter"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestSetPeerOptions(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer peer.Close()
+	replicator, err := handler.NewReplicator(peer.URL, 10, time.Second, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replicator.Close()
+	noReplicator, err := handler.NewReplicator("", 10, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	noForwarder, err := handler.NewForwarder("", 10, time.Second, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"job": "job1", "instance": "instance1"}
+	mf := &dto.MetricFamily{
+		Name: proto.String("mf1"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("job"), Value: proto.String("job1")},
+				{Name: proto.String("instance"), Value: proto.String("instance1")},
+			},
+			Untyped: &dto.Untyped{Value: proto.Float64(1)},
+		}},
+	}
+	// Only a store recording its changes for replication remembers the
+	// deletion of a group to hand it out in its snapshot.
+	for _, s := range []struct {
+		name       string
+		replicator *handler.Replicator
+		wantLen    int
+	}{
+		{"without peers", noReplicator, 0},
+		{"with a peer", replicator, 1},
+	} {
+		opts := storage.DiskMetricStoreOptions{}
+		setPeerOptions(&opts, noForwarder, s.replicator)
+		if opts.Forward != nil {
+			t.Errorf("%s: Forward set without forward URLs.", s.name)
+		}
+		if got := opts.Replicate != nil; got != (s.replicator != nil) {
+			t.Errorf("%s: Wanted Replicate set %v, got %v.", s.name, s.replicator != nil, got)
+		}
+		ms := storage.NewDiskMetricStore("", time.Minute, opts)
+		if err := ms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:         labels,
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ms.SubmitWriteRequest(storage.WriteRequest{Labels: labels, Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+		if expected, got := s.wantLen, len(ms.ReplicationSnapshot()); expected != got {
+			t.Errorf("%s: Wanted %d changes in the snapshot, got %d.", s.name, expected, got)
+		}
+		if err := ms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRegisterLifecycle(t *testing.T) {
+	admin := func(h httprouter.Handle) httprouter.Handle { return h }
+	for _, enabled := range []bool{false, true} {
+		reloads := 0
+		reloader := handler.NewReloader(func() error {
+			reloads++
+			return nil
+		})
+		quit := make(chan struct{})
+		r := httprouter.New()
+		registerLifecycle(r, enabled, admin, reloader, quit)
+
+		wantCode, wantReloads := http.StatusNotFound, 0
+		if enabled {
+			wantCode, wantReloads = http.StatusOK, 1
+		}
+		for _, path := range []string{"/-/reload", "/-/quit"} {
+			req, err := http.NewRequest("POST", "http://example.org"+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if expected, got := wantCode, w.Code; expected != got {
+				t.Errorf("Enabled %v, %s: Wanted status code %d, got %d.", enabled, path, expected, got)
+			}
+		}
+		if expected, got := wantReloads, reloads; expected != got {
+			t.Errorf("Enabled %v: Wanted %d reloads, got %d.", enabled, expected, got)
+		}
+		select {
+		case <-quit:
+			if !enabled {
+				t.Errorf("Quit without -web.enable-lifecycle.")
+			}
+		default:
+			if enabled {
+				t.Errorf("No quit with -web.enable-lifecycle.")
+			}
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	for _, s := range []struct {
+		list    string
+		want    []uint16
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, false},
+		{
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			false,
+		},
+		{"TLS_NO_SUCH_SUITE", nil, true},
+		// Suites with known security issues are rejected, too.
+		{"TLS_RSA_WITH_RC4_128_SHA", nil, true},
+		{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_RSA_WITH_RC4_128_SHA", nil, true},
+	} {
+		got, err := parseCipherSuites(s.list)
+		if s.wantErr != (err != nil) {
+			t.Errorf("%q: Wanted error %v, got %v.", s.list, s.wantErr, err)
+		}
+		if !reflect.DeepEqual(s.want, got) {
+			t.Errorf("%q: Wanted %v, got %v.", s.list, s.want, got)
+		}
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pushgateway.TestLoadTLSConfig.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	for _, s := range []struct {
+		name                string
+		certFile, keyFile   string
+		minVersion, suites  string
+		wantConfig, wantErr bool
+	}{
+		{"no certificate", "", "", "TLS12", "", false, false},
+		{"no certificate, valid suite", "", "", "TLS12", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", false, false},
+		// The flags are validated even without a certificate.
+		{"no certificate, unknown version", "", "", "TLS14", "", false, true},
+		{"no certificate, unknown suite", "", "", "TLS12", "TLS_NO_SUCH_SUITE", false, true},
+		{"no certificate, insecure suite", "", "", "TLS12", "TLS_RSA_WITH_RC4_128_SHA", false, true},
+		{"certificate", certFile, keyFile, "TLS12", "", true, false},
+		{"certificate, valid suite", certFile, keyFile, "TLS12", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", true, false},
+		{"certificate, insecure suite", certFile, keyFile, "TLS12", "TLS_RSA_WITH_RC4_128_SHA", false, true},
+		{"certificate, TLS13", certFile, keyFile, "TLS13", "", true, false},
+		{"certificate, TLS13 with suites", certFile, keyFile, "TLS13", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", false, true},
+	} {
+		cfg, err := loadTLSConfig(s.certFile, s.keyFile, "", s.minVersion, s.suites, tls.VerifyClientCertIfGiven)
+		if s.wantErr != (err != nil) {
+			t.Errorf("%s: Wanted error %v, got %v.", s.name, s.wantErr, err)
+		}
+		if s.wantConfig != (cfg != nil) {
+			t.Errorf("%s: Wanted config %v, got %v.", s.name, s.wantConfig, cfg)
+		}
+		if cfg == nil {
+			continue
+		}
+		if expected, got := tlsVersions[s.minVersion], cfg.MinVersion; expected != got {
+			t.Errorf("%s: Wanted minimum version %x, got %x.", s.name, expected, got)
+		}
+		if suites, _ := parseCipherSuites(s.suites); !reflect.DeepEqual(suites, cfg.CipherSuites) {
+			t.Errorf("%s: Wanted cipher suites %v, got %v.", s.name, suites, cfg.CipherSuites)
+		}
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir and
+// returns the names of the files.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+	})
+	server := newServer(":9091", h, 50*time.Millisecond, time.Second, 2*time.Second)
+	if server.Addr != ":9091" || server.ReadTimeout != 50*time.Millisecond || server.WriteTimeout != time.Second || server.IdleTimeout != 2*time.Second {
+		t.Fatalf("Unexpected server %+v.", server)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	// A client that stops sending in the middle of a push is
+	// disconnected once the read timeout has passed.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("PUT /metrics/job/slow HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\nsome_metric")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("Expected the server to close the connection, got %v.", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connection closed after %v, expected the read timeout to apply.", elapsed)
+	}
+
+	// A complete request is answered.
+	resp, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if expected, got := http.StatusOK, resp.StatusCode; expected != got {
+		t.Errorf("Wanted status code %d, got %d.", expected, got)
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	})
+	for _, s := range []struct {
+		flag, prefix string
+		paths        map[string]int // Requested path to status code.
+	}{
+		{"", "", map[string]int{"/metrics": http.StatusOK}},
+		{"/", "", map[string]int{"/metrics": http.StatusOK}},
+		{"pushgateway", "/pushgateway", map[string]int{"/pushgateway/metrics": http.StatusOK, "/metrics": http.StatusNotFound}},
+		{"/pushgateway/", "/pushgateway", map[string]int{"/pushgateway/metrics": http.StatusOK, "/pushgatewaymetrics": http.StatusNotFound}},
+		{"/a/b", "/a/b", map[string]int{"/a/b/metrics": http.StatusOK, "/a/metrics": http.StatusNotFound}},
+	} {
+		prefix := normalizeRoutePrefix(s.flag)
+		if prefix != s.prefix {
+			t.Errorf("%q: Wanted prefix %q, got %q.", s.flag, s.prefix, prefix)
+		}
+		ph := withRoutePrefix(h, prefix)
+		for path, code := range s.paths {
+			req, err := http.NewRequest("GET", "http://example.org"+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			ph.ServeHTTP(w, req)
+			if w.Code != code {
+				t.Errorf("%q, %s: Wanted status code %d, got %d.", s.flag, path, code, w.Code)
+			}
+			// The handler sees the path without the prefix.
+			if code == http.StatusOK && w.Body.String() != "/metrics" {
+				t.Errorf("%q, %s: Wanted path /metrics, got %q.", s.flag, path, w.Body.String())
+			}
+		}
+	}
+}
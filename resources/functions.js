@@ -1,10 +1,11 @@
 // Namespace.
 var pushgateway = {};
 
-pushgateway.jobName = '';
-pushgateway.jobPanel = null;
-pushgateway.instanceName = '';
-pushgateway.instancePanel = null;
+// Set by the status page.
+pushgateway.routePrefix = '';
+
+pushgateway.groupPath = '';
+pushgateway.groupPanel = null;
 
 pushgateway.switchToMetrics = function(){
     $('#metrics-div').removeClass('hidden');
@@ -20,53 +21,124 @@ pushgateway.switchToStatus = function(){
     $('#status-li').addClass('active');
 }
 
-pushgateway.showJobModal = function(jobName, jobPanelID, event){
+pushgateway.showGroupModal = function(group, groupPath, groupPanelID, event){
     event.stopPropagation(); // Don't trigger accordion collapse.
-    pushgateway.jobName = jobName;
-    pushgateway.jobPanel = $('#' + jobPanelID);
-    $('#del-job-modal-msg').text(
-	'Do you really want to delete all metrics of job="' + jobName + '"?'
+    pushgateway.groupPath = groupPath;
+    pushgateway.groupPanel = $('#' + groupPanelID);
+    $('#del-group-modal-msg').text(
+	'Do you really want to delete all metrics of ' + group + '?'
     );
-    $('#del-job-modal').modal('show');
+    $('#del-group-modal').modal('show');
 }
 
-pushgateway.showInstanceModal = function(jobName, instanceName, instancePanelID, event){
-    event.stopPropagation(); // Don't trigger accordion collapse.
-    pushgateway.jobName = jobName;
-    pushgateway.instanceName = instanceName;
-    pushgateway.instancePanel = $('#' + instancePanelID);
-    $('#del-instance-modal-msg').text(
-	'Do you really want to delete all metrics of job="' + jobName +
-	    '", instance="' + instanceName + '"?'
-    );
-    $('#del-instance-modal').modal('show');
-}
-
-pushgateway.deleteJob = function(){
+pushgateway.deleteGroup = function(){
     $.ajax({
 	type: 'DELETE',
-	url: '/metrics/jobs/' + pushgateway.jobName,
+	url: pushgateway.routePrefix + pushgateway.groupPath,
 	success: function(data, textStatus, jqXHR) {
-	    pushgateway.jobPanel.remove();
-	    $('#del-job-modal').modal('hide');
+	    pushgateway.groupPanel.remove();
+	    $('#del-group-modal').modal('hide');
 	},
 	error: function(jqXHR, textStatus, error) {
-	    alert('Deleting job failed: ' + error);
+	    alert('Deleting group failed: ' + error);
 	}
     });
 }
 
-pushgateway.deleteInstance = function(){
+// Shows or hides the metric families of the group with the given selector (see
+// storage.FormatGroup) and grouping labels (as a list of {Name, Value}) in the
+// row with the given ID, loading them from the JSON API when shown.
+pushgateway.toggleDetails = function(selector, labels, rowID){
+    var row = $('#' + rowID);
+    if (!row.hasClass('hidden')) {
+	row.addClass('hidden');
+	return;
+    }
+    var cell = row.children('td').first();
+    cell.text('Loading...');
+    row.removeClass('hidden');
     $.ajax({
-	type: 'DELETE',
-	url: '/metrics/jobs/' + escape(pushgateway.jobName) +
-	    '/instances/' + escape(pushgateway.instanceName),
+	type: 'GET',
+	url: pushgateway.routePrefix + '/api/v1/metrics',
+	data: {'match[]': selector},
+	dataType: 'json',
 	success: function(data, textStatus, jqXHR) {
-	    pushgateway.instancePanel.remove();
-	    $('#del-instance-modal').modal('hide');
+	    // The selector also matches groups with further grouping
+	    // labels.
+	    var groups = $.grep(data.data.groups, function(g){
+		return pushgateway.sameGroup(g, labels);
+	    });
+	    cell.empty();
+	    if (groups.length === 0) {
+		cell.text('The group does not exist anymore.');
+		return;
+	    }
+	    $.each(groups[0].metric_families, function(i, mf){
+		cell.append(pushgateway.renderMetricFamily(mf));
+	    });
 	},
 	error: function(jqXHR, textStatus, error) {
-	    alert('Deleting instance failed: ' + error);
+	    cell.text('Loading metrics failed: ' + error);
+	}
+    });
+}
+
+// Returns whether the group returned by the JSON API has exactly the given
+// grouping labels.
+pushgateway.sameGroup = function(g, labels){
+    var want = {};
+    $.each(labels, function(i, l){ want[l.Name] = l.Value; });
+    var got = $.extend({job: g.job, instance: g.instance}, g.labels);
+    if (!('instance' in want)) {
+	want.instance = '';
+    }
+    if (Object.keys(want).length !== Object.keys(got).length) {
+	return false;
+    }
+    for (var name in want) {
+	if (got[name] !== want[name]) {
+	    return false;
+	}
+    }
+    return true;
+}
+
+pushgateway.renderMetricFamily = function(mf){
+    var panel = $('<div class="panel panel-default">');
+    var heading = $('<div class="panel-heading">').appendTo(panel);
+    heading.append($('<strong>').text(mf.name), ' ');
+    if (mf.help) {
+	heading.append($('<span class="badge">').text(mf.help), ' ');
+    }
+    heading.append($('<span class="label label-success">').text(mf.type), ' ');
+    heading.append(document.createTextNode('last pushed: ' + mf.last_push));
+    var table = $('<table class="table table-condensed table-striped">').appendTo(panel);
+    table.append('<thead><tr><th>Labels</th><th>Value</th><th>Timestamp</th></tr></thead>');
+    var body = $('<tbody>').appendTo(table);
+    $.each(mf.metrics, function(i, m){
+	var labels = $('<td>');
+	$.each(Object.keys(m.labels).sort(), function(i, name){
+	    var cls = name === 'job' ? 'label-warning' : name === 'instance' ? 'label-primary' : 'label-info';
+	    labels.append($('<span class="label">').addClass(cls).text(name + '="' + m.labels[name] + '"'), ' ');
+	});
+	var value = $('<td>');
+	if (m.value !== undefined) {
+	    value.text(m.value);
+	} else {
+	    var rows = [];
+	    $.each(m.quantiles || {}, function(q, v){ rows.push(['Quantile ' + q, v]); });
+	    $.each(m.buckets || {}, function(le, c){ rows.push(['Sample values \u2264 ' + le, c]); });
+	    rows.push(['Sample count', m.count], ['Sample sum', m.sum]);
+	    var t = $('<table class="table table-condensed">').appendTo(value);
+	    $.each(rows, function(i, r){
+		t.append($('<tr>').append($('<th scope="row">').text(r[0]), $('<td>').text(r[1])));
+	    });
+	}
+	var ts = $('<td>');
+	if (m.timestamp_ms) {
+	    ts.text(new Date(m.timestamp_ms).toISOString());
 	}
+	body.append($('<tr>').append(labels, value, ts));
     });
+    return panel;
 }
@@ -0,0 +1,152 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// maxAggregationEntries is the maximum number of pushes retained per metric
+// family for a windowed aggregation. Older pushes are dropped even if they are
+// still within the window.
+const maxAggregationEntries = 1000
+
+// AggregationFunc is the function used by an Aggregation.
+type AggregationFunc int
+
+// The available AggregationFuncs.
+const (
+	AggregateMax AggregationFunc = iota
+	AggregateSum
+)
+
+// Aggregation requests that the values of a gauge (or untyped metric) are
+// aggregated over all pushes within Window (counting back from the time of
+// reading) instead of only exposing the value of the most recent push. The
+// most recent push is always part of the aggregation, even if it is older than
+// Window. Series are identified by their labels.
+type Aggregation struct {
+	Func   AggregationFunc
+	Window time.Duration
+}
+
+// aggregationHistory is the history of pushes of one metric family (in one
+// group) pushed with the same Aggregation. It is never modified once created,
+// so that it can be shared between copies of a TimestampedMetricFamily.
+type aggregationHistory struct {
+	Aggregation
+	entries []TimestampedMetricFamily // Oldest first.
+}
+
+// add returns a new aggregationHistory with tmf appended for the given
+// Aggregation. Entries of h are carried over if h was created with the same
+// Aggregation and they are still within the window at the time of tmf.
+func (h *aggregationHistory) add(a Aggregation, tmf TimestampedMetricFamily) *aggregationHistory {
+	result := &aggregationHistory{Aggregation: a}
+	if h != nil && h.Aggregation == a {
+		cutoff := tmf.Timestamp.Add(-a.Window)
+		for _, e := range h.entries {
+			if e.Timestamp.After(cutoff) {
+				result.entries = append(result.entries, e)
+			}
+		}
+	}
+	tmf.aggregation = nil
+	result.entries = append(result.entries, tmf)
+	if len(result.entries) > maxAggregationEntries {
+		result.entries = result.entries[len(result.entries)-maxAggregationEntries:]
+	}
+	return result
+}
+
+// aggregate returns the aggregated MetricFamily as of the given time.
+func (h *aggregationHistory) aggregate(now time.Time) *dto.MetricFamily {
+	latest := h.entries[len(h.entries)-1].MetricFamily
+	cutoff := now.Add(-h.Window)
+	type series struct {
+		metric *dto.Metric
+		value  float64
+	}
+	bySignature := map[string]*series{}
+	order := []string{}
+	// Go backwards so that labels and timestamps of the most recent push
+	// win.
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if i < len(h.entries)-1 && !e.Timestamp.After(cutoff) {
+			break
+		}
+		for _, m := range e.MetricFamily.GetMetric() {
+			v := m.GetGauge().GetValue()
+			if m.Untyped != nil {
+				v = m.GetUntyped().GetValue()
+			}
+			sig := labelsSignature(m.GetLabel())
+			s, ok := bySignature[sig]
+			switch {
+			case !ok:
+				bySignature[sig] = &series{metric: m, value: v}
+				order = append(order, sig)
+			case h.Func == AggregateSum:
+				s.value += v
+			case v > s.value:
+				s.value = v
+			}
+		}
+	}
+
+	result := &dto.MetricFamily{
+		Name: latest.Name,
+		Help: latest.Help,
+		Type: latest.Type,
+	}
+	for _, sig := range order {
+		s := bySignature[sig]
+		m := proto.Clone(s.metric).(*dto.Metric)
+		if m.Untyped != nil {
+			m.Untyped.Value = proto.Float64(s.value)
+		} else {
+			m.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+		}
+		result.Metric = append(result.Metric, m)
+	}
+	return result
+}
+
+// resolve returns tmf with the MetricFamily replaced by the aggregated one as
+// of the given time if tmf has an aggregation history. Otherwise, tmf is
+// returned unchanged.
+func (tmf TimestampedMetricFamily) resolve(now time.Time) TimestampedMetricFamily {
+	if tmf.aggregation == nil {
+		return tmf
+	}
+	tmf.MetricFamily = tmf.aggregation.aggregate(now)
+	return tmf
+}
+
+func labelsSignature(lps []*dto.LabelPair) string {
+	parts := make([]string, 0, len(lps))
+	for _, lp := range lps {
+		parts = append(parts, lp.GetName()+"="+strconv.Quote(lp.GetValue()))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
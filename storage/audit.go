@@ -0,0 +1,190 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+// The reasons for the deletion of a group recorded in the AuditLog.
+const (
+	// DeletionDelete is a delete request for the group or its job.
+	DeletionDelete = "delete"
+	// DeletionReplace is a replacing push without any metrics.
+	DeletionReplace = "replace"
+	// DeletionMetricNames is a push deleting all remaining metrics of the
+	// group, see WriteRequest.MetricNames.
+	DeletionMetricNames = "metric_names"
+	// DeletionDeleteGroups is a call of MetricStore.DeleteGroups.
+	DeletionDeleteGroups = "delete_groups"
+	// DeletionReset is a call of MetricStore.Reset.
+	DeletionReset = "reset"
+	// DeletionRestore is a call of MetricStore.Restore replacing all
+	// groups.
+	DeletionRestore = "restore"
+	// DeletionEviction is an eviction because of the size limit.
+	DeletionEviction = "eviction"
+	// DeletionExpiration is an expiry of a group not pushed to for
+	// longer than its expiration.
+	DeletionExpiration = "expiration"
+)
+
+// AuditFormat is the format of the records in an AuditLog.
+type AuditFormat int
+
+// The available AuditFormat values.
+const (
+	// AuditText writes one line of key=value pairs per record.
+	AuditText AuditFormat = iota
+	// AuditJSON writes one JSON object per line.
+	AuditJSON
+)
+
+var auditFormatNames = map[string]AuditFormat{
+	"text": AuditText,
+	"json": AuditJSON,
+}
+
+// ParseAuditFormat returns the AuditFormat with the given name, i.e. "text" or
+// "json".
+func ParseAuditFormat(s string) (AuditFormat, error) {
+	if f, ok := auditFormatNames[s]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("unknown audit log format %q", s)
+}
+
+// auditRecord describes the deletion of a group.
+type auditRecord struct {
+	Time     time.Time         `json:"time"`
+	Reason   string            `json:"reason"`
+	Labels   map[string]string `json:"labels"`
+	Origin   string            `json:"origin"`
+	LastPush time.Time         `json:"last_push"`
+}
+
+func (r auditRecord) format(f AuditFormat) ([]byte, error) {
+	if f == AuditJSON {
+		b, err := json.Marshal(r)
+		return append(b, '\n'), err
+	}
+	return []byte(fmt.Sprintf(
+		"time=%s reason=%s labels=%s origin=%q last_push=%s\n",
+		r.Time.UTC().Format(time.RFC3339Nano), r.Reason, FormatGroup(r.Labels), r.Origin, r.LastPush.UTC().Format(time.RFC3339Nano),
+	)), nil
+}
+
+// AuditLog is an append-only file recording every deletion of a group from a
+// DiskMetricStore, no matter its source (see the Deletion... constants).
+// Once the file would exceed its maximum size, it is renamed by appending
+// ".1" (replacing an older file of that name), and a new file is started. It
+// is safe for concurrent use. A nil *AuditLog records nothing.
+type AuditLog struct {
+	mtx      sync.Mutex
+	file     string
+	format   AuditFormat
+	maxBytes int64
+	f        *os.File
+	size     int64
+}
+
+// OpenAuditLog opens (or creates) the given file for appending audit records in
+// the given format. A maxBytes of 0 or less means that the file is never
+// rotated.
+func OpenAuditLog(file string, format AuditFormat, maxBytes int64) (*AuditLog, error) {
+	l := &AuditLog{file: file, format: format, maxBytes: maxBytes}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, fi.Size()
+	return nil
+}
+
+// record appends the given record. Errors are logged, as a deletion cannot be
+// undone anymore at this point.
+func (l *AuditLog) record(r auditRecord) {
+	if l == nil {
+		return
+	}
+	b, err := r.format(l.format)
+	if err != nil {
+		logging.Error("Error formatting audit record.", "err", err)
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.maxBytes > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxBytes {
+		if err := l.rotate(); err != nil {
+			logging.Error("Error rotating audit log.", "err", err)
+		}
+	}
+	if l.f == nil {
+		logging.Error("Audit log not open, dropping record.", "record", string(b))
+		return
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		logging.Error("Error writing audit record.", "err", err)
+	}
+}
+
+func (l *AuditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		logging.Error("Error closing audit log.", "err", err)
+	}
+	l.f = nil
+	if err := os.Rename(l.file, l.file+".1"); err != nil {
+		// Keep appending to the current file rather than losing records.
+		if openErr := l.open(); openErr != nil {
+			return fmt.Errorf("%s, and reopening failed: %s", err, openErr)
+		}
+		return err
+	}
+	return l.open()
+}
+
+// Close closes the underlying file.
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,135 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// checkConsistency returns an error for the first metric of the write request
+// that would make the metrics returned by GetMetricFamilies fail a scrape as a
+// whole (see DiskMetricStoreOptions.CheckConsistency): an invalid metric or
+// label name, a label value that is not valid UTF-8, a label reserved for
+// summaries or histograms ("quantile" or "le"), a metric without a value of
+// the type of its metric family, the same series more than once, or label
+// names inconsistent with the other metrics of the same name, in the push or
+// in other groups, or a type different from the metric family of the same
+// name in other groups. Grouping labels (of any group) and the ingestion time
+// label are not taken into account for the label names, as they are padded or
+// set on all metrics anyway. The caller must hold the lock.
+func (dms *DiskMetricStore) checkConsistency(req WriteRequest) error {
+	key := GroupingKeyFor(req.Labels)
+	names := make([]string, 0, len(req.MetricFamilies))
+	for name := range req.MetricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mf := req.MetricFamilies[name]
+		if !metricNameRE.MatchString(name) {
+			return fmt.Errorf("invalid metric name %q", name)
+		}
+		dims := ""
+		seen := make(map[string]bool, len(mf.GetMetric()))
+		for i, m := range mf.GetMetric() {
+			sig := labelsSignature(m.GetLabel())
+			if err := checkMetric(mf.GetType(), m); err != nil {
+				return fmt.Errorf("series %s{%s}: %s", name, sig, err)
+			}
+			if seen[sig] {
+				return fmt.Errorf("series %s{%s} pushed more than once", name, sig)
+			}
+			seen[sig] = true
+			d := dms.dimensions(m, req.Labels, nil)
+			if i == 0 {
+				dims = d
+				continue
+			}
+			if d != dims {
+				return fmt.Errorf("series %s{%s} has the label names (%s), but other series of the push have (%s)", name, sig, d, dims)
+			}
+		}
+		if len(mf.GetMetric()) == 0 {
+			continue
+		}
+		for k, group := range dms.metricFamilies {
+			tmf, ok := group.Metrics[name]
+			if !ok || len(tmf.MetricFamily.GetMetric()) == 0 {
+				continue
+			}
+			if k == key && (req.Replace || req.Merge == MergeLast || tmf.MetricFamily.GetType() != mf.GetType()) {
+				// The stored metric family is replaced.
+				continue
+			}
+			if t := tmf.MetricFamily.GetType(); t != mf.GetType() {
+				return fmt.Errorf("metric %q pushed as %s, but stored as %s by group %s", name, mf.GetType(), t, FormatGroup(group.Labels))
+			}
+			if d := dms.dimensions(tmf.MetricFamily.GetMetric()[0], req.Labels, group.Labels); d != dims {
+				return fmt.Errorf("metric %q pushed with the label names (%s), but stored with (%s) by group %s", name, dims, d, FormatGroup(group.Labels))
+			}
+		}
+	}
+	return nil
+}
+
+// checkMetric returns an error if m is not a valid metric of a metric family
+// of the given type.
+func checkMetric(t dto.MetricType, m *dto.Metric) error {
+	for _, lp := range m.GetLabel() {
+		ln := lp.GetName()
+		if !labelNameRE.MatchString(ln) {
+			return fmt.Errorf("invalid label name %q", ln)
+		}
+		if !utf8.ValidString(lp.GetValue()) {
+			return fmt.Errorf("value of label %q is not valid UTF-8", ln)
+		}
+		if t == dto.MetricType_SUMMARY && ln == "quantile" || t == dto.MetricType_HISTOGRAM && ln == "le" {
+			return fmt.Errorf("label %q is reserved for %s metrics", ln, strings.ToLower(t.String()))
+		}
+	}
+	if t == dto.MetricType_GAUGE && m.Gauge == nil ||
+		t == dto.MetricType_COUNTER && m.Counter == nil ||
+		t == dto.MetricType_SUMMARY && m.Summary == nil ||
+		t == dto.MetricType_HISTOGRAM && m.Histogram == nil ||
+		t == dto.MetricType_UNTYPED && m.Untyped == nil {
+		return fmt.Errorf("no %s value", strings.ToLower(t.String()))
+	}
+	return nil
+}
+
+// dimensions returns the sorted label names of m, separated by commas, leaving
+// out the names of the given grouping labels and the ingestion time label.
+func (dms *DiskMetricStore) dimensions(m *dto.Metric, grouping, otherGrouping map[string]string) string {
+	names := make([]string, 0, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		ln := lp.GetName()
+		if _, ok := grouping[ln]; ok {
+			continue
+		}
+		if _, ok := otherGrouping[ln]; ok || ln == dms.ingestionLabel {
+			continue
+		}
+		names = append(names, ln)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
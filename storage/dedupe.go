@@ -0,0 +1,177 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// minContentPoolSize is the number of entries in a contentPool below which it
+// is never rebuilt.
+const minContentPoolSize = 4096
+
+// contentPool shares identical parts of stored metric families, keyed by their
+// content: help strings, label pairs, and the values of metrics (gauges,
+// counters, untyped, summaries, histograms). Typically, most of those are
+// the same across groups of templated jobs, even though the metric families
+// differ by their grouping labels. Shared parts must never be
+// modified, which is already required for all stored metric families (see
+// MetricStore.GetMetricFamiliesMap).
+//
+// Entries are not removed when the last metric family referencing them is
+// deleted. Instead, the pool is rebuilt from the stored metric families once
+// it has grown to twice its size after the previous rebuild.
+type contentPool struct {
+	lock       sync.Mutex // Pushes are deduplicated without holding the store's lock.
+	strings    map[string]*string
+	labelPairs map[string]*dto.LabelPair
+	values     map[string]proto.Message
+	rebuildAt  int
+}
+
+func newContentPool() *contentPool {
+	return &contentPool{
+		strings:    map[string]*string{},
+		labelPairs: map[string]*dto.LabelPair{},
+		values:     map[string]proto.Message{},
+		rebuildAt:  minContentPoolSize,
+	}
+}
+
+func (p *contentPool) size() int {
+	return len(p.strings) + len(p.labelPairs) + len(p.values)
+}
+
+// dedupe replaces the parts of the given metric families by equal parts
+// already in the pool, or adds them to the pool. The metric families must not
+// be shared with anything yet, i.e. they have to be freshly pushed.
+func (p *contentPool) dedupe(metricFamilies map[string]*dto.MetricFamily) {
+	for _, mf := range metricFamilies {
+		p.dedupeMetricFamily(mf)
+	}
+}
+
+func (p *contentPool) dedupeMetricFamily(mf *dto.MetricFamily) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if mf.Help != nil {
+		mf.Help = p.string(*mf.Help)
+	}
+	for _, m := range mf.GetMetric() {
+		for i, lp := range m.GetLabel() {
+			m.Label[i] = p.labelPair(lp)
+		}
+		switch {
+		case m.Gauge != nil:
+			m.Gauge = p.value("g", m.Gauge).(*dto.Gauge)
+		case m.Counter != nil:
+			m.Counter = p.value("c", m.Counter).(*dto.Counter)
+		case m.Untyped != nil:
+			m.Untyped = p.value("u", m.Untyped).(*dto.Untyped)
+		case m.Summary != nil:
+			m.Summary = p.value("s", m.Summary).(*dto.Summary)
+		case m.Histogram != nil:
+			m.Histogram = p.value("h", m.Histogram).(*dto.Histogram)
+		}
+	}
+}
+
+func (p *contentPool) string(s string) *string {
+	if shared, ok := p.strings[s]; ok {
+		return shared
+	}
+	shared := proto.String(s)
+	p.strings[s] = shared
+	return shared
+}
+
+func (p *contentPool) labelPair(lp *dto.LabelPair) *dto.LabelPair {
+	key := lp.GetName() + "\xff" + lp.GetValue()
+	if shared, ok := p.labelPairs[key]; ok {
+		return shared
+	}
+	p.labelPairs[key] = lp
+	return lp
+}
+
+// value returns the pooled message equal to msg. The kind is part of the key
+// as messages of different types might marshal to the same bytes.
+func (p *contentPool) value(kind string, msg proto.Message) proto.Message {
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		// Cannot happen for the types used here, but not sharing is
+		// always safe.
+		return msg
+	}
+	key := kind + string(buf)
+	if shared, ok := p.values[key]; ok {
+		return shared
+	}
+	p.values[key] = msg
+	return msg
+}
+
+// maybeRebuild rebuilds the pool from the given stored metric families if it
+// has grown too large, dropping all entries not referenced anymore. The
+// stored metric families are not modified.
+func (p *contentPool) maybeRebuild(groups GroupingKeyToMetricGroup) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.size() < p.rebuildAt {
+		return
+	}
+	p.strings = map[string]*string{}
+	p.labelPairs = map[string]*dto.LabelPair{}
+	p.values = map[string]proto.Message{}
+	for _, group := range groups {
+		for _, tmf := range group.Metrics {
+			p.register(tmf.MetricFamily)
+		}
+	}
+	p.rebuildAt = 2 * p.size()
+	if p.rebuildAt < minContentPoolSize {
+		p.rebuildAt = minContentPoolSize
+	}
+}
+
+// register adds the parts of the given metric family to the pool where no
+// equal part is pooled yet, without modifying the metric family.
+func (p *contentPool) register(mf *dto.MetricFamily) {
+	if mf.Help != nil {
+		if _, ok := p.strings[*mf.Help]; !ok {
+			p.strings[*mf.Help] = mf.Help
+		}
+	}
+	for _, m := range mf.GetMetric() {
+		for _, lp := range m.GetLabel() {
+			p.labelPair(lp)
+		}
+		switch {
+		case m.Gauge != nil:
+			p.value("g", m.Gauge)
+		case m.Counter != nil:
+			p.value("c", m.Counter)
+		case m.Untyped != nil:
+			p.value("u", m.Untyped)
+		case m.Summary != nil:
+			p.value("s", m.Summary)
+		case m.Histogram != nil:
+			p.value("h", m.Histogram)
+		}
+	}
+}
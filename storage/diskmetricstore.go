@@ -14,326 +14,2624 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/gob"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
-	"log"
+	"math"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/text"
 
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+const (
+	// writeQueueCapacity is the default of
+	// DiskMetricStoreOptions.QueueLength.
+	writeQueueCapacity = 1000
+
+	// expirationSweepInterval is how often groups are checked for
+	// expiry, see DiskMetricStoreOptions.Expiration.
+	expirationSweepInterval = 10 * time.Second
+
+	// loopStallTimeout is how long loop() may go without an iteration
+	// before the DiskMetricStore is reported as unhealthy. As the
+	// expiration sweep alone makes loop() iterate every
+	// expirationSweepInterval, it is only exceeded if loop() is stuck.
+	loopStallTimeout = time.Minute
+
+	// GroupSeriesCountName is the name of the synthetic metric reporting
+	// the number of metrics in each group, see
+	// DiskMetricStoreOptions.GroupSeriesCount.
+	GroupSeriesCountName = "group_series_count"
+	// GroupContentHashName is the name of the synthetic metric reporting
+	// a hash of the content of each group, see
+	// DiskMetricStoreOptions.GroupContentHash.
+	GroupContentHashName = "group_content_hash"
+	// GroupUpName is the name of the synthetic metric reporting whether
+	// each group has been pushed to recently, see
+	// DiskMetricStoreOptions.GroupUpFreshness.
+	GroupUpName = "up"
+	// PushTimeName and PushFailureTimeName are the names of the synthetic
+	// metrics reporting the time of the last successful and the last
+	// failed push to each group, see DiskMetricStoreOptions.PushTime.
+	PushTimeName        = "push_time_seconds"
+	PushFailureTimeName = "push_failure_time_seconds"
+)
+
+var writeRequestLatency = prometheus.NewSummary(prometheus.SummaryOpts{
+	Namespace: "pushgateway",
+	Name:      "write_request_latency_seconds",
+	Help:      "Time from submitting a write request to the metric store until it has been processed.",
+})
+
+var (
+	groupsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pushgateway",
+		Name:      "groups",
+		Help:      "Number of groups (distinct sets of grouping labels) currently stored.",
+	})
+	groupsLimitGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pushgateway",
+		Name:      "groups_limit",
+		Help:      "Maximum number of groups that can be stored, 0 means unlimited.",
+	})
+	storeBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pushgateway",
+		Name:      "store_bytes",
+		Help:      "Estimated size of all stored metrics, as the sum of the serialized sizes of the stored metric families.",
+	})
+	storeBytesLimitGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pushgateway",
+		Name:      "store_bytes_limit",
+		Help:      "Estimated size of the stored metrics beyond which groups are evicted, 0 means unlimited.",
+	})
+	evictedGroups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pushgateway",
+		Name:      "evicted_groups_total",
+		Help:      "Total number of groups evicted because the estimated size of the stored metrics exceeded the limit, or the number of groups or metric families did with the evict limit policy.",
+	})
+	expiredGroups = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pushgateway",
+		Name:      "expired_groups_total",
+		Help:      "Total number of groups deleted because they had not been pushed to within their expiration.",
+	})
+)
+
+var helpConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "pushgateway",
+	Name:      "help_conflicts_total",
+	Help:      "Total number of conflicting help strings encountered while merging metric families of the same name for exposition.",
+})
+
+var rejectedWriteRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "pushgateway",
+		Name:      "rejected_pushes_total",
+		Help:      "Total number of pushes rejected by the checks of the store, by reason.",
+	},
+	[]string{"reason"},
+)
+
+var (
+	persistDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "pushgateway",
+		Name:      "persist_duration_seconds",
+		Help:      "Time it took to write all persistence files, including failed attempts.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+	})
+	persistErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pushgateway",
+		Name:      "persist_errors_total",
+		Help:      "Total number of persists that failed to write at least one persistence file.",
+	})
+)
+
+// storeDescs are the descriptors of the metrics collected by a DiskMetricStore
+// itself, see DiskMetricStore.Collect. The descriptors of groups and bytes are
+// nil for the DiskMetricStore without tenant, which sets groupsGauge and
+// storeBytesGauge instead.
+type storeDescs struct {
+	writeQueueLength, writeQueueCapacity, metricFamilies, groups, bytes *prometheus.Desc
+}
+
+var defaultStoreDescs = storeDescs{
+	writeQueueLength: prometheus.NewDesc(
+		"pushgateway_write_queue_length",
+		"Number of write requests submitted but not yet processed.",
+		nil, nil,
+	),
+	writeQueueCapacity: prometheus.NewDesc(
+		"pushgateway_write_queue_capacity",
+		"Number of write requests that can wait for processing before further requests are rejected.",
+		nil, nil,
+	),
+	metricFamilies: prometheus.NewDesc(
+		"pushgateway_metric_families",
+		"Number of metric families currently stored, summed over all groups.",
+		nil, nil,
+	),
+}
+
+// newTenantStoreDescs returns the descriptors of the metrics of the
+// DiskMetricStore of the given tenant. They have names of their own, as the
+// label dimensions of a metric name have to be the same throughout.
+func newTenantStoreDescs(tenant string) storeDescs {
+	labels := prometheus.Labels{"tenant": tenant}
+	return storeDescs{
+		writeQueueLength: prometheus.NewDesc(
+			"pushgateway_tenant_write_queue_length",
+			"Number of write requests of the tenant submitted but not yet processed.",
+			nil, labels,
+		),
+		writeQueueCapacity: prometheus.NewDesc(
+			"pushgateway_tenant_write_queue_capacity",
+			"Number of write requests of the tenant that can wait for processing before further requests are rejected.",
+			nil, labels,
+		),
+		metricFamilies: prometheus.NewDesc(
+			"pushgateway_tenant_metric_families",
+			"Number of metric families of the tenant currently stored, summed over all groups.",
+			nil, labels,
+		),
+		groups: prometheus.NewDesc(
+			"pushgateway_tenant_groups",
+			"Number of groups (distinct sets of grouping labels) of the tenant currently stored.",
+			nil, labels,
+		),
+		bytes: prometheus.NewDesc(
+			"pushgateway_tenant_store_bytes",
+			"Estimated size of all stored metrics of the tenant, as the sum of the serialized sizes of the stored metric families.",
+			nil, labels,
+		),
+	}
+}
+
+var scrapeGroupErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "pushgateway",
+	Name:      "scrape_group_errors_total",
+	Help:      "Total number of times a group was left out of the exposed metrics because its metrics could not be encoded.",
+})
+
+func init() {
+	prometheus.MustRegister(helpConflicts)
+	prometheus.MustRegister(scrapeGroupErrors)
+	prometheus.MustRegister(rejectedWriteRequests)
+	prometheus.MustRegister(writeRequestLatency)
+	prometheus.MustRegister(groupsGauge)
+	prometheus.MustRegister(groupsLimitGauge)
+	prometheus.MustRegister(storeBytesGauge)
+	prometheus.MustRegister(storeBytesLimitGauge)
+	prometheus.MustRegister(evictedGroups)
+	prometheus.MustRegister(expiredGroups)
+	prometheus.MustRegister(persistDuration)
+	prometheus.MustRegister(persistErrors)
+}
+
+// DiskMetricStore is an implementation of MetricStore that persists metrics to
+// disk.
+type DiskMetricStore struct {
+	lock            sync.RWMutex // Protects metricFamilies and bytes, see snapshot.
+	writeQueue      chan queuedWriteRequest
+	drain           chan struct{}
+	done            chan error
+	metricFamilies  GroupingKeyToMetricGroup
+	persistenceFile string
+	routing         *PersistenceRouting
+	workerQueues    []chan queuedWriteRequest
+	workersDone     sync.WaitGroup
+	written         chan struct{} // Signals a write not done by loop() itself.
+	lastPersist     int64         // Unix time in ns, accessed atomically.
+	persistLock     sync.Mutex    // Serializes persists.
+	ingestionLabel  string
+	maxGroups       int   // Protected by lock, see SetLimits.
+	maxBytes        int64 // Protected by lock, see SetLimits.
+	maxFamilies     int
+	limitPolicy     LimitPolicy
+	bytes           int64 // Estimated size of metricFamilies, see namesSize.
+	families        int   // Number of metric families in metricFamilies.
+	helpPolicy      HelpConflictPolicy
+	seriesCount     bool
+	contentHash     bool
+	upFreshness     time.Duration
+	pushTime        bool
+	expiration      time.Duration
+	syntheticLabel  *dto.LabelPair
+	pool            *contentPool // Nil unless deduplicating.
+	audit           *AuditLog    // May be nil.
+	events          *EventLog    // May be nil.
+	nonFinite       NonFiniteValuePolicy
+	typeChange      TypeChangePolicy
+	maxLabels       int
+	countGrouping   bool
+	consistency     bool
+	forward         func(WriteRequest)     // May be nil.
+	wal             *writeAheadLog         // May be nil, protected by lock.
+	redis           *Redis                 // May be nil.
+	replicate       func([]byte)           // May be nil.
+	lastChanges     map[string]groupChange // By grouping key, for replication only, protected by lock.
+	tenant          string
+	descs           storeDescs
+	nonFiniteValue  float64
+	quietPeriod     time.Duration
+	paused          int32         // Accessed atomically, 1 means paused.
+	shutdown        int32         // Accessed atomically, 1 once Shutdown is called.
+	pauseChanged    chan struct{} // Signals a change of paused to loop().
+	pendingLock     sync.Mutex    // Protects pending and lastPendingID.
+	pending         map[uint64]PendingWriteRequest
+	lastPendingID   uint64
+	version         uint64 // Accessed atomically, see Version.
+	loopHeartbeat   int64  // Accessed atomically, Unix nanoseconds of the last loop() iteration.
+
+	// exposable holds the results of checking stored metric families (see
+	// resolveGroup). It is protected by exposableLock.
+	exposableLock sync.Mutex
+	exposable     map[*dto.MetricFamily]error
+}
+
+// queuedWriteRequest is a WriteRequest together with the time it was
+// submitted.
+type queuedWriteRequest struct {
+	WriteRequest
+	submitted time.Time
+	id        uint64 // Key in DiskMetricStore.pending.
+}
+
+// DiskMetricStoreOptions contains the tuning knobs of a DiskMetricStore. The
+// zero value results in the default behavior.
+type DiskMetricStoreOptions struct {
+	// WriteConcurrency is the number of goroutines processing write
+	// requests in parallel. Requests are sharded by job so that requests
+	// for the same job (and thereby for the same group) are still
+	// processed in the order of submission. A
+	// value of 0 or 1 processes all requests serially.
+	WriteConcurrency int
+	// QueueLength is the number of write requests that can wait for
+	// processing. Submitting further requests fails with ErrQueueFull
+	// until there is room again. A value of 0 or less results in the
+	// default of 1000.
+	QueueLength int
+	// IngestionTimeLabel, if not empty, is the name of a label that is set
+	// on all metrics of an update to the Timestamp of the WriteRequest,
+	// formatted according to RFC 3339 in UTC. A label of that name already
+	// present in the pushed metrics is overwritten. The label does not
+	// play any role in identifying a group. It must not be used as a
+	// grouping label.
+	IngestionTimeLabel string
+	// MaxGroups is the maximum number of groups (distinct sets of grouping
+	// labels) to store. A write request that would create a new
+	// group beyond that number is rejected, while updates of existing
+	// groups are still processed (but see LimitPolicy). This limit is
+	// independent of the number of series in each group. A value of 0
+	// means no limit.
+	MaxGroups int
+	// MaxMetricFamilies is the maximum number of metric families to store,
+	// summed over all groups. A write request that would add metric
+	// families beyond that number is rejected (but see LimitPolicy),
+	// while write requests not adding any are still processed. A value of
+	// 0 means no limit.
+	MaxMetricFamilies int
+	// LimitPolicy decides what happens to write requests exceeding
+	// MaxGroups or MaxMetricFamilies, see LimitPolicy.
+	LimitPolicy LimitPolicy
+	// HelpConflictPolicy decides which help string is exposed if groups
+	// have pushed metric families of the same name with different help
+	// strings.
+	HelpConflictPolicy HelpConflictPolicy
+	// MaxBytes is the estimated size of the stored metric families (see
+	// Stats.Bytes) beyond which groups are evicted. After each
+	// update (and after restoring from the persistence file), groups are
+	// deleted in the order of their last push, oldest first, until the
+	// estimate is within MaxBytes again. This includes the group just
+	// updated if it alone exceeds MaxBytes. A value of 0 means no limit.
+	MaxBytes int64
+	// If GroupSeriesCount is true, GetMetricFamilies returns an additional
+	// gauge named GroupSeriesCountName with a metric per group (labeled
+	// with the grouping labels of the group), reporting the number of
+	// metrics in the group. Pushing metrics of that name is then
+	// rejected.
+	GroupSeriesCount bool
+	// If GroupContentHash is true, GetMetricFamilies returns an additional
+	// gauge named GroupContentHashName with a metric per group, whose value
+	// is a hash (reduced to 53 bits to be exactly representable as a
+	// float64) of all metric families of the group. The hash changes
+	// whenever the content of the group changes, and it is independent of
+	// the order of the metrics within each family. It is meant for change
+	// detection, not for security. Pushing metrics of that name is then
+	// rejected.
+	GroupContentHash bool
+	// ScrapeQuietPeriod is the time a group has to go without pushes
+	// before GetMetricFamilies includes it. This keeps a group that is
+	// updated by a sequence of pushes out of scrapes until the sequence is
+	// complete. Note that an updated group is left out again during the
+	// quiet period after each push, and a group pushed to more often than
+	// once per ScrapeQuietPeriod is never included. A value of 0 includes
+	// all groups immediately.
+	ScrapeQuietPeriod time.Duration
+	// PersistenceRouting, if not nil, persists groups to separate files by
+	// the value of a grouping label, see PersistenceRouting. All files
+	// are restored on start-up, and groups restored from a file they are
+	// not routed to anymore are moved to the right file with the next
+	// persist.
+	PersistenceRouting *PersistenceRouting
+	// GroupUpFreshness, if positive, makes GetMetricFamilies return an
+	// additional gauge named GroupUpName with a metric per group, which
+	// is 1 if the last push to the group (see
+	// NameToTimestampedMetricFamilyMap.LastPushTime) happened within
+	// GroupUpFreshness, and 0 otherwise. Pushing metrics of that name is
+	// then rejected.
+	GroupUpFreshness time.Duration
+	// If PushTime is true, GetMetricFamilies returns two additional gauges
+	// with a metric per group: PushTimeName reports the time of the last
+	// push to the group (see NameToTimestampedMetricFamilyMap.LastPushTime),
+	// PushFailureTimeName the time of the last push to the group that was
+	// rejected by SubmitWriteRequest or dropped during processing (see
+	// MetricGroup.LastPushFailure), both as Unix time in seconds. The
+	// latter is 0 if no push has failed. Alerting on the former being old,
+	// or on the latter being more recent than the former, detects jobs
+	// that have stopped pushing successfully. Failed pushes to groups that
+	// do not exist are not recorded. Pushing metrics of these names is
+	// then rejected.
+	PushTime bool
+	// SyntheticLabelName, if not empty, is the name of a label set to
+	// SyntheticLabelValue on all synthetic metrics (see GroupSeriesCount,
+	// GroupContentHash, GroupUpFreshness, and PushTime), e.g. to tell apart the
+	// synthetic metrics of several Pushgateways. Pushed metrics and the
+	// identity of groups are not affected. It must not be used as a
+	// grouping label.
+	SyntheticLabelName, SyntheticLabelValue string
+	// If DeduplicateContent is true, identical parts of the stored metric
+	// families (help strings, label pairs, and metric values) are shared
+	// in memory rather than stored once per metric, which saves memory
+	// if many groups push similar content, at the cost of hashing the
+	// pushed metrics. Stats.Bytes and MaxBytes do not take the sharing
+	// into account.
+	DeduplicateContent bool
+	// RestoreErrorPolicy decides what happens if a persistence file exists
+	// but cannot be restored completely, see RestoreErrorPolicy. It only
+	// takes effect with OpenDiskMetricStore.
+	RestoreErrorPolicy RestoreErrorPolicy
+	// AuditLog, if not nil, records every deletion of a group, see
+	// AuditLog. The store does not close it.
+	AuditLog *AuditLog
+	// EventLog, if not nil, records every push and delete request
+	// processed by the store, see EventLog.
+	EventLog *EventLog
+	// NonFiniteValuePolicy decides what happens to pushed NaN and infinite
+	// values, see NonFiniteValuePolicy. NonFiniteReplacement is the
+	// replacement for NonFiniteReplace.
+	NonFiniteValuePolicy NonFiniteValuePolicy
+	NonFiniteReplacement float64
+	// TypeChangePolicy decides whether a push may change the type of a
+	// metric family stored in the group, see TypeChangePolicy.
+	TypeChangePolicy TypeChangePolicy
+	// MaxLabelsPerMetric, if positive, is the maximum number of labels
+	// (with a non-empty value) of a pushed metric. Pushes with a metric
+	// exceeding it are rejected. The grouping labels only count if
+	// CountGroupingLabels is true.
+	MaxLabelsPerMetric  int
+	CountGroupingLabels bool
+	// If CheckConsistency is true, CheckWriteRequest rejects pushes with
+	// metrics that would make a scrape of the metrics returned by
+	// GetMetricFamilies fail as a whole, e.g. the same series pushed twice,
+	// or a metric pushed with a type or label names different from those
+	// of the metrics of the same name stored by other groups (see
+	// checkConsistency for the details). The check compares with all
+	// stored groups, so it costs time proportional to the number of
+	// groups for each pushed metric family. As requests are processed
+	// asynchronously, conflicting pushes checked at the same time can
+	// still both pass.
+	CheckConsistency bool
+	// Expiration, if positive, is the default time after the last push
+	// (see NameToTimestampedMetricFamilyMap.LastPushTime) to a group
+	// after which the group is deleted, so that the metrics of jobs that
+	// have stopped pushing do not live forever. A push may override it for
+	// its group, see WriteRequest.Expiration. Groups are checked for
+	// expiry every ten seconds, so they may be exposed for up to that long
+	// after they have expired. The expiration of each group is persisted.
+	// A value of 0 means that groups only expire with a per-push
+	// expiration.
+	Expiration time.Duration
+	// WriteAheadLog, if not empty, is the prefix of the segment files of
+	// a write-ahead log, which records the state of each persisted group
+	// after every change (e.g. a processed push, a deletion, or an
+	// eviction), so that changes since the last persist survive a crash.
+	// On start-up, the segments are replayed on top of the restored
+	// persistence files. Each persist starts a new segment and removes the
+	// older ones after it has succeeded. The records are not synced to
+	// disk individually, so they survive a crash of the process, but not
+	// necessarily one of the machine. Writing the record costs time
+	// proportional to the size of the changed group. It is only used with
+	// persistence files. A segment that cannot be replayed is handled
+	// like a persistence file that cannot be restored, see
+	// RestoreErrorPolicy (but a segment is never moved aside).
+	WriteAheadLog string
+	// Forward, if not nil, is called with every push after it has been
+	// applied (with the lock held, so it must not block). The
+	// MetricFamilies of the WriteRequest are not modified anymore
+	// afterwards.
+	Forward func(WriteRequest)
+	// Redis, if not nil, keeps all groups in Redis in addition to
+	// memory, see Redis. On start-up, the groups stored in Redis are
+	// loaded on top of the restored persistence files (if any). Each
+	// change of a group is queued for writing to Redis in the background.
+	// Changes by other DiskMetricStores sharing the Redis keys are picked
+	// up after each sync interval of the Redis by fetching the changed
+	// groups. There is no locking across DiskMetricStores, so for
+	// concurrent changes of the same group, the last write wins.
+	Redis *Redis
+	// Replicate, if not nil, is called with every change of a group (a
+	// push, a deletion, an expiry, an eviction, or a recorded push
+	// failure), encoded to be applied to another MetricStore with
+	// ApplyReplicated. It is called with the lock held, so it must not
+	// block. Changes applied with ApplyReplicated are not passed on to
+	// Replicate again.
+	Replicate func(change []byte)
+	// Tenant is the name of the tenant the DiskMetricStore keeps the groups
+	// of, if any. The metrics common to all DiskMetricStores (like
+	// pushgateway_groups) describe the DiskMetricStore without tenant
+	// only. A DiskMetricStore of a tenant collects its own metrics instead
+	// (see Collect), with the name of the tenant as the tenant label.
+	Tenant string
+}
+
+// RestoreErrorPolicy decides how a DiskMetricStore starts if one of its
+// persistence files cannot be restored. A missing file is never an error.
+type RestoreErrorPolicy int
+
+// The available RestoreErrorPolicy values. In all cases, the groups of the
+// affected file are discarded, even if part of the file could be read, and the
+// file is overwritten with the next persist (unless moved aside).
+const (
+	// RestoreErrorEmpty starts without the groups of the affected file.
+	RestoreErrorEmpty RestoreErrorPolicy = iota
+	// RestoreErrorFail makes OpenDiskMetricStore return the error.
+	RestoreErrorFail
+	// RestoreErrorBackup renames the affected file (by appending
+	// ".corrupt-" and the current Unix time) and starts without its
+	// groups, so that the file is kept for inspection.
+	RestoreErrorBackup
+)
+
+var restoreErrorPolicyNames = map[string]RestoreErrorPolicy{
+	"empty":            RestoreErrorEmpty,
+	"fail":             RestoreErrorFail,
+	"backup-and-empty": RestoreErrorBackup,
+}
+
+// ParseRestoreErrorPolicy returns the RestoreErrorPolicy with the given name,
+// i.e. one of "empty", "fail", or "backup-and-empty".
+func ParseRestoreErrorPolicy(s string) (RestoreErrorPolicy, error) {
+	if p, ok := restoreErrorPolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown restore error policy %q", s)
+}
+
+// LimitPolicy decides what happens to a write request that would exceed
+// DiskMetricStoreOptions.MaxGroups or MaxMetricFamilies.
+type LimitPolicy int
+
+// The available LimitPolicy values.
+const (
+	// LimitReject rejects the write request with ErrTooManyGroups or
+	// ErrTooManyMetricFamilies.
+	LimitReject LimitPolicy = iota
+	// LimitEvict processes the write request and then evicts groups in
+	// the order of their last push, oldest first, until both limits are
+	// kept again (like MaxBytes does). A write request with more metric
+	// families than MaxMetricFamilies on its own is still rejected.
+	LimitEvict
+)
+
+var limitPolicyNames = map[string]LimitPolicy{
+	"reject": LimitReject,
+	"evict":  LimitEvict,
+}
+
+// ParseLimitPolicy returns the LimitPolicy with the given name, i.e. one of
+// "reject" or "evict".
+func ParseLimitPolicy(s string) (LimitPolicy, error) {
+	if p, ok := limitPolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown limit policy %q, must be one of reject, evict", s)
+}
+
+// HelpConflictPolicy decides which help string wins if metric families of the
+// same name pushed by different groups have different help strings. Groups
+// are ordered according to GroupLess for that purpose. Conflicts are
+// logged and counted in any case.
+type HelpConflictPolicy int
+
+// The available HelpConflictPolicy values.
+const (
+	// HelpFirst uses the help string of the group sorting first.
+	HelpFirst HelpConflictPolicy = iota
+	// HelpLast uses the help string of the group sorting last.
+	HelpLast
+	// HelpLongest uses the longest help string (of those, the one of the
+	// group sorting first).
+	HelpLongest
+	// HelpError does not expose the affected metric family at all.
+	HelpError
+)
+
+var helpConflictPolicyNames = map[string]HelpConflictPolicy{
+	"first-wins": HelpFirst,
+	"last-wins":  HelpLast,
+	"longest":    HelpLongest,
+	"error":      HelpError,
+}
+
+// ParseHelpConflictPolicy returns the HelpConflictPolicy with the given name,
+// i.e. one of "first-wins", "last-wins", "longest", or "error".
+func ParseHelpConflictPolicy(s string) (HelpConflictPolicy, error) {
+	if p, ok := helpConflictPolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown help conflict policy %q", s)
+}
+
+// TypeChangePolicy decides what happens to a push containing a metric family
+// whose name is already stored in the group with a different type, e.g. a
+// gauge pushed to a group holding a counter of the same name. This applies
+// to replacing pushes, too, as the type would still change from one scrape to
+// the next.
+type TypeChangePolicy int
+
+// The available TypeChangePolicy values.
+const (
+	// TypeChangeReject makes CheckWriteRequest return an error. Write
+	// requests changing a type are dropped (and logged) when processed.
+	TypeChangeReject TypeChangePolicy = iota
+	// TypeChangeAllow applies the type change and logs it.
+	TypeChangeAllow
 )
 
-const (
-	writeQueueCapacity = 1000
-)
+var typeChangePolicyNames = map[string]TypeChangePolicy{
+	"reject": TypeChangeReject,
+	"allow":  TypeChangeAllow,
+}
+
+// ParseTypeChangePolicy returns the TypeChangePolicy with the given name, i.e.
+// one of "reject" or "allow".
+func ParseTypeChangePolicy(s string) (TypeChangePolicy, error) {
+	if p, ok := typeChangePolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown type change policy %q, must be one of reject, allow", s)
+}
+
+type metricFamiliesByName []*dto.MetricFamily
+
+func (s metricFamiliesByName) Len() int           { return len(s) }
+func (s metricFamiliesByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s metricFamiliesByName) Less(i, j int) bool { return s[i].GetName() < s[j].GetName() }
+
+type mfStat struct {
+	pos      int  // Where in the result slice is the MetricFamily?
+	copied   bool // Has the MetricFamily already been copied?
+	conflict bool // Are there conflicting help strings?
+}
+
+// NewDiskMetricStore returns a DiskMetricStore ready to use. To cleanly shut it
+// down and free resources, the Shutdown() method has to be called.  If
+// persistenceFile is the empty string, no persisting to disk will
+// happen. Otherwise, a file of that name is used for persisting metrics to
+// disk. If the file already exists, metrics are read from it as part of the
+// start-up. Persisting is happening upon shutdown and after every write action,
+// but the latter will only happen persistenceDuration after the previous
+// persisting. See DiskMetricStoreOptions for the remaining tuning knobs.
+//
+// NewDiskMetricStore cannot fail. Persistence files that cannot be restored
+// are handled as with RestoreErrorEmpty or RestoreErrorBackup (whichever is
+// set in opts), a file that cannot be moved aside and groups that cannot be
+// loaded from Redis are logged and left out. Use OpenDiskMetricStore to fail
+// instead.
+func NewDiskMetricStore(
+	persistenceFile string,
+	persistenceInterval time.Duration,
+	opts DiskMetricStoreOptions,
+) *DiskMetricStore {
+	if opts.RestoreErrorPolicy == RestoreErrorFail {
+		opts.RestoreErrorPolicy = RestoreErrorEmpty
+	}
+	dms, _ := openDiskMetricStore(persistenceFile, persistenceInterval, opts, false)
+	return dms
+}
+
+// OpenDiskMetricStore works like NewDiskMetricStore, but it returns an error
+// if a persistence file cannot be restored and opts.RestoreErrorPolicy is
+// RestoreErrorFail, if moving the file aside fails with RestoreErrorBackup, or
+// if the groups cannot be loaded from Redis. In that case, no store is
+// started.
+func OpenDiskMetricStore(
+	persistenceFile string,
+	persistenceInterval time.Duration,
+	opts DiskMetricStoreOptions,
+) (*DiskMetricStore, error) {
+	return openDiskMetricStore(persistenceFile, persistenceInterval, opts, true)
+}
+
+// openDiskMetricStore implements NewDiskMetricStore (strict false, it then
+// never returns an error) and OpenDiskMetricStore (strict true).
+func openDiskMetricStore(
+	persistenceFile string,
+	persistenceInterval time.Duration,
+	opts DiskMetricStoreOptions,
+	strict bool,
+) (*DiskMetricStore, error) {
+	queueLength := opts.QueueLength
+	if queueLength <= 0 {
+		queueLength = writeQueueCapacity
+	}
+	dms := &DiskMetricStore{
+		writeQueue:      make(chan queuedWriteRequest, queueLength),
+		drain:           make(chan struct{}),
+		done:            make(chan error),
+		metricFamilies:  GroupingKeyToMetricGroup{},
+		persistenceFile: persistenceFile,
+		written:         make(chan struct{}, 1),
+		ingestionLabel:  opts.IngestionTimeLabel,
+		pauseChanged:    make(chan struct{}, 1),
+		maxGroups:       opts.MaxGroups,
+		maxBytes:        opts.MaxBytes,
+		maxFamilies:     opts.MaxMetricFamilies,
+		limitPolicy:     opts.LimitPolicy,
+		helpPolicy:      opts.HelpConflictPolicy,
+		seriesCount:     opts.GroupSeriesCount,
+		contentHash:     opts.GroupContentHash,
+		upFreshness:     opts.GroupUpFreshness,
+		pushTime:        opts.PushTime,
+		expiration:      opts.Expiration,
+		quietPeriod:     opts.ScrapeQuietPeriod,
+		routing:         opts.PersistenceRouting,
+		audit:           opts.AuditLog,
+		events:          opts.EventLog,
+		nonFinite:       opts.NonFiniteValuePolicy,
+		nonFiniteValue:  opts.NonFiniteReplacement,
+		typeChange:      opts.TypeChangePolicy,
+		maxLabels:       opts.MaxLabelsPerMetric,
+		countGrouping:   opts.CountGroupingLabels,
+		consistency:     opts.CheckConsistency,
+		forward:         opts.Forward,
+		redis:           opts.Redis,
+		replicate:       opts.Replicate,
+		lastChanges:     map[string]groupChange{},
+		tenant:          opts.Tenant,
+		descs:           defaultStoreDescs,
+	}
+	if opts.Tenant != "" {
+		dms.descs = newTenantStoreDescs(opts.Tenant)
+	}
+	if opts.SyntheticLabelName != "" {
+		dms.syntheticLabel = &dto.LabelPair{
+			Name:  proto.String(opts.SyntheticLabelName),
+			Value: proto.String(opts.SyntheticLabelValue),
+		}
+	}
+	for _, file := range dms.routing.files(dms.persistenceFile) {
+		groups := GroupingKeyToMetricGroup{}
+		err := restore(file, groups)
+		switch {
+		case err == nil:
+			mergeGroups(dms.metricFamilies, groups)
+			continue
+		case os.IsNotExist(err):
+			logging.Info("Persistence file does not exist yet, starting without its groups.", "file", file)
+			continue
+		}
+		switch opts.RestoreErrorPolicy {
+		case RestoreErrorFail:
+			return nil, fmt.Errorf("could not restore persisted metrics from '%s': %s", file, err)
+		case RestoreErrorBackup:
+			backup := fmt.Sprintf("%s.corrupt-%d", file, time.Now().Unix())
+			if renameErr := os.Rename(file, backup); renameErr != nil {
+				if strict {
+					return nil, fmt.Errorf("could not restore persisted metrics from '%s' (%s) nor move the file aside: %s", file, err, renameErr)
+				}
+				logging.Error("Could not restore persisted metrics nor move the file aside. Starting without its groups, the file will be overwritten.", "file", file, "err", err, "rename_err", renameErr)
+				continue
+			}
+			logging.Error("Could not restore persisted metrics. Moved the file aside and starting without its groups.", "file", file, "backup", backup, "err", err)
+		default:
+			logging.Error("Could not restore persisted metrics. Starting without its groups, the file will be overwritten.", "file", file, "err", err)
+		}
+	}
+	if opts.WriteAheadLog != "" && len(dms.routing.files(dms.persistenceFile)) > 0 {
+		if err := dms.openWriteAheadLog(opts.WriteAheadLog); err != nil {
+			if opts.RestoreErrorPolicy == RestoreErrorFail {
+				if dms.wal != nil {
+					dms.wal.Close()
+				}
+				return nil, err
+			}
+			logging.Error("Starting without the changes not replayed.", "err", err)
+		}
+	}
+	if dms.redis != nil {
+		groups, err := dms.redis.load()
+		switch {
+		case err == nil:
+			mergeGroups(dms.metricFamilies, groups)
+		case strict:
+			if dms.wal != nil {
+				dms.wal.Close()
+			}
+			return nil, fmt.Errorf("could not load groups from Redis: %s", err)
+		default:
+			// The first sync fetches all groups.
+			redisErrors.Inc()
+			logging.Error("Could not load groups from Redis. Starting without them.", "err", err)
+		}
+	}
+	if opts.DeduplicateContent {
+		dms.pool = newContentPool()
+		for _, group := range dms.metricFamilies {
+			for _, tmf := range group.Metrics {
+				dms.pool.dedupeMetricFamily(tmf.MetricFamily)
+			}
+		}
+	}
+	// Groups restored from the persistence file are kept even if they
+	// exceed the group or metric family limit (unless the limit policy
+	// is LimitEvict), but not if they exceed the size limit.
+	for _, group := range dms.metricFamilies {
+		dms.bytes += namesSize(group.Metrics)
+		dms.families += len(group.Metrics)
+	}
+	if dms.evict() > 0 {
+		dms.signalWrite()
+	}
+	dms.setLimitGauges(opts.MaxGroups, opts.MaxBytes)
+	dms.setSizeGauges()
+	if opts.WriteConcurrency > 1 {
+		dms.workerQueues = make([]chan queuedWriteRequest, opts.WriteConcurrency)
+		for i := range dms.workerQueues {
+			dms.workerQueues[i] = make(chan queuedWriteRequest, queueLength/opts.WriteConcurrency+1)
+			dms.workersDone.Add(1)
+			go dms.worker(dms.workerQueues[i])
+		}
+	}
+	atomic.StoreInt64(&dms.loopHeartbeat, time.Now().UnixNano())
+	go dms.loop(persistenceInterval)
+	return dms, nil
+}
+
+// SubmitWriteRequest implements the MetricStore interface.
+func (dms *DiskMetricStore) SubmitWriteRequest(req WriteRequest) error {
+	if atomic.LoadInt32(&dms.shutdown) == 1 {
+		rejectedWriteRequests.WithLabelValues("shutdown").Inc()
+		return ErrShutdown
+	}
+	if !req.SkipValidation {
+		if reason, err := dms.checkWriteRequest(req); err != nil {
+			rejectedWriteRequests.WithLabelValues(reason).Inc()
+			if dms.pushTime && req.MetricFamilies != nil {
+				dms.lock.Lock()
+				dms.recordPushFailure(GroupingKeyFor(req.Labels), req.Timestamp)
+				dms.lock.Unlock()
+			}
+			return err
+		}
+	}
+	wr := queuedWriteRequest{WriteRequest: req, submitted: time.Now()}
+	wr.id = dms.addPending(wr)
+	select {
+	case dms.writeQueue <- wr:
+		return nil
+	default:
+		dms.pendingLock.Lock()
+		delete(dms.pending, wr.id)
+		dms.pendingLock.Unlock()
+		rejectedWriteRequests.WithLabelValues("queue_full").Inc()
+		return ErrQueueFull
+	}
+}
+
+// addPending registers the given request as pending and returns its ID.
+func (dms *DiskMetricStore) addPending(wr queuedWriteRequest) uint64 {
+	pwr := PendingWriteRequest{
+		Labels:         wr.Labels,
+		Submitted:      wr.submitted,
+		Delete:         wr.MetricFamilies == nil,
+		Replace:        wr.Replace,
+		MetricFamilies: len(wr.MetricFamilies),
+	}
+	for _, mf := range wr.MetricFamilies {
+		pwr.Series += len(mf.GetMetric())
+		pwr.Bytes += proto.Size(mf)
+	}
+
+	dms.pendingLock.Lock()
+	defer dms.pendingLock.Unlock()
+	if dms.pending == nil {
+		dms.pending = map[uint64]PendingWriteRequest{}
+	}
+	dms.lastPendingID++
+	dms.pending[dms.lastPendingID] = pwr
+	return dms.lastPendingID
+}
+
+// PendingWriteRequests implements the MetricStore interface.
+func (dms *DiskMetricStore) PendingWriteRequests(limit int) ([]PendingWriteRequest, int) {
+	dms.pendingLock.Lock()
+	defer dms.pendingLock.Unlock()
+	ids := make([]uint64, 0, len(dms.pending))
+	for id := range dms.pending {
+		ids = append(ids, id)
+	}
+	sort.Sort(pendingIDs(ids))
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	result := make([]PendingWriteRequest, len(ids))
+	for i, id := range ids {
+		result[i] = dms.pending[id]
+	}
+	return result, len(dms.pending)
+}
+
+type pendingIDs []uint64
+
+func (s pendingIDs) Len() int           { return len(s) }
+func (s pendingIDs) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s pendingIDs) Less(i, j int) bool { return s[i] < s[j] }
+
+// CheckWriteRequest implements the MetricStore interface.
+func (dms *DiskMetricStore) CheckWriteRequest(req WriteRequest) error {
+	_, err := dms.checkWriteRequest(req)
+	return err
+}
+
+// recordPushFailure sets the time of the last failed push to the group with
+// the given grouping key, if it exists. The caller must hold the write lock.
+func (dms *DiskMetricStore) recordPushFailure(key string, at time.Time) {
+	group, ok := dms.metricFamilies[key]
+	if !ok {
+		return
+	}
+	// Like all stored groups, the group is replaced rather than
+	// modified, see snapshot.
+	group.LastPushFailure = at
+	dms.metricFamilies[key] = group
+	dms.logGroup(key, group.Labels)
+	atomic.AddUint64(&dms.version, 1)
+}
+
+// checkWriteRequest implements CheckWriteRequest. If the WriteRequest is
+// rejected, it also returns the reason for the rejected pushes counter.
+func (dms *DiskMetricStore) checkWriteRequest(req WriteRequest) (string, error) {
+	if err := validateWriteRequest(req); err != nil {
+		return "invalid", err
+	}
+	for name, enabled := range map[string]bool{
+		GroupSeriesCountName: dms.seriesCount,
+		GroupContentHashName: dms.contentHash,
+		GroupUpName:          dms.upFreshness > 0,
+		PushTimeName:         dms.pushTime,
+		PushFailureTimeName:  dms.pushTime,
+	} {
+		if _, ok := req.MetricFamilies[name]; ok && enabled {
+			return "reserved_name", fmt.Errorf("metric name %q is reserved for a synthetic metric", name)
+		}
+	}
+	if dms.nonFinite == NonFiniteReject {
+		if err := checkFinite(req.MetricFamilies); err != nil {
+			return "non_finite", err
+		}
+	}
+	if dms.maxLabels > 0 {
+		if err := dms.checkLabelCount(req.MetricFamilies, req.Labels); err != nil {
+			return "too_many_labels", err
+		}
+	}
+	if len(req.MetricFamilies) == 0 {
+		return "", nil
+	}
+	dms.lock.RLock()
+	defer dms.lock.RUnlock()
+	if err := dms.checkLimits(req); err == ErrTooManyGroups {
+		return "too_many_groups", err
+	} else if err != nil {
+		return "too_many_metric_families", err
+	}
+	if dms.typeChange == TypeChangeReject {
+		if err := dms.checkTypeChange(req); err != nil {
+			return "type_change", err
+		}
+	}
+	if dms.consistency {
+		if err := dms.checkConsistency(req); err != nil {
+			return "inconsistent", err
+		}
+	}
+	return "", nil
+}
+
+// checkLabelCount returns an error for the first metric with more labels than
+// allowed by MaxLabelsPerMetric. The labels of summary quantiles and histogram
+// buckets do not count, the given grouping labels only according to
+// CountGroupingLabels.
+func (dms *DiskMetricStore) checkLabelCount(mfs map[string]*dto.MetricFamily, grouping map[string]string) error {
+	for name, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			n := 0
+			for _, lp := range m.GetLabel() {
+				if _, ok := grouping[lp.GetName()]; lp.GetValue() == "" || ok && !dms.countGrouping {
+					continue
+				}
+				n++
+			}
+			if n > dms.maxLabels {
+				return fmt.Errorf("series %s{%s} has %d labels, more than the maximum of %d", name, labelsSignature(m.GetLabel()), n, dms.maxLabels)
+			}
+		}
+	}
+	return nil
+}
+
+// validateWriteRequest checks that the grouping labels include a non-empty job
+// and, unless the WriteRequest is a delete, an instance label and have valid
+// names and non-empty values (except for
+// the instance), that the MetricFamilies are keyed by their name (which has
+// to be one of the MetricNames, if given), and that each metric has all the
+// grouping labels with the values of the WriteRequest and no duplicate label
+// names.
+func validateWriteRequest(req WriteRequest) error {
+	if req.Labels["job"] == "" {
+		return fmt.Errorf("empty job in write request")
+	}
+	if _, ok := req.Labels["instance"]; !ok && req.MetricFamilies != nil {
+		return fmt.Errorf("no instance in write request")
+	}
+	for ln, lv := range req.Labels {
+		if !labelNameRE.MatchString(ln) || strings.HasPrefix(ln, "__") {
+			return fmt.Errorf("invalid grouping label name %q", ln)
+		}
+		if lv == "" && ln != "instance" {
+			return fmt.Errorf("empty value of grouping label %q", ln)
+		}
+	}
+	var listed map[string]bool
+	if req.MetricNames != nil {
+		listed = make(map[string]bool, len(req.MetricNames))
+		for _, name := range req.MetricNames {
+			listed[name] = true
+		}
+	}
+	for name, mf := range req.MetricFamilies {
+		if name != mf.GetName() {
+			return fmt.Errorf("metric family %q keyed as %q", mf.GetName(), name)
+		}
+		if listed != nil && !listed[name] {
+			return fmt.Errorf("metric %q is not one of the listed metric names", name)
+		}
+		for _, m := range mf.GetMetric() {
+			seen := make(map[string]bool, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				ln := lp.GetName()
+				if seen[ln] {
+					return fmt.Errorf("duplicate label %q in metric %q", ln, name)
+				}
+				seen[ln] = true
+				if lv, ok := req.Labels[ln]; ok && lp.GetValue() != lv {
+					return fmt.Errorf("%s label %q of metric %q does not match grouping label value %q", ln, lp.GetValue(), name, lv)
+				}
+			}
+			for ln := range req.Labels {
+				if !seen[ln] {
+					return fmt.Errorf("metric %q lacks the grouping label %q", name, ln)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkLimits returns ErrTooManyGroups if the given update would create a new
+// group while the maximum number of groups is reached, and
+// ErrTooManyMetricFamilies if it would add metric families beyond their
+// maximum number. With LimitEvict, only an update with more metric families
+// than the maximum on its own is rejected, as evicting other groups cannot
+// make room for it. The caller must hold the lock.
+func (dms *DiskMetricStore) checkLimits(req WriteRequest) error {
+	if dms.maxFamilies > 0 && len(req.MetricFamilies) > dms.maxFamilies {
+		return ErrTooManyMetricFamilies
+	}
+	if dms.limitPolicy == LimitEvict {
+		return nil
+	}
+	stored, exists := dms.metricFamilies[GroupingKeyFor(req.Labels)]
+	if dms.maxGroups > 0 && !exists && dms.groupCount() >= dms.maxGroups {
+		return ErrTooManyGroups
+	}
+	if dms.maxFamilies <= 0 {
+		return nil
+	}
+	added := len(req.MetricFamilies)
+	if req.Replace {
+		added -= len(stored.Metrics)
+	} else {
+		for name := range req.MetricFamilies {
+			if _, ok := stored.Metrics[name]; ok {
+				added--
+			}
+		}
+	}
+	if added > 0 && dms.families+added > dms.maxFamilies {
+		return ErrTooManyMetricFamilies
+	}
+	return nil
+}
+
+// checkTypeChange returns an error for the first metric family of the write
+// request with a different type than the metric family of the same name
+// stored in the group. The caller must hold the lock.
+func (dms *DiskMetricStore) checkTypeChange(req WriteRequest) error {
+	stored := dms.metricFamilies[GroupingKeyFor(req.Labels)].Metrics
+	for name, mf := range req.MetricFamilies {
+		if tmf, ok := stored[name]; ok && tmf.MetricFamily.GetType() != mf.GetType() {
+			return fmt.Errorf("metric %q is stored as %s, cannot change its type to %s", name, tmf.MetricFamily.GetType(), mf.GetType())
+		}
+	}
+	return nil
+}
+
+// groupCount returns the number of stored groups. The caller must hold the
+// lock (or otherwise make sure that metricFamilies is not modified
+// concurrently).
+func (dms *DiskMetricStore) groupCount() int {
+	return len(dms.metricFamilies)
+}
+
+// GetMetricFamilies implements the MetricStore interface.
+func (dms *DiskMetricStore) GetMetricFamilies() []*dto.MetricFamily {
+	return dms.GetMetricFamiliesFiltered(nil)
+}
+
+// GetMetricFamiliesFiltered implements the MetricStore interface.
+func (dms *DiskMetricStore) GetMetricFamiliesFiltered(keep func(labels map[string]string) bool) []*dto.MetricFamily {
+	result := []*dto.MetricFamily{}
+	mfStatByName := map[string]mfStat{}
+
+	groups := dms.snapshot()
+	now := time.Now()
+	var seriesCount, contentHash, up, pushTime, pushFailureTime *dto.MetricFamily
+	if dms.seriesCount {
+		seriesCount = &dto.MetricFamily{
+			Name: proto.String(GroupSeriesCountName),
+			Help: proto.String("Number of metrics in the group (counting each summary or histogram as one)."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+	}
+	if dms.contentHash {
+		contentHash = &dto.MetricFamily{
+			Name: proto.String(GroupContentHashName),
+			Help: proto.String("Hash of the content of the group, changing whenever the content changes. For change detection only, not for security."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+	}
+	if dms.upFreshness > 0 {
+		up = &dto.MetricFamily{
+			Name: proto.String(GroupUpName),
+			Help: proto.String(fmt.Sprintf("1 if the group has been pushed to within the last %s, 0 otherwise.", dms.upFreshness)),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+	}
+	if dms.pushTime {
+		pushTime = &dto.MetricFamily{
+			Name: proto.String(PushTimeName),
+			Help: proto.String("Last Unix time when this group was changed in the Pushgateway."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		pushFailureTime = &dto.MetricFamily{
+			Name: proto.String(PushFailureTimeName),
+			Help: proto.String("Last Unix time when changing this group in the Pushgateway failed, 0 if it never failed."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+	}
+
+	// The groups are sorted (see GroupLess) so that the output is
+	// deterministic, in particular which help string and type win in case
+	// of inconsistencies.
+	groupingNames := map[string]struct{}{}
+	dms.exposableLock.Lock()
+	checked := dms.exposable
+	dms.exposableLock.Unlock()
+	exposable := make(map[*dto.MetricFamily]error, len(checked))
+	for _, g := range groups {
+		if keep != nil && !keep(g.labels) {
+			continue
+		}
+		names := g.names
+		if dms.quietPeriod > 0 && now.Sub(g.lastPushTime()) < dms.quietPeriod {
+			continue
+		}
+		for ln := range g.labels {
+			groupingNames[ln] = struct{}{}
+		}
+		mfs, err := resolveGroup(names, now, checked, exposable)
+		if err != nil {
+			// Leave out the group rather than failing the
+			// whole scrape.
+			scrapeGroupErrors.Inc()
+			logging.Warn("Not exposing group.", "group", FormatGroup(g.labels), "err", err)
+			continue
+		}
+		groupSeries := 0
+		for _, mf := range mfs {
+			name := mf.GetName()
+			groupSeries += len(mf.GetMetric())
+			stat, exists := mfStatByName[name]
+			if exists {
+				existingMF := result[stat.pos]
+				if !stat.copied {
+					stat.copied = true
+					existingMF = copyMetricFamily(existingMF)
+					result[stat.pos] = existingMF
+				}
+				if mf.GetType() != existingMF.GetType() {
+					logging.Warn(
+						"Metric families have inconsistent types, the type of the existing one (pushed by the group sorting first) will have priority. This is bad. Fix your pushed metrics!",
+						"metric_family", mf, "existing_metric_family", existingMF,
+					)
+				}
+				if mf.GetHelp() != existingMF.GetHelp() {
+					helpConflicts.Inc()
+					stat.conflict = true
+					logging.Warn(
+						"Metric families have inconsistent help strings, resolving according to the help conflict policy. This is bad. Fix your pushed metrics!",
+						"metric_family", mf, "existing_metric_family", existingMF,
+					)
+					switch dms.helpPolicy {
+					case HelpLast:
+						existingMF.Help = mf.Help
+					case HelpLongest:
+						if len(mf.GetHelp()) > len(existingMF.GetHelp()) {
+							existingMF.Help = mf.Help
+						}
+					}
+				}
+				mfStatByName[name] = stat
+				for _, metric := range mf.Metric {
+					existingMF.Metric = append(existingMF.Metric, metric)
+				}
+			} else {
+				mfStatByName[name] = mfStat{
+					pos:    len(result),
+					copied: false,
+				}
+				result = append(result, mf)
+			}
+		}
+		if seriesCount != nil {
+			seriesCount.Metric = append(seriesCount.Metric, dms.groupGauge(g.labels, float64(groupSeries)))
+		}
+		if contentHash != nil {
+			contentHash.Metric = append(contentHash.Metric, dms.groupGauge(g.labels, groupHash(mfs)))
+		}
+		if up != nil {
+			fresh := 0.
+			if now.Sub(g.lastPushTime()) <= dms.upFreshness {
+				fresh = 1
+			}
+			up.Metric = append(up.Metric, dms.groupGauge(g.labels, fresh))
+		}
+		if pushTime != nil {
+			pushTime.Metric = append(pushTime.Metric, dms.groupGauge(g.labels, unixSeconds(g.lastPushTime())))
+			pushFailureTime.Metric = append(pushFailureTime.Metric, dms.groupGauge(g.labels, unixSeconds(g.lastPushFailure)))
+		}
+	}
+	// Only an unfiltered call has seen all groups (but those in their
+	// quiet period), so only its results replace the previous ones.
+	if keep == nil {
+		dms.exposableLock.Lock()
+		dms.exposable = exposable
+		dms.exposableLock.Unlock()
+	}
+	for _, synthetic := range []*dto.MetricFamily{seriesCount, contentHash, up, pushTime, pushFailureTime} {
+		if synthetic == nil || len(synthetic.Metric) == 0 {
+			continue
+		}
+		if _, exists := mfStatByName[synthetic.GetName()]; exists {
+			// Only possible with metrics restored from a persistence
+			// file written without the synthetic metric enabled.
+			logging.Warn("Not exposing synthetic metric as metrics of the same name have been pushed.", "metric", synthetic.GetName())
+			continue
+		}
+		result = append(result, synthetic)
+	}
+	if dms.helpPolicy == HelpError {
+		filtered := result[:0]
+		for _, mf := range result {
+			if mfStatByName[mf.GetName()].conflict {
+				logging.Warn("Not exposing metric family because of conflicting help strings.", "name", mf.GetName())
+				continue
+			}
+			filtered = append(filtered, mf)
+		}
+		result = filtered
+	}
+	padLabels(result, groupingNames)
+	sort.Sort(metricFamiliesByName(result))
+	return result
+}
+
+// padLabels adds labels with an empty value to metrics lacking a grouping label
+// (i.e. one of the given label names) that other metrics of the same metric
+// family have, as happens with grouping labels only some groups have.
+// Inconsistent label names within a metric family would fail the whole
+// scrape, while an empty label is the same as a missing one. Metric families
+// and metrics are copied before they are changed.
+func padLabels(mfs []*dto.MetricFamily, grouping map[string]struct{}) {
+	for i, mf := range mfs {
+		if len(mf.GetMetric()) < 2 {
+			continue
+		}
+		names := map[string]struct{}{}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if _, ok := grouping[lp.GetName()]; ok {
+					names[lp.GetName()] = struct{}{}
+				}
+			}
+		}
+		copied := false
+		for j, m := range mf.GetMetric() {
+			present := make(map[string]struct{}, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				present[lp.GetName()] = struct{}{}
+			}
+			var missing []string
+			for ln := range names {
+				if _, ok := present[ln]; !ok {
+					missing = append(missing, ln)
+				}
+			}
+			if len(missing) == 0 {
+				continue
+			}
+			if !copied {
+				mf = copyMetricFamily(mf)
+				mfs[i] = mf
+				copied = true
+			}
+			sort.Strings(missing)
+			padded := *m
+			padded.Label = append([]*dto.LabelPair{}, m.Label...)
+			for _, ln := range missing {
+				padded.Label = append(padded.Label, &dto.LabelPair{
+					Name:  proto.String(ln),
+					Value: proto.String(""),
+				})
+			}
+			mf.Metric[j] = &padded
+		}
+	}
+}
+
+// resolveGroup returns the resolved metric families of a group, sorted by
+// name. It returns an error if any of them cannot be encoded in the text
+// format or contains the same series more than once, which would both fail
+// the whole scrape.
+//
+// As stored metric families are never modified but replaced (see snapshot),
+// the result of checking one stays valid as long as it is stored. checked
+// holds the results of the previous unfiltered call of
+// GetMetricFamiliesFiltered, and the results of this call are added to
+// exposable, so that each stored metric family is encoded only once rather
+// than on every scrape, and results for metric families no longer stored are
+// dropped. Aggregated metric families
+// are resolved anew each time and therefore checked each time.
+func resolveGroup(names NameToTimestampedMetricFamilyMap, now time.Time, checked, exposable map[*dto.MetricFamily]error) ([]*dto.MetricFamily, error) {
+	result := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range sortedNames(names) {
+		tmf := names[name]
+		mf := tmf.resolve(now).MetricFamily
+		// Empty metric families do not encode, but they are dropped
+		// during exposition anyway.
+		if len(mf.GetMetric()) > 0 {
+			var err error
+			if tmf.aggregation != nil {
+				err = checkExposable(name, mf)
+			} else {
+				var ok bool
+				if err, ok = checked[mf]; !ok {
+					err = checkExposable(name, mf)
+				}
+				exposable[mf] = err
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, mf)
+	}
+	return result, nil
+}
+
+// checkExposable returns an error if the given non-empty metric family cannot
+// be encoded in the text format or contains the same series more than once.
+func checkExposable(name string, mf *dto.MetricFamily) error {
+	if _, err := text.MetricFamilyToText(ioutil.Discard, mf); err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(mf.GetMetric()))
+	for _, m := range mf.GetMetric() {
+		sig := labelsSignature(m.GetLabel())
+		if seen[sig] {
+			return fmt.Errorf("duplicate series {%s} in metric family %q", sig, name)
+		}
+		seen[sig] = true
+	}
+	return nil
+}
+
+// groupGauge returns a gauge metric with the given value, labeled with the
+// given grouping labels and with the synthetic label, if configured.
+func (dms *DiskMetricStore) groupGauge(labels map[string]string, value float64) *dto.Metric {
+	m := &dto.Metric{
+		Label: make([]*dto.LabelPair, 0, len(labels)+1),
+		Gauge: &dto.Gauge{Value: proto.Float64(value)},
+	}
+	for _, ln := range GroupingLabelNames(labels) {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(ln), Value: proto.String(labels[ln])})
+	}
+	if dms.syntheticLabel != nil {
+		m.Label = append(m.Label, dms.syntheticLabel)
+	}
+	return m
+}
+
+// unixSeconds returns the given time as Unix time in seconds, or 0 for the zero
+// time.
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// groupHash returns an FNV-1a hash of the given metric families, which have
+// to be sorted by name, reduced to 53 bits. The metrics of each family are
+// hashed in the order of their label signatures.
+func groupHash(mfs []*dto.MetricFamily) float64 {
+	h := fnv.New64a()
+	for _, mf := range mfs {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", mf.GetName(), mf.GetType(), mf.GetHelp())
+		metrics := make(map[string]string, len(mf.GetMetric()))
+		sigs := make([]string, 0, len(mf.GetMetric()))
+		for _, m := range mf.GetMetric() {
+			sig := labelsSignature(m.GetLabel())
+			withoutLabels := *m
+			withoutLabels.Label = nil
+			metrics[sig] = proto.CompactTextString(&withoutLabels)
+			sigs = append(sigs, sig)
+		}
+		sort.Strings(sigs)
+		for _, sig := range sigs {
+			fmt.Fprintf(h, "%s\x00%s\x00", sig, metrics[sig])
+		}
+	}
+	return float64(h.Sum64() & (1<<53 - 1))
+}
+
+// Reset implements the MetricStore interface.
+func (dms *DiskMetricStore) Reset(origin string) (int, error) {
+	deleted := dms.deleteGroups(func(map[string]string, time.Time) bool { return true }, DeletionReset, origin)
+	return deleted, dms.persistAndRecord()
+}
+
+// Describe implements prometheus.Collector.
+func (dms *DiskMetricStore) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dms.descs.writeQueueLength
+	ch <- dms.descs.writeQueueCapacity
+	ch <- dms.descs.metricFamilies
+	if dms.tenant != "" {
+		ch <- dms.descs.groups
+		ch <- dms.descs.bytes
+	}
+}
+
+// Collect implements prometheus.Collector. Unlike the metrics common to all
+// DiskMetricStores (like pushgateway_groups), the collected metrics describe
+// this DiskMetricStore, which therefore has to be registered to expose them.
+func (dms *DiskMetricStore) Collect(ch chan<- prometheus.Metric) {
+	dms.pendingLock.Lock()
+	pending := len(dms.pending)
+	dms.pendingLock.Unlock()
+	dms.lock.RLock()
+	families, groups, size := dms.families, dms.groupCount(), dms.bytes
+	dms.lock.RUnlock()
+	ch <- prometheus.MustNewConstMetric(dms.descs.writeQueueLength, prometheus.GaugeValue, float64(pending))
+	ch <- prometheus.MustNewConstMetric(dms.descs.writeQueueCapacity, prometheus.GaugeValue, float64(cap(dms.writeQueue)))
+	ch <- prometheus.MustNewConstMetric(dms.descs.metricFamilies, prometheus.GaugeValue, float64(families))
+	if dms.tenant != "" {
+		ch <- prometheus.MustNewConstMetric(dms.descs.groups, prometheus.GaugeValue, float64(groups))
+		ch <- prometheus.MustNewConstMetric(dms.descs.bytes, prometheus.GaugeValue, float64(size))
+	}
+}
+
+// setSizeGauges sets groupsGauge and storeBytesGauge to the current size of the
+// DiskMetricStore, unless it is the DiskMetricStore of a tenant (see
+// DiskMetricStoreOptions.Tenant). The caller must hold the lock.
+func (dms *DiskMetricStore) setSizeGauges() {
+	if dms.tenant != "" {
+		return
+	}
+	groupsGauge.Set(float64(dms.groupCount()))
+	storeBytesGauge.Set(float64(dms.bytes))
+}
+
+// setLimitGauges is like setSizeGauges for the limits of the DiskMetricStore.
+func (dms *DiskMetricStore) setLimitGauges(maxGroups int, maxBytes int64) {
+	if dms.tenant != "" {
+		return
+	}
+	groupsLimitGauge.Set(float64(maxGroups))
+	storeBytesLimitGauge.Set(float64(maxBytes))
+}
+
+// Healthy implements the MetricStore interface. The DiskMetricStore is
+// unhealthy once it is shut down or if the loop processing the write requests
+// has not made progress for loopStallTimeout.
+func (dms *DiskMetricStore) Healthy() error {
+	if atomic.LoadInt32(&dms.shutdown) == 1 {
+		return ErrShutdown
+	}
+	if stalled := time.Since(time.Unix(0, atomic.LoadInt64(&dms.loopHeartbeat))); stalled > loopStallTimeout {
+		return fmt.Errorf("write request processing stuck for %s", stalled)
+	}
+	return nil
+}
+
+// Ready implements the MetricStore interface. The DiskMetricStore is ready
+// once it has been opened, i.e. the persistence file has been restored, until
+// it is shut down, unless its write request queue is full.
+func (dms *DiskMetricStore) Ready() error {
+	if err := dms.Healthy(); err != nil {
+		return err
+	}
+	if len(dms.writeQueue) == cap(dms.writeQueue) {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// SetPaused implements the MetricStore interface.
+func (dms *DiskMetricStore) SetPaused(paused bool) {
+	var v int32
+	if paused {
+		v = 1
+	}
+	if atomic.SwapInt32(&dms.paused, v) == v {
+		return
+	}
+	select {
+	case dms.pauseChanged <- struct{}{}:
+	default:
+		// A signal is already pending.
+	}
+}
+
+// SetLimits changes the MaxGroups and MaxBytes options of the running store
+// (see DiskMetricStoreOptions). Lowering the group limit does not delete any
+// groups, it only prevents the creation of new ones. Lowering the size limit
+// evicts groups right away if the store exceeds the new limit. It returns the
+// number of evicted groups. With LimitEvict, lowering the group limit evicts
+// groups right away, too.
+func (dms *DiskMetricStore) SetLimits(maxGroups int, maxBytes int64) int {
+	dms.lock.Lock()
+	dms.maxGroups = maxGroups
+	dms.maxBytes = maxBytes
+	evicted := dms.evict()
+	if evicted > 0 {
+		atomic.AddUint64(&dms.version, 1)
+		if dms.pool != nil {
+			dms.pool.maybeRebuild(dms.metricFamilies)
+		}
+	}
+	dms.setSizeGauges()
+	dms.lock.Unlock()
+
+	dms.setLimitGauges(maxGroups, maxBytes)
+	if evicted > 0 {
+		dms.signalWrite()
+	}
+	return evicted
+}
+
+// SetExpiration changes the Expiration option of the running store (see
+// DiskMetricStoreOptions). It applies to all groups without a per-push
+// expiration from the next check for expired groups on.
+func (dms *DiskMetricStore) SetExpiration(expiration time.Duration) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dms.expiration = expiration
+}
+
+// Stats implements the MetricStore interface.
+func (dms *DiskMetricStore) Stats() Stats {
+	stats := Stats{
+		QueueLength:      len(dms.writeQueue),
+		QueueCapacity:    cap(dms.writeQueue),
+		LatencyQuantiles: map[float64]time.Duration{},
+		Paused:           atomic.LoadInt32(&dms.paused) == 1,
+	}
+	for _, q := range dms.workerQueues {
+		stats.QueueLength += len(q)
+	}
+	if ns := atomic.LoadInt64(&dms.lastPersist); ns != 0 {
+		stats.LastPersist = time.Unix(0, ns)
+	}
+	m := &dto.Metric{}
+	if err := writeRequestLatency.Write(m); err == nil {
+		for _, q := range m.GetSummary().GetQuantile() {
+			if math.IsNaN(q.GetValue()) {
+				continue // No observations yet.
+			}
+			stats.LatencyQuantiles[q.GetQuantile()] = time.Duration(q.GetValue() * float64(time.Second))
+		}
+	}
+
+	dms.lock.RLock()
+	stats.Bytes = dms.bytes
+	dms.lock.RUnlock()
+	groups := dms.snapshot()
+	stats.Groups = len(groups)
+	for _, g := range groups {
+		for _, tmf := range g.names {
+			stats.Series += len(tmf.MetricFamily.GetMetric())
+		}
+	}
+	return stats
+}
+
+// Shutdown implements the MetricStore interface.
+func (dms *DiskMetricStore) Shutdown() error {
+	atomic.StoreInt32(&dms.shutdown, 1)
+	close(dms.drain)
+	return <-dms.done
+}
+
+func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
+	lastPersist := time.Now()
+	persistScheduled := false
+	lastWrite := time.Time{}
+	persistDone := make(chan time.Time)
+	var persistTimer *time.Timer
+	expirationTicker := time.NewTicker(expirationSweepInterval)
+	defer expirationTicker.Stop()
+	// Receiving from a nil channel blocks forever, so there is no sync
+	// without Redis.
+	var redisSync <-chan time.Time
+	if dms.redis != nil {
+		redisTicker := time.NewTicker(dms.redis.syncInterval)
+		defer redisTicker.Stop()
+		redisSync = redisTicker.C
+	}
+
+	checkPersist := func() {
+		if !persistScheduled && lastWrite.After(lastPersist) {
+			persistTimer = time.AfterFunc(
+				persistenceInterval-lastWrite.Sub(lastPersist),
+				func() {
+					persistStarted := time.Now()
+					if err := dms.persistAndRecord(); err != nil {
+						logging.Error("Error persisting metrics.", "err", err)
+					} else {
+						logging.Info(
+							"Metrics persisted.",
+							"files", strings.Join(dms.routing.files(dms.persistenceFile), ","),
+						)
+					}
+					persistDone <- persistStarted
+				},
+			)
+			persistScheduled = true
+		}
+	}
+
+	for {
+		atomic.StoreInt64(&dms.loopHeartbeat, time.Now().UnixNano())
+		// Receiving from a nil channel blocks forever, so a paused
+		// loop leaves the write requests in the queue.
+		writeQueue := dms.writeQueue
+		if atomic.LoadInt32(&dms.paused) == 1 {
+			writeQueue = nil
+		}
+		select {
+		case wr := <-writeQueue:
+			if dms.dispatch(wr) {
+				lastWrite = time.Now()
+				checkPersist()
+			}
+		case <-dms.pauseChanged:
+			// Nothing to do, the paused state is evaluated above.
+		case <-dms.written:
+			lastWrite = time.Now()
+			checkPersist()
+		case lastPersist = <-persistDone:
+			persistScheduled = false
+			checkPersist() // In case something has been written in the meantime.
+		case now := <-expirationTicker.C:
+			dms.expire(now)
+		case <-redisSync:
+			dms.syncRedis()
+		case <-dms.drain:
+			// Prevent a scheduled persist from firing later.
+			if persistTimer != nil {
+				persistTimer.Stop()
+			}
+			// Now draining...
+			for {
+				select {
+				case wr := <-dms.writeQueue:
+					dms.dispatch(wr)
+				default:
+					for _, q := range dms.workerQueues {
+						close(q)
+					}
+					dms.workersDone.Wait()
+					err := dms.persistAndRecord()
+					dms.lock.Lock()
+					if dms.wal != nil {
+						if walErr := dms.wal.Close(); walErr != nil && err == nil {
+							err = walErr
+						}
+					}
+					if dms.redis != nil {
+						if redisErr := dms.redis.close(); redisErr != nil && err == nil {
+							err = redisErr
+						}
+					}
+					dms.lock.Unlock()
+					dms.done <- err
+					return
+				}
+			}
+		}
+	}
+}
+
+// dispatch processes the WriteRequest directly if there are no workers and
+// returns true. Otherwise, it hands the WriteRequest over to the worker
+// responsible for its job and returns false. The worker will signal the
+// completed processing via the written channel.
+func (dms *DiskMetricStore) dispatch(wr queuedWriteRequest) bool {
+	if len(dms.workerQueues) == 0 {
+		dms.processQueuedWriteRequest(wr)
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(wr.Labels["job"]))
+	dms.workerQueues[h.Sum32()%uint32(len(dms.workerQueues))] <- wr
+	return false
+}
+
+func (dms *DiskMetricStore) worker(q <-chan queuedWriteRequest) {
+	defer dms.workersDone.Done()
+	for wr := range q {
+		dms.processQueuedWriteRequest(wr)
+		dms.signalWrite()
+	}
+}
+
+// signalWrite notifies loop() about a write it has not done itself so that a
+// persist can be scheduled.
+func (dms *DiskMetricStore) signalWrite() {
+	select {
+	case dms.written <- struct{}{}:
+	default:
+		// A signal is already pending.
+	}
+}
+
+// DeleteGroups implements the MetricStore interface.
+func (dms *DiskMetricStore) DeleteGroups(filter func(labels map[string]string, lastPush time.Time) bool, origin string) int {
+	return dms.deleteGroups(filter, DeletionDeleteGroups, origin)
+}
+
+func (dms *DiskMetricStore) deleteGroups(filter func(labels map[string]string, lastPush time.Time) bool, reason, origin string) int {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+
+	deleted := 0
+	for key, group := range dms.metricFamilies {
+		if filter(group.Labels, group.LastPushTime()) {
+			dms.auditDeletion(key, reason, origin)
+			dms.deleteGroup(key)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		atomic.AddUint64(&dms.version, 1)
+		dms.setSizeGauges()
+		dms.signalWrite()
+	}
+	return deleted
+}
+
+// expire deletes all groups whose last push is longer ago than their
+// expiration (see DiskMetricStoreOptions.Expiration) and returns the number of
+// deleted groups.
+func (dms *DiskMetricStore) expire(now time.Time) int {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+
+	dms.forgetDeletions(now)
+	expired := 0
+	for key, group := range dms.metricFamilies {
+		expiration := group.Expiration
+		if expiration == 0 {
+			expiration = dms.expiration
+		}
+		if expiration <= 0 {
+			continue
+		}
+		lastPush := group.LastPushTime()
+		if now.Sub(lastPush) <= expiration {
+			continue
+		}
+		dms.auditDeletion(key, DeletionExpiration, "")
+		dms.deleteGroup(key)
+		expired++
+		logging.Info("Expired group.", "group", FormatGroup(group.Labels), "last_push", lastPush, "expiration", expiration)
+	}
+	if expired > 0 {
+		atomic.AddUint64(&dms.version, 1)
+		if dms.pool != nil {
+			dms.pool.maybeRebuild(dms.metricFamilies)
+		}
+		dms.setSizeGauges()
+		expiredGroups.Add(float64(expired))
+		dms.signalWrite()
+	}
+	return expired
+}
+
+func (dms *DiskMetricStore) processQueuedWriteRequest(wr queuedWriteRequest) {
+	dms.processWriteRequest(wr.WriteRequest)
+	writeRequestLatency.Observe(time.Since(wr.submitted).Seconds())
+	dms.pendingLock.Lock()
+	delete(dms.pending, wr.id)
+	dms.pendingLock.Unlock()
+}
+
+// processWriteRequest applies the given WriteRequest. The updated metrics of
+// a group are built while only holding the read lock, so that the workers (see
+// DiskMetricStoreOptions.WriteConcurrency) can do most of their work in
+// parallel. The write lock is only held to check the limits and to swap in the
+// updated group. If the group has been changed in the meantime, its updated
+// metrics are built again under the write lock.
+func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
+	var update *metricsUpdate
+	if wr.MetricFamilies != nil {
+		// These only modify the pushed metric families and thereby do
+		// not need the lock at all.
+		if dms.nonFinite == NonFiniteReplace {
+			replaceNonFinite(wr.MetricFamilies, dms.nonFiniteValue)
+		}
+		if dms.ingestionLabel != "" {
+			setLabel(wr.MetricFamilies, dms.ingestionLabel, wr.Timestamp.UTC().Format(time.RFC3339Nano))
+		}
+		if dms.pool != nil {
+			dms.pool.dedupe(wr.MetricFamilies)
+		}
+		if wr.Replace {
+			update = dms.newMetricsUpdate(nil, wr)
+		} else {
+			dms.lock.RLock()
+			stored := dms.metricFamilies[GroupingKeyFor(wr.Labels)].Metrics
+			dms.lock.RUnlock()
+			// Stored metrics are never modified, see below.
+			update = dms.newMetricsUpdate(stored, wr)
+		}
+	}
+
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	defer atomic.AddUint64(&dms.version, 1)
+	defer func() {
+		dms.setSizeGauges()
+	}()
+	key := GroupingKeyFor(wr.Labels)
+	if wr.MetricFamilies == nil {
+		// Delete.
+		keys := []string{}
+		if _, ok := wr.Labels["instance"]; ok {
+			if _, ok := dms.metricFamilies[key]; ok {
+				keys = append(keys, key)
+			}
+		} else {
+			for k, group := range dms.metricFamilies {
+				if includesLabels(group.Labels, wr.Labels) {
+					keys = append(keys, k)
+				}
+			}
+		}
+		if wr.DeleteMetric != "" {
+			// Only the groups with the metric family are affected.
+			affected := keys[:0]
+			for _, k := range keys {
+				if _, ok := dms.metricFamilies[k].Metrics[wr.DeleteMetric]; ok {
+					affected = append(affected, k)
+				}
+			}
+			keys = affected
+		}
+		outcome := OutcomeNotFound
+		if len(keys) > 0 {
+			outcome = OutcomeApplied
+		}
+		dms.recordEvent(wr, EventDelete, outcome)
+		for _, k := range keys {
+			if wr.DeleteMetric != "" && len(dms.metricFamilies[k].Metrics) > 1 {
+				dms.deleteMetricFamily(k, wr.DeleteMetric)
+				continue
+			}
+			dms.auditDeletion(k, DeletionDelete, wr.Origin)
+			dms.deleteGroup(k)
+		}
+		return
+	}
+	// Update. Check the limits before a replace to not delete an
+	// existing group.
+	if len(wr.MetricFamilies) > 0 || wr.KeepEmpty {
+		if err := dms.checkLimits(wr); err != nil {
+			logging.Warn("Dropping push.", "group", FormatGroup(wr.Labels), "err", err)
+			outcome := OutcomeTooManyGroups
+			if err == ErrTooManyMetricFamilies {
+				outcome = OutcomeTooManyMetricFamilies
+			}
+			dms.recordEvent(wr, EventPush, outcome)
+			return
+		}
+		if err := dms.checkTypeChange(wr); err != nil {
+			if dms.typeChange == TypeChangeReject {
+				logging.Warn("Dropping push.", "group", FormatGroup(wr.Labels), "err", err)
+				dms.recordEvent(wr, EventPush, OutcomeTypeChange)
+				dms.recordPushFailure(key, wr.Timestamp)
+				return
+			}
+			logging.Warn("Type change in push.", "group", FormatGroup(wr.Labels), "err", err)
+		}
+	}
+	dms.recordEvent(wr, EventPush, OutcomeApplied)
+	lastPushFailure := dms.metricFamilies[key].LastPushFailure
+	lastEmptyPush := dms.metricFamilies[key].LastEmptyPush
+	if wr.Replace {
+		if len(wr.MetricFamilies) == 0 && !wr.KeepEmpty {
+			dms.auditDeletion(key, DeletionReplace, wr.Origin)
+		}
+		dms.deleteGroup(key)
+		lastEmptyPush = time.Time{}
+	}
+	stored := dms.metricFamilies[key].Metrics
+	if !update.basedOn(stored) {
+		update = dms.newMetricsUpdate(stored, wr)
+	}
+	if len(wr.MetricFamilies) == 0 && wr.KeepEmpty {
+		lastEmptyPush = wr.Timestamp
+	} else if len(wr.MetricFamilies) == 0 {
+		if len(update.obsolete) > 0 && len(update.obsolete) == len(stored) {
+			dms.auditDeletion(key, DeletionMetricNames, wr.Origin)
+			dms.deleteGroup(key)
+			return
+		}
+		if len(update.obsolete) == 0 {
+			return
+		}
+	}
+	dms.bytes += update.bytes
+	dms.families += update.families
+	dms.metricFamilies[key] = MetricGroup{
+		Labels:          wr.Labels,
+		Metrics:         update.metrics,
+		Expiration:      wr.Expiration,
+		LastPushFailure: lastPushFailure,
+		LastPushInfo:    wr.PushInfo,
+		LastEmptyPush:   lastEmptyPush,
+	}
+	dms.logGroup(key, wr.Labels)
+	if dms.forward != nil && len(wr.MetricFamilies) > 0 {
+		dms.forward(wr)
+	}
+	dms.evict()
+	if dms.pool != nil {
+		dms.pool.maybeRebuild(dms.metricFamilies)
+	}
+}
+
+// metricsUpdate is the result of applying a push to the stored metrics of a
+// group.
+type metricsUpdate struct {
+	stored   NameToTimestampedMetricFamilyMap // The metrics the update is based on.
+	obsolete []string                         // Listed in MetricNames, but not pushed.
+	metrics  NameToTimestampedMetricFamilyMap
+	bytes    int64 // Change of DiskMetricStore.bytes.
+	families int   // Change of DiskMetricStore.families.
+}
+
+// newMetricsUpdate applies the pushed metric families of the given
+// WriteRequest to the given stored metrics of its group. Stored groups are
+// never modified, so that readers can use them without holding the lock (see
+// snapshot). Instead, the updated metrics are built as a copy, which replaces
+// the stored ones. Therefore, the caller only has to make sure that the stored
+// metrics are not modified concurrently, which they never are.
+func (dms *DiskMetricStore) newMetricsUpdate(stored NameToTimestampedMetricFamilyMap, wr WriteRequest) *metricsUpdate {
+	u := &metricsUpdate{stored: stored}
+	if !wr.Replace {
+		for _, name := range wr.MetricNames {
+			if _, ok := wr.MetricFamilies[name]; ok {
+				continue
+			}
+			if _, ok := stored[name]; ok {
+				u.obsolete = append(u.obsolete, name)
+			}
+		}
+	}
+	u.metrics = make(NameToTimestampedMetricFamilyMap, len(stored)+len(wr.MetricFamilies))
+	for name, tmf := range stored {
+		u.metrics[name] = tmf
+	}
+	for _, name := range u.obsolete {
+		u.bytes -= int64(proto.Size(u.metrics[name].MetricFamily))
+		u.families--
+		delete(u.metrics, name)
+	}
+	for name, mf := range wr.MetricFamilies {
+		if old, ok := u.metrics[name]; ok {
+			mf = mergeMetricFamily(old.MetricFamily, mf, wr.Merge, dms.ingestionLabel)
+		}
+		tmf := TimestampedMetricFamily{
+			Timestamp:    wr.Timestamp,
+			MetricFamily: mf,
+		}
+		if wr.Aggregation != nil {
+			tmf.aggregation = u.metrics[name].aggregation.add(*wr.Aggregation, tmf)
+		}
+		if old, ok := u.metrics[name]; ok {
+			u.bytes -= int64(proto.Size(old.MetricFamily))
+		} else {
+			u.families++
+		}
+		u.bytes += int64(proto.Size(mf))
+		u.metrics[name] = tmf
+	}
+	return u
+}
+
+// basedOn returns whether the update is based on the given stored metrics,
+// i.e. whether they are still the same map. A nil update is based on nothing.
+func (u *metricsUpdate) basedOn(stored NameToTimestampedMetricFamilyMap) bool {
+	if u == nil {
+		return false
+	}
+	return reflect.ValueOf(u.stored).Pointer() == reflect.ValueOf(stored).Pointer()
+}
 
-// DiskMetricStore is an implementation of MetricStore that persists metrics to
-// disk.
-type DiskMetricStore struct {
-	lock            sync.RWMutex // Protects metricFamilies.
-	writeQueue      chan WriteRequest
-	drain           chan struct{}
-	done            chan error
-	metricFamilies  JobToInstanceMap
-	persistenceFile string
+// deleteGroup deletes the group with the given grouping key (if it exists).
+// The caller must hold the write lock.
+func (dms *DiskMetricStore) deleteGroup(key string) {
+	if group, ok := dms.metricFamilies[key]; ok {
+		dms.bytes -= namesSize(group.Metrics)
+		dms.families -= len(group.Metrics)
+		delete(dms.metricFamilies, key)
+		dms.logGroup(key, group.Labels)
+	}
 }
 
-type mfStat struct {
-	pos    int  // Where in the result slice is the MetricFamily?
-	copied bool // Has the MetricFamily already been copied?
+// deleteMetricFamily deletes the metric family with the given name from the
+// group with the given grouping key, which must exist and must keep other
+// metric families. The caller must hold the write lock.
+func (dms *DiskMetricStore) deleteMetricFamily(key, name string) {
+	group := dms.metricFamilies[key]
+	// Like all stored groups, the group is replaced rather than
+	// modified, see snapshot.
+	names := make(NameToTimestampedMetricFamilyMap, len(group.Metrics)-1)
+	for n, tmf := range group.Metrics {
+		if n == name {
+			dms.bytes -= int64(proto.Size(tmf.MetricFamily))
+			dms.families--
+			continue
+		}
+		names[n] = tmf
+	}
+	group.Metrics = names
+	dms.metricFamilies[key] = group
+	dms.logGroup(key, group.Labels)
 }
 
-// NewDiskMetricStore returns a DiskMetricStore ready to use. To cleanly shut it
-// down and free resources, the Shutdown() method has to be called.  If
-// persistenceFile is the empty string, no persisting to disk will
-// happen. Otherwise, a file of that name is used for persisting metrics to
-// disk. If the file already exists, metrics are read from it as part of the
-// start-up. Persisting is happening upon shutdown and after every write action,
-// but the latter will only happen persistenceDuration after the previous
-// persisting.
-func NewDiskMetricStore(
-	persistenceFile string,
-	persistenceInterval time.Duration,
-) *DiskMetricStore {
-	dms := &DiskMetricStore{
-		writeQueue:      make(chan WriteRequest, writeQueueCapacity),
-		drain:           make(chan struct{}),
-		done:            make(chan error),
-		metricFamilies:  JobToInstanceMap{},
-		persistenceFile: persistenceFile,
+// openWriteAheadLog opens the write-ahead log with the given prefix and
+// replays its segments into the groups restored so far. If the log can be
+// opened, it is used even if replaying fails.
+func (dms *DiskMetricStore) openWriteAheadLog(prefix string) error {
+	wal, segments, err := openWriteAheadLog(prefix)
+	if err != nil {
+		return fmt.Errorf("could not open write-ahead log '%s': %s", prefix, err)
 	}
-	if err := dms.restore(); err != nil {
-		log.Print("Could not load persisted metrics: ", err)
+	dms.wal = wal
+	if len(segments) == 0 {
+		return nil
 	}
-	go dms.loop(persistenceInterval)
-	return dms
+	// Persist the replayed changes soon.
+	dms.signalWrite()
+	if err := replayWAL(segments, dms.metricFamilies); err != nil {
+		return err
+	}
+	logging.Info("Replayed write-ahead log segments.", "count", len(segments))
+	return nil
 }
 
-// SubmitWriteRequest implements the MetricStore interface.
-func (dms *DiskMetricStore) SubmitWriteRequest(req WriteRequest) {
-	dms.writeQueue <- req
+// logGroup records the current state of the group with the given grouping key
+// and labels (which is deleted if it does not exist anymore) in the
+// write-ahead log, unless there is none or the group is not persisted, in
+// Redis, if any, and passes it on for replication, if enabled. The caller must
+// hold the write lock.
+func (dms *DiskMetricStore) logGroup(key string, labels map[string]string) {
+	logged := dms.wal != nil && dms.routing.file(labels, dms.persistenceFile) != ""
+	if !logged && dms.redis == nil && dms.replicate == nil {
+		return
+	}
+	rec := walRecord{Labels: labels, Deleted: true}
+	if group, ok := dms.metricFamilies[key]; ok {
+		rec = groupRecord(group)
+	}
+	if logged {
+		dms.wal.append(rec)
+	}
+	if dms.redis != nil {
+		dms.redis.write(key, rec)
+	}
+	if dms.replicate != nil {
+		rec.Changed = time.Now()
+		dms.recordChange(key, rec)
+		dms.replicateGroup(rec)
+	}
 }
 
-// GetMetricFamilies implements the MetricStore interface.
-func (dms *DiskMetricStore) GetMetricFamilies() []*dto.MetricFamily {
-	result := []*dto.MetricFamily{}
-	mfStatByName := map[string]mfStat{}
+// syncRedis applies the groups changed in Redis by other DiskMetricStores.
+// Errors are logged and counted, the groups in memory stay as they are until
+// the next try.
+func (dms *DiskMetricStore) syncRedis() {
+	err := dms.redis.sync(&dms.lock, func(changes map[string]*MetricGroup) {
+		if len(changes) == 0 {
+			return
+		}
+		for key, group := range changes {
+			dms.replaceGroup(key, group)
+		}
+		if dms.pool != nil {
+			dms.pool.maybeRebuild(dms.metricFamilies)
+		}
+		dms.setSizeGauges()
+		atomic.AddUint64(&dms.version, 1)
+	})
+	if err != nil {
+		redisErrors.Inc()
+		logging.Error("Error syncing groups from Redis.", "err", err)
+	}
+}
 
-	dms.lock.RLock()
-	defer dms.lock.RUnlock()
+// replaceGroup replaces the group with the given grouping key by the given
+// group, or deletes it if group is nil, without logging the change. The caller
+// must hold the write lock.
+func (dms *DiskMetricStore) replaceGroup(key string, group *MetricGroup) {
+	if old, ok := dms.metricFamilies[key]; ok {
+		dms.bytes -= namesSize(old.Metrics)
+		dms.families -= len(old.Metrics)
+		delete(dms.metricFamilies, key)
+	}
+	if group == nil {
+		return
+	}
+	if dms.pool != nil {
+		for _, tmf := range group.Metrics {
+			dms.pool.dedupeMetricFamily(tmf.MetricFamily)
+		}
+	}
+	dms.metricFamilies[key] = *group
+	dms.bytes += namesSize(group.Metrics)
+	dms.families += len(group.Metrics)
+}
 
-	for _, instances := range dms.metricFamilies {
-		for _, names := range instances {
-			for name, tmf := range names {
-				mf := tmf.MetricFamily
-				stat, exists := mfStatByName[name]
-				if exists {
-					existingMF := result[stat.pos]
-					if !stat.copied {
-						mfStatByName[name] = mfStat{
-							pos:    stat.pos,
-							copied: true,
-						}
-						existingMF = copyMetricFamily(existingMF)
-						result[stat.pos] = existingMF
-					}
-					if mf.GetHelp() != existingMF.GetHelp() || mf.GetType() != existingMF.GetType() {
-						log.Printf(
-							"Metric families '%s' and '%s' are inconsistent, help and type of the latter will have priority. This is bad. Fix your pushed metrics!",
-							mf, existingMF,
-						)
-					}
-					for _, metric := range mf.Metric {
-						existingMF.Metric = append(existingMF.Metric, metric)
-					}
-				} else {
-					mfStatByName[name] = mfStat{
-						pos:    len(result),
-						copied: false,
-					}
-					result = append(result, mf)
-				}
-			}
+// includesLabels returns whether labels includes all the label pairs of
+// subset.
+func includesLabels(labels, subset map[string]string) bool {
+	for ln, lv := range subset {
+		if v, ok := labels[ln]; !ok || v != lv {
+			return false
 		}
 	}
-	return result
+	return true
 }
 
-// Shutdown implements the MetricStore interface.
-func (dms *DiskMetricStore) Shutdown() error {
-	close(dms.drain)
-	return <-dms.done
+// recordEvent records the given write request in the event log, if any, and
+// logs it at level debug.
+func (dms *DiskMetricStore) recordEvent(wr WriteRequest, typ, outcome string) {
+	if logging.Enabled(logging.LevelDebug) {
+		logging.Debug(
+			"Processed write request.",
+			"type", typ, "group", FormatGroup(wr.Labels), "outcome", outcome,
+			"origin", wr.Origin, "bytes", wr.PushInfo.BodyBytes,
+		)
+	}
+	if dms.events == nil {
+		return
+	}
+	dms.events.record(Event{
+		Time:    time.Now(),
+		Type:    typ,
+		Labels:  wr.Labels,
+		Outcome: outcome,
+		Origin:  wr.Origin,
+	})
 }
 
-func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
-	lastPersist := time.Now()
-	persistScheduled := false
-	lastWrite := time.Time{}
-	persistDone := make(chan time.Time)
-	var persistTimer *time.Timer
+// auditDeletion records the imminent deletion of the group with the given
+// grouping key in the audit log, if any, and if the group exists. The caller
+// must hold the lock.
+func (dms *DiskMetricStore) auditDeletion(key, reason, origin string) {
+	if dms.audit == nil {
+		return
+	}
+	group, ok := dms.metricFamilies[key]
+	if !ok {
+		return
+	}
+	dms.audit.record(auditRecord{
+		Time:     time.Now(),
+		Reason:   reason,
+		Labels:   group.Labels,
+		Origin:   origin,
+		LastPush: group.LastPushTime(),
+	})
+}
 
-	checkPersist := func() {
-		if !persistScheduled && lastWrite.After(lastPersist) {
-			persistTimer = time.AfterFunc(
-				persistenceInterval-lastWrite.Sub(lastPersist),
-				func() {
-					persistStarted := time.Now()
-					if err := dms.persist(); err != nil {
-						log.Print("Error persisting metrics: ", err)
-					} else {
-						log.Printf(
-							"Metrics persisted to '%s'.",
-							dms.persistenceFile,
-						)
-					}
-					persistDone <- persistStarted
-				},
-			)
-			persistScheduled = true
+// evict deletes groups, oldest last push first, until the estimated size of
+// the store is within maxBytes and, with LimitEvict, the numbers of groups and
+// metric families are within their limits. It returns the number of deleted
+// groups. The caller must hold the write lock.
+func (dms *DiskMetricStore) evict() int {
+	if dms.exceededLimit() == "" {
+		return 0
+	}
+	groups := groupsByLastPush{}
+	for key, group := range dms.metricFamilies {
+		groups = append(groups, groupLastPush{key, group.Labels, group.LastPushTime()})
+	}
+	sort.Sort(groups)
+	evicted := 0
+	for _, g := range groups {
+		exceeded := dms.exceededLimit()
+		if exceeded == "" {
+			break
 		}
+		dms.auditDeletion(g.key, DeletionEviction, "")
+		dms.deleteGroup(g.key)
+		evicted++
+		logging.Warn("Evicted group as the store exceeded a limit.", "group", FormatGroup(g.labels), "last_push", g.lastPush, "exceeded", exceeded)
 	}
+	evictedGroups.Add(float64(evicted))
+	return evicted
+}
 
-	for {
-		select {
-		case wr := <-dms.writeQueue:
-			dms.processWriteRequest(wr)
-			lastWrite = time.Now()
-			checkPersist()
-		case lastPersist = <-persistDone:
-			persistScheduled = false
-			checkPersist() // In case something has been written in the meantime.
-		case <-dms.drain:
-			// Prevent a scheduled persist from firing later.
-			if persistTimer != nil {
-				persistTimer.Stop()
-			}
-			// Now draining...
-			for {
-				select {
-				case wr := <-dms.writeQueue:
-					dms.processWriteRequest(wr)
-				default:
-					dms.done <- dms.persist()
-					return
+// exceededLimit describes the first limit evict has to enforce that the store
+// exceeds, or returns the empty string if there is none. The caller must hold
+// the lock.
+func (dms *DiskMetricStore) exceededLimit() string {
+	switch {
+	case dms.maxBytes > 0 && dms.bytes > dms.maxBytes:
+		return fmt.Sprintf("%d bytes", dms.maxBytes)
+	case dms.limitPolicy != LimitEvict:
+		return ""
+	case dms.maxGroups > 0 && dms.groupCount() > dms.maxGroups:
+		return fmt.Sprintf("%d groups", dms.maxGroups)
+	case dms.maxFamilies > 0 && dms.families > dms.maxFamilies:
+		return fmt.Sprintf("%d metric families", dms.maxFamilies)
+	}
+	return ""
+}
+
+// namesSize returns the estimated size of a group, i.e. the sum of the
+// serialized sizes of its metric families. The additional pushes retained
+// for windowed aggregation are not taken into account.
+func namesSize(names NameToTimestampedMetricFamilyMap) int64 {
+	var size int64
+	for _, tmf := range names {
+		size += int64(proto.Size(tmf.MetricFamily))
+	}
+	return size
+}
+
+type groupLastPush struct {
+	key      string
+	labels   map[string]string
+	lastPush time.Time
+}
+
+// groupsByLastPush sorts groups by their last push, oldest first, and then
+// according to GroupLess.
+type groupsByLastPush []groupLastPush
+
+func (s groupsByLastPush) Len() int      { return len(s) }
+func (s groupsByLastPush) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s groupsByLastPush) Less(i, j int) bool {
+	if !s[i].lastPush.Equal(s[j].lastPush) {
+		return s[i].lastPush.Before(s[j].lastPush)
+	}
+	return groupLess(s[i].labels, s[j].labels, s[i].key, s[j].key)
+}
+
+// setLabel sets the label with the given name to the given value on all
+// metrics, adding the label where missing.
+func setLabel(metricFamilies map[string]*dto.MetricFamily, name, value string) {
+	for _, mf := range metricFamilies {
+	metric:
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == name {
+					lp.Value = proto.String(value)
+					continue metric
 				}
 			}
+			m.Label = append(m.Label, &dto.LabelPair{
+				Name:  proto.String(name),
+				Value: proto.String(value),
+			})
 		}
 	}
 }
 
-func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
-	dms.lock.Lock()
-	defer dms.lock.Unlock()
-	if wr.MetricFamilies == nil {
-		// Delete.
-		if wr.Instance == "" {
-			delete(dms.metricFamilies, wr.Job)
-		} else {
-			instances, ok := dms.metricFamilies[wr.Job]
-			if ok {
-				delete(instances, wr.Instance)
-				if len(instances) == 0 {
-					// Clean up empty instance maps to not leak memory.
-					delete(dms.metricFamilies, wr.Job)
-				}
-			}
+// storedGroup is a group as returned by snapshot.
+type storedGroup struct {
+	key             string
+	labels          map[string]string
+	names           NameToTimestampedMetricFamilyMap
+	expiration      time.Duration
+	lastPushFailure time.Time
+	lastPushInfo    PushInfo
+	lastEmptyPush   time.Time
+}
+
+// lastPushTime is MetricGroup.LastPushTime for a storedGroup.
+func (g storedGroup) lastPushTime() time.Time {
+	return MetricGroup{Metrics: g.names, LastEmptyPush: g.lastEmptyPush}.LastPushTime()
+}
+
+// snapshot returns all stored groups, sorted according to GroupLess. The lock is
+// only held to collect the groups, not while the caller processes them. That
+// is safe because stored groups are never modified but replaced by an updated
+// copy (see processWriteRequest), so that scrapes and other reads neither
+// block nor are blocked by write requests and deletions for longer than it
+// takes to copy the references to all groups.
+func (dms *DiskMetricStore) snapshot() []storedGroup {
+	dms.lock.RLock()
+	groups := make([]storedGroup, 0, dms.groupCount())
+	for key, group := range dms.metricFamilies {
+		groups = append(groups, storedGroup{key, group.Labels, group.Metrics, group.Expiration, group.LastPushFailure, group.LastPushInfo, group.LastEmptyPush})
+	}
+	dms.lock.RUnlock()
+	sort.Sort(storedGroupsByName(groups))
+	return groups
+}
+
+type storedGroupsByName []storedGroup
+
+func (s storedGroupsByName) Len() int      { return len(s) }
+func (s storedGroupsByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s storedGroupsByName) Less(i, j int) bool {
+	return groupLess(s[i].labels, s[j].labels, s[i].key, s[j].key)
+}
+
+// getGroupsByFile returns all stored groups, keyed by the file they are
+// persisted to. Each of the given files is part of the result, even if no
+// group is persisted to it.
+func (dms *DiskMetricStore) getGroupsByFile(files []string) map[string][]storedGroup {
+	result := make(map[string][]storedGroup, len(files))
+	for _, file := range files {
+		result[file] = []storedGroup{}
+	}
+	for _, g := range dms.snapshot() {
+		file := dms.routing.file(g.labels, dms.persistenceFile)
+		if file == "" {
+			continue // Not persisted.
 		}
-		return
+		result[file] = append(result[file], g)
 	}
-	// Update.
-	for name, mf := range wr.MetricFamilies {
-		instances, ok := dms.metricFamilies[wr.Job]
-		if !ok {
-			instances = InstanceToNameMap{}
-			dms.metricFamilies[wr.Job] = instances
+	return result
+}
+
+// Version returns a number that changes with every change of the stored
+// metrics, i.e. with every processed write request and every deletion.
+// Results of GetMetricFamilies that depend on the current time (see
+// GroupUpFreshness and ScrapeQuietPeriod) can change without a change of the
+// version.
+func (dms *DiskMetricStore) Version() uint64 {
+	return atomic.LoadUint64(&dms.version)
+}
+
+// GetMetricFamiliesMap implements the MetricStore interface.
+func (dms *DiskMetricStore) GetMetricFamiliesMap() GroupingKeyToMetricGroup {
+	now := time.Now()
+	groupsCopy := GroupingKeyToMetricGroup{}
+	for _, g := range dms.snapshot() {
+		labelsCopy := make(map[string]string, len(g.labels))
+		for ln, lv := range g.labels {
+			labelsCopy[ln] = lv
 		}
-		names, ok := instances[wr.Instance]
-		if !ok {
-			names = NameToTimestampedMetricFamilyMap{}
-			instances[wr.Instance] = names
+		n2tmfCopy := make(NameToTimestampedMetricFamilyMap, len(g.names))
+		for n, tmf := range g.names {
+			n2tmfCopy[n] = tmf.resolve(now)
 		}
-		names[name] = TimestampedMetricFamily{
-			Timestamp:    wr.Timestamp,
-			MetricFamily: mf,
+		groupsCopy[g.key] = MetricGroup{
+			Labels:          labelsCopy,
+			Metrics:         n2tmfCopy,
+			Expiration:      g.expiration,
+			LastPushFailure: g.lastPushFailure,
+			LastPushInfo:    g.lastPushInfo,
+			LastEmptyPush:   g.lastEmptyPush,
 		}
 	}
+	return groupsCopy
 }
 
-func (dms *DiskMetricStore) getTimestampedMetricFamilies() []TimestampedMetricFamily {
-	result := []TimestampedMetricFamily{}
+// GetGroup implements the MetricStore interface.
+func (dms *DiskMetricStore) GetGroup(labels map[string]string) ([]*dto.MetricFamily, time.Time, bool) {
 	dms.lock.RLock()
-	defer dms.lock.RUnlock()
-	for _, i2n := range dms.metricFamilies {
-		for _, n2tmf := range i2n {
-			for _, tmf := range n2tmf {
-				result = append(result, tmf)
-			}
-		}
+	group, ok := dms.metricFamilies[GroupingKeyFor(labels)]
+	dms.lock.RUnlock()
+	names := group.Metrics
+	if !ok {
+		return nil, time.Time{}, false
 	}
-	return result
+	// Stored groups are never modified (see processWriteRequest), so
+	// they can be copied without holding the lock.
+	now := time.Now()
+	mfs := make([]*dto.MetricFamily, 0, len(names))
+	for _, tmf := range names {
+		mfs = append(mfs, proto.Clone(tmf.resolve(now).MetricFamily).(*dto.MetricFamily))
+	}
+	sort.Sort(metricFamiliesByName(mfs))
+	return mfs, group.LastPushTime(), true
 }
 
-// GetMetricFamiliesMap implements the MetricStore interface.
-func (dms *DiskMetricStore) GetMetricFamiliesMap() JobToInstanceMap {
-	dms.lock.RLock()
-	defer dms.lock.RUnlock()
-	j2iCopy := make(JobToInstanceMap, len(dms.metricFamilies))
-	for j, i2n := range dms.metricFamilies {
-		i2nCopy := make(InstanceToNameMap, len(i2n))
-		j2iCopy[j] = i2nCopy
-		for i, n2tmf := range i2n {
-			n2tmfCopy := make(NameToTimestampedMetricFamilyMap, len(n2tmf))
-			i2nCopy[i] = n2tmfCopy
-			for n, tmf := range n2tmf {
-				n2tmfCopy[n] = tmf
-			}
-		}
+// persistAndRecord calls persist and records the time of a successful persist
+// for the Stats.
+func (dms *DiskMetricStore) persistAndRecord() error {
+	if len(dms.routing.files(dms.persistenceFile)) == 0 {
+		return nil
+	}
+	started := time.Now()
+	err := dms.persist()
+	persistDuration.Observe(time.Since(started).Seconds())
+	if err != nil {
+		persistErrors.Inc()
+		return err
 	}
-	return j2iCopy
+	atomic.StoreInt64(&dms.lastPersist, started.UnixNano())
+	return nil
 }
 
+// persist writes all persistence files. Each file is written completely (and
+// replaced atomically) even if none of its groups has changed. The first error
+// is returned, but the remaining files are still written.
 func (dms *DiskMetricStore) persist() error {
-	if dms.persistenceFile == "" {
+	files := dms.routing.files(dms.persistenceFile)
+	if len(files) == 0 {
 		return nil
 	}
+	// Concurrent persists could otherwise overtake each other, so that an
+	// older state ends up in the persistence file.
+	dms.persistLock.Lock()
+	defer dms.persistLock.Unlock()
+
+	// Everything recorded in the write-ahead log before the rotation is
+	// part of the persisted state. Changes between the rotation and
+	// collecting the groups end up in both, which is fine as replaying a
+	// record is idempotent.
+	var obsolete []string // Segments to remove after the persist.
+	if dms.wal != nil {
+		dms.lock.Lock()
+		var err error
+		obsolete, err = dms.wal.rotate()
+		dms.lock.Unlock()
+		if err != nil {
+			logging.Error("Error rotating write-ahead log.", "err", err)
+		}
+	}
+	var firstErr error
+	for file, groups := range dms.getGroupsByFile(files) {
+		if err := persistFile(file, groups); err != nil {
+			logging.Error("Error persisting metrics.", "file", file, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr == nil {
+		removeSegments(obsolete)
+	}
+	return firstErr
+}
+
+func persistFile(file string, groups []storedGroup) error {
 	f, err := ioutil.TempFile(
-		path.Dir(dms.persistenceFile),
-		path.Base(dms.persistenceFile)+".in_progress.",
+		path.Dir(file),
+		path.Base(file)+".in_progress.",
 	)
 	if err != nil {
 		return err
 	}
 	inProgressFileName := f.Name()
-	e := gob.NewEncoder(f)
-	for _, tmf := range dms.getTimestampedMetricFamilies() {
-		if err := writeTimestampedMetricFamily(e, tmf); err != nil {
-			f.Close()
-			os.Remove(inProgressFileName)
-			return err
-		}
+	if err := writePersistence(f, groups); err != nil {
+		f.Close()
+		os.Remove(inProgressFileName)
+		return err
 	}
 	if err := f.Close(); err != nil {
 		os.Remove(inProgressFileName)
 		return err
 	}
-	return os.Rename(inProgressFileName, dms.persistenceFile)
+	return os.Rename(inProgressFileName, file)
 }
 
-func (dms *DiskMetricStore) restore() error {
-	if dms.persistenceFile == "" {
-		return nil
+// writePersistence writes the given groups to w in the format of the
+// persistence files.
+func writePersistence(w io.Writer, groups []storedGroup) error {
+	e := gob.NewEncoder(w)
+	if err := e.Encode(persistenceMagic); err != nil {
+		return err
 	}
-	f, err := os.Open(dms.persistenceFile)
+	for _, g := range groups {
+		state := persistedGroupState{Expiration: g.expiration, LastPushFailure: g.lastPushFailure, LastPushInfo: g.lastPushInfo, LastEmptyPush: g.lastEmptyPush}
+		if len(g.names) == 0 {
+			// A group without metric families (see
+			// WriteRequest.KeepEmpty) is persisted as a metric
+			// family without metrics, which only creates the
+			// group on restore.
+			tmf := TimestampedMetricFamily{Timestamp: g.lastEmptyPush, MetricFamily: &dto.MetricFamily{}}
+			if err := writeTimestampedMetricFamily(e, tmf, g.labels, state); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, tmf := range g.names {
+			if err := writeTimestampedMetricFamily(e, tmf, g.labels, state); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restore reads the given persistence file into groups. Files written before
+// the grouping labels were persisted (i.e. without persistenceMagic) are
+// restored, too, taking the job and instance label of the first metric of
+// each metric family as its grouping labels and the zero value as the state
+// of its group, e.g. the default expiration.
+func restore(file string, groups GroupingKeyToMetricGroup) error {
+	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	var tmf TimestampedMetricFamily
-	for d := gob.NewDecoder(f); err == nil; tmf, err = readTimestampedMetricFamily(d) {
-		if len(tmf.MetricFamily.GetMetric()) == 0 {
+	return readPersistence(f, groups)
+}
+
+// readPersistence reads groups from r in either format of the persistence
+// files, see restore.
+func readPersistence(f io.ReadSeeker, groups GroupingKeyToMetricGroup) error {
+	d := gob.NewDecoder(f)
+	var magic []byte
+	if err := d.Decode(&magic); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+	legacy := !bytes.Equal(magic, persistenceMagic)
+	if legacy {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		d = gob.NewDecoder(f)
+	}
+	for {
+		tmf, labels, state, err := readTimestampedMetricFamily(d, legacy)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(tmf.MetricFamily.GetMetric()) == 0 && state.LastEmptyPush.IsZero() {
 			continue // No metric in this MetricFamily.
 		}
-		name := tmf.MetricFamily.GetName()
-		var job, instance string
-		for _, lp := range tmf.MetricFamily.GetMetric()[0].GetLabel() {
-			// With the way the pushgateway persists things, all
-			// metrics in a single MetricFamily proto message share
-			// the same job and instance label. So we only have to
-			// peek at the first metric to find it.
-			switch lp.GetName() {
-			case "job":
-				job = lp.GetValue()
-			case "instance":
-				instance = lp.GetValue()
-			}
-			if job != "" && instance != "" {
-				break
+		if legacy {
+			labels = map[string]string{}
+			for _, lp := range tmf.MetricFamily.GetMetric()[0].GetLabel() {
+				// All metrics in a single MetricFamily proto
+				// message share the same job and instance
+				// label. So we only have to peek at the first
+				// metric to find it.
+				if ln := lp.GetName(); ln == "job" || ln == "instance" {
+					labels[ln] = lp.GetValue()
+				}
 			}
 		}
-		instances, ok := dms.metricFamilies[job]
+		key := GroupingKeyFor(labels)
+		group, ok := groups[key]
 		if !ok {
-			instances = InstanceToNameMap{}
-			dms.metricFamilies[job] = instances
+			group = MetricGroup{
+				Labels:          labels,
+				Metrics:         NameToTimestampedMetricFamilyMap{},
+				Expiration:      state.Expiration,
+				LastPushFailure: state.LastPushFailure,
+				LastPushInfo:    state.LastPushInfo,
+				LastEmptyPush:   state.LastEmptyPush,
+			}
+			groups[key] = group
 		}
-		names, ok := instances[instance]
-		if !ok {
-			names = NameToTimestampedMetricFamilyMap{}
-			instances[instance] = names
+		if len(tmf.MetricFamily.GetMetric()) == 0 {
+			continue // Only recorded to create the group.
 		}
-		names[name] = tmf
+		group.Metrics[tmf.MetricFamily.GetName()] = tmf
 	}
-	if err == io.EOF {
-		return nil
+}
+
+// mergeGroups adds the metric families in src to dst, replacing metric
+// families of the same group and name.
+func mergeGroups(dst, src GroupingKeyToMetricGroup) {
+	for key, group := range src {
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = group
+			continue
+		}
+		for name, tmf := range group.Metrics {
+			existing.Metrics[name] = tmf
+		}
+		if group.LastEmptyPush.After(existing.LastEmptyPush) {
+			existing.LastEmptyPush = group.LastEmptyPush
+			dst[key] = existing
+		}
 	}
-	return err
 }
 
-func writeTimestampedMetricFamily(e *gob.Encoder, tmf TimestampedMetricFamily) error {
+// persistenceMagic starts every persistence file that records the grouping
+// labels and the persistedGroupState of the group of each metric family
+// (following its timestamp).
+var persistenceMagic = []byte("\xffpushgateway grouping labels and group state")
+
+// persistedGroupState is the state of a group persisted besides its metric
+// families and grouping labels. As gob ignores fields missing on either side,
+// fields can be added without a new persistence format.
+type persistedGroupState struct {
+	Expiration      time.Duration
+	LastPushFailure time.Time
+	LastPushInfo    PushInfo
+	LastEmptyPush   time.Time
+}
+
+func writeTimestampedMetricFamily(e *gob.Encoder, tmf TimestampedMetricFamily, labels map[string]string, state persistedGroupState) error {
 	// Since we have to serialize the timestamp, too, we are using gob for
 	// everything (and not pbutil.WriteDelimited).
 	buffer, err := proto.Marshal(tmf.MetricFamily)
@@ -346,23 +2644,40 @@ func writeTimestampedMetricFamily(e *gob.Encoder, tmf TimestampedMetricFamily) e
 	if err := e.Encode(tmf.Timestamp); err != nil {
 		return err
 	}
-	return nil
+	if err := e.Encode(labels); err != nil {
+		return err
+	}
+	return e.Encode(state)
 }
 
-func readTimestampedMetricFamily(d *gob.Decoder) (TimestampedMetricFamily, error) {
+// readTimestampedMetricFamily reads a TimestampedMetricFamily and, unless
+// reading the legacy format, the grouping labels and the state of its group.
+func readTimestampedMetricFamily(d *gob.Decoder, legacy bool) (TimestampedMetricFamily, map[string]string, persistedGroupState, error) {
 	var buffer []byte
 	if err := d.Decode(&buffer); err != nil {
-		return TimestampedMetricFamily{}, err
+		return TimestampedMetricFamily{}, nil, persistedGroupState{}, err
 	}
 	mf := &dto.MetricFamily{}
 	if err := proto.Unmarshal(buffer, mf); err != nil {
-		return TimestampedMetricFamily{}, err
+		return TimestampedMetricFamily{}, nil, persistedGroupState{}, err
 	}
 	var timestamp time.Time
 	if err := d.Decode(&timestamp); err != nil {
-		return TimestampedMetricFamily{}, err
+		return TimestampedMetricFamily{}, nil, persistedGroupState{}, err
 	}
-	return TimestampedMetricFamily{MetricFamily: mf, Timestamp: timestamp}, nil
+	var (
+		labels map[string]string
+		state  persistedGroupState
+	)
+	if !legacy {
+		if err := d.Decode(&labels); err != nil {
+			return TimestampedMetricFamily{}, nil, persistedGroupState{}, err
+		}
+		if err := d.Decode(&state); err != nil {
+			return TimestampedMetricFamily{}, nil, persistedGroupState{}, err
+		}
+	}
+	return TimestampedMetricFamily{MetricFamily: mf, Timestamp: timestamp}, labels, state, nil
 }
 
 func copyMetricFamily(mf *dto.MetricFamily) *dto.MetricFamily {
@@ -373,3 +2688,12 @@ func copyMetricFamily(mf *dto.MetricFamily) *dto.MetricFamily {
 		Metric: append([]*dto.Metric{}, mf.Metric...),
 	}
 }
+
+func sortedNames(n2tmf NameToTimestampedMetricFamilyMap) []string {
+	result := make([]string, 0, len(n2tmf))
+	for name := range n2tmf {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -14,16 +14,29 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net"
 	"os"
 	"path"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/text"
 
 	dto "github.com/prometheus/client_model/go"
 )
@@ -262,10 +275,47 @@ var (
 	}
 )
 
+// jobToInstance and instanceToName describe groups identified by job and
+// instance only, see groupsOf.
+type (
+	jobToInstance  map[string]instanceToName
+	instanceToName map[string]NameToTimestampedMetricFamilyMap
+)
+
+// groupsOf returns the given groups as stored by a DiskMetricStore.
+func groupsOf(j2i jobToInstance) GroupingKeyToMetricGroup {
+	groups := GroupingKeyToMetricGroup{}
+	for job, i2n := range j2i {
+		for instance, n2tmf := range i2n {
+			labels := map[string]string{"job": job, "instance": instance}
+			groups[GroupingKeyFor(labels)] = MetricGroup{Labels: labels, Metrics: n2tmf}
+		}
+	}
+	return groups
+}
+
+// groupMetrics returns the metrics of the group with the given job and
+// instance (and no other grouping labels).
+func groupMetrics(groups GroupingKeyToMetricGroup, job, instance string) NameToTimestampedMetricFamilyMap {
+	return groups[GroupingKeyFor(map[string]string{"job": job, "instance": instance})].Metrics
+}
+
+// instancesOf returns the sorted instances of the groups of the given job.
+func instancesOf(groups GroupingKeyToMetricGroup, job string) []string {
+	instances := []string{}
+	for _, group := range groups {
+		if group.Labels["job"] == job {
+			instances = append(instances, group.Labels["instance"])
+		}
+	}
+	sort.Strings(instances)
+	return instances
+}
+
 func TestGetMetricFamilies(t *testing.T) {
 	testTime := time.Now()
-	j2i := JobToInstanceMap{
-		"job1": InstanceToNameMap{
+	j2i := groupsOf(jobToInstance{
+		"job1": instanceToName{
 			"instance1": NameToTimestampedMetricFamilyMap{
 				"mf2": TimestampedMetricFamily{
 					Timestamp:    testTime,
@@ -283,14 +333,14 @@ func TestGetMetricFamilies(t *testing.T) {
 				},
 			},
 		},
-		"job2": InstanceToNameMap{
+		"job2": instanceToName{
 			"instance1": NameToTimestampedMetricFamilyMap{
 				"mf1": TimestampedMetricFamily{
 					Timestamp:    testTime,
 					MetricFamily: mf1c,
 				},
 			}},
-		"job3": InstanceToNameMap{
+		"job3": instanceToName{
 			"instance1": NameToTimestampedMetricFamilyMap{},
 			"instance2": NameToTimestampedMetricFamilyMap{
 				"mf4": TimestampedMetricFamily{
@@ -303,8 +353,8 @@ func TestGetMetricFamilies(t *testing.T) {
 				},
 			},
 		},
-		"job4": InstanceToNameMap{},
-	}
+		"job4": instanceToName{},
+	})
 
 	dms := &DiskMetricStore{metricFamilies: j2i}
 
@@ -313,6 +363,147 @@ func TestGetMetricFamilies(t *testing.T) {
 	}
 }
 
+func TestGetMetricFamiliesMergedText(t *testing.T) {
+	mf := func(job, help string, value float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("mf"),
+			Help: proto.String(help),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				&dto.Metric{
+					Label: []*dto.LabelPair{
+						&dto.LabelPair{
+							Name:  proto.String("job"),
+							Value: proto.String(job),
+						},
+					},
+					Gauge: &dto.Gauge{Value: proto.Float64(value)},
+				},
+			},
+		}
+	}
+	dms := &DiskMetricStore{metricFamilies: groupsOf(jobToInstance{
+		"b": instanceToName{
+			"i": NameToTimestampedMetricFamilyMap{
+				"mf": TimestampedMetricFamily{MetricFamily: mf("b", "help b", 2)},
+			},
+		},
+		"a": instanceToName{
+			"i": NameToTimestampedMetricFamilyMap{
+				"mf": TimestampedMetricFamily{MetricFamily: mf("a", "help a", 1)},
+			},
+		},
+		"c": instanceToName{
+			"i": NameToTimestampedMetricFamilyMap{
+				"mf": TimestampedMetricFamily{MetricFamily: mf("c", "help a", 3)},
+			},
+		},
+	})}
+
+	var buf bytes.Buffer
+	for _, mf := range dms.GetMetricFamilies() {
+		if _, err := text.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := `# HELP mf help a
+# TYPE mf gauge
+mf{job="a"} 1
+mf{job="b"} 2
+mf{job="c"} 3
+`
+	if got := buf.String(); expected != got {
+		t.Errorf("Expected text output %q, got %q.", expected, got)
+	}
+}
+
+func TestHelpConflictPolicy(t *testing.T) {
+	mf := func(job, help string) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("mf"),
+			Help: proto.String(help),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				&dto.Metric{
+					Label: []*dto.LabelPair{
+						&dto.LabelPair{
+							Name:  proto.String("job"),
+							Value: proto.String(job),
+						},
+					},
+					Gauge: &dto.Gauge{Value: proto.Float64(1)},
+				},
+			},
+		}
+	}
+	group := func(mfs ...*dto.MetricFamily) instanceToName {
+		n2tmf := NameToTimestampedMetricFamilyMap{}
+		for _, mf := range mfs {
+			n2tmf[mf.GetName()] = TimestampedMetricFamily{MetricFamily: mf}
+		}
+		return instanceToName{"i": n2tmf}
+	}
+	j2i := groupsOf(jobToInstance{
+		"a": group(mf("a", "short"), mf3),
+		"b": group(mf("b", "the longest help")),
+		"c": group(mf("c", "medium help")),
+	})
+
+	scenarios := []struct {
+		policy    string
+		wantHelp  string
+		wantNames []string
+	}{
+		{"first-wins", "short", []string{"mf", "mf3"}},
+		{"last-wins", "medium help", []string{"mf", "mf3"}},
+		{"longest", "the longest help", []string{"mf", "mf3"}},
+		{"error", "", []string{"mf3"}},
+	}
+	for _, s := range scenarios {
+		policy, err := ParseHelpConflictPolicy(s.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dms := &DiskMetricStore{metricFamilies: j2i, helpPolicy: policy}
+		conflictsBefore := counterValue(t, helpConflicts)
+		mfs := dms.GetMetricFamilies()
+		names := []string{}
+		for _, mf := range mfs {
+			names = append(names, mf.GetName())
+			if mf.GetName() == "mf" {
+				if expected, got := s.wantHelp, mf.GetHelp(); expected != got {
+					t.Errorf("%s: Expected help %q, got %q.", s.policy, expected, got)
+				}
+				if expected, got := 3, len(mf.GetMetric()); expected != got {
+					t.Errorf("%s: Expected %d metrics, got %d.", s.policy, expected, got)
+				}
+			}
+		}
+		if expected, got := fmt.Sprint(s.wantNames), fmt.Sprint(names); expected != got {
+			t.Errorf("%s: Expected metric families %s, got %s.", s.policy, expected, got)
+		}
+		if expected, got := 2.0, counterValue(t, helpConflicts)-conflictsBefore; expected != got {
+			t.Errorf("%s: Expected %v counted conflicts, got %v.", s.policy, expected, got)
+		}
+		// The stored metric families must not have been modified.
+		if expected, got := "short", groupMetrics(j2i, "a", "i")["mf"].MetricFamily.GetHelp(); expected != got {
+			t.Errorf("%s: Stored help modified to %q.", s.policy, got)
+		}
+	}
+
+	if _, err := ParseHelpConflictPolicy("random"); err == nil {
+		t.Error("Expected error for unknown policy.")
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
 func TestAddDeletePersistRestore(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestAddDeletePersistRestore.")
 	if err != nil {
@@ -320,13 +511,12 @@ func TestAddDeletePersistRestore(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 	fileName := path.Join(tempDir, "persistence")
-	dms := NewDiskMetricStore(fileName, 100*time.Millisecond)
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
 
 	// Submit a single simple metric family.
 	ts1 := time.Now()
 	dms.SubmitWriteRequest(WriteRequest{
-		Job:            "job1",
-		Instance:       "instance1",
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
 		Timestamp:      ts1,
 		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
 	})
@@ -338,8 +528,7 @@ func TestAddDeletePersistRestore(t *testing.T) {
 	// Submit two metric families for a different instance.
 	ts2 := ts1.Add(time.Second)
 	dms.SubmitWriteRequest(WriteRequest{
-		Job:            "job1",
-		Instance:       "instance2",
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
 		Timestamp:      ts2,
 		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1b, "mf2": mf2},
 	})
@@ -352,8 +541,7 @@ func TestAddDeletePersistRestore(t *testing.T) {
 	// Should overwrite the previous metric family for the same job/instance
 	ts3 := ts2.Add(time.Second)
 	dms.SubmitWriteRequest(WriteRequest{
-		Job:            "job1",
-		Instance:       "instance2",
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
 		Timestamp:      ts3,
 		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a},
 	})
@@ -368,20 +556,19 @@ func TestAddDeletePersistRestore(t *testing.T) {
 	}
 
 	// Load it again.
-	dms = NewDiskMetricStore(fileName, 100*time.Millisecond)
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
 	if err := checkMetricFamilies(dms, mf1a, mf2, mf3); err != nil {
 		t.Error(err)
 	}
 	// Spot-check timestamp.
-	tmf := dms.metricFamilies["job1"]["instance2"]["mf1"]
+	tmf := groupMetrics(dms.metricFamilies, "job1", "instance2")["mf1"]
 	if expected, got := ts3, tmf.Timestamp; expected != got {
 		t.Errorf("Expected timestamp %v, got %v.", expected, got)
 	}
 
 	// Delete an instance.
 	dms.SubmitWriteRequest(WriteRequest{
-		Job:      "job1",
-		Instance: "instance1",
+		Labels: map[string]string{"job": "job1", "instance": "instance1"},
 	})
 	time.Sleep(time.Microsecond) // Give loop() time to process.
 	if err := checkMetricFamilies(dms, mf1a, mf2); err != nil {
@@ -391,8 +578,7 @@ func TestAddDeletePersistRestore(t *testing.T) {
 	// Submit another one.
 	ts4 := ts3.Add(time.Second)
 	dms.SubmitWriteRequest(WriteRequest{
-		Job:            "job3",
-		Instance:       "instance2",
+		Labels:         map[string]string{"job": "job3", "instance": "instance2"},
 		Timestamp:      ts4,
 		MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
 	})
@@ -403,7 +589,7 @@ func TestAddDeletePersistRestore(t *testing.T) {
 
 	// Delete a job.
 	dms.SubmitWriteRequest(WriteRequest{
-		Job: "job1",
+		Labels: map[string]string{"job": "job1"},
 	})
 	time.Sleep(time.Microsecond) // Give loop() time to process.
 	if err := checkMetricFamilies(dms, mf4); err != nil {
@@ -412,21 +598,20 @@ func TestAddDeletePersistRestore(t *testing.T) {
 
 	// Delete last instance of a job.
 	dms.SubmitWriteRequest(WriteRequest{
-		Job:      "job3",
-		Instance: "instance2",
+		Labels: map[string]string{"job": "job3", "instance": "instance2"},
 	})
 	time.Sleep(time.Microsecond) // Give loop() time to process.
 	if err := checkMetricFamilies(dms); err != nil {
 		t.Error(err)
 	}
-	// Check that no empty instance map for job3 was left behind.
-	if _, stillExists := dms.metricFamilies["job3"]; stillExists {
-		t.Error("An instance map for 'job3' still exists.")
+	// Check that no empty group was left behind.
+	if len(dms.metricFamilies) > 0 {
+		t.Errorf("Expected no groups, got %v.", dms.metricFamilies)
 	}
 
 	// Delete a non existing job.
 	dms.SubmitWriteRequest(WriteRequest{
-		Job: "job4",
+		Labels: map[string]string{"job": "job4"},
 	})
 	time.Sleep(150 * time.Millisecond) // Give time for persistence to kick in.
 	if err := checkMetricFamilies(dms); err != nil {
@@ -437,8 +622,7 @@ func TestAddDeletePersistRestore(t *testing.T) {
 	// (to check draining).
 	for i := 0; i < 10; i++ {
 		dms.SubmitWriteRequest(WriteRequest{
-			Job:            "job3",
-			Instance:       "instance2",
+			Labels:         map[string]string{"job": "job3", "instance": "instance2"},
 			Timestamp:      ts4,
 			MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4},
 		})
@@ -451,77 +635,3344 @@ func TestAddDeletePersistRestore(t *testing.T) {
 	}
 }
 
-func checkNoPersistenc(t *testing.T) {
-	dms := NewDiskMetricStore("", 100*time.Millisecond)
+func TestConcurrentWriteProcessing(t *testing.T) {
+	// The queue is long enough for all requests of the test, so that
+	// none is rejected as the queue is full.
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{WriteConcurrency: 4, QueueLength: 2000})
 
-	ts1 := time.Now()
+	gauge := func(job string, value float64) map[string]*dto.MetricFamily {
+		return map[string]*dto.MetricFamily{
+			"mf": &dto.MetricFamily{
+				Name: proto.String("mf"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					&dto.Metric{
+						Label: []*dto.LabelPair{
+							&dto.LabelPair{
+								Name:  proto.String("job"),
+								Value: proto.String(job),
+							},
+							&dto.LabelPair{
+								Name:  proto.String("instance"),
+								Value: proto.String("instance1"),
+							},
+						},
+						Gauge: &dto.Gauge{Value: proto.Float64(value)},
+					},
+				},
+			},
+		}
+	}
+
+	// Interleave requests for different jobs. Per job, the last request
+	// has to win.
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			job := fmt.Sprint("job", j)
+			dms.SubmitWriteRequest(WriteRequest{
+				Labels:         map[string]string{"job": job, "instance": "instance1"},
+				Timestamp:      time.Now(),
+				MetricFamilies: gauge(job, float64(i)),
+			})
+			if i == 99 && j%2 == 0 {
+				dms.SubmitWriteRequest(WriteRequest{
+					Labels:    map[string]string{"job": job},
+					Timestamp: time.Now(),
+				})
+			}
+		}
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	j2i := dms.GetMetricFamiliesMap()
+	if expected, got := 5, len(j2i); expected != got {
+		t.Fatalf("Expected %d groups, got %d.", expected, got)
+	}
+	for j := 1; j < 10; j += 2 {
+		job := fmt.Sprint("job", j)
+		tmf, ok := groupMetrics(j2i, job, "instance1")["mf"]
+		if !ok {
+			t.Errorf("Metric family for %s missing.", job)
+			continue
+		}
+		if expected, got := 99., tmf.MetricFamily.GetMetric()[0].GetGauge().GetValue(); expected != got {
+			t.Errorf("Expected value %v for %s, got %v.", expected, job, got)
+		}
+	}
+}
+
+func TestConcurrentDeleteReadPush(t *testing.T) {
+	// See TestConcurrentWriteProcessing for the queue length.
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{WriteConcurrency: 4, QueueLength: 4000})
+
+	// Each push sets two metric families to the same value, so that a
+	// reader seeing different values has seen a partially updated group.
+	push := func(job, instance string, value float64) map[string]*dto.MetricFamily {
+		mfs := map[string]*dto.MetricFamily{}
+		for _, name := range []string{"mf_a", "mf_b"} {
+			mfs[name] = &dto.MetricFamily{
+				Name: proto.String(name),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{
+					&dto.Metric{
+						Label: []*dto.LabelPair{
+							&dto.LabelPair{
+								Name:  proto.String("job"),
+								Value: proto.String(job),
+							},
+							&dto.LabelPair{
+								Name:  proto.String("instance"),
+								Value: proto.String(instance),
+							},
+						},
+						Gauge: &dto.Gauge{Value: proto.Float64(value)},
+					},
+				},
+			}
+		}
+		return mfs
+	}
+
+	stop := make(chan struct{})
+	readersDone := sync.WaitGroup{}
+	for r := 0; r < 2; r++ {
+		readersDone.Add(1)
+		go func() {
+			defer readersDone.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				dms.GetMetricFamilies()
+				dms.Stats()
+				for _, group := range dms.GetMetricFamiliesMap() {
+					a := group.Metrics["mf_a"].MetricFamily.GetMetric()[0].GetGauge().GetValue()
+					b := group.Metrics["mf_b"].MetricFamily.GetMetric()[0].GetGauge().GetValue()
+					if a != b {
+						t.Errorf("Inconsistent group %s: %v != %v.", FormatGroup(group.Labels), a, b)
+					}
+				}
+			}
+		}()
+	}
+
+	// Pushes and deletes for the same job are processed in order, while
+	// groups of other jobs are deleted concurrently.
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 10; j++ {
+			job := fmt.Sprint("job", j)
+			if i%10 == j {
+				dms.SubmitWriteRequest(WriteRequest{
+					Labels:    map[string]string{"job": job, "instance": "instance0"},
+					Timestamp: time.Now(),
+				})
+			}
+			for k := 0; k < 3; k++ {
+				instance := fmt.Sprint("instance", k)
+				dms.SubmitWriteRequest(WriteRequest{
+					Labels:         map[string]string{"job": job, "instance": instance},
+					Timestamp:      time.Now(),
+					MetricFamilies: push(job, instance, float64(i)),
+				})
+			}
+		}
+		if i%7 == 0 {
+			dms.DeleteGroups(func(labels map[string]string, lastPush time.Time) bool {
+				return labels["instance"] == "instance1"
+			}, "")
+		}
+	}
+	for j := 0; j < 10; j += 2 {
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:    map[string]string{"job": fmt.Sprint("job", j)},
+			Timestamp: time.Now(),
+		})
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	readersDone.Wait()
+
+	j2i := dms.GetMetricFamiliesMap()
+	if expected, got := 15, len(j2i); expected != got {
+		t.Fatalf("Expected %d groups, got %d.", expected, got)
+	}
+	for j := 1; j < 10; j += 2 {
+		job := fmt.Sprint("job", j)
+		// All deletes of groups of this job were followed by pushes.
+		for _, instance := range []string{"instance0", "instance1", "instance2"} {
+			tmf, ok := groupMetrics(j2i, job, instance)["mf_a"]
+			if !ok {
+				t.Errorf("Group with job %q, instance %q missing.", job, instance)
+				continue
+			}
+			if expected, got := 99., tmf.MetricFamily.GetMetric()[0].GetGauge().GetValue(); expected != got {
+				t.Errorf("Expected value %v for job %q, instance %q, got %v.", expected, job, instance, got)
+			}
+		}
+	}
+}
+
+func TestDeleteGroups(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+	ts := time.Now()
 	dms.SubmitWriteRequest(WriteRequest{
-		Job:            "job1",
-		Instance:       "instance1",
-		Timestamp:      ts1,
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a, "mf2": mf2},
+	})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job2", "instance": "instance1"},
+		Timestamp:      ts.Add(time.Second),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1c},
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+
+	var gotLastPush time.Time
+	if expected, got := 1, dms.DeleteGroups(func(labels map[string]string, lastPush time.Time) bool {
+		if labels["job"] == "job1" && labels["instance"] == "instance2" {
+			gotLastPush = lastPush
+			return true
+		}
+		return false
+	}, ""); expected != got {
+		t.Errorf("Expected %d deleted groups, got %d.", expected, got)
+	}
+	if !gotLastPush.Equal(ts) {
+		t.Errorf("Expected last push time %v, got %v.", ts, gotLastPush)
+	}
+	if err := checkMetricFamilies(dms, mf1c); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 1, len(dms.metricFamilies); expected != got {
+		t.Errorf("Expected %d remaining group, got %d.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteMetricFamily(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+	ts := time.Now()
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a, "mf2": mf2},
+	})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job2", "instance": "instance1"},
+		Timestamp:      ts,
 		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+		SkipValidation: true, // The fixture does not match the group.
 	})
-	time.Sleep(time.Microsecond) // Give loop() time to process.
-	if err := checkMetricFamilies(dms, mf3); err != nil {
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	bytes := dms.bytes
+
+	// Deleting a metric family the group does not have changes nothing.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:       map[string]string{"job": "job2", "instance": "instance1"},
+		Timestamp:    ts.Add(time.Second),
+		DeleteMetric: "mf2",
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a, mf2, mf3); err != nil {
+		t.Error(err)
+	}
+
+	// The group keeps its other metric families.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:       map[string]string{"job": "job1"},
+		Timestamp:    ts.Add(time.Second),
+		DeleteMetric: "mf2",
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a, mf3); err != nil {
 		t.Error(err)
 	}
+	if expected, got := bytes-int64(proto.Size(mf2)), dms.bytes; expected != got {
+		t.Errorf("Expected %d bytes stored, got %d.", expected, got)
+	}
 
+	// A group left without metric families is deleted.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:       map[string]string{"job": "job2", "instance": "instance1"},
+		Timestamp:    ts.Add(time.Second),
+		DeleteMetric: "mf3",
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 1, len(dms.metricFamilies); expected != got {
+		t.Errorf("Expected %d remaining group, got %d.", expected, got)
+	}
 	if err := dms.Shutdown(); err != nil {
 		t.Fatal(err)
 	}
+}
 
-	dms = NewDiskMetricStore("", 100*time.Millisecond)
-	if err := checkMetricFamilies(dms); err != nil {
+func TestStats(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestStats.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dms := NewDiskMetricStore(path.Join(tempDir, "persistence"), 10*time.Millisecond, DiskMetricStoreOptions{})
+
+	if stats := dms.Stats(); !stats.LastPersist.IsZero() || stats.Groups != 0 || stats.Series != 0 {
+		t.Errorf("Unexpected stats of empty store: %+v", stats)
+	}
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a, "mf2": mf2},
+	})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job2", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1c},
+	})
+	time.Sleep(50 * time.Millisecond) // Give loop() time to process and persist.
+
+	stats := dms.Stats()
+	if expected, got := 2, stats.Groups; expected != got {
+		t.Errorf("Expected %d groups, got %d.", expected, got)
+	}
+	if expected, got := len(mf1a.Metric)+len(mf2.Metric)+len(mf1c.Metric), stats.Series; expected != got {
+		t.Errorf("Expected %d series, got %d.", expected, got)
+	}
+	if expected, got := writeQueueCapacity, stats.QueueCapacity; expected != got {
+		t.Errorf("Expected queue capacity %d, got %d.", expected, got)
+	}
+	if stats.LastPersist.IsZero() {
+		t.Error("Expected a persist to have happened.")
+	}
+	if _, ok := stats.LatencyQuantiles[0.99]; !ok {
+		t.Errorf("Expected a 99th percentile latency, got %v.", stats.LatencyQuantiles)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplaceAndMergeSemantics(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+	submit := func(replace bool, mfs map[string]*dto.MetricFamily) {
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+			Timestamp:      time.Now(),
+			MetricFamilies: mfs,
+			Replace:        replace,
+		})
+		time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	}
+
+	// PUT to a non-existing group creates it.
+	submit(true, map[string]*dto.MetricFamily{"mf1": mf1a})
+	if err := checkMetricFamilies(dms, mf1a); err != nil {
+		t.Error(err)
+	}
+	// POST adds metric families and keeps the others.
+	submit(false, map[string]*dto.MetricFamily{"mf2": mf2})
+	if err := checkMetricFamilies(dms, mf1a, mf2); err != nil {
+		t.Error(err)
+	}
+	// POST replaces metric families with the same name.
+	submit(false, map[string]*dto.MetricFamily{"mf1": mf1b})
+	if err := checkMetricFamilies(dms, mf1b, mf2); err != nil {
+		t.Error(err)
+	}
+	// PUT removes all metric families not pushed.
+	submit(true, map[string]*dto.MetricFamily{"mf1": mf1a})
+	if err := checkMetricFamilies(dms, mf1a); err != nil {
+		t.Error(err)
+	}
+	// POST to a non-existing group creates it, too.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job2", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+		SkipValidation: true, // The fixture does not match the group.
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf1a, mf3); err != nil {
+		t.Error(err)
+	}
+	// PUT without any metric families leaves no group behind.
+	submit(true, map[string]*dto.MetricFamily{})
+	if err := checkMetricFamilies(dms, mf3); err != nil {
 		t.Error(err)
 	}
+	if _, exists := dms.GetMetricFamiliesMap()["job1"]; exists {
+		t.Error("Group for 'job1' still exists.")
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
 }
 
-func checkMetricFamilies(dms *DiskMetricStore, expectedMFs ...*dto.MetricFamily) error {
-	gotMFs := dms.GetMetricFamilies()
-	if expected, got := len(expectedMFs), len(gotMFs); expected != got {
-		return fmt.Errorf("expected %d metric families, got %d", expected, got)
+func TestReset(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestReset.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	// Long persistence interval to make sure Reset persists by itself.
+	dms := NewDiskMetricStore(fileName, time.Hour, DiskMetricStoreOptions{})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a, "mf2": mf2},
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, DiskMetricStoreOptions{})
+	if err := checkMetricFamilies(dms, mf1a, mf2); err != nil {
+		t.Error(err)
 	}
 
-	expectedMFsAsStrings := make([]string, len(expectedMFs))
-	for i, mf := range expectedMFs {
-		sort.Sort(metricSorter(mf.Metric))
-		expectedMFsAsStrings[i] = mf.String()
+	deleted, err := dms.Reset("")
+	if err != nil {
+		t.Fatal(err)
 	}
-	sort.Strings(expectedMFsAsStrings)
+	if expected, got := 1, deleted; expected != got {
+		t.Errorf("Expected %d deleted groups, got %d.", expected, got)
+	}
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+	// Simulate a crash by not shutting down before loading again.
+	dms = NewDiskMetricStore(fileName, time.Hour, DiskMetricStoreOptions{})
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+}
 
-	gotMFsAsStrings := make([]string, len(gotMFs))
-	for i, mf := range gotMFs {
-		sort.Sort(metricSorter(mf.Metric))
-		gotMFsAsStrings[i] = mf.String()
+func TestIngestionTimeLabel(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{
+		IngestionTimeLabel: "ingested_at",
+	})
+	ts := time.Date(2015, 3, 1, 12, 30, 0, 123000000, time.FixedZone("CET", 3600))
+	mf := proto.Clone(mf3).(*dto.MetricFamily)
+	// A pushed label of the same name is overwritten.
+	mf.Metric[0].Label = append(mf.Metric[0].Label, &dto.LabelPair{
+		Name:  proto.String("ingested_at"),
+		Value: proto.String("yesterday"),
+	})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf, "mf2": proto.Clone(mf2).(*dto.MetricFamily)},
+		SkipValidation: true, // The fixture does not match the group.
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
 	}
-	sort.Strings(gotMFsAsStrings)
 
-	for i, got := range gotMFsAsStrings {
-		expected := expectedMFsAsStrings[i]
-		if expected != got {
-			return fmt.Errorf("expected metric family %#v, got %#v", expected, got)
+	group, ok := dms.GetMetricFamiliesMap()[GroupingKeyFor(map[string]string{"job": "job1", "instance": "instance1"})]
+	if !ok {
+		t.Fatal("Group job1/instance1 not found, the label must not change the group.")
+	}
+	for name, tmf := range group.Metrics {
+		for _, m := range tmf.MetricFamily.GetMetric() {
+			var values []string
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "ingested_at" {
+					values = append(values, lp.GetValue())
+				}
+			}
+			if len(values) != 1 || values[0] != "2015-03-01T11:30:00.123Z" {
+				t.Errorf("Unexpected ingested_at labels %v in %s.", values, name)
+			}
 		}
 	}
-	return nil
 }
 
-type metricSorter []*dto.Metric
+func TestPauseResume(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+	dms.SetPaused(true)
+	if !dms.Stats().Paused {
+		t.Error("Store not reported as paused.")
+	}
+	time.Sleep(10 * time.Millisecond) // Give loop() time to notice.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process (which it must not).
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 1, dms.Stats().QueueLength; expected != got {
+		t.Errorf("Expected queue length %d, got %d.", expected, got)
+	}
 
-func (s metricSorter) Len() int {
-	return len(s)
-}
+	dms.SetPaused(false)
+	if dms.Stats().Paused {
+		t.Error("Store still reported as paused.")
+	}
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
 
-func (s metricSorter) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
+	// Shutdown processes queued requests even while paused.
+	dms.SetPaused(true)
+	time.Sleep(10 * time.Millisecond) // Give loop() time to notice.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2},
+		SkipValidation: true, // The fixture does not match the group.
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, mf2, mf3); err != nil {
+		t.Error(err)
+	}
 }
 
-func (s metricSorter) Less(i, j int) bool {
-	for n, lp := range s[i].Label {
-		vi := lp.GetValue()
+func TestQueueFull(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{QueueLength: 1})
+	if expected, got := 1, dms.Stats().QueueCapacity; expected != got {
+		t.Errorf("Expected queue capacity %d, got %d.", expected, got)
+	}
+	dms.SetPaused(true)
+	time.Sleep(10 * time.Millisecond) // Give loop() time to notice.
+	wr := WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	}
+	if err := dms.SubmitWriteRequest(wr); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := ErrQueueFull, dms.SubmitWriteRequest(wr); expected != got {
+		t.Errorf("Expected error %v, got %v.", expected, got)
+	}
+	if _, total := dms.PendingWriteRequests(0); total != 1 {
+		t.Errorf("Expected 1 pending write request, got %d.", total)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+	if expected, got := ErrShutdown, dms.SubmitWriteRequest(wr); expected != got {
+		t.Errorf("Expected error %v, got %v.", expected, got)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{QueueLength: 10})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": mf1a, "mf2": mf2},
+	})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+
+	collect := func(dms *DiskMetricStore) map[string]float64 {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			dms.Collect(ch)
+			close(ch)
+		}()
+		got := map[string]float64{}
+		nameRE := regexp.MustCompile(`fqName: "([^"]+)"`)
+		for m := range ch {
+			name := nameRE.FindStringSubmatch(m.Desc().String())[1]
+			var pb dto.Metric
+			if err := m.Write(&pb); err != nil {
+				t.Fatal(err)
+			}
+			for _, lp := range pb.GetLabel() {
+				name += "/" + lp.GetName() + "=" + lp.GetValue()
+			}
+			got[name] = pb.GetGauge().GetValue()
+		}
+		return got
+	}
+	want := map[string]float64{
+		"pushgateway_metric_families":      3,
+		"pushgateway_write_queue_capacity": 10,
+		"pushgateway_write_queue_length":   0,
+	}
+	if got := collect(dms); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected collected metrics %v, got %v.", want, got)
+	}
+
+	// The store of a tenant collects its size, too, rather than setting
+	// the gauges of the default store.
+	tms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{QueueLength: 10, Tenant: "red"})
+	tms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	want = map[string]float64{
+		"pushgateway_tenant_groups/tenant=red":               1,
+		"pushgateway_tenant_metric_families/tenant=red":      1,
+		"pushgateway_tenant_store_bytes/tenant=red":          float64(tms.bytes),
+		"pushgateway_tenant_write_queue_capacity/tenant=red": 10,
+		"pushgateway_tenant_write_queue_length/tenant=red":   0,
+	}
+	if got := collect(tms); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected collected metrics %v, got %v.", want, got)
+	}
+	if expected, got := 2.0, gaugeValue(t, groupsGauge); expected != got {
+		t.Errorf("Expected %v groups, got %v.", expected, got)
+	}
+	if err := tms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHealthyReady(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{QueueLength: 1})
+	if err := dms.Healthy(); err != nil {
+		t.Errorf("Unexpected unhealthy store: %s", err)
+	}
+	if err := dms.Ready(); err != nil {
+		t.Errorf("Unexpected unready store: %s", err)
+	}
+
+	// A full queue makes the store unready, but not unhealthy.
+	dms.SetPaused(true)
+	time.Sleep(10 * time.Millisecond) // Give loop() time to notice.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	if err := dms.Healthy(); err != nil {
+		t.Errorf("Unexpected unhealthy store: %s", err)
+	}
+	if expected, got := ErrQueueFull, dms.Ready(); expected != got {
+		t.Errorf("Expected error %v, got %v.", expected, got)
+	}
+	dms.SetPaused(false)
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := dms.Ready(); err != nil {
+		t.Errorf("Unexpected unready store: %s", err)
+	}
+
+	// A stuck loop makes the store unhealthy.
+	heartbeat := atomic.LoadInt64(&dms.loopHeartbeat)
+	atomic.StoreInt64(&dms.loopHeartbeat, time.Now().Add(-2*loopStallTimeout).UnixNano())
+	if err := dms.Healthy(); err == nil {
+		t.Error("Expected unhealthy store.")
+	}
+	atomic.StoreInt64(&dms.loopHeartbeat, heartbeat)
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := ErrShutdown, dms.Healthy(); expected != got {
+		t.Errorf("Expected error %v, got %v.", expected, got)
+	}
+	if expected, got := ErrShutdown, dms.Ready(); expected != got {
+		t.Errorf("Expected error %v, got %v.", expected, got)
+	}
+}
+
+func TestMaxGroups(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{MaxGroups: 1})
+	// mf3 has the labels of job1/instance1. Adjust for other instances
+	// to get valid write requests.
+	wr := func(instance string, replace bool, mfs map[string]*dto.MetricFamily) WriteRequest {
+		if instance != "instance1" && mfs != nil {
+			adjusted := map[string]*dto.MetricFamily{}
+			for name, mf := range mfs {
+				mf = proto.Clone(mf).(*dto.MetricFamily)
+				for _, m := range mf.GetMetric() {
+					for _, lp := range m.GetLabel() {
+						if lp.GetName() == "instance" {
+							lp.Value = proto.String(instance)
+						}
+					}
+				}
+				adjusted[name] = mf
+			}
+			mfs = adjusted
+		}
+		return WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      time.Now(),
+			MetricFamilies: mfs,
+			Replace:        replace,
+		}
+	}
+	mfs := map[string]*dto.MetricFamily{"mf3": mf3}
+
+	if err := dms.CheckWriteRequest(wr("instance1", false, mfs)); err != nil {
+		t.Fatal(err)
+	}
+	dms.SubmitWriteRequest(wr("instance1", false, mfs))
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+
+	// Updating the existing group is fine, also with replace.
+	for _, replace := range []bool{false, true} {
+		if err := dms.CheckWriteRequest(wr("instance1", replace, mfs)); err != nil {
+			t.Errorf("Unexpected error for update with replace=%v: %s", replace, err)
+		}
+	}
+	unchecked := wr("instance1", true, map[string]*dto.MetricFamily{"mf2": mf2})
+	unchecked.SkipValidation = true // The fixture does not match the group.
+	dms.SubmitWriteRequest(unchecked)
+	// A new group is rejected, also if it was submitted without check.
+	if expected, got := ErrTooManyGroups, dms.CheckWriteRequest(wr("instance2", false, mfs)); expected != got {
+		t.Errorf("Expected error %v, got %v.", expected, got)
+	}
+	if expected, got := ErrTooManyGroups, dms.SubmitWriteRequest(wr("instance2", false, mfs)); expected != got {
+		t.Errorf("Expected error %v, got %v.", expected, got)
+	}
+	unchecked = wr("instance2", false, mfs)
+	unchecked.SkipValidation = true
+	dms.SubmitWriteRequest(unchecked)
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf2); err != nil {
+		t.Error(err)
+	}
+	// Deletes are always fine.
+	if err := dms.CheckWriteRequest(wr("instance2", false, nil)); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 1.0, gaugeValue(t, groupsGauge); expected != got {
+		t.Errorf("Expected groups gauge %v, got %v.", expected, got)
+	}
+	if expected, got := 1.0, gaugeValue(t, groupsLimitGauge); expected != got {
+		t.Errorf("Expected groups limit gauge %v, got %v.", expected, got)
+	}
+
+	// After deleting the group, a new one can be created.
+	dms.SubmitWriteRequest(wr("instance1", false, nil))
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := dms.CheckWriteRequest(wr("instance2", false, mfs)); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 0.0, gaugeValue(t, groupsGauge); expected != got {
+		t.Errorf("Expected groups gauge %v, got %v.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWriteRequestValidation(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+	defer dms.Shutdown()
+	withLabels := func(lps ...string) map[string]*dto.MetricFamily {
+		m := &dto.Metric{Untyped: &dto.Untyped{Value: proto.Float64(1)}}
+		for i := 0; i < len(lps); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(lps[i]), Value: proto.String(lps[i+1])})
+		}
+		return map[string]*dto.MetricFamily{"mf": {
+			Name:   proto.String("mf"),
+			Type:   dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{m},
+		}}
+	}
+	scenarios := []struct {
+		job, instance string
+		mfs           map[string]*dto.MetricFamily
+		valid         bool
+	}{
+		{"job1", "instance1", withLabels("job", "job1", "instance", "instance1"), true},
+		{"job1", "instance1", withLabels("instance", "instance1", "a", "b", "job", "job1"), true},
+		{"job1", "instance1", nil, true}, // A delete.
+		{"job1", "instance2", map[string]*dto.MetricFamily{"mf3": mf3}, false},
+		{"job2", "instance1", map[string]*dto.MetricFamily{"mf3": mf3}, false},
+		{"job1", "instance1", map[string]*dto.MetricFamily{"other": mf3}, false},
+		{"job1", "instance1", withLabels("job", "job1"), false},
+		{"job1", "instance1", withLabels("job", "job1", "instance", "instance1", "job", "job1"), false},
+		{"job1", "instance1", withLabels("job", "job1", "instance", "instance1", "a", "b", "a", "c"), false},
+		{"", "instance1", withLabels("job", "", "instance", "instance1"), false},
+	}
+	for i, s := range scenarios {
+		err := dms.CheckWriteRequest(WriteRequest{Labels: map[string]string{"job": s.job, "instance": s.instance}, MetricFamilies: s.mfs})
+		if s.valid != (err == nil) {
+			t.Errorf("%d. Expected valid %v, got error %v.", i, s.valid, err)
+		}
+		// SubmitWriteRequest validates, too, unless told otherwise.
+		err = dms.SubmitWriteRequest(WriteRequest{Labels: map[string]string{"job": s.job, "instance": s.instance}, Timestamp: time.Now(), MetricFamilies: s.mfs})
+		if s.valid != (err == nil) {
+			t.Errorf("%d. Expected submission accepted %v, got error %v.", i, s.valid, err)
+		}
+		err = dms.SubmitWriteRequest(WriteRequest{Labels: map[string]string{"job": s.job, "instance": s.instance}, Timestamp: time.Now(), MetricFamilies: s.mfs, SkipValidation: true})
+		if err != nil {
+			t.Errorf("%d. Expected submission without validation accepted, got error %v.", i, err)
+		}
+	}
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestPendingWriteRequests(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+	dms.SetPaused(true)
+	time.Sleep(10 * time.Millisecond) // Give loop() time to notice.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+		Replace:        true,
+	})
+	dms.SubmitWriteRequest(WriteRequest{Labels: map[string]string{"job": "job2", "instance": "instance2"}, Timestamp: time.Now()})
+	dms.SubmitWriteRequest(WriteRequest{Labels: map[string]string{"job": "job3"}, Timestamp: time.Now()})
+
+	pending, total := dms.PendingWriteRequests(2)
+	if expected, got := 3, total; expected != got {
+		t.Errorf("Expected %d pending requests, got %d.", expected, got)
+	}
+	if expected, got := 2, len(pending); expected != got {
+		t.Fatalf("Expected %d returned requests, got %d.", expected, got)
+	}
+	if p := pending[0]; p.Labels["job"] != "job1" || p.Labels["instance"] != "instance1" || p.Delete || !p.Replace ||
+		p.MetricFamilies != 1 || p.Series != len(mf3.Metric) || p.Bytes != proto.Size(mf3) || p.Submitted.IsZero() {
+		t.Errorf("Unexpected first pending request %+v.", p)
+	}
+	if p := pending[1]; p.Labels["job"] != "job2" || p.Labels["instance"] != "instance2" || !p.Delete {
+		t.Errorf("Unexpected second pending request %+v.", p)
+	}
+	if pending, _ := dms.PendingWriteRequests(0); len(pending) != 3 {
+		t.Errorf("Expected 3 returned requests without limit, got %d.", len(pending))
+	}
+
+	dms.SetPaused(false)
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if pending, total := dms.PendingWriteRequests(0); len(pending) != 0 || total != 0 {
+		t.Errorf("Expected no pending requests, got %d of %d.", len(pending), total)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	size := int64(proto.Size(mf3))
+	dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}, maxBytes: 2 * size}
+	t0 := time.Now()
+	push := func(instance string, offset time.Duration) {
+		dms.processWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      t0.Add(offset),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+		})
+	}
+	groups := func() string {
+		return strings.Join(instancesOf(dms.metricFamilies, "job1"), ",")
+	}
+	evictedBefore := counterValue(t, evictedGroups)
+
+	push("instance1", 0)
+	push("instance2", time.Second)
+	// Updating a group does not change the size.
+	push("instance1", 2*time.Second)
+	if expected, got := 2*size, dms.Stats().Bytes; expected != got {
+		t.Errorf("Expected %d bytes, got %d.", expected, got)
+	}
+	if expected, got := "instance1,instance2", groups(); expected != got {
+		t.Errorf("Expected groups %q, got %q.", expected, got)
+	}
+	// A new group evicts the group with the oldest push.
+	push("instance3", 3*time.Second)
+	if expected, got := "instance1,instance3", groups(); expected != got {
+		t.Errorf("Expected groups %q, got %q.", expected, got)
+	}
+	if expected, got := 1.0, counterValue(t, evictedGroups)-evictedBefore; expected != got {
+		t.Errorf("Expected %v evicted groups, got %v.", expected, got)
+	}
+	if expected, got := float64(2*size), gaugeValue(t, storeBytesGauge); expected != got {
+		t.Errorf("Expected store bytes gauge %v, got %v.", expected, got)
+	}
+	// Deletion frees up space.
+	dms.processWriteRequest(WriteRequest{Labels: map[string]string{"job": "job1", "instance": "instance1"}})
+	if expected, got := size, dms.Stats().Bytes; expected != got {
+		t.Errorf("Expected %d bytes, got %d.", expected, got)
+	}
+	push("instance4", 4*time.Second)
+	if expected, got := "instance3,instance4", groups(); expected != got {
+		t.Errorf("Expected groups %q, got %q.", expected, got)
+	}
+}
+
+func TestMaxMetricFamilies(t *testing.T) {
+	mfs := func(instance string, names ...string) map[string]*dto.MetricFamily {
+		result := map[string]*dto.MetricFamily{}
+		for _, name := range names {
+			mf := proto.Clone(mf3).(*dto.MetricFamily)
+			mf.Name = proto.String(name)
+			mf.Metric[0].Label[1].Value = proto.String(instance)
+			result[name] = mf
+		}
+		return result
+	}
+	t0 := time.Now()
+	wr := func(instance string, offset time.Duration, names ...string) WriteRequest {
+		return WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      t0.Add(offset),
+			MetricFamilies: mfs(instance, names...),
+		}
+	}
+
+	for _, policy := range []LimitPolicy{LimitReject, LimitEvict} {
+		dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}, maxGroups: 2, maxFamilies: 3, limitPolicy: policy}
+		dms.processWriteRequest(wr("instance1", 0, "a", "b"))
+		dms.processWriteRequest(wr("instance2", time.Second, "a"))
+		// Updating existing metric families is always fine.
+		if err := dms.CheckWriteRequest(wr("instance1", 2*time.Second, "a", "b")); err != nil {
+			t.Errorf("Unexpected error for policy %d: %s", policy, err)
+		}
+		// A push with more metric families than allowed is always
+		// rejected.
+		if expected, got := ErrTooManyMetricFamilies, dms.CheckWriteRequest(wr("instance3", 0, "a", "b", "c", "d")); expected != got {
+			t.Errorf("Expected error %v for policy %d, got %v.", expected, policy, got)
+		}
+
+		newFamily, newGroup := wr("instance2", 3*time.Second, "b"), wr("instance3", 4*time.Second, "a")
+		if policy == LimitReject {
+			if err := dms.CheckWriteRequest(newFamily); err != ErrTooManyMetricFamilies {
+				t.Errorf("Expected error %v, got %v.", ErrTooManyMetricFamilies, err)
+			}
+			if err := dms.CheckWriteRequest(newGroup); err != ErrTooManyGroups {
+				t.Errorf("Expected error %v, got %v.", ErrTooManyGroups, err)
+			}
+			// Dropped if processed anyway.
+			dms.processWriteRequest(newFamily)
+			if expected, got := 3, dms.families; expected != got {
+				t.Errorf("Expected %d metric families, got %d.", expected, got)
+			}
+			continue
+		}
+
+		evictedBefore := counterValue(t, evictedGroups)
+		if err := dms.CheckWriteRequest(newFamily); err != nil {
+			t.Fatal(err)
+		}
+		// The oldest group is evicted to make room.
+		dms.processWriteRequest(newFamily)
+		if expected, got := []string{"instance2"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+			t.Errorf("Expected instances %v, got %v.", expected, got)
+		}
+		dms.processWriteRequest(newGroup)
+		dms.processWriteRequest(wr("instance4", 5*time.Second, "a"))
+		if expected, got := []string{"instance3", "instance4"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+			t.Errorf("Expected instances %v, got %v.", expected, got)
+		}
+		if expected, got := 2, dms.families; expected != got {
+			t.Errorf("Expected %d metric families, got %d.", expected, got)
+		}
+		if expected, got := 2.0, counterValue(t, evictedGroups)-evictedBefore; expected != got {
+			t.Errorf("Expected %v evicted groups, got %v.", expected, got)
+		}
+	}
+
+	if _, err := ParseLimitPolicy("lru"); err == nil {
+		t.Error("Expected error for unknown limit policy.")
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	size := int64(proto.Size(mf3))
+	dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}}
+	t0 := time.Now()
+	for i, instance := range []string{"instance1", "instance2", "instance3"} {
+		dms.processWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      t0.Add(time.Duration(i) * time.Second),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+		})
+	}
+
+	// A lower group limit keeps the existing groups.
+	if expected, got := 0, dms.SetLimits(1, 0); expected != got {
+		t.Errorf("Expected %d evicted groups, got %d.", expected, got)
+	}
+	if expected, got := 3, dms.Stats().Groups; expected != got {
+		t.Errorf("Expected %d groups, got %d.", expected, got)
+	}
+	mf := proto.Clone(mf3).(*dto.MetricFamily)
+	for _, lp := range mf.Metric[0].Label {
+		if lp.GetName() == "instance" {
+			lp.Value = proto.String("instance4")
+		}
+	}
+	newGroup := WriteRequest{Labels: map[string]string{"job": "job1", "instance": "instance4"}, MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf}}
+	if expected, got := ErrTooManyGroups, dms.CheckWriteRequest(newGroup); expected != got {
+		t.Errorf("Expected error %v, got %v.", expected, got)
+	}
+	if expected, got := 1.0, gaugeValue(t, groupsLimitGauge); expected != got {
+		t.Errorf("Expected groups limit gauge %v, got %v.", expected, got)
+	}
+
+	// A lower size limit evicts right away.
+	if expected, got := 2, dms.SetLimits(0, size); expected != got {
+		t.Errorf("Expected %d evicted groups, got %d.", expected, got)
+	}
+	if expected, got := "instance3", strings.Join(instancesOf(dms.metricFamilies, "job1"), ","); expected != got {
+		t.Errorf("Expected groups %q, got %q.", expected, got)
+	}
+	if err := dms.CheckWriteRequest(newGroup); err != nil {
+		t.Errorf("Unexpected error after removing the group limit: %s", err)
+	}
+	// Only an eviction changes the version.
+	version := dms.Version()
+	dms.SetLimits(0, size)
+	if expected, got := version, dms.Version(); expected != got {
+		t.Errorf("Expected version %d, got %d.", expected, got)
+	}
+	dms.SetLimits(0, size-1)
+	if dms.Version() == version {
+		t.Error("Expected version to change with eviction.")
+	}
+}
+
+func TestGroupContentHash(t *testing.T) {
+	metric := func(instance string, v float64) *dto.Metric {
+		return &dto.Metric{
+			Label: []*dto.LabelPair{
+				&dto.LabelPair{Name: proto.String("job"), Value: proto.String("job1")},
+				&dto.LabelPair{Name: proto.String("instance"), Value: proto.String(instance)},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(v)},
+		}
+	}
+	hash := func(metrics ...*dto.Metric) float64 {
+		dms := &DiskMetricStore{
+			metricFamilies: groupsOf(jobToInstance{
+				"job1": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+					"mf": TimestampedMetricFamily{MetricFamily: &dto.MetricFamily{
+						Name:   proto.String("mf"),
+						Type:   dto.MetricType_GAUGE.Enum(),
+						Metric: metrics,
+					}},
+				}},
+			}),
+			contentHash: true,
+		}
+		for _, mf := range dms.GetMetricFamilies() {
+			if mf.GetName() == GroupContentHashName {
+				if len(mf.Metric) != 1 {
+					t.Fatalf("Expected 1 metric, got %d.", len(mf.Metric))
+				}
+				return mf.Metric[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatalf("Metric %q not found.", GroupContentHashName)
+		return 0
+	}
+
+	h := hash(metric("a", 1), metric("b", 2))
+	if h == 0 || h >= 1<<53 {
+		t.Errorf("Unexpected hash %v.", h)
+	}
+	if got := hash(metric("b", 2), metric("a", 1)); got != h {
+		t.Errorf("Expected hash %v independent of the metric order, got %v.", h, got)
+	}
+	if got := hash(metric("a", 1), metric("b", 3)); got == h {
+		t.Error("Expected different hash for different values.")
+	}
+	if got := hash(metric("a", 1), metric("c", 2)); got == h {
+		t.Error("Expected different hash for different labels.")
+	}
+
+	dms := &DiskMetricStore{contentHash: true}
+	err := dms.CheckWriteRequest(WriteRequest{
+		Labels: map[string]string{"job": "job1", "instance": "a"},
+		MetricFamilies: map[string]*dto.MetricFamily{
+			GroupContentHashName: {
+				Name:   proto.String(GroupContentHashName),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{metric("a", 1)},
+			},
+		},
+	})
+	if err == nil {
+		t.Error("Expected error pushing reserved metric name.")
+	}
+}
+
+func TestGroupUp(t *testing.T) {
+	now := time.Now()
+	dms := &DiskMetricStore{
+		metricFamilies: groupsOf(jobToInstance{
+			"job1": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"mf3": TimestampedMetricFamily{Timestamp: now.Add(-time.Minute), MetricFamily: mf3},
+			}},
+			"job3": instanceToName{"instance2": NameToTimestampedMetricFamilyMap{
+				"mf4": TimestampedMetricFamily{Timestamp: now.Add(-time.Hour), MetricFamily: mf4},
+			}},
+		}),
+		upFreshness: 10 * time.Minute,
+	}
+	var got []string
+	for _, mf := range dms.GetMetricFamilies() {
+		if mf.GetName() != GroupUpName {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			got = append(got, fmt.Sprintf("%s=%v", labelsSignature(m.GetLabel()), m.GetGauge().GetValue()))
+		}
+	}
+	want := []string{
+		labelsSignature(dms.groupGauge(map[string]string{"job": "job1", "instance": "instance1"}, 0).GetLabel()) + "=1",
+		labelsSignature(dms.groupGauge(map[string]string{"job": "job3", "instance": "instance2"}, 0).GetLabel()) + "=0",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected %v, got %v.", want, got)
+	}
+
+	err := dms.CheckWriteRequest(WriteRequest{
+		Labels: map[string]string{"job": "job1", "instance": "instance1"},
+		MetricFamilies: map[string]*dto.MetricFamily{
+			GroupUpName: {
+				Name:   proto.String(GroupUpName),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{dms.groupGauge(map[string]string{"job": "job1", "instance": "instance1"}, 1)},
+			},
+		},
+	})
+	if err == nil {
+		t.Error("Expected error pushing reserved metric name.")
+	}
+}
+
+func TestSyntheticLabel(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{
+		GroupSeriesCount:    true,
+		GroupUpFreshness:    time.Hour,
+		SyntheticLabelName:  "pushgateway",
+		SyntheticLabelValue: "host1",
+	})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs := dms.GetMetricFamilies()
+	if expected, got := 3, len(mfs); expected != got {
+		t.Fatalf("Expected %d metric families, got %d.", expected, got)
+	}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			value := ""
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "pushgateway" {
+					value = lp.GetValue()
+				}
+			}
+			want := "host1"
+			if mf.GetName() == "mf3" {
+				want = ""
+			}
+			if value != want {
+				t.Errorf("%s: Expected label value %q, got %q.", mf.GetName(), want, value)
+			}
+		}
+	}
+	if _, ok := dms.GetMetricFamiliesMap()[GroupingKeyFor(map[string]string{"job": "job1", "instance": "instance1"})]; !ok {
+		t.Error("Expected group to be unaffected by the synthetic label.")
+	}
+}
+
+func TestDeduplicateContent(t *testing.T) {
+	metricFamily := func(instance string, value float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("build_info"),
+			Help: proto.String("Build information."),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("job"), Value: proto.String("job1")},
+					{Name: proto.String("instance"), Value: proto.String(instance)},
+					{Name: proto.String("version"), Value: proto.String("1.2.3")},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(value)},
+			}},
+		}
+	}
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{DeduplicateContent: true})
+	for _, wr := range []WriteRequest{
+		{Labels: map[string]string{"job": "job1", "instance": "instance1"}, MetricFamilies: map[string]*dto.MetricFamily{"build_info": metricFamily("instance1", 1)}},
+		{Labels: map[string]string{"job": "job1", "instance": "instance2"}, MetricFamilies: map[string]*dto.MetricFamily{"build_info": metricFamily("instance2", 1)}},
+		{Labels: map[string]string{"job": "job1", "instance": "instance3"}, MetricFamilies: map[string]*dto.MetricFamily{"build_info": metricFamily("instance3", 2)}},
+	} {
+		wr.Timestamp = time.Now()
+		dms.SubmitWriteRequest(wr)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The content is unchanged.
+	if err := checkMetricFamilies(dms, &dto.MetricFamily{
+		Name: proto.String("build_info"),
+		Help: proto.String("Build information."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			metricFamily("instance1", 1).Metric[0],
+			metricFamily("instance2", 1).Metric[0],
+			metricFamily("instance3", 2).Metric[0],
+		},
+	}); err != nil {
+		t.Error(err)
+	}
+
+	// Identical parts are shared, different ones are not.
+	groups := dms.GetMetricFamiliesMap()
+	m1 := groupMetrics(groups, "job1", "instance1")["build_info"].MetricFamily
+	m2 := groupMetrics(groups, "job1", "instance2")["build_info"].MetricFamily
+	m3 := groupMetrics(groups, "job1", "instance3")["build_info"].MetricFamily
+	if m1.Help != m2.Help || m1.Help != m3.Help {
+		t.Error("Expected help strings to be shared.")
+	}
+	if m1.Metric[0].Label[0] != m2.Metric[0].Label[0] || m1.Metric[0].Label[2] != m3.Metric[0].Label[2] {
+		t.Error("Expected identical label pairs to be shared.")
+	}
+	if m1.Metric[0].Label[1] == m2.Metric[0].Label[1] {
+		t.Error("Expected different label pairs not to be shared.")
+	}
+	if m1.Metric[0].Gauge != m2.Metric[0].Gauge {
+		t.Error("Expected identical values to be shared.")
+	}
+	if m1.Metric[0].Gauge == m3.Metric[0].Gauge {
+		t.Error("Expected different values not to be shared.")
+	}
+
+	// Rebuilding the pool drops unreferenced entries but keeps sharing.
+	p := newContentPool()
+	p.dedupe(map[string]*dto.MetricFamily{"build_info": metricFamily("gone", 3)})
+	p.rebuildAt = 0
+	p.maybeRebuild(dms.metricFamilies)
+	if _, ok := p.labelPairs["instance\xffgone"]; ok {
+		t.Error("Expected unreferenced label pair to be dropped.")
+	}
+	mf := metricFamily("instance1", 1)
+	p.dedupeMetricFamily(mf)
+	if mf.Help != m1.Help || mf.Metric[0].Label[1] != m1.Metric[0].Label[1] || mf.Metric[0].Gauge != m1.Metric[0].Gauge {
+		t.Error("Expected rebuilt pool to share the stored parts.")
+	}
+	if p.rebuildAt < minContentPoolSize {
+		t.Errorf("Expected next rebuild at %d entries at the earliest, got %d.", minContentPoolSize, p.rebuildAt)
+	}
+}
+
+func TestScrapeQuietPeriod(t *testing.T) {
+	now := time.Now()
+	dms := &DiskMetricStore{
+		metricFamilies: groupsOf(jobToInstance{
+			"job1": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"mf1": TimestampedMetricFamily{Timestamp: now.Add(-time.Minute), MetricFamily: mf1a},
+			}},
+			"job2": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"mf2": TimestampedMetricFamily{Timestamp: now.Add(-time.Minute), MetricFamily: mf2},
+				// A recent push to the group holds back the whole group.
+				"mf3": TimestampedMetricFamily{Timestamp: now, MetricFamily: mf3},
+			}},
+		}),
+		quietPeriod: 30 * time.Second,
+	}
+	if err := checkMetricFamilies(dms, mf1a); err != nil {
+		t.Error(err)
+	}
+	dms.quietPeriod = 0
+	if err := checkMetricFamilies(dms, mf1a, mf2, mf3); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetMetricFamiliesFiltered(t *testing.T) {
+	now := time.Now()
+	dms := &DiskMetricStore{
+		metricFamilies: groupsOf(jobToInstance{
+			"job1": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"mf1": TimestampedMetricFamily{Timestamp: now, MetricFamily: mf1a},
+			}},
+			"job2": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"mf2": TimestampedMetricFamily{Timestamp: now, MetricFamily: mf2},
+				"mf3": TimestampedMetricFamily{Timestamp: now, MetricFamily: mf3},
+			}},
+		}),
+		pushTime: true,
+	}
+	job := func(job string) func(map[string]string) bool {
+		return func(labels map[string]string) bool { return labels["job"] == job }
+	}
+	for _, s := range []struct {
+		keep  func(map[string]string) bool
+		names []string
+		push  int
+	}{
+		{nil, []string{"mf1", "mf2", "mf3"}, 2},
+		{job("job1"), []string{"mf1"}, 1},
+		{job("job2"), []string{"mf2", "mf3"}, 1},
+		{job("job3"), nil, 0},
+	} {
+		var names []string
+		push := 0
+		for _, mf := range dms.GetMetricFamiliesFiltered(s.keep) {
+			switch mf.GetName() {
+			case PushTimeName:
+				push = len(mf.GetMetric())
+			case PushFailureTimeName:
+			default:
+				names = append(names, mf.GetName())
+			}
+		}
+		if !reflect.DeepEqual(s.names, names) {
+			t.Errorf("Wanted metric families %v, got %v.", s.names, names)
+		}
+		if expected, got := s.push, push; expected != got {
+			t.Errorf("Wanted %d push times, got %d.", expected, got)
+		}
+	}
+}
+
+func TestScrapeGroupErrors(t *testing.T) {
+	// A gauge family with a counter value cannot be encoded.
+	malformed := &dto.MetricFamily{
+		Name: proto.String("malformed"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			&dto.Metric{Counter: &dto.Counter{Value: proto.Float64(1)}},
+		},
+	}
+	duplicate := &dto.MetricFamily{
+		Name: proto.String("duplicate"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			&dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+			&dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(2)}},
+		},
+	}
+	dms := &DiskMetricStore{
+		metricFamilies: groupsOf(jobToInstance{
+			"job1": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"mf1": TimestampedMetricFamily{MetricFamily: mf1a},
+			}},
+			"job2": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"mf2":       TimestampedMetricFamily{MetricFamily: mf2},
+				"malformed": TimestampedMetricFamily{MetricFamily: malformed},
+			}},
+			"job3": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"duplicate": TimestampedMetricFamily{MetricFamily: duplicate},
+			}},
+		}),
+	}
+	errorsBefore := counterValue(t, scrapeGroupErrors)
+	if err := checkMetricFamilies(dms, mf1a); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 2.0, counterValue(t, scrapeGroupErrors)-errorsBefore; expected != got {
+		t.Errorf("Expected %v group errors, got %v.", expected, got)
+	}
+
+	// The results are cached per stored metric family (mf2 is never
+	// checked as malformed fails the group first).
+	if expected, got := 3, len(dms.exposable); expected != got {
+		t.Errorf("Expected %d cached results, got %d.", expected, got)
+	}
+	if dms.exposable[mf1a] != nil || dms.exposable[malformed] == nil || dms.exposable[duplicate] == nil {
+		t.Errorf("Unexpected cached results %v.", dms.exposable)
+	}
+	// A cached result is used rather than encoding again.
+	dms.exposable[mf1a] = fmt.Errorf("cached")
+	errorsBefore = counterValue(t, scrapeGroupErrors)
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 3.0, counterValue(t, scrapeGroupErrors)-errorsBefore; expected != got {
+		t.Errorf("Expected %v group errors, got %v.", expected, got)
+	}
+	// Results for metric families no longer stored are dropped, and
+	// filtered reads do not replace the cache.
+	delete(dms.metricFamilies, GroupingKeyFor(map[string]string{"job": "job3", "instance": "instance1"}))
+	dms.GetMetricFamiliesFiltered(func(labels map[string]string) bool { return labels["job"] == "job1" })
+	if _, ok := dms.exposable[duplicate]; !ok {
+		t.Error("Expected filtered read to keep the cached results.")
+	}
+	dms.GetMetricFamilies()
+	if _, ok := dms.exposable[duplicate]; ok {
+		t.Error("Expected cached result of deleted metric family to be dropped.")
+	}
+}
+
+func TestGroupSeriesCount(t *testing.T) {
+	dms := &DiskMetricStore{
+		metricFamilies: groupsOf(jobToInstance{
+			"job1": instanceToName{"instance1": NameToTimestampedMetricFamilyMap{
+				"mf1": TimestampedMetricFamily{MetricFamily: mf1a},
+				"mf2": TimestampedMetricFamily{MetricFamily: mf2},
+			}},
+			"job3": instanceToName{"instance2": NameToTimestampedMetricFamilyMap{
+				"mf3": TimestampedMetricFamily{MetricFamily: mf3},
+			}},
+		}),
+		seriesCount: true,
+	}
+	var got *dto.MetricFamily
+	for _, mf := range dms.GetMetricFamilies() {
+		if mf.GetName() == GroupSeriesCountName {
+			got = mf
+		}
+	}
+	if got == nil {
+		t.Fatalf("Metric %q not found.", GroupSeriesCountName)
+	}
+	expected := map[string]float64{
+		"job1/instance1": float64(len(mf1a.Metric) + len(mf2.Metric)),
+		"job3/instance2": float64(len(mf3.Metric)),
+	}
+	if len(got.Metric) != len(expected) {
+		t.Fatalf("Expected %d metrics, got %d.", len(expected), len(got.Metric))
+	}
+	for _, m := range got.Metric {
+		group := m.Label[0].GetValue() + "/" + m.Label[1].GetValue()
+		if want, have := expected[group], m.GetGauge().GetValue(); want != have {
+			t.Errorf("Group %s: Expected %v, got %v.", group, want, have)
+		}
+	}
+
+	err := dms.CheckWriteRequest(WriteRequest{
+		Labels: map[string]string{"job": "job1", "instance": "instance1"},
+		MetricFamilies: map[string]*dto.MetricFamily{
+			GroupSeriesCountName: {
+				Name: proto.String(GroupSeriesCountName),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("job"), Value: proto.String("job1")},
+						{Name: proto.String("instance"), Value: proto.String("instance1")},
+					},
+					Gauge: &dto.Gauge{Value: proto.Float64(1)},
+				}},
+			},
+		},
+	})
+	if err == nil {
+		t.Error("Expected error pushing reserved metric name.")
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	gauge := func(values ...float64) *dto.MetricFamily {
+		mf := &dto.MetricFamily{
+			Name: proto.String("progress"),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		for i, v := range values {
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("job"), Value: proto.String("job1")},
+					{Name: proto.String("instance"), Value: proto.String("instance1")},
+					{Name: proto.String("shard"), Value: proto.String(fmt.Sprint(i))},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(v)},
+			})
+		}
+		return mf
+	}
+	now := time.Now()
+
+	for _, s := range []struct {
+		fn   AggregationFunc
+		want *dto.MetricFamily
+	}{
+		// The push 50s ago is outside of the window.
+		{AggregateMax, gauge(7, 3)},
+		{AggregateSum, gauge(12, 4)},
+	} {
+		dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+		agg := &Aggregation{Func: s.fn, Window: 30 * time.Second}
+		for _, p := range []struct {
+			age time.Duration
+			mf  *dto.MetricFamily
+		}{
+			{50 * time.Second, gauge(100, 100)},
+			{20 * time.Second, gauge(7, 1)},
+			{10 * time.Second, gauge(3)},
+			{0, gauge(2, 3)},
+		} {
+			dms.SubmitWriteRequest(WriteRequest{
+				Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+				Timestamp:      now.Add(-p.age),
+				MetricFamilies: map[string]*dto.MetricFamily{"progress": p.mf},
+				Aggregation:    agg,
+			})
+		}
+		time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+		if err := checkMetricFamilies(dms, s.want); err != nil {
+			t.Errorf("%v: %s", s.fn, err)
+		}
+		if got := groupMetrics(dms.GetMetricFamiliesMap(), "job1", "instance1")["progress"].MetricFamily; !proto.Equal(got, s.want) {
+			t.Errorf("%v: Expected %v from GetMetricFamiliesMap, got %v.", s.fn, s.want, got)
+		}
+
+		// A push without aggregation ends the aggregation.
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+			Timestamp:      now,
+			MetricFamilies: map[string]*dto.MetricFamily{"progress": gauge(1)},
+		})
+		time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+		if err := checkMetricFamilies(dms, gauge(1)); err != nil {
+			t.Errorf("%v: %s", s.fn, err)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once everything is out of the window, the most recent push remains.
+	h := (*aggregationHistory)(nil).add(Aggregation{Func: AggregateSum, Window: time.Minute}, TimestampedMetricFamily{
+		Timestamp: now.Add(-2 * time.Minute), MetricFamily: gauge(1, 2),
+	})
+	h = h.add(Aggregation{Func: AggregateSum, Window: time.Minute}, TimestampedMetricFamily{
+		Timestamp: now.Add(-90 * time.Second), MetricFamily: gauge(5),
+	})
+	if got, want := h.aggregate(now.Add(-85*time.Second)), gauge(6, 2); !proto.Equal(got, want) {
+		t.Errorf("Expected %v, got %v.", want, got)
+	}
+	if got, want := h.aggregate(now), gauge(5); !proto.Equal(got, want) {
+		t.Errorf("Expected %v, got %v.", want, got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	metricFamily := func(typ dto.MetricType, values ...float64) *dto.MetricFamily {
+		mf := &dto.MetricFamily{
+			Name: proto.String("high_water_mark"),
+			Type: typ.Enum(),
+		}
+		for i, v := range values {
+			m := &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("job"), Value: proto.String("job1")},
+					{Name: proto.String("instance"), Value: proto.String("instance1")},
+					{Name: proto.String("shard"), Value: proto.String(fmt.Sprint(i))},
+				},
+			}
+			switch typ {
+			case dto.MetricType_GAUGE:
+				m.Gauge = &dto.Gauge{Value: proto.Float64(v)}
+			case dto.MetricType_COUNTER:
+				m.Counter = &dto.Counter{Value: proto.Float64(v)}
+			case dto.MetricType_HISTOGRAM:
+				m.Histogram = &dto.Histogram{
+					SampleCount: proto.Uint64(uint64(v)),
+					SampleSum:   proto.Float64(v),
+					Bucket:      []*dto.Bucket{{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(uint64(v))}},
+				}
+			default:
+				m.Untyped = &dto.Untyped{Value: proto.Float64(v)}
+			}
+			mf.Metric = append(mf.Metric, m)
+		}
+		return mf
+	}
+	gauge := func(values ...float64) *dto.MetricFamily {
+		return metricFamily(dto.MetricType_GAUGE, values...)
+	}
+
+	for _, s := range []struct {
+		name         string
+		fn           MergeFunc
+		first, later *dto.MetricFamily
+		want         *dto.MetricFamily
+	}{
+		{"last", MergeLast, gauge(5, 2), gauge(3), gauge(3)},
+		// Shard 1 is not part of the later push and is retained.
+		{"max", MergeMax, gauge(5, 2), gauge(3), gauge(5, 2)},
+		{"max", MergeMax, gauge(5), gauge(7, 1), gauge(7, 1)},
+		{"min", MergeMin, gauge(5, 2), gauge(3), gauge(3, 2)},
+		{"sum", MergeSum, gauge(5, 2), gauge(3), gauge(8, 2)},
+		{"sum counter", MergeSum, metricFamily(dto.MetricType_COUNTER, 5), metricFamily(dto.MetricType_COUNTER, 3), metricFamily(dto.MetricType_COUNTER, 8)},
+		{"sum histogram", MergeSum, metricFamily(dto.MetricType_HISTOGRAM, 5, 2), metricFamily(dto.MetricType_HISTOGRAM, 3), metricFamily(dto.MetricType_HISTOGRAM, 8, 2)},
+		{"max histogram", MergeMax, metricFamily(dto.MetricType_HISTOGRAM, 5, 2), metricFamily(dto.MetricType_HISTOGRAM, 3), metricFamily(dto.MetricType_HISTOGRAM, 3)},
+		{"max untyped", MergeMax, metricFamily(dto.MetricType_UNTYPED, 5), metricFamily(dto.MetricType_UNTYPED, 3), metricFamily(dto.MetricType_UNTYPED, 5)},
+		// A type change (if allowed) replaces the stored MetricFamily.
+		{"type mismatch", MergeMax, gauge(5, 2), metricFamily(dto.MetricType_COUNTER, 3), metricFamily(dto.MetricType_COUNTER, 3)},
+	} {
+		dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{TypeChangePolicy: TypeChangeAllow})
+		for _, mf := range []*dto.MetricFamily{s.first, s.later} {
+			dms.SubmitWriteRequest(WriteRequest{
+				Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+				Timestamp:      time.Now(),
+				MetricFamilies: map[string]*dto.MetricFamily{"high_water_mark": mf},
+				Merge:          s.fn,
+			})
+		}
+		time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+		if err := checkMetricFamilies(dms, s.want); err != nil {
+			t.Errorf("%s: %s", s.name, err)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The stored MetricFamily is not modified by merging.
+	stored := gauge(5)
+	if got, want := mergeMetricFamily(stored, gauge(7), MergeSum, ""), gauge(12); !proto.Equal(got, want) {
+		t.Errorf("Expected %v, got %v.", want, got)
+	}
+	if want := gauge(5); !proto.Equal(stored, want) {
+		t.Errorf("Expected stored MetricFamily to remain %v, got %v.", want, stored)
+	}
+
+	// A histogram with other bucket boundaries replaces the stored one.
+	pushed := metricFamily(dto.MetricType_HISTOGRAM, 3)
+	pushed.Metric[0].Histogram.Bucket[0].UpperBound = proto.Float64(2)
+	if got, want := mergeMetricFamily(metricFamily(dto.MetricType_HISTOGRAM, 5), pushed, MergeSum, ""), pushed; !proto.Equal(got, want) {
+		t.Errorf("Expected %v, got %v.", want, got)
+	}
+}
+
+func TestPersistenceRouting(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPersistenceRouting.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	defaultFile := path.Join(tempDir, "default")
+	job3File := path.Join(tempDir, "job3")
+	routing, err := ParsePersistenceRouting("job:job3=" + job3File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DiskMetricStoreOptions{PersistenceRouting: routing}
+
+	dms := NewDiskMetricStore(defaultFile, 100*time.Millisecond, opts)
+	for _, wr := range []WriteRequest{
+		{Labels: map[string]string{"job": "job1", "instance": "instance1"}, MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}},
+		{Labels: map[string]string{"job": "job3", "instance": "instance2"}, MetricFamilies: map[string]*dto.MetricFamily{"mf4": mf4}},
+	} {
+		wr.Timestamp = time.Now()
+		dms.SubmitWriteRequest(wr)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each file contains only the groups routed to it.
+	for file, want := range map[string]*dto.MetricFamily{defaultFile: mf3, job3File: mf4} {
+		dms = NewDiskMetricStore(file, 100*time.Millisecond, DiskMetricStoreOptions{})
+		if err := checkMetricFamilies(dms, want); err != nil {
+			t.Errorf("%s: %s", file, err)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// All files are restored. A group restored from the wrong file is
+	// moved with the next persist.
+	routing.Files = map[string]string{"job1": job3File}
+	dms = NewDiskMetricStore(defaultFile, 100*time.Millisecond, opts)
+	if err := checkMetricFamilies(dms, mf3, mf4); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	for file, want := range map[string]*dto.MetricFamily{defaultFile: mf4, job3File: mf3} {
+		dms = NewDiskMetricStore(file, 100*time.Millisecond, DiskMetricStoreOptions{})
+		if err := checkMetricFamilies(dms, want); err != nil {
+			t.Errorf("%s: %s", file, err)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range []string{
+		"job",
+		"1tenant:a=/tmp/a",
+		"instance:a",
+		"job:a=/tmp/a,=/tmp/b",
+		"job:a=/tmp/a,a=/tmp/b",
+	} {
+		if _, err := ParsePersistenceRouting(s); err == nil {
+			t.Errorf("Expected error parsing %q.", s)
+		}
+	}
+}
+
+func checkNoPersistenc(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+
+	ts1 := time.Now()
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      ts1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	dms = NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestoreErrorPolicy(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestRestoreErrorPolicy.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A valid beginning, so that a partial restore would find mf3.
+	corrupt := append(append([]byte{}, valid...), "garbage"...)
+
+	for _, s := range []struct {
+		policy     RestoreErrorPolicy
+		wantErr    bool
+		wantBackup bool
+	}{
+		{RestoreErrorFail, true, false},
+		{RestoreErrorEmpty, false, false},
+		{RestoreErrorBackup, false, true},
+	} {
+		if err := ioutil.WriteFile(fileName, corrupt, 0666); err != nil {
+			t.Fatal(err)
+		}
+		dms, err := OpenDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{RestoreErrorPolicy: s.policy})
+		if s.wantErr != (err != nil) {
+			t.Errorf("%d: Unexpected error %v.", s.policy, err)
+		}
+		if err == nil {
+			if err := checkMetricFamilies(dms); err != nil {
+				t.Errorf("%d: %s", s.policy, err)
+			}
+			// Shutting down overwrites the corrupt file.
+			if err := dms.Shutdown(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.wantErr != bytes.Equal(content, corrupt) {
+			t.Errorf("%d: Persistence file unexpectedly (not) overwritten.", s.policy)
+		}
+		backups, err := ioutil.ReadDir(tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		foundBackup := false
+		for _, fi := range backups {
+			if strings.HasPrefix(fi.Name(), "persistence.corrupt-") {
+				foundBackup = true
+				os.Remove(path.Join(tempDir, fi.Name()))
+			}
+		}
+		if s.wantBackup != foundBackup {
+			t.Errorf("%d: Wanted backup %v, found backup %v.", s.policy, s.wantBackup, foundBackup)
+		}
+	}
+
+	// A missing file is not an error, no matter the policy.
+	os.Remove(fileName)
+	dms, err = OpenDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{RestoreErrorPolicy: RestoreErrorFail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestAuditLog.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "audit.log")
+	if _, err := ParseAuditFormat("xml"); err == nil {
+		t.Error("Expected error for unknown format.")
+	}
+	audit, err := OpenAuditLog(fileName, AuditJSON, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(proto.Size(mf3))
+	dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}, audit: audit}
+	ts := time.Unix(1400000000, 0).UTC()
+	push := func(instance string) {
+		mf := proto.Clone(mf3).(*dto.MetricFamily)
+		mf.Metric[0].Label[1].Value = proto.String(instance)
+		dms.processWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      ts,
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf},
+		})
+	}
+	for _, instance := range []string{"instance1", "instance2", "instance3", "instance4"} {
+		push(instance)
+	}
+	// A replace with metrics is no deletion, neither are deletes of
+	// groups that do not exist.
+	dms.processWriteRequest(WriteRequest{Labels: map[string]string{"job": "job1", "instance": "instance1"}, Timestamp: ts, Replace: true, MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}})
+	dms.processWriteRequest(WriteRequest{Labels: map[string]string{"job": "job1", "instance": "nope"}, Origin: "x"})
+
+	dms.processWriteRequest(WriteRequest{Labels: map[string]string{"job": "job1", "instance": "instance1"}, Origin: "alice@10.0.0.1:1234"})
+	dms.processWriteRequest(WriteRequest{Labels: map[string]string{"job": "job1", "instance": "instance2"}, Replace: true, MetricFamilies: map[string]*dto.MetricFamily{}, Origin: "bob"})
+	dms.DeleteGroups(func(labels map[string]string, _ time.Time) bool { return labels["instance"] == "instance3" }, "carol")
+	dms.maxBytes = size
+	ts = ts.Add(time.Second)
+	push("instance5") // Evicts instance4.
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	want := []string{
+		"delete job1/instance1 alice@10.0.0.1:1234",
+		"replace job1/instance2 bob",
+		"delete_groups job1/instance3 carol",
+		"eviction job1/instance4 ",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d records, got %q.", len(want), lines)
+	}
+	for i, line := range lines {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := want[i], fmt.Sprintf("%s %s/%s %s", rec.Reason, rec.Labels["job"], rec.Labels["instance"], rec.Origin); expected != got {
+			t.Errorf("%d. Expected record %q, got %q.", i, expected, got)
+		}
+		if expected, got := time.Unix(1400000000, 0), rec.LastPush; !expected.Equal(got) {
+			t.Errorf("%d. Expected last push %s, got %s.", i, expected, got)
+		}
+	}
+
+	// Rotation.
+	audit, err = OpenAuditLog(fileName, AuditText, int64(len(content))+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.record(auditRecord{Reason: DeletionDelete, Labels: map[string]string{"job": "job2"}})
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := ioutil.ReadFile(fileName + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rotated, content) {
+		t.Errorf("Expected rotated file to contain %q, got %q.", content, rotated)
+	}
+	content, err = ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := `time=0001-01-01T00:00:00Z reason=delete labels={job="job2"} origin="" last_push=0001-01-01T00:00:00Z`+"\n", string(content); expected != got {
+		t.Errorf("Expected %q, got %q.", expected, got)
+	}
+}
+
+func checkMetricFamilies(dms *DiskMetricStore, expectedMFs ...*dto.MetricFamily) error {
+	gotMFs := dms.GetMetricFamilies()
+	if expected, got := len(expectedMFs), len(gotMFs); expected != got {
+		return fmt.Errorf("expected %d metric families, got %d", expected, got)
+	}
+
+	expectedMFsAsStrings := make([]string, len(expectedMFs))
+	for i, mf := range expectedMFs {
+		sort.Sort(metricSorter(mf.Metric))
+		expectedMFsAsStrings[i] = mf.String()
+	}
+	sort.Strings(expectedMFsAsStrings)
+
+	gotMFsAsStrings := make([]string, len(gotMFs))
+	for i, mf := range gotMFs {
+		sort.Sort(metricSorter(mf.Metric))
+		gotMFsAsStrings[i] = mf.String()
+	}
+	sort.Strings(gotMFsAsStrings)
+
+	for i, got := range gotMFsAsStrings {
+		expected := expectedMFsAsStrings[i]
+		if expected != got {
+			return fmt.Errorf("expected metric family %#v, got %#v", expected, got)
+		}
+	}
+	return nil
+}
+
+type metricSorter []*dto.Metric
+
+func (s metricSorter) Len() int {
+	return len(s)
+}
+
+func (s metricSorter) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s metricSorter) Less(i, j int) bool {
+	for n, lp := range s[i].Label {
+		vi := lp.GetValue()
 		vj := s[j].Label[n].GetValue()
 		if vi != vj {
 			return vi < vj
 		}
 	}
-	return true
+	return true
+}
+
+func TestEventLog(t *testing.T) {
+	events := NewEventLog(3, 0)
+	dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}, events: events, maxGroups: 2}
+	ts := time.Unix(1400000000, 0).UTC()
+	push := func(instance string) {
+		dms.processWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      ts,
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": proto.Clone(mf3).(*dto.MetricFamily)},
+			Origin:         "alice",
+		})
+	}
+	push("instance1")
+	push("instance2")
+	push("instance3")
+	dms.processWriteRequest(WriteRequest{Labels: map[string]string{"job": "job1", "instance": "nope"}, Origin: "bob"})
+	dms.processWriteRequest(WriteRequest{Labels: map[string]string{"job": "job1"}, Origin: "bob"})
+
+	type summary struct{ typ, instance, outcome, origin string }
+	summarize := func(events []Event) []summary {
+		result := []summary{}
+		for _, e := range events {
+			result = append(result, summary{e.Type, e.Labels["instance"], e.Outcome, e.Origin})
+		}
+		return result
+	}
+	// The oldest two events have been dropped.
+	if expected, got := []summary{
+		{EventPush, "instance3", OutcomeTooManyGroups, "alice"},
+		{EventDelete, "nope", OutcomeNotFound, "bob"},
+		{EventDelete, "", OutcomeApplied, "bob"},
+	}, summarize(events.Events("")); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected events %v, got %v.", expected, got)
+	}
+	if expected, got := []summary{
+		{EventPush, "instance3", OutcomeTooManyGroups, "alice"},
+	}, summarize(events.Events(EventPush)); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected push events %v, got %v.", expected, got)
+	}
+	if got := summarize(events.Events(EventDelete)); len(got) != 2 {
+		t.Errorf("Expected 2 delete events, got %v.", got)
+	}
+
+	// The byte limit drops events, too.
+	small := NewEventLog(100, 2*(eventOverhead+30))
+	for i := 0; i < 5; i++ {
+		small.record(Event{Type: EventPush, Labels: map[string]string{"job": "job", "instance": strconv.Itoa(i)}, Outcome: OutcomeApplied})
+	}
+	if got := small.Events(""); len(got) != 2 || got[0].Labels["instance"] != "3" {
+		t.Errorf("Expected the last 2 events, got %v.", got)
+	}
+	var disabled *EventLog
+	disabled.record(Event{Type: EventPush})
+	if got := disabled.Events(""); len(got) != 0 {
+		t.Errorf("Expected no events from a nil event log, got %v.", got)
+	}
+}
+
+func TestGetGroup(t *testing.T) {
+	ts := time.Unix(1400000000, 0).UTC()
+	dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}}
+	dms.processWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": mf2, "mf1": mf1a},
+	})
+	dms.processWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      ts.Add(time.Second),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+
+	mfs, lastPush, ok := dms.GetGroup(map[string]string{"job": "job1", "instance": "instance2"})
+	if !ok {
+		t.Fatal("Expected group job1/instance2 to be found.")
+	}
+	if !lastPush.Equal(ts) {
+		t.Errorf("Expected last push %v, got %v.", ts, lastPush)
+	}
+	if len(mfs) != 2 || !proto.Equal(mfs[0], mf1a) || !proto.Equal(mfs[1], mf2) {
+		t.Errorf("Expected mf1 and mf2, got %v.", mfs)
+	}
+	// The result is a deep copy.
+	mfs[0].Metric[0].Untyped.Value = proto.Float64(42)
+	mfs, _, _ = dms.GetGroup(map[string]string{"job": "job1", "instance": "instance2"})
+	if len(mfs) != 2 || !proto.Equal(mfs[0], mf1a) {
+		t.Errorf("Expected the stored mf1 to be unchanged, got %v.", mfs)
+	}
+
+	for _, labels := range []map[string]string{
+		{"job": "job1", "instance": "instance3"},
+		{"job": "job2", "instance": "instance1"},
+		{"job": "job1"},
+		{"instance": "instance1"},
+		{"job": "job1", "instance": "instance1", "zone": "a"},
+		{},
+	} {
+		if mfs, _, ok := dms.GetGroup(labels); ok {
+			t.Errorf("Expected no group for %v, got %v.", labels, mfs)
+		}
+	}
+}
+
+func TestNonFiniteValues(t *testing.T) {
+	if _, err := ParseNonFiniteValuePolicy("drop"); err == nil {
+		t.Error("Expected error for unknown policy.")
+	}
+	gauge := func(v float64) map[string]*dto.MetricFamily {
+		return map[string]*dto.MetricFamily{"g": {
+			Name: proto.String("g"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("job"), Value: proto.String("job1")},
+					{Name: proto.String("instance"), Value: proto.String("instance1")},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(v)},
+			}},
+		}}
+	}
+	for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		wr := WriteRequest{Labels: map[string]string{"job": "job1", "instance": "instance1"}, MetricFamilies: gauge(v)}
+
+		keep := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}}
+		if err := keep.CheckWriteRequest(wr); err != nil {
+			t.Errorf("%v: unexpected error with policy keep: %s", v, err)
+		}
+
+		reject := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}, nonFinite: NonFiniteReject}
+		err := reject.CheckWriteRequest(wr)
+		if err == nil {
+			t.Errorf("%v: expected error with policy reject.", v)
+		} else if expected := `g{instance="instance1",job="job1"}`; !strings.Contains(err.Error(), expected) {
+			t.Errorf("%v: expected error naming %s, got %q.", v, expected, err)
+		}
+		if err := reject.CheckWriteRequest(WriteRequest{Labels: map[string]string{"job": "job1", "instance": "instance1"}, MetricFamilies: gauge(42)}); err != nil {
+			t.Errorf("%v: unexpected error for finite value: %s", v, err)
+		}
+
+		replace := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}, nonFinite: NonFiniteReplace, nonFiniteValue: -1}
+		if err := replace.CheckWriteRequest(wr); err != nil {
+			t.Errorf("%v: unexpected error with policy replace: %s", v, err)
+		}
+		replace.processWriteRequest(wr)
+		if got := groupMetrics(replace.metricFamilies, "job1", "instance1")["g"].MetricFamily.Metric[0].GetGauge().GetValue(); got != -1 {
+			t.Errorf("%v: expected replacement -1, got %v.", v, got)
+		}
+	}
+}
+
+func TestTypeChange(t *testing.T) {
+	if _, err := ParseTypeChangePolicy("warn"); err == nil {
+		t.Error("Expected error for unknown policy.")
+	}
+	metric := func(typ dto.MetricType) *dto.Metric {
+		m := &dto.Metric{Label: []*dto.LabelPair{
+			{Name: proto.String("job"), Value: proto.String("job1")},
+			{Name: proto.String("instance"), Value: proto.String("instance1")},
+		}}
+		switch typ {
+		case dto.MetricType_COUNTER:
+			m.Counter = &dto.Counter{Value: proto.Float64(1)}
+		case dto.MetricType_GAUGE:
+			m.Gauge = &dto.Gauge{Value: proto.Float64(1)}
+		case dto.MetricType_SUMMARY:
+			m.Summary = &dto.Summary{SampleCount: proto.Uint64(1), SampleSum: proto.Float64(1)}
+		case dto.MetricType_HISTOGRAM:
+			m.Histogram = &dto.Histogram{SampleCount: proto.Uint64(1), SampleSum: proto.Float64(1)}
+		}
+		return m
+	}
+	wr := func(typ dto.MetricType, replace bool) WriteRequest {
+		return WriteRequest{
+			Labels: map[string]string{"job": "job1", "instance": "instance1"},
+			MetricFamilies: map[string]*dto.MetricFamily{"foo": {
+				Name:   proto.String("foo"),
+				Type:   typ.Enum(),
+				Metric: []*dto.Metric{metric(typ)},
+			}},
+			Replace: replace,
+		}
+	}
+	for _, s := range []struct{ from, to dto.MetricType }{
+		{dto.MetricType_COUNTER, dto.MetricType_GAUGE},
+		{dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY},
+	} {
+		for _, replace := range []bool{false, true} {
+			reject := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}}
+			reject.processWriteRequest(wr(s.from, false))
+			if err := reject.CheckWriteRequest(wr(s.from, replace)); err != nil {
+				t.Errorf("%s: unexpected error for the same type: %s", s.from, err)
+			}
+			if err := reject.CheckWriteRequest(wr(s.to, replace)); err == nil {
+				t.Errorf("%s->%s (replace %t): expected error.", s.from, s.to, replace)
+			}
+			// A request that passed the check earlier is dropped.
+			reject.processWriteRequest(wr(s.to, replace))
+			if got := groupMetrics(reject.metricFamilies, "job1", "instance1")["foo"].MetricFamily.GetType(); got != s.from {
+				t.Errorf("%s->%s (replace %t): expected type %s to be retained, got %s.", s.from, s.to, replace, s.from, got)
+			}
+			// Other groups are not affected.
+			other := wr(s.to, replace)
+			other.Labels = map[string]string{"job": "job1", "instance": "instance2"}
+			other.MetricFamilies["foo"].Metric[0].Label[1].Value = proto.String("instance2")
+			if err := reject.CheckWriteRequest(other); err != nil {
+				t.Errorf("%s->%s (replace %t): unexpected error for another group: %s", s.from, s.to, replace, err)
+			}
+
+			allow := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}, typeChange: TypeChangeAllow}
+			allow.processWriteRequest(wr(s.from, false))
+			if err := allow.CheckWriteRequest(wr(s.to, replace)); err != nil {
+				t.Errorf("%s->%s (replace %t): unexpected error with policy allow: %s", s.from, s.to, replace, err)
+			}
+			allow.processWriteRequest(wr(s.to, replace))
+			if got := groupMetrics(allow.metricFamilies, "job1", "instance1")["foo"].MetricFamily.GetType(); got != s.to {
+				t.Errorf("%s->%s (replace %t): expected type %s, got %s.", s.from, s.to, replace, s.to, got)
+			}
+		}
+	}
+}
+
+func TestMaxLabelsPerMetric(t *testing.T) {
+	gauge := func(labels ...string) WriteRequest {
+		lps := []*dto.LabelPair{
+			{Name: proto.String("job"), Value: proto.String("job1")},
+			{Name: proto.String("instance"), Value: proto.String("instance1")},
+		}
+		for i := 0; i < len(labels); i += 2 {
+			lps = append(lps, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return WriteRequest{Labels: map[string]string{"job": "job1", "instance": "instance1"}, MetricFamilies: map[string]*dto.MetricFamily{"g": {
+			Name:   proto.String("g"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Label: lps, Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		}}}
+	}
+	rejected := func() float64 {
+		m := &dto.Metric{}
+		if err := rejectedWriteRequests.WithLabelValues("too_many_labels").Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	for _, s := range []struct {
+		maxLabels     int
+		countGrouping bool
+		wr            WriteRequest
+		wantErr       bool
+	}{
+		{0, true, gauge("a", "1", "b", "2", "c", "3"), false},
+		{3, true, gauge("a", "1"), false},
+		{3, true, gauge("a", "1", "b", "2"), true},
+		{3, true, gauge("a", "1", "b", ""), false},
+		{3, false, gauge("a", "1", "b", "2", "c", "3"), false},
+		{3, false, gauge("a", "1", "b", "2", "c", "3", "d", "4"), true},
+	} {
+		dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}, maxLabels: s.maxLabels, countGrouping: s.countGrouping, writeQueue: make(chan queuedWriteRequest, 1)}
+		before := rejected()
+		err := dms.CheckWriteRequest(s.wr)
+		if s.wantErr != (err != nil) {
+			t.Errorf("Max labels %d, counting grouping labels %v, labels %v: unexpected error %v.", s.maxLabels, s.countGrouping, s.wr.MetricFamilies["g"].Metric[0].Label, err)
+		}
+		// Only rejected submissions are counted, not failed checks.
+		if rejected() != before {
+			t.Errorf("Max labels %d: expected no rejection counted for a check.", s.maxLabels)
+		}
+		if submitErr := dms.SubmitWriteRequest(s.wr); s.wantErr != (submitErr != nil) {
+			t.Errorf("Max labels %d: unexpected submission error %v.", s.maxLabels, submitErr)
+		}
+		if want := map[bool]float64{false: 0, true: 1}[s.wantErr]; rejected()-before != want {
+			t.Errorf("Max labels %d: expected rejection count to increase by %v, got %v.", s.maxLabels, want, rejected()-before)
+		}
+		if err != nil && !strings.Contains(err.Error(), "more than the maximum of 3") {
+			t.Errorf("Unexpected error message %q.", err)
+		}
+	}
+}
+
+func TestMetricNames(t *testing.T) {
+	gauge := func(name string, v float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String(name),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("job"), Value: proto.String("job1")},
+					{Name: proto.String("instance"), Value: proto.String("instance1")},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(v)},
+			}},
+		}
+	}
+	push := func(values map[string]float64, names []string, replace bool) WriteRequest {
+		wr := WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{},
+			Replace:        replace,
+			MetricNames:    names,
+		}
+		for name, v := range values {
+			wr.MetricFamilies[name] = gauge(name, v)
+		}
+		return wr
+	}
+	stored := func(dms *DiskMetricStore) map[string]float64 {
+		result := map[string]float64{}
+		for name, tmf := range groupMetrics(dms.metricFamilies, "job1", "instance1") {
+			result[name] = tmf.MetricFamily.GetMetric()[0].GetGauge().GetValue()
+		}
+		return result
+	}
+
+	for i, s := range []struct {
+		wr   WriteRequest
+		want map[string]float64
+	}{
+		// Without metric names, the semantics of POST: Absent names are kept.
+		{push(map[string]float64{"a": 2}, nil, false), map[string]float64{"a": 2, "b": 1, "c": 1}},
+		// Listed and pushed names are replaced, listed but absent names
+		// are deleted, other names are kept.
+		{push(map[string]float64{"a": 2}, []string{"a", "b"}, false), map[string]float64{"a": 2, "c": 1}},
+		// Listing a name that is not stored changes nothing.
+		{push(map[string]float64{}, []string{"d"}, false), map[string]float64{"a": 1, "b": 1, "c": 1}},
+		{push(map[string]float64{"d": 2}, []string{"b", "d"}, false), map[string]float64{"a": 1, "c": 1, "d": 2}},
+		// Deleting all remaining metrics deletes the group.
+		{push(map[string]float64{}, []string{"a", "b", "c"}, false), map[string]float64{}},
+		// Metric names are ignored with replace.
+		{push(map[string]float64{"a": 2}, []string{"b"}, true), map[string]float64{"a": 2}},
+	} {
+		dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}}
+		dms.processWriteRequest(push(map[string]float64{"a": 1, "b": 1, "c": 1}, nil, false))
+		// The replacing push is not valid (a is not listed), but it is
+		// processed anyway to show that MetricNames is ignored.
+		if err := dms.CheckWriteRequest(s.wr); err != nil && !s.wr.Replace {
+			t.Errorf("%d. Unexpected error: %s", i, err)
+		}
+		dms.processWriteRequest(s.wr)
+		if got := stored(dms); !reflect.DeepEqual(s.want, got) {
+			t.Errorf("%d. Wanted %v, got %v.", i, s.want, got)
+		}
+		if len(s.want) == 0 {
+			if len(dms.metricFamilies) > 0 {
+				t.Errorf("%d. Expected group to be deleted.", i)
+			}
+		}
+		if expected, got := namesSize(groupMetrics(dms.metricFamilies, "job1", "instance1")), dms.bytes; expected != got {
+			t.Errorf("%d. Wanted %d bytes, got %d.", i, expected, got)
+		}
+	}
+
+	dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}}
+	if err := dms.CheckWriteRequest(push(map[string]float64{"a": 1, "b": 1}, []string{"a"}, false)); err == nil {
+		t.Error("Expected error for a pushed metric that is not listed.")
+	}
+}
+
+func TestGroupingLabels(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestGroupingLabels.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	gauge := func(labels map[string]string) *dto.MetricFamily {
+		mf := &dto.MetricFamily{
+			Name:   proto.String("mf"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		}
+		for _, ln := range GroupingLabelNames(labels) {
+			mf.Metric[0].Label = append(mf.Metric[0].Label, &dto.LabelPair{
+				Name: proto.String(ln), Value: proto.String(labels[ln]),
+			})
+		}
+		return mf
+	}
+	groups := []map[string]string{
+		{"job": "job1", "instance": "instance1"},
+		{"job": "job1", "instance": "instance1", "zone": "a"},
+		{"job": "job1", "instance": "", "zone": "b"},
+		{"job": "job2", "instance": "instance1", "zone": "a"},
+	}
+
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
+	for _, labels := range groups {
+		wr := WriteRequest{
+			Labels:         labels,
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf": gauge(labels)},
+		}
+		if err := dms.CheckWriteRequest(wr); err != nil {
+			t.Fatalf("Unexpected error for %v: %s", labels, err)
+		}
+		dms.SubmitWriteRequest(wr)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// All groups survive a persistence round trip with their labels.
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
+	for _, labels := range groups {
+		if _, _, ok := dms.GetGroup(labels); !ok {
+			t.Errorf("Expected group %s to be restored.", FormatGroup(labels))
+		}
+	}
+	if expected, got := len(groups), len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Expected %d groups, got %d.", expected, got)
+	}
+
+	// Deleting without an instance deletes all groups matching the given
+	// labels.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:    map[string]string{"job": "job1", "zone": "a"},
+		Timestamp: time.Now(),
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{"", "instance1"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v of job1, got %v.", expected, got)
+	}
+	if _, _, ok := dms.GetGroup(groups[1]); ok {
+		t.Errorf("Expected group %s to be deleted.", FormatGroup(groups[1]))
+	}
+
+	// A persistence file without grouping labels is restored, too.
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gob.NewEncoder(f)
+	buffer, err := proto.Marshal(mf3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(buffer); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+	if expected, got := []string{"instance1"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v of job1, got %v.", expected, got)
+	}
+
+	wr := WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1", "__zone": "a"},
+		Timestamp:      time.Now(),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf": gauge(map[string]string{"job": "job1", "instance": "instance1", "__zone": "a"})},
+	}
+	if err := dms.CheckWriteRequest(wr); err == nil {
+		t.Error("Expected error for reserved grouping label name.")
+	}
+	wr.Labels = map[string]string{"job": "job1", "instance": "instance1", "zone": "b"}
+	if err := dms.CheckWriteRequest(wr); err == nil {
+		t.Error("Expected error for metric not carrying the grouping labels.")
+	}
+}
+
+func TestPadLabels(t *testing.T) {
+	dms := &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}}
+	for _, labels := range []map[string]string{
+		{"job": "job1", "instance": "instance1"},
+		{"job": "job1", "instance": "instance1", "zone": "a"},
+	} {
+		mf := &dto.MetricFamily{
+			Name:   proto.String("mf"),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+		}
+		for _, ln := range GroupingLabelNames(labels) {
+			mf.Metric[0].Label = append(mf.Metric[0].Label, &dto.LabelPair{
+				Name: proto.String(ln), Value: proto.String(labels[ln]),
+			})
+		}
+		dms.processWriteRequest(WriteRequest{
+			Labels:         labels,
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf": mf},
+		})
+	}
+
+	mfs := dms.GetMetricFamilies()
+	if len(mfs) != 1 || len(mfs[0].GetMetric()) != 2 {
+		t.Fatalf("Expected one metric family with two metrics, got %v.", mfs)
+	}
+	for _, m := range mfs[0].GetMetric() {
+		if expected, got := 3, len(m.GetLabel()); expected != got {
+			t.Errorf("Expected %d labels, got %v.", expected, m.GetLabel())
+		}
+	}
+	expected := `zone=""`
+	if got := labelsSignature(mfs[0].GetMetric()[0].GetLabel()); !strings.Contains(got, expected) {
+		t.Errorf("Expected %s in labels of the first metric, got %s.", expected, got)
+	}
+	// The stored metric is left alone.
+	if got := len(groupMetrics(dms.metricFamilies, "job1", "instance1")["mf"].MetricFamily.GetMetric()[0].GetLabel()); got != 2 {
+		t.Errorf("Expected the stored metric to keep its 2 labels, got %d.", got)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestExpiration.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	now := time.Now()
+	pushes := []struct {
+		instance   string
+		timestamp  time.Time
+		expiration time.Duration
+	}{
+		{"default-old", now.Add(-2 * time.Hour), 0},
+		{"default-new", now, 0},
+		{"override", now.Add(-2 * time.Hour), 3 * time.Hour},
+		{"never", now.Add(-2 * time.Hour), -1},
+	}
+	opts := DiskMetricStoreOptions{Expiration: time.Hour}
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, opts)
+	for _, p := range pushes {
+		mf := proto.Clone(mf3).(*dto.MetricFamily)
+		mf.Metric[0].Label[1].Value = proto.String(p.instance)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": p.instance},
+			Timestamp:      p.timestamp,
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf},
+			Expiration:     p.expiration,
+		})
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expirations survive a persistence round trip.
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, opts)
+	for _, p := range pushes {
+		group := dms.metricFamilies[GroupingKeyFor(map[string]string{"job": "job1", "instance": p.instance})]
+		if group.Expiration != p.expiration {
+			t.Errorf("Expected expiration %s of instance %q, got %s.", p.expiration, p.instance, group.Expiration)
+		}
+	}
+
+	if expected, got := 1, dms.expire(now); expected != got {
+		t.Errorf("Expected %d expired groups, got %d.", expected, got)
+	}
+	if expected, got := []string{"default-new", "never", "override"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	if expected, got := 2, dms.expire(now.Add(2*time.Hour)); expected != got {
+		t.Errorf("Expected %d expired groups, got %d.", expected, got)
+	}
+	if expected, got := []string{"never"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	// A changed default expiration applies to the groups pushed without
+	// their own expiration.
+	mf := proto.Clone(mf3).(*dto.MetricFamily)
+	mf.Metric[0].Label[1].Value = proto.String("default-recent")
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "default-recent"},
+		Timestamp:      now.Add(-10 * time.Minute),
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf},
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if expected, got := 0, dms.expire(now); expected != got {
+		t.Errorf("Expected %d expired groups, got %d.", expected, got)
+	}
+	dms.SetExpiration(time.Minute)
+	if expected, got := 1, dms.expire(now); expected != got {
+		t.Errorf("Expected %d expired groups after changing the expiration, got %d.", expected, got)
+	}
+	if expected, got := []string{"never"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a default expiration, only groups pushed with an expiration
+	// expire.
+	dms = &DiskMetricStore{metricFamilies: GroupingKeyToMetricGroup{}}
+	for _, p := range pushes {
+		mf := proto.Clone(mf3).(*dto.MetricFamily)
+		mf.Metric[0].Label[1].Value = proto.String(p.instance)
+		dms.processWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": p.instance},
+			Timestamp:      p.timestamp,
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf},
+			Expiration:     p.expiration,
+		})
+	}
+	if expected, got := 1, dms.expire(now.Add(2*time.Hour)); expected != got {
+		t.Errorf("Expected %d expired groups, got %d.", expected, got)
+	}
+	if expected, got := []string{"default-new", "default-old", "never"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+
+	// A group persisted without an expiration is restored with the
+	// default expiration.
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gob.NewEncoder(f)
+	buffer, err := proto.Marshal(mf3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []interface{}{persistenceMagic, buffer, now.Add(-2 * time.Hour), map[string]string{"job": "job1", "instance": "instance1"}, persistedGroupState{}} {
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, opts)
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+	if expected, got := 1, dms.expire(now); expected != got {
+		t.Errorf("Expected %d expired groups, got %d.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushInfo(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPushInfo.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	labels := map[string]string{"job": "job1", "instance": "instance1"}
+	key := GroupingKeyFor(labels)
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
+	infos := []PushInfo{
+		{Remote: "192.0.2.1", ContentType: "text/plain", UserAgent: "first", BodyBytes: 10},
+		{Remote: "192.0.2.2", ContentType: "application/vnd.google.protobuf", UserAgent: "second", BodyBytes: 20},
+	}
+	for _, info := range infos {
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         labels,
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+			PushInfo:       info,
+		})
+	}
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	// The last push decides.
+	if expected, got := infos[1], dms.GetMetricFamiliesMap()[key].LastPushInfo; expected != got {
+		t.Errorf("Expected push info %#v, got %#v.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The push info survives a persistence round trip.
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
+	if expected, got := infos[1], dms.GetMetricFamiliesMap()[key].LastPushInfo; expected != got {
+		t.Errorf("Expected push info %#v after restart, got %#v.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepEmpty(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestKeepEmpty.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	labels1 := map[string]string{"job": "job1", "instance": "instance1"}
+	labels2 := map[string]string{"job": "job1", "instance": "instance2"}
+	ts1 := time.Now().Add(-time.Minute).Round(0)
+	ts2 := ts1.Add(time.Second)
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
+	// An empty push creates the group.
+	dms.processWriteRequest(WriteRequest{Labels: labels1, Timestamp: ts1, MetricFamilies: map[string]*dto.MetricFamily{}, KeepEmpty: true})
+	// An empty POST keeps the metrics of the group.
+	dms.processWriteRequest(WriteRequest{Labels: labels2, Timestamp: ts1, MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3}})
+	dms.processWriteRequest(WriteRequest{Labels: labels2, Timestamp: ts2, MetricFamilies: map[string]*dto.MetricFamily{}, KeepEmpty: true})
+	check := func(when string) {
+		groups := dms.GetMetricFamiliesMap()
+		if expected, got := 2, len(groups); expected != got {
+			t.Fatalf("%s: expected %d groups, got %d.", when, expected, got)
+		}
+		group := groups[GroupingKeyFor(labels1)]
+		if expected, got := 0, len(group.Metrics); expected != got {
+			t.Errorf("%s: expected %d metric families, got %d.", when, expected, got)
+		}
+		if expected, got := ts1, group.LastPushTime(); !expected.Equal(got) {
+			t.Errorf("%s: expected last push %v, got %v.", when, expected, got)
+		}
+		group = groups[GroupingKeyFor(labels2)]
+		if expected, got := 1, len(group.Metrics); expected != got {
+			t.Errorf("%s: expected %d metric families, got %d.", when, expected, got)
+		}
+		if expected, got := ts2, group.LastPushTime(); !expected.Equal(got) {
+			t.Errorf("%s: expected last push %v, got %v.", when, expected, got)
+		}
+	}
+	check("before restart")
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty groups survive a persistence round trip.
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, DiskMetricStoreOptions{})
+	check("after restart")
+
+	// An empty PUT deletes the metrics, but not the group.
+	dms.processWriteRequest(WriteRequest{Labels: labels2, Timestamp: ts2, MetricFamilies: map[string]*dto.MetricFamily{}, Replace: true, KeepEmpty: true})
+	group, ok := dms.GetMetricFamiliesMap()[GroupingKeyFor(labels2)]
+	if !ok || len(group.Metrics) != 0 || !group.LastPushTime().Equal(ts2) {
+		t.Errorf("Expected empty group pushed at %v, got %#v (exists %v).", ts2, group, ok)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushTime(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPushTime.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	labels := map[string]string{"job": "job1", "instance": "instance1"}
+	pushTimes := func(dms *DiskMetricStore) (float64, float64) {
+		var pushTime, pushFailureTime float64
+		for _, mf := range dms.GetMetricFamilies() {
+			for _, m := range mf.GetMetric() {
+				switch mf.GetName() {
+				case PushTimeName:
+					pushTime = m.GetGauge().GetValue()
+				case PushFailureTimeName:
+					pushFailureTime = m.GetGauge().GetValue()
+				}
+			}
+		}
+		return pushTime, pushFailureTime
+	}
+	ts1 := time.Unix(1400000000, 0)
+	ts2 := ts1.Add(time.Minute)
+	ts3 := ts2.Add(time.Minute)
+	ts4 := ts3.Add(time.Minute)
+
+	opts := DiskMetricStoreOptions{PushTime: true}
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, opts)
+	// A rejected push to a group that does not exist is not recorded.
+	reserved := &dto.MetricFamily{
+		Name:   proto.String(PushTimeName),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{dms.groupGauge(labels, 1)},
+	}
+	if err := dms.SubmitWriteRequest(WriteRequest{
+		Labels:         labels,
+		Timestamp:      ts1,
+		MetricFamilies: map[string]*dto.MetricFamily{PushTimeName: reserved},
+	}); err == nil {
+		t.Error("Expected error pushing reserved metric name.")
+	}
+	if expected, got := 0, len(dms.GetMetricFamilies()); expected != got {
+		t.Errorf("Expected %d metric families, got %d.", expected, got)
+	}
+
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         labels,
+		Timestamp:      ts1,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	// A failed check is no failed push.
+	invalid := WriteRequest{
+		Labels:         labels,
+		Timestamp:      ts2,
+		MetricFamilies: map[string]*dto.MetricFamily{PushTimeName: reserved},
+	}
+	if err := dms.CheckWriteRequest(invalid); err == nil {
+		t.Error("Expected error checking reserved metric name.")
+	}
+	if _, pushFailureTime := pushTimes(dms); pushFailureTime != 0 {
+		t.Errorf("Expected no push failure time after a check, got %v.", pushFailureTime)
+	}
+	if err := dms.SubmitWriteRequest(invalid); err == nil {
+		t.Error("Expected error pushing reserved metric name.")
+	}
+	if _, pushFailureTime := pushTimes(dms); pushFailureTime != float64(ts2.Unix()) {
+		t.Errorf("Expected push failure time %v, got %v.", ts2.Unix(), pushFailureTime)
+	}
+	// A push dropped during processing is recorded, too.
+	changed := proto.Clone(mf3).(*dto.MetricFamily)
+	changed.Type = dto.MetricType_GAUGE.Enum()
+	changed.Metric[0].Untyped = nil
+	changed.Metric[0].Gauge = &dto.Gauge{Value: proto.Float64(1)}
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         labels,
+		Timestamp:      ts3,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": changed},
+		SkipValidation: true,
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The time of the last failed push survives a persistence round trip.
+	dms = NewDiskMetricStore(fileName, 100*time.Millisecond, opts)
+	pushTime, pushFailureTime := pushTimes(dms)
+	if expected := float64(ts1.Unix()); pushTime != expected {
+		t.Errorf("Expected push time %v, got %v.", expected, pushTime)
+	}
+	if expected := float64(ts3.Unix()); pushFailureTime != expected {
+		t.Errorf("Expected push failure time %v, got %v.", expected, pushFailureTime)
+	}
+
+	// A successful push does not reset the time of the last failed push.
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         labels,
+		Timestamp:      ts4,
+		Replace:        true,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf3},
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	pushTime, pushFailureTime = pushTimes(dms)
+	if expected := float64(ts4.Unix()); pushTime != expected {
+		t.Errorf("Expected push time %v, got %v.", expected, pushTime)
+	}
+	if expected := float64(ts3.Unix()); pushFailureTime != expected {
+		t.Errorf("Expected push failure time %v, got %v.", expected, pushFailureTime)
+	}
+}
+
+func TestCheckConsistency(t *testing.T) {
+	metric := func(instance string, labels ...string) *dto.Metric {
+		m := &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("job"), Value: proto.String("job1")},
+				{Name: proto.String("instance"), Value: proto.String(instance)},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(1)},
+		}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return m
+	}
+	push := func(instance string, t dto.MetricType, metrics ...*dto.Metric) WriteRequest {
+		return WriteRequest{
+			Labels:    map[string]string{"job": "job1", "instance": instance},
+			Timestamp: time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"a": {Name: proto.String("a"), Type: t.Enum(), Metric: metrics},
+			},
+		}
+	}
+
+	dms := NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{CheckConsistency: true})
+	stored := push("instance1", dto.MetricType_GAUGE, metric("instance1", "x", "1"), metric("instance1", "x", "2"))
+	if err := dms.CheckWriteRequest(stored); err != nil {
+		t.Fatal(err)
+	}
+	dms.SubmitWriteRequest(stored)
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	untyped := metric("instance2", "x", "1")
+	untyped.Gauge = nil
+	untyped.Untyped = &dto.Untyped{Value: proto.Float64(1)}
+	for _, s := range []struct {
+		name    string
+		req     WriteRequest
+		wantErr bool
+	}{
+		{"consistent", push("instance2", dto.MetricType_GAUGE, metric("instance2", "x", "1")), false},
+		{"replacing own group", push("instance1", dto.MetricType_GAUGE, metric("instance1", "y", "1")), false},
+		{"duplicate series", push("instance2", dto.MetricType_GAUGE, metric("instance2", "x", "1"), metric("instance2", "x", "1")), true},
+		{"inconsistent label names in push", push("instance2", dto.MetricType_GAUGE, metric("instance2", "x", "1"), metric("instance2", "y", "1")), true},
+		{"label names of other group", push("instance2", dto.MetricType_GAUGE, metric("instance2", "y", "1")), true},
+		{"type of other group", push("instance2", dto.MetricType_UNTYPED, untyped), true},
+		{"value not matching type", push("instance2", dto.MetricType_COUNTER, metric("instance2", "x", "1")), true},
+		{"invalid label name", push("instance2", dto.MetricType_GAUGE, metric("instance2", "x-y", "1")), true},
+		{"invalid UTF-8", push("instance2", dto.MetricType_GAUGE, metric("instance2", "x", "\xff")), true},
+	} {
+		err := dms.CheckWriteRequest(s.req)
+		if s.wantErr && err == nil {
+			t.Errorf("%s: Expected error.", s.name)
+		}
+		if !s.wantErr && err != nil {
+			t.Errorf("%s: Unexpected error: %s", s.name, err)
+		}
+	}
+
+	// Merging with the own group has to be consistent, too.
+	merge := push("instance1", dto.MetricType_GAUGE, metric("instance1", "y", "1"))
+	merge.Merge = MergeSum
+	if err := dms.CheckWriteRequest(merge); err == nil {
+		t.Error("Expected error merging with inconsistent label names.")
+	}
+
+	// Without the check, all of the above is accepted.
+	dms = NewDiskMetricStore("", 100*time.Millisecond, DiskMetricStoreOptions{})
+	dms.SubmitWriteRequest(stored)
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.CheckWriteRequest(push("instance2", dto.MetricType_GAUGE, metric("instance2", "y", "1"))); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestWriteAheadLog(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestWriteAheadLog.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	walPrefix := path.Join(tempDir, "wal")
+	opts := DiskMetricStoreOptions{WriteAheadLog: walPrefix}
+
+	push := func(dms *DiskMetricStore, instance string) {
+		mf := proto.Clone(mf3).(*dto.MetricFamily)
+		mf.Metric[0].Label[1].Value = proto.String(instance)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf},
+			Expiration:     time.Hour,
+		})
+	}
+	// The persistence interval is long enough for nothing to be persisted
+	// before the stores "crash", i.e. are abandoned without shutting them
+	// down. (They are shut down at the end to not leak their goroutines.)
+	crashed := NewDiskMetricStore(fileName, time.Hour, opts)
+	defer crashed.Shutdown()
+	push(crashed, "instance1")
+	push(crashed, "instance2")
+	crashed.SubmitWriteRequest(WriteRequest{
+		Labels:    map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp: time.Now(),
+	})
+	time.Sleep(10 * time.Millisecond) // Give loop() time to process.
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatalf("Expected no persistence file, got %v.", err)
+	}
+
+	replayed := NewDiskMetricStore(fileName, time.Hour, opts)
+	defer replayed.Shutdown()
+	if expected, got := []string{"instance1"}, instancesOf(replayed.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	group := replayed.metricFamilies[GroupingKeyFor(map[string]string{"job": "job1", "instance": "instance1"})]
+	if expected, got := time.Hour, group.Expiration; expected != got {
+		t.Errorf("Expected expiration %s, got %s.", expected, got)
+	}
+
+	// A segment cut off in the middle of the last record (the deletion)
+	// is replayed up to that record.
+	segments, err := walSegments(walPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(segments); expected != got {
+		t.Fatalf("Expected %d segments, got %d.", expected, got)
+	}
+	fi, err := os.Stat(segments[0].name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segments[0].name, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	dms := NewDiskMetricStore(fileName, time.Hour, opts)
+	if expected, got := []string{"instance1", "instance2"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+
+	// Persisting removes all segments.
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if segments, err = walSegments(walPrefix); err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 0 {
+		t.Errorf("Expected no segments, got %v.", segments)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, DiskMetricStoreOptions{})
+	if expected, got := []string{"instance1", "instance2"}, instancesOf(dms.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeRedis serves the few Redis commands used by Redis from memory.
+type fakeRedis struct {
+	listener net.Listener
+
+	mtx    sync.Mutex
+	values map[string]string
+	hashes map[string]map[string]string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: l, values: map[string]string{}, hashes: map[string]map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		req, err := readRedisReply(br)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range req.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		conn.Write(f.reply(args))
+	}
+}
+
+func (f *fakeRedis) reply(args []string) []byte {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	bulk := func(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+	switch args[0] {
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return []byte("$-1\r\n")
+		}
+		return []byte(bulk(v))
+	case "INCR":
+		n, _ := strconv.Atoi(f.values[args[1]])
+		f.values[args[1]] = strconv.Itoa(n + 1)
+		return []byte(fmt.Sprintf(":%d\r\n", n+1))
+	case "HSET":
+		if f.hashes[args[1]] == nil {
+			f.hashes[args[1]] = map[string]string{}
+		}
+		f.hashes[args[1]][args[2]] = args[3]
+		return []byte(":1\r\n")
+	case "HDEL":
+		delete(f.hashes[args[1]], args[2])
+		return []byte(":1\r\n")
+	case "HGETALL":
+		s := fmt.Sprintf("*%d\r\n", 2*len(f.hashes[args[1]]))
+		for field, value := range f.hashes[args[1]] {
+			s += bulk(field) + bulk(value)
+		}
+		return []byte(s)
+	case "HMGET":
+		s := fmt.Sprintf("*%d\r\n", len(args)-2)
+		for _, field := range args[2:] {
+			value, ok := f.hashes[args[1]][field]
+			if !ok {
+				s += "$-1\r\n"
+				continue
+			}
+			s += bulk(value)
+		}
+		return []byte(s)
+	}
+	return []byte("-ERR unknown command '" + args[0] + "'\r\n")
+}
+
+func TestRedis(t *testing.T) {
+	f := newFakeRedis(t)
+	defer f.listener.Close()
+
+	open := func() *DiskMetricStore {
+		r := NewRedis(f.listener.Addr().String(), "", "test:", time.Second)
+		r.syncInterval = 10 * time.Millisecond // Below the minimum to keep the test fast.
+		dms, err := OpenDiskMetricStore("", time.Minute, DiskMetricStoreOptions{Redis: r})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dms
+	}
+	push := func(dms *DiskMetricStore, instance string) {
+		mf := proto.Clone(mf3).(*dto.MetricFamily)
+		mf.Metric[0].Label[1].Value = proto.String(instance)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf},
+		})
+	}
+	instances := func(dms *DiskMetricStore) []string {
+		dms.lock.RLock()
+		defer dms.lock.RUnlock()
+		return instancesOf(dms.metricFamilies, "job1")
+	}
+
+	first := open()
+	defer first.Shutdown()
+	push(first, "instance1")
+	time.Sleep(20 * time.Millisecond) // Give loop() time to process.
+	f.mtx.Lock()
+	if expected, got := 1, len(f.hashes["test:groups"]); expected != got {
+		t.Errorf("Expected %d group in Redis, got %d.", expected, got)
+	}
+	f.mtx.Unlock()
+
+	// A second store loads the groups on start-up.
+	second := open()
+	defer second.Shutdown()
+	if expected, got := []string{"instance1"}, instances(second); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+
+	// Changes by one store are picked up by the other one.
+	push(second, "instance2")
+	time.Sleep(100 * time.Millisecond) // Give both loops time to process and sync.
+	if expected, got := []string{"instance1", "instance2"}, instances(first); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	first.SubmitWriteRequest(WriteRequest{
+		Labels:    map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp: time.Now(),
+	})
+	time.Sleep(100 * time.Millisecond)
+	if expected, got := []string{"instance2"}, instances(second); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	f.mtx.Lock()
+	if expected, got := "3", f.values["test:version"]; expected != got {
+		t.Errorf("Expected version %s, got %s.", expected, got)
+	}
+	if expected, got := 1, len(f.hashes["test:hashes"]); expected != got {
+		t.Errorf("Expected %d hash in Redis, got %d.", expected, got)
+	}
+	f.mtx.Unlock()
+
+	// Only the changed group is fetched, the unchanged one stays as it
+	// is in memory.
+	first.lock.RLock()
+	unchanged := first.metricFamilies[GroupingKeyFor(map[string]string{"job": "job1", "instance": "instance2"})]
+	first.lock.RUnlock()
+	push(second, "instance3")
+	time.Sleep(100 * time.Millisecond)
+	if expected, got := []string{"instance2", "instance3"}, instances(first); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	first.lock.RLock()
+	if got := first.metricFamilies[GroupingKeyFor(map[string]string{"job": "job1", "instance": "instance2"})]; got.Metrics["mf3"].MetricFamily != unchanged.Metrics["mf3"].MetricFamily {
+		t.Error("Expected the unchanged group not to be fetched again.")
+	}
+	first.lock.RUnlock()
+
+	// Error replies are returned as errors without losing the connection.
+	r := NewRedis(f.listener.Addr().String(), "", "test:", time.Second)
+	r.mtx.Lock()
+	_, err := r.do(redisCommand("FLUSHALL"))
+	if _, ok := err.(redisError); !ok {
+		t.Errorf("Expected a redisError, got %v.", err)
+	}
+	version, err := r.version()
+	r.mtx.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := int64(4), version; expected != got {
+		t.Errorf("Expected version %d, got %d.", expected, got)
+	}
+	r.close()
+
+	// If Redis cannot be reached, OpenDiskMetricStore fails, while
+	// NewDiskMetricStore starts without the groups.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if _, err := OpenDiskMetricStore("", time.Minute, DiskMetricStoreOptions{Redis: NewRedis(l.Addr().String(), "", "test:", time.Second)}); err == nil {
+		t.Error("Expected error for unreachable Redis.")
+	}
+	dms := NewDiskMetricStore("", time.Minute, DiskMetricStoreOptions{Redis: NewRedis(l.Addr().String(), "", "test:", time.Second)})
+	if got := instances(dms); len(got) != 0 {
+		t.Errorf("Expected no instances, got %v.", got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyReplicated(t *testing.T) {
+	var changes [][]byte
+	source := NewDiskMetricStore("", time.Minute, DiskMetricStoreOptions{
+		Replicate: func(change []byte) { changes = append(changes, change) },
+	})
+	defer source.Shutdown()
+	replica := NewDiskMetricStore("", time.Minute, DiskMetricStoreOptions{
+		Replicate: func(change []byte) { t.Error("Replicated change applied from a peer.") },
+	})
+	defer replica.Shutdown()
+
+	for _, instance := range []string{"instance1", "instance2"} {
+		mf := proto.Clone(mf3).(*dto.MetricFamily)
+		mf.Metric[0].Label[1].Value = proto.String(instance)
+		source.processWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf},
+			Expiration:     time.Hour,
+		})
+	}
+	source.processWriteRequest(WriteRequest{
+		Labels:    map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp: time.Now(),
+	})
+	if expected, got := 3, len(changes); expected != got {
+		t.Fatalf("Expected %d changes, got %d.", expected, got)
+	}
+	if err := replica.ApplyReplicated(changes); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{"instance1"}, instancesOf(replica.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	key := GroupingKeyFor(map[string]string{"job": "job1", "instance": "instance1"})
+	if expected, got := source.metricFamilies[key].Expiration, replica.metricFamilies[key].Expiration; expected != got {
+		t.Errorf("Expected expiration %s, got %s.", expected, got)
+	}
+	if expected, got := source.bytes, replica.bytes; expected != got {
+		t.Errorf("Expected %d bytes, got %d.", expected, got)
+	}
+
+	// A change older than the last change of the group is ignored, so
+	// the deleted group does not come back.
+	if err := replica.ApplyReplicated([][]byte{changes[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{"instance1"}, instancesOf(replica.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+
+	// Changes that would be rejected as a push are ignored.
+	invalid, err := encodeChange(walRecord{
+		Labels:         map[string]string{"job": "job2", "instance": "instance1"},
+		MetricFamilies: groupRecord(source.metricFamilies[key]).MetricFamilies, // Labels do not match.
+		Timestamps:     []time.Time{time.Now()},
+		Changed:        time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.ApplyReplicated([][]byte{invalid}); err != nil {
+		t.Fatal(err)
+	}
+	if got := instancesOf(replica.metricFamilies, "job2"); len(got) != 0 {
+		t.Errorf("Expected no instances of job2, got %v.", got)
+	}
+
+	// A snapshot brings a new replica up to date, including the deletion.
+	snapshot := source.ReplicationSnapshot()
+	if expected, got := 2, len(snapshot); expected != got {
+		t.Errorf("Expected %d changes in the snapshot, got %d.", expected, got)
+	}
+	fresh := NewDiskMetricStore("", time.Minute, DiskMetricStoreOptions{})
+	defer fresh.Shutdown()
+	if err := fresh.ApplyReplicated([][]byte{changes[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.ApplyReplicated(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{"instance1"}, instancesOf(fresh.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+
+	// Nothing is applied if any change is broken.
+	if err := fresh.ApplyReplicated([][]byte{changes[2], []byte("garbage")}); err == nil {
+		t.Error("Expected error for undecodable change.")
+	}
+	if expected, got := []string{"instance1"}, instancesOf(fresh.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	push := func(dms *DiskMetricStore, instance string) {
+		mf := proto.Clone(mf3).(*dto.MetricFamily)
+		mf.Metric[0].Label[1].Value = proto.String(instance)
+		dms.processWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": instance},
+			Timestamp:      time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"mf3": mf},
+			Expiration:     time.Hour,
+		})
+	}
+	source := NewDiskMetricStore("", time.Minute, DiskMetricStoreOptions{})
+	defer source.Shutdown()
+	push(source, "instance1")
+	push(source, "instance2")
+	dump := &bytes.Buffer{}
+	if err := source.Dump(dump); err != nil {
+		t.Fatal(err)
+	}
+
+	target := NewDiskMetricStore("", time.Minute, DiskMetricStoreOptions{})
+	defer target.Shutdown()
+	push(target, "instance3")
+	if _, err := target.Restore(strings.NewReader("garbage"), true, ""); err == nil {
+		t.Error("Expected error for invalid dump.")
+	} else if _, ok := err.(InvalidDumpError); !ok {
+		t.Errorf("Expected InvalidDumpError, got %T.", err)
+	}
+	if expected, got := []string{"instance3"}, instancesOf(target.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+
+	// A dump larger than the store may get is not even read completely.
+	target.SetLimits(0, int64(dump.Len()-1))
+	if _, err := target.Restore(bytes.NewReader(dump.Bytes()), true, ""); err != ErrDumpTooLarge {
+		t.Errorf("Expected ErrDumpTooLarge, got %v.", err)
+	}
+	if expected, got := []string{"instance3"}, instancesOf(target.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	target.SetLimits(0, 0)
+
+	restored, err := target.Restore(bytes.NewReader(dump.Bytes()), false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, restored; expected != got {
+		t.Errorf("Expected %d restored groups, got %d.", expected, got)
+	}
+	if expected, got := []string{"instance1", "instance2", "instance3"}, instancesOf(target.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	key := GroupingKeyFor(map[string]string{"job": "job1", "instance": "instance1"})
+	if expected, got := time.Hour, target.metricFamilies[key].Expiration; expected != got {
+		t.Errorf("Expected expiration %s, got %s.", expected, got)
+	}
+
+	if _, err := target.Restore(bytes.NewReader(dump.Bytes()), true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := []string{"instance1", "instance2"}, instancesOf(target.metricFamilies, "job1"); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected instances %v, got %v.", expected, got)
+	}
+	if expected, got := source.bytes, target.bytes; expected != got {
+		t.Errorf("Expected %d bytes, got %d.", expected, got)
+	}
 }
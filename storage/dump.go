@@ -0,0 +1,89 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// Dump implements the MetricStore interface.
+func (dms *DiskMetricStore) Dump(w io.Writer) error {
+	return writePersistence(w, dms.snapshot())
+}
+
+// Restore implements the MetricStore interface.
+func (dms *DiskMetricStore) Restore(r io.Reader, replace bool, origin string) (int, error) {
+	// The oldest format can only be told apart by reading the start
+	// twice, so the dump has to be read completely. To not run out of
+	// memory on a huge dump, it must not be larger than the store may get
+	// (see SetLimits), if limited.
+	dms.lock.RLock()
+	limit := dms.maxBytes
+	dms.lock.RUnlock()
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, InvalidDumpError(err.Error())
+	}
+	if limit > 0 && int64(len(buf)) > limit {
+		return 0, ErrDumpTooLarge
+	}
+	groups := GroupingKeyToMetricGroup{}
+	if err := readPersistence(bytes.NewReader(buf), groups); err != nil {
+		return 0, InvalidDumpError(err.Error())
+	}
+	for _, group := range groups {
+		if group.Labels["job"] == "" {
+			return 0, InvalidDumpError("group without job label")
+		}
+	}
+
+	dms.lock.Lock()
+	if replace {
+		for key := range dms.metricFamilies {
+			if _, ok := groups[key]; !ok {
+				dms.auditDeletion(key, DeletionRestore, origin)
+				dms.deleteGroup(key)
+			}
+		}
+	}
+	for key, group := range groups {
+		if old, ok := dms.metricFamilies[key]; ok {
+			dms.bytes -= namesSize(old.Metrics)
+			dms.families -= len(old.Metrics)
+		}
+		if dms.pool != nil {
+			for _, tmf := range group.Metrics {
+				dms.pool.dedupeMetricFamily(tmf.MetricFamily)
+			}
+		}
+		dms.metricFamilies[key] = group
+		dms.bytes += namesSize(group.Metrics)
+		dms.families += len(group.Metrics)
+		dms.logGroup(key, group.Labels)
+	}
+	dms.evict()
+	if dms.pool != nil {
+		dms.pool.maybeRebuild(dms.metricFamilies)
+	}
+	atomic.AddUint64(&dms.version, 1)
+	dms.setSizeGauges()
+	dms.lock.Unlock()
+	return len(groups), dms.persistAndRecord()
+}
@@ -0,0 +1,116 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// The types of the events recorded in an EventLog.
+const (
+	// EventPush is a processed push, i.e. a write request with metric
+	// families.
+	EventPush = "push"
+	// EventDelete is a processed delete request for a group or a job.
+	EventDelete = "delete"
+)
+
+// The outcomes of the events recorded in an EventLog.
+const (
+	// OutcomeApplied means that the write request changed the store as
+	// requested.
+	OutcomeApplied = "applied"
+	// OutcomeNotFound means that a delete request found nothing to delete.
+	OutcomeNotFound = "not_found"
+	// OutcomeTooManyGroups means that a push has been dropped because of
+	// the group limit.
+	OutcomeTooManyGroups = "too_many_groups"
+	// OutcomeTooManyMetricFamilies means that a push has been dropped
+	// because of the metric family limit.
+	OutcomeTooManyMetricFamilies = "too_many_metric_families"
+	// OutcomeTypeChange means that a push has been dropped because it
+	// would have changed the type of a stored metric family.
+	OutcomeTypeChange = "type_change"
+)
+
+// eventOverhead is the estimated size of an Event without its strings.
+const eventOverhead = 64
+
+// Event describes a write request processed by a DiskMetricStore. Labels are
+// the grouping labels of the request, which lack the instance label for the
+// deletion of a whole job (see WriteRequest).
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	Labels  map[string]string `json:"labels"`
+	Outcome string            `json:"outcome"`
+	Origin  string            `json:"origin"`
+}
+
+func (e Event) size() int {
+	n := eventOverhead + len(e.Type) + len(e.Outcome) + len(e.Origin)
+	for ln, lv := range e.Labels {
+		n += len(ln) + len(lv)
+	}
+	return n
+}
+
+// EventLog keeps the most recent Events in memory, at most maxEvents of them
+// and at most as many as fit into maxBytes (estimated). Older events are
+// dropped. It is safe for concurrent use. A nil *EventLog records nothing.
+type EventLog struct {
+	mtx       sync.Mutex
+	maxEvents int
+	maxBytes  int
+	events    []Event // Oldest first.
+	bytes     int
+}
+
+// NewEventLog returns an EventLog with the given limits. A maxBytes of 0 or
+// less means no limit besides maxEvents.
+func NewEventLog(maxEvents, maxBytes int) *EventLog {
+	return &EventLog{maxEvents: maxEvents, maxBytes: maxBytes}
+}
+
+func (l *EventLog) record(e Event) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.events = append(l.events, e)
+	l.bytes += e.size()
+	for len(l.events) > 0 && (len(l.events) > l.maxEvents || l.maxBytes > 0 && l.bytes > l.maxBytes) {
+		l.bytes -= l.events[0].size()
+		l.events = l.events[1:]
+	}
+}
+
+// Events returns the recorded events of the given type (or of all types if
+// typ is empty), oldest first.
+func (l *EventLog) Events(typ string) []Event {
+	result := []Event{}
+	if l == nil {
+		return result
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, e := range l.events {
+		if typ == "" || e.Type == typ {
+			result = append(result, e)
+		}
+	}
+	return result
+}
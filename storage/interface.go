@@ -14,39 +14,180 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"time"
 
 	dto "github.com/prometheus/client_model/go"
 )
 
+// ErrTooManyGroups is returned by MetricStore.CheckWriteRequest if a write
+// request would create a new group while the maximum number of groups is
+// already stored.
+var ErrTooManyGroups = errors.New("maximum number of groups reached")
+
+// ErrTooManyMetricFamilies is returned by MetricStore.CheckWriteRequest if a
+// write request would add metric families while the maximum number of metric
+// families is already stored.
+var ErrTooManyMetricFamilies = errors.New("maximum number of metric families reached")
+
+// ErrQueueFull is returned by MetricStore.SubmitWriteRequest if the queue of
+// write requests waiting for processing is full.
+var ErrQueueFull = errors.New("write request queue full")
+
+// ErrShutdown is returned by MetricStore.SubmitWriteRequest once the
+// MetricStore is shutting down.
+var ErrShutdown = errors.New("metric store shut down")
+
+// ErrDumpTooLarge is returned by MetricStore.Restore if the dump is larger than
+// the maximum size of the store, in which case nothing has been loaded.
+var ErrDumpTooLarge = errors.New("dump larger than the maximum size of the store")
+
+// InvalidDumpError is returned by MetricStore.Restore if the dump cannot be
+// read, in which case nothing has been loaded.
+type InvalidDumpError string
+
+func (e InvalidDumpError) Error() string { return "invalid dump: " + string(e) }
+
 // MetricStore is the interface to the storage layer for metrics. All its
 // methods must be safe to be called concurrently.
 type MetricStore interface {
 	// SubmitWriteRequest submits a WriteRequest for processing. There is no
 	// guarantee when a request will be processed, but it is guaranteed that
-	// the requests are processed in the order of submission.
-	SubmitWriteRequest(req WriteRequest)
+	// the requests for the same job (i.e. with the same job label) are
+	// processed in the order of submission. (Requests for different jobs
+	// may be processed concurrently.) Unless WriteRequest.SkipValidation is
+	// set, the request is checked like by CheckWriteRequest first, and the
+	// error is returned if it fails the check. SubmitWriteRequest never
+	// blocks: If the request cannot be queued, it is dropped and
+	// ErrQueueFull or ErrShutdown is returned, so that the caller can tell
+	// the client to retry later.
+	SubmitWriteRequest(req WriteRequest) error
+	// CheckWriteRequest returns an error if the given WriteRequest is
+	// invalid (see WriteRequest for the requirements, which are checked
+	// for each metric) or would be rejected if submitted now, e.g.
+	// ErrTooManyGroups. It changes nothing, i.e. a failed check is
+	// neither counted nor recorded as a failed push to the group, unlike
+	// a request rejected by SubmitWriteRequest. It allows callers to
+	// check several requests before submitting any of them. As requests
+	// are processed asynchronously, a request that has passed the check
+	// can still be rejected during processing (if other requests have
+	// created groups in the meantime), in which case it is dropped and
+	// logged.
+	CheckWriteRequest(req WriteRequest) error
 	// GetMetricFamilies returns all the currently saved MetricFamilies. The
 	// returned MetricFamilies are guaranteed to not be modified by the
 	// MetricStore anymore. However, they may still be read somewhere else,
 	// so the caller is not allowed to modify the returned MetricFamilies.
-	// If different jobs and instances have saved MetricFamilies of the same
-	// name, they are all merged into one MetricFamily by concatenating the
-	// contained Metrics. Inconsistent help strings or types are logged, and
-	// one of the versions will "win". Inconsistent labels will go
-	// undetected.
+	// If different groups have saved MetricFamilies of the same name, they
+	// are all merged into one MetricFamily by concatenating the contained
+	// Metrics. The returned MetricFamilies are sorted by name, and the
+	// contained Metrics are ordered by group (see GroupLess).
+	// Inconsistent help strings or types are logged. The type pushed by
+	// the group sorting first will "win", while inconsistent help strings
+	// are resolved according to the configured policy of the
+	// implementation (by default, the group sorting first wins, too).
+	// Inconsistent labels will go undetected, except that metrics lacking a
+	// grouping label that other metrics of the same name have get that
+	// label with an empty value.
 	GetMetricFamilies() []*dto.MetricFamily
-	// GetMetricFamiliesMap returns a nested map (job -> instance ->
-	// metric-name -> TimestampedMetricFamily). The MetricFamily pointed to
-	// by each TimestampedMetricFamily is guaranteed to not be modified by
-	// the MetricStore anymore. However, they may still be read somewhere
-	// else, so the caller is not allowed to modify it. Otherwise, the
-	// returned nested map is a deep copy of the internal state of the
-	// MetricStore and completely owned by the caller.
-	GetMetricFamiliesMap() JobToInstanceMap
-	// Shutdown must only be called after the caller has made sure that
+	// GetMetricFamiliesFiltered works like GetMetricFamilies but only
+	// includes the groups for whose grouping labels keep returns true, so
+	// that the other groups are not even copied. The grouping labels
+	// passed to keep must not be modified. A nil keep includes all groups.
+	GetMetricFamiliesFiltered(keep func(labels map[string]string) bool) []*dto.MetricFamily
+	// GetMetricFamiliesMap returns a map grouping-key -> MetricGroup (see
+	// GroupingKeyFor). The MetricFamily pointed to by each
+	// TimestampedMetricFamily is guaranteed to not be modified by the
+	// MetricStore anymore. However, they may still be read somewhere else,
+	// so the caller is not allowed to modify it. Otherwise, the returned
+	// map is a deep copy of the internal state of the MetricStore and
+	// completely owned by the caller.
+	GetMetricFamiliesMap() GroupingKeyToMetricGroup
+	// GetGroup returns the MetricFamilies of the group with exactly the
+	// given grouping labels, sorted by name, and the time of the last push
+	// to the group. Unlike with GetMetricFamiliesMap, only the requested
+	// group is copied, and the returned MetricFamilies are a deep copy,
+	// completely owned by the caller. The last return value is false if
+	// the group does not exist.
+	GetGroup(labels map[string]string) ([]*dto.MetricFamily, time.Time, bool)
+	// DeleteGroups deletes all groups for which the provided filter
+	// returns true and returns the number of deleted groups. The filter is
+	// called with the grouping labels of the group (which it must not
+	// modify) and the time of the last push to the group. Evaluating the
+	// filter and deleting the groups happens atomically, i.e. no write
+	// request is processed in between. Write requests still queued at the
+	// time of the call are not affected. The origin describes who
+	// requested the deletion (see WriteRequest.Origin).
+	DeleteGroups(filter func(labels map[string]string, lastPush time.Time) bool, origin string) int
+	// Reset deletes all groups and returns the number of deleted groups.
+	// Implementations that persist metrics make sure that the deletion is
+	// persisted before Reset returns. An error is returned if that fails
+	// (but the groups are deleted nevertheless). The origin is the same
+	// as for DeleteGroups.
+	Reset(origin string) (int, error)
+	// Dump writes all groups to w in the format of the persistence files
+	// of the DiskMetricStore, regardless of where (and whether) they are
+	// persisted.
+	Dump(w io.Writer) error
+	// Restore loads all groups of a dump (see Dump, but any persistence
+	// file works, too) and returns their number. Each group of the dump
+	// replaces the stored group with the same grouping labels completely.
+	// If replace is true, all stored groups not part of the dump are
+	// deleted, too. Loading the groups happens atomically and is
+	// persisted like Reset. An error is returned if the dump is invalid,
+	// (an InvalidDumpError) or too large (ErrDumpTooLarge), in which case
+	// nothing is loaded, or if persisting fails (but the
+	// groups are loaded nevertheless). The origin is the same as for
+	// DeleteGroups.
+	Restore(r io.Reader, replace bool, origin string) (int, error)
+	// ApplyReplicated applies the given changes, as passed to the
+	// replication hook of another MetricStore (see
+	// DiskMetricStoreOptions.Replicate) or returned by its
+	// ReplicationSnapshot, in order and atomically. Each change sets a
+	// group to the state it had in the other MetricStore, or deletes it,
+	// unless the group has seen a later change already.
+	// The changes are applied directly, i.e. not queued like write
+	// requests, and they are not passed on for replication again. If any
+	// change cannot be decoded, an error is returned and nothing is
+	// applied.
+	ApplyReplicated(changes [][]byte) error
+	// ReplicationSnapshot returns the current state of all groups as
+	// changes for ApplyReplicated, e.g. to bring a newly started replica
+	// up to date.
+	ReplicationSnapshot() [][]byte
+	// SetPaused pauses or resumes the processing of write requests. While
+	// paused, write requests are still accepted by SubmitWriteRequest
+	// until the queue is full, at which point SubmitWriteRequest returns
+	// ErrQueueFull until processing is resumed. Shutdown processes all
+	// queued requests regardless of the paused state.
+	SetPaused(paused bool)
+	// PendingWriteRequests returns a point-in-time view of the write
+	// requests submitted but not yet processed, in the order of
+	// submission, but at most limit of them (all if limit is 0 or
+	// negative). The second return value is the total number of pending
+	// write requests, including those omitted because of the limit.
+	PendingWriteRequests(limit int) ([]PendingWriteRequest, int)
+	// Healthy returns an error if the MetricStore is not working properly
+	// anymore, e.g. because it has been shut down or the processing of
+	// write requests is stuck. An unhealthy MetricStore will not recover
+	// by itself.
+	Healthy() error
+	// Ready returns an error if the MetricStore cannot take write
+	// requests right now, e.g. because it is not healthy or its queue is
+	// full (see SubmitWriteRequest), which may change by itself. It is
+	// cheap enough to be called by frequent probes.
+	Ready() error
+	// Stats returns operational statistics of the MetricStore. It is cheap
+	// enough to be called whenever the status page is rendered.
+	Stats() Stats
+	// Shutdown should only be called after the caller has made sure that
 	// SubmitWriteRequests is not called anymore. (If it is called later,
-	// the request might get submitted, but not processed anymore.) The
+	// it returns ErrShutdown, but a request submitted concurrently with
+	// Shutdown might get queued without being processed anymore.) The
 	// Shutdown method waits for the write request queue to empty, then it
 	// persists the content of the MetricStore (if supported by the
 	// implementation). Also, all internal goroutines are stopped. This
@@ -58,33 +199,284 @@ type MetricStore interface {
 }
 
 // WriteRequest is a request to change the MetricStore, i.e. to process it, a
-// write lock has to be acquired. If MetricFamilies is nil, this is a request to
-// delete metrics that share the given Job and (if not empty) Instance
-// labels. Otherwise, this is a request to update the MetricStore with the
-// MetricFamilies. The key in MetricFamilies is the name of the mapped metric
-// family. All metrics in MetricFamilies MUST have already set job and instance
-// labels that are consistent with the Job and Instance fields. The Timestamp
-// field marks the time the request was received from the network. It is not
-// related to the timestamp_ms field in the Metric proto message.
+// write lock has to be acquired. Labels are the grouping labels identifying the
+// group, which always include a non-empty job label. If MetricFamilies is nil,
+// this is a request to delete the group with exactly these Labels or, if there
+// is no instance label, all groups whose grouping labels include all of the
+// Labels (e.g. all groups of a job). Otherwise, this is a request to update the
+// MetricStore with the MetricFamilies, and Labels must include an instance
+// label. The key in MetricFamilies is the name of the mapped metric family. All
+// metrics in MetricFamilies MUST have already set all grouping labels to the
+// values in Labels. The Timestamp field marks the time the request was
+// received from the network. It is not related to the timestamp_ms field in
+// the Metric proto message.
+//
+// An update merges the MetricFamilies into the group given by Labels: Each
+// MetricFamily replaces a previously stored MetricFamily of the same name
+// completely, while stored MetricFamilies with other names are left alone (the
+// semantics of POST). If Replace is true, all previously stored MetricFamilies
+// of the group are removed first, so that only the MetricFamilies of the
+// request remain (the semantics of PUT). In both cases, the group is created
+// if it does not exist yet. A group without any MetricFamilies after the
+// update does not exist. Replace is ignored for deletes.
+//
+// If Aggregation is not nil, the MetricFamilies of an update are retained
+// together with the MetricFamilies of the same name previously pushed with the
+// same Aggregation, and the aggregated values are returned on reading, see
+// Aggregation. All MetricFamilies must then be gauges or untyped, and Replace
+// must be false.
+//
+// Merge decides how the value of a pushed gauge, counter, or untyped metric is
+// combined with the stored value of the metric with the same labels. For any
+// MergeFunc other than MergeLast, stored metrics of a MetricFamily that are
+// not part of the update are retained. With MergeSum, histograms with the
+// same bucket boundaries are summed, too, e.g. to aggregate the counters and
+// histograms pushed by many short-lived workers into the same group.
+// Summaries, histograms with other bucket boundaries, and MetricFamilies
+// whose type differs from the stored one replace the stored metric. Merge is
+// ignored if Replace is true.
+//
+// If MetricNames is not nil, an update is authoritative for exactly the metric
+// names listed: MetricFamilies must only contain MetricFamilies with one of
+// these names, and stored MetricFamilies with one of these names that are not
+// part of MetricFamilies are deleted (while stored MetricFamilies with other
+// names are left alone as usual). MetricNames is ignored if Replace is true.
+//
+// If DeleteMetric is not empty, a delete only deletes the MetricFamily of that
+// name from the affected groups, leaving their other MetricFamilies alone. A
+// group left without any MetricFamilies is deleted as a whole.
+//
+// Expiration overrides the default expiration of the group (see
+// DiskMetricStoreOptions.Expiration) for an update: If positive, the group is
+// deleted once its last push is longer ago than Expiration. If negative, the
+// group never expires. If zero, the default applies. Each update sets the
+// expiration of the group anew, i.e. the last push decides.
+//
+// Origin describes who submitted the request, e.g. the remote address and the
+// client certificate identity. It is only used to record deletions in the
+// AuditLog.
+//
+// PushInfo describes the push that resulted in the request. It is stored with
+// the group as MetricGroup.LastPushInfo, i.e. the last push decides.
+//
+// If KeepEmpty is true, an update with an empty (but not nil) MetricFamilies
+// creates the group if it does not exist yet and records Timestamp as its
+// MetricGroup.LastEmptyPush, rather than changing nothing or, with Replace,
+// deleting the group. With Replace, the stored MetricFamilies of the group are
+// deleted, leaving a group without any.
+//
+// If SkipValidation is true, SubmitWriteRequest does not check the request,
+// saving the cost of validating each metric. It is meant for trusted callers,
+// e.g. embedders of the storage package, that construct their WriteRequests in
+// a way that guarantees validity, or that have checked them with
+// MetricStore.CheckWriteRequest before. Misuse corrupts the MetricStore: An
+// invalid WriteRequest results, e.g., in metrics exposed with the wrong
+// grouping labels, in scrapes that fail as a whole, or in metrics ending up in
+// the wrong group after restoring from the persistence file. Limits (like
+// DiskMetricStoreOptions.MaxGroups) are still enforced during processing.
 type WriteRequest struct {
-	Job, Instance  string
+	Labels         map[string]string
 	Timestamp      time.Time
 	MetricFamilies map[string]*dto.MetricFamily
+	Replace        bool
+	Aggregation    *Aggregation
+	Merge          MergeFunc
+	MetricNames    []string
+	Expiration     time.Duration
+	DeleteMetric   string
+	Origin         string
+	PushInfo       PushInfo
+	KeepEmpty      bool
+	SkipValidation bool
+}
+
+// PushInfo is the metadata of a push: the IP number of the pusher, the
+// Content-Type and User-Agent headers, and the size of the request body in
+// bytes (after decompression). Fields are empty if unknown.
+type PushInfo struct {
+	Remote      string
+	ContentType string
+	UserAgent   string
+	BodyBytes   int64
+}
+
+// Stats contains operational statistics of a MetricStore.
+type Stats struct {
+	// QueueLength is the number of write requests waiting for
+	// processing, QueueCapacity the maximum number of waiting requests.
+	QueueLength, QueueCapacity int
+	// LatencyQuantiles maps quantiles (e.g. 0.99) to the time it took
+	// recently from submitting a write request to completing its
+	// processing. The map is empty if no write request has been
+	// processed recently.
+	LatencyQuantiles map[float64]time.Duration
+	// LastPersist is the time of the last successful persist. It is the
+	// zero time if nothing has been persisted yet.
+	LastPersist time.Time
+	// Groups is the number of stored groups, Series
+	// the total number of stored metrics.
+	Groups, Series int
+	// Bytes is the estimated size of the stored metrics, i.e. the sum of
+	// the serialized sizes of the stored metric families.
+	Bytes int64
+	// Paused is true if the processing of write requests is paused, see
+	// MetricStore.SetPaused.
+	Paused bool
+}
+
+// PendingWriteRequest describes a submitted but not yet processed
+// WriteRequest, see MetricStore.PendingWriteRequests.
+type PendingWriteRequest struct {
+	Labels    map[string]string
+	Submitted time.Time
+	// Delete is true if the request deletes a group or a whole job.
+	Delete, Replace bool
+	// MetricFamilies and Series count the metric families and metrics
+	// of the request, Bytes is the sum of the serialized sizes of its
+	// metric families.
+	MetricFamilies, Series, Bytes int
 }
 
 // TimestampedMetricFamily adds a timestamp to a MetricFamily-DTO.
 type TimestampedMetricFamily struct {
 	Timestamp    time.Time
 	MetricFamily *dto.MetricFamily
+	aggregation  *aggregationHistory // Only set for aggregated pushes.
+}
+
+// GroupingKeyToMetricGroup is the first level of the metric store, keyed by
+// grouping key (see GroupingKeyFor).
+type GroupingKeyToMetricGroup map[string]MetricGroup
+
+// MetricGroup adds the grouping labels, the expiration set by the last push
+// (see WriteRequest.Expiration), the time of the last failed push (the zero
+// time if none has failed), the metadata of the last push (see
+// WriteRequest.PushInfo), and the time of the last push without metric
+// families that kept the group (see WriteRequest.KeepEmpty, the zero time if
+// there was none) to a NameToTimestampedMetricFamilyMap.
+type MetricGroup struct {
+	Labels          map[string]string
+	Metrics         NameToTimestampedMetricFamilyMap
+	Expiration      time.Duration
+	LastPushFailure time.Time
+	LastPushInfo    PushInfo
+	LastEmptyPush   time.Time
 }
 
-// JobToInstanceMap is the first level of the metric store, keyed by job name.
-type JobToInstanceMap map[string]InstanceToNameMap
+// LastPushTime returns the time of the last push to the group, including
+// pushes without metric families that kept the group.
+func (g MetricGroup) LastPushTime() time.Time {
+	last := g.Metrics.LastPushTime()
+	if g.LastEmptyPush.After(last) {
+		return g.LastEmptyPush
+	}
+	return last
+}
 
-// InstanceToNameMap is the second level of the metric store, keyed by instance
-// name.
-type InstanceToNameMap map[string]NameToTimestampedMetricFamilyMap
+// Sorted returns the groups ordered according to GroupLess.
+func (groups GroupingKeyToMetricGroup) Sorted() []MetricGroup {
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Sort(groupKeys{keys, groups})
+	result := make([]MetricGroup, len(keys))
+	for i, key := range keys {
+		result[i] = groups[key]
+	}
+	return result
+}
 
-// NameToTimestampedMetricFamilyMap is the third level of the metric store,
+// groupKeys sorts the grouping keys of groups according to GroupLess.
+type groupKeys struct {
+	keys   []string
+	groups GroupingKeyToMetricGroup
+}
+
+func (s groupKeys) Len() int      { return len(s.keys) }
+func (s groupKeys) Swap(i, j int) { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s groupKeys) Less(i, j int) bool {
+	return groupLess(s.groups[s.keys[i]].Labels, s.groups[s.keys[j]].Labels, s.keys[i], s.keys[j])
+}
+
+// NameToTimestampedMetricFamilyMap is the second level of the metric store,
 // keyed by metric name.
 type NameToTimestampedMetricFamilyMap map[string]TimestampedMetricFamily
+
+// LastPushTime returns the most recent Timestamp of all contained
+// TimestampedMetricFamilies, i.e. the time of the last push to the group the
+// map belongs to. The zero time is returned for an empty map.
+func (n2tmf NameToTimestampedMetricFamilyMap) LastPushTime() time.Time {
+	var last time.Time
+	for _, tmf := range n2tmf {
+		if tmf.Timestamp.After(last) {
+			last = tmf.Timestamp
+		}
+	}
+	return last
+}
+
+// GroupingKeyFor returns the grouping key for the given grouping labels, i.e.
+// the label pairs sorted by label name and separated by 0xff bytes (which do
+// not occur in valid UTF-8).
+func GroupingKeyFor(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for ln := range labels {
+		names = append(names, ln)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, 2*len(names))
+	for _, ln := range names {
+		parts = append(parts, ln, labels[ln])
+	}
+	return strings.Join(parts, "\xff")
+}
+
+// GroupingLabelNames returns the names of the given grouping labels in the
+// order they are added to metrics and exposed: job and instance first (if
+// present), then all others sorted.
+func GroupingLabelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for _, ln := range []string{"job", "instance"} {
+		if _, ok := labels[ln]; ok {
+			names = append(names, ln)
+		}
+	}
+	others := make([]string, 0, len(labels))
+	for ln := range labels {
+		if ln != "job" && ln != "instance" {
+			others = append(others, ln)
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// GroupLess orders groups by their grouping labels: by job, then by instance,
+// then by grouping key (so that groups with further grouping labels sort
+// after the group with only the same job and instance).
+func GroupLess(a, b map[string]string) bool {
+	return groupLess(a, b, GroupingKeyFor(a), GroupingKeyFor(b))
+}
+
+// groupLess implements GroupLess with the grouping keys already at hand.
+func groupLess(a, b map[string]string, aKey, bKey string) bool {
+	if a["job"] != b["job"] {
+		return a["job"] < b["job"]
+	}
+	if a["instance"] != b["instance"] {
+		return a["instance"] < b["instance"]
+	}
+	return aKey < bKey
+}
+
+// FormatGroup formats the given grouping labels for log messages and errors,
+// e.g. `{job="a",instance="b",region="c"}` (in the order of
+// GroupingLabelNames).
+func FormatGroup(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, ln := range GroupingLabelNames(labels) {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", ln, labels[ln]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,134 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"math"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MergeFunc decides how the value of a pushed metric is combined with the
+// value of the stored metric with the same labels, see WriteRequest.
+type MergeFunc int
+
+// The available MergeFuncs. MergeLast is the default behavior of simply
+// replacing the stored value.
+const (
+	MergeLast MergeFunc = iota
+	MergeMax
+	MergeMin
+	MergeSum
+)
+
+func (f MergeFunc) apply(stored, pushed float64) float64 {
+	switch f {
+	case MergeMax:
+		return math.Max(stored, pushed)
+	case MergeMin:
+		return math.Min(stored, pushed)
+	case MergeSum:
+		return stored + pushed
+	default:
+		return pushed
+	}
+}
+
+// mergeMetricFamily returns the result of merging the pushed MetricFamily into
+// the stored one with the given MergeFunc. Neither of them is modified. If the
+// types differ or are neither gauge, counter, nor untyped (nor histogram, for
+// MergeSum), or if f is MergeLast, pushed is returned unchanged. Otherwise, the
+// values of metrics with the same labels (ignoring the label named ignore, if
+// not empty) are combined, and stored metrics without a pushed counterpart are
+// kept. All other fields are taken from pushed. Histograms are summed (sample
+// count, sample sum, and bucket counts) only if their buckets have the same
+// upper bounds. Otherwise, the pushed histogram replaces the stored one.
+func mergeMetricFamily(stored, pushed *dto.MetricFamily, f MergeFunc, ignore string) *dto.MetricFamily {
+	if f == MergeLast || stored == nil || stored.GetType() != pushed.GetType() {
+		return pushed
+	}
+	switch pushed.GetType() {
+	case dto.MetricType_GAUGE, dto.MetricType_COUNTER, dto.MetricType_UNTYPED:
+	case dto.MetricType_HISTOGRAM:
+		if f != MergeSum {
+			return pushed
+		}
+	default:
+		return pushed
+	}
+
+	signature := func(m *dto.Metric) string {
+		lps := make([]*dto.LabelPair, 0, len(m.GetLabel()))
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() != ignore {
+				lps = append(lps, lp)
+			}
+		}
+		return labelsSignature(lps)
+	}
+	storedBySig := make(map[string]*dto.Metric, len(stored.GetMetric()))
+	for _, m := range stored.GetMetric() {
+		storedBySig[signature(m)] = m
+	}
+
+	merged := &dto.MetricFamily{}
+	*merged = *pushed
+	merged.Metric = make([]*dto.Metric, 0, len(pushed.GetMetric())+len(stored.GetMetric()))
+	for _, m := range pushed.GetMetric() {
+		sig := signature(m)
+		if sm, ok := storedBySig[sig]; ok {
+			m = proto.Clone(m).(*dto.Metric)
+			switch pushed.GetType() {
+			case dto.MetricType_GAUGE:
+				m.Gauge.Value = proto.Float64(f.apply(sm.GetGauge().GetValue(), m.GetGauge().GetValue()))
+			case dto.MetricType_COUNTER:
+				m.Counter.Value = proto.Float64(f.apply(sm.GetCounter().GetValue(), m.GetCounter().GetValue()))
+			case dto.MetricType_HISTOGRAM:
+				sumHistograms(sm.GetHistogram(), m.GetHistogram())
+			default:
+				m.Untyped.Value = proto.Float64(f.apply(sm.GetUntyped().GetValue(), m.GetUntyped().GetValue()))
+			}
+			delete(storedBySig, sig)
+		}
+		merged.Metric = append(merged.Metric, m)
+	}
+	// Keep the remaining stored metrics in their original order.
+	for _, m := range stored.GetMetric() {
+		if _, ok := storedBySig[signature(m)]; ok {
+			merged.Metric = append(merged.Metric, m)
+		}
+	}
+	return merged
+}
+
+// sumHistograms adds the sample count, sample sum, and bucket counts of stored
+// to pushed, which must be a copy, if the buckets of both have the same upper
+// bounds. Otherwise, pushed is left unchanged.
+func sumHistograms(stored, pushed *dto.Histogram) {
+	if stored == nil || pushed == nil || len(stored.GetBucket()) != len(pushed.GetBucket()) {
+		return
+	}
+	for i, b := range pushed.GetBucket() {
+		if b.GetUpperBound() != stored.GetBucket()[i].GetUpperBound() {
+			return
+		}
+	}
+	pushed.SampleCount = proto.Uint64(stored.GetSampleCount() + pushed.GetSampleCount())
+	pushed.SampleSum = proto.Float64(stored.GetSampleSum() + pushed.GetSampleSum())
+	for i, b := range pushed.GetBucket() {
+		b.CumulativeCount = proto.Uint64(stored.GetBucket()[i].GetCumulativeCount() + b.GetCumulativeCount())
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"math"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// NonFiniteValuePolicy decides what happens to pushed sample values that are
+// NaN, +Inf, or -Inf. The values checked are those of gauges, counters, and
+// untyped metrics, and the sums of summaries and histograms. Quantiles of
+// summaries are not checked, as they are legitimately NaN without
+// observations.
+type NonFiniteValuePolicy int
+
+// The available NonFiniteValuePolicy values.
+const (
+	// NonFiniteKeep stores non-finite values as pushed.
+	NonFiniteKeep NonFiniteValuePolicy = iota
+	// NonFiniteReject makes CheckWriteRequest return an error naming the
+	// first series with a non-finite value.
+	NonFiniteReject
+	// NonFiniteReplace replaces non-finite values by the configured
+	// replacement when the write request is processed.
+	NonFiniteReplace
+)
+
+var nonFiniteValuePolicyNames = map[string]NonFiniteValuePolicy{
+	"keep":    NonFiniteKeep,
+	"reject":  NonFiniteReject,
+	"replace": NonFiniteReplace,
+}
+
+// ParseNonFiniteValuePolicy returns the NonFiniteValuePolicy with the given
+// name, i.e. one of "keep", "reject", or "replace".
+func ParseNonFiniteValuePolicy(s string) (NonFiniteValuePolicy, error) {
+	if p, ok := nonFiniteValuePolicyNames[s]; ok {
+		return p, nil
+	}
+	return 0, fmt.Errorf("unknown non-finite value policy %q, must be one of keep, reject, replace", s)
+}
+
+// checkedValues returns pointers to the values of m subject to a
+// NonFiniteValuePolicy.
+func checkedValues(m *dto.Metric) []*float64 {
+	var values []*float64
+	if m.Gauge != nil {
+		values = append(values, m.Gauge.Value)
+	}
+	if m.Counter != nil {
+		values = append(values, m.Counter.Value)
+	}
+	if m.Untyped != nil {
+		values = append(values, m.Untyped.Value)
+	}
+	if m.Summary != nil {
+		values = append(values, m.Summary.SampleSum)
+	}
+	if m.Histogram != nil {
+		values = append(values, m.Histogram.SampleSum)
+	}
+	return values
+}
+
+func isFinite(v *float64) bool {
+	return v == nil || !math.IsNaN(*v) && !math.IsInf(*v, 0)
+}
+
+// checkFinite returns an error for the first series with a non-finite value.
+func checkFinite(metricFamilies map[string]*dto.MetricFamily) error {
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			for _, v := range checkedValues(m) {
+				if !isFinite(v) {
+					return fmt.Errorf("non-finite value %v of series %s{%s}", *v, name, labelsSignature(m.GetLabel()))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// replaceNonFinite replaces all non-finite values by the given value (in
+// place) and returns the number of replaced values.
+func replaceNonFinite(metricFamilies map[string]*dto.MetricFamily, replacement float64) int {
+	replaced := 0
+	for _, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			for _, v := range checkedValues(m) {
+				if !isFinite(v) {
+					*v = replacement
+					replaced++
+				}
+			}
+		}
+	}
+	return replaced
+}
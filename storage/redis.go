@@ -0,0 +1,543 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+// redisTimeout limits each round trip to Redis, including connecting.
+const redisTimeout = 5 * time.Second
+
+var (
+	redisErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pushgateway",
+		Name:      "redis_errors_total",
+		Help:      "Total number of failed requests to Redis.",
+	})
+	redisSyncs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pushgateway",
+		Name:      "redis_syncs_total",
+		Help:      "Total number of times the groups have been synced from Redis after changes by other Pushgateways.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(redisErrors)
+	prometheus.MustRegister(redisSyncs)
+}
+
+// Redis keeps the groups of a DiskMetricStore in Redis (see
+// DiskMetricStoreOptions.Redis), so that several Pushgateways can share them
+// and they survive restarts. The groups are stored in the hash <prefix>groups,
+// with the grouping key (see GroupingKeyFor) as the field and the state of the
+// group as the value, encoded like a record of the write-ahead log. The hash
+// <prefix>hashes has a hash of each value in <prefix>groups under the same
+// field, by which the changed groups are found without fetching all of them.
+// Each batch of changes increments the counter <prefix>version, by which the
+// other Pushgateways notice that they have to sync. Changes are queued and
+// written by a goroutine of their own, so that the DiskMetricStore does not
+// wait for Redis. It is safe for concurrent use.
+type Redis struct {
+	address      string
+	password     string
+	groupsKey    string
+	hashesKey    string
+	versionKey   string
+	syncInterval time.Duration
+
+	mtx    sync.Mutex // Protects the fields below. Held during round trips.
+	conn   net.Conn
+	br     *bufio.Reader
+	seen   int64             // The version of the groups in memory.
+	hashes map[string]string // The hashes of the groups in memory, by grouping key.
+
+	qmtx     sync.Mutex // Protects the fields below. Never held during round trips.
+	queued   map[string]walRecord
+	inFlight map[string]walRecord // Taken from queued and being written.
+	seq      uint64               // Number of queued changes.
+	dirty    map[string]uint64    // The seq of the last change queued, by grouping key.
+	kick     chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewRedis returns a Redis for the server at the given address (host:port),
+// authenticating with password unless it is empty, with the given prefix for
+// all keys. The groups are synced after changes by other Pushgateways every
+// syncInterval (at the minimum of one second). No connection is made yet.
+func NewRedis(address, password, keyPrefix string, syncInterval time.Duration) *Redis {
+	if syncInterval < time.Second {
+		syncInterval = time.Second
+	}
+	r := &Redis{
+		address:      address,
+		password:     password,
+		groupsKey:    keyPrefix + "groups",
+		hashesKey:    keyPrefix + "hashes",
+		versionKey:   keyPrefix + "version",
+		syncInterval: syncInterval,
+		hashes:       map[string]string{},
+		queued:       map[string]walRecord{},
+		dirty:        map[string]uint64{},
+		kick:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	go r.writeLoop()
+	return r
+}
+
+// load returns all groups stored in Redis and remembers their version.
+func (r *Redis) load() (GroupingKeyToMetricGroup, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	replies, err := r.do(redisCommand("GET", r.versionKey), redisCommand("HGETALL", r.groupsKey))
+	if err != nil {
+		return nil, err
+	}
+	version, err := redisVersion(replies[0])
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := replies[1].([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("unexpected reply %v to HGETALL", replies[1])
+	}
+	groups := GroupingKeyToMetricGroup{}
+	hashes := map[string]string{}
+	for i := 0; i < len(fields); i += 2 {
+		key, _ := fields[i].([]byte)
+		value, ok := fields[i+1].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected value %v in hash %s", fields[i+1], r.groupsKey)
+		}
+		if _, err := replayWALSegment(bytes.NewReader(value), groups); err != nil {
+			return nil, fmt.Errorf("cannot decode group %q: %s", key, err)
+		}
+		hashes[string(key)] = redisHash(value)
+	}
+	r.seen, r.hashes = version, hashes
+	return groups, nil
+}
+
+// sync checks whether other Pushgateways have changed the groups since the
+// last load or sync. If so, it fetches the changed groups and calls apply with
+// them (nil for a deleted group), leaving out groups changed in memory in the
+// meantime, as those changes are still to be written. Only apply is called
+// with lock held, without waiting for Redis.
+func (r *Redis) sync(lock sync.Locker, apply func(map[string]*MetricGroup)) error {
+	r.mtx.Lock()
+	version, err := r.version()
+	if err != nil || version == r.seen {
+		r.mtx.Unlock()
+		r.forgetDirty()
+		return err
+	}
+	seq, skip := r.pending()
+	changes, err := r.fetchChanges()
+	if err != nil {
+		r.mtx.Unlock()
+		return err
+	}
+	r.seen = version
+	r.mtx.Unlock()
+
+	lock.Lock()
+	r.qmtx.Lock()
+	for key := range changes {
+		if _, ok := skip[key]; ok || r.dirty[key] > seq || r.isPending(key) {
+			delete(changes, key)
+		}
+	}
+	r.qmtx.Unlock()
+	apply(changes)
+	lock.Unlock()
+	r.forgetDirty()
+	redisSyncs.Inc()
+	return nil
+}
+
+// fetchChanges returns the groups whose hash in Redis differs from the hash
+// of the group in memory, nil for deleted groups, and remembers the new
+// hashes. The caller must hold mtx.
+func (r *Redis) fetchChanges() (map[string]*MetricGroup, error) {
+	replies, err := r.do(redisCommand("HGETALL", r.hashesKey))
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := replies[0].([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("unexpected reply %v to HGETALL", replies[0])
+	}
+	changes := map[string]*MetricGroup{}
+	current := make(map[string]bool, len(fields)/2)
+	hmget := []string{"HMGET", r.groupsKey}
+	for i := 0; i < len(fields); i += 2 {
+		key, _ := fields[i].([]byte)
+		hash, _ := fields[i+1].([]byte)
+		current[string(key)] = true
+		if r.hashes[string(key)] != string(hash) {
+			hmget = append(hmget, string(key))
+		}
+	}
+	for key := range r.hashes {
+		if !current[key] {
+			changes[key] = nil
+			delete(r.hashes, key)
+		}
+	}
+	if len(hmget) == 2 {
+		return changes, nil
+	}
+	if replies, err = r.do(redisCommand(hmget...)); err != nil {
+		return nil, err
+	}
+	values, ok := replies[0].([]interface{})
+	if !ok || len(values) != len(hmget)-2 {
+		return nil, fmt.Errorf("unexpected reply %v to HMGET", replies[0])
+	}
+	for i, key := range hmget[2:] {
+		if values[i] == nil { // Deleted in the meantime.
+			changes[key] = nil
+			delete(r.hashes, key)
+			continue
+		}
+		value, ok := values[i].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("unexpected value %v in hash %s", values[i], r.groupsKey)
+		}
+		var rec walRecord
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&rec); err != nil {
+			return nil, fmt.Errorf("cannot decode group %q: %s", key, err)
+		}
+		group, err := recordGroup(rec)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode group %q: %s", key, err)
+		}
+		changes[key] = &group
+		r.hashes[key] = redisHash(value)
+	}
+	return changes, nil
+}
+
+// write queues the given state of the group with the given grouping key for
+// writing to Redis, deleting it if the record says so. Only the latest state
+// of a group is written if it changes again before it is written. Errors are
+// logged and counted, as the change has already happened in memory.
+func (r *Redis) write(key string, rec walRecord) {
+	r.qmtx.Lock()
+	r.seq++
+	r.queued[key] = rec
+	r.dirty[key] = r.seq
+	r.qmtx.Unlock()
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop writes the queued changes until stop is closed, then writes the
+// remaining ones and closes stopped.
+func (r *Redis) writeLoop() {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-r.kick:
+			r.flush()
+		case <-r.stop:
+			r.flush()
+			return
+		}
+	}
+}
+
+// flush writes all queued changes in one round trip.
+func (r *Redis) flush() {
+	r.qmtx.Lock()
+	batch := r.queued
+	r.queued, r.inFlight = map[string]walRecord{}, batch
+	r.qmtx.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	defer func() {
+		r.qmtx.Lock()
+		r.inFlight = nil
+		r.qmtx.Unlock()
+	}()
+	cmds := make([][][]byte, 0, 2*len(batch)+1)
+	hashes := make(map[string]string, len(batch))
+	for key, rec := range batch {
+		if rec.Deleted {
+			cmds = append(cmds, redisCommand("HDEL", r.groupsKey, key), redisCommand("HDEL", r.hashesKey, key))
+			hashes[key] = ""
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if err := gob.NewEncoder(buf).Encode(rec); err != nil {
+			redisErrors.Inc()
+			logging.Error("Error encoding group for Redis.", "group", FormatGroup(rec.Labels), "err", err)
+			continue
+		}
+		hash := redisHash(buf.Bytes())
+		cmds = append(cmds, redisCommand("HSET", r.groupsKey, key, buf.String()), redisCommand("HSET", r.hashesKey, key, hash))
+		hashes[key] = hash
+	}
+	cmds = append(cmds, redisCommand("INCR", r.versionKey))
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	replies, err := r.do(cmds...)
+	if err != nil {
+		redisErrors.Inc()
+		logging.Error("Error writing groups to Redis.", "groups", len(batch), "err", err)
+		return
+	}
+	for key, hash := range hashes {
+		if hash == "" {
+			delete(r.hashes, key)
+		} else {
+			r.hashes[key] = hash
+		}
+	}
+	// Unless another Pushgateway has written in the meantime, the groups
+	// in memory are still up to date.
+	if version, ok := replies[len(replies)-1].(int64); ok && version == r.seen+1 {
+		r.seen = version
+	}
+}
+
+// pending returns the number of queued changes so far and the grouping keys
+// of the changes not written yet.
+func (r *Redis) pending() (uint64, map[string]struct{}) {
+	r.qmtx.Lock()
+	defer r.qmtx.Unlock()
+	keys := make(map[string]struct{}, len(r.queued)+len(r.inFlight))
+	for key := range r.queued {
+		keys[key] = struct{}{}
+	}
+	for key := range r.inFlight {
+		keys[key] = struct{}{}
+	}
+	return r.seq, keys
+}
+
+// isPending returns whether a change of the group with the given grouping key
+// has not been written yet. The caller must hold qmtx.
+func (r *Redis) isPending(key string) bool {
+	_, queued := r.queued[key]
+	_, inFlight := r.inFlight[key]
+	return queued || inFlight
+}
+
+// forgetDirty forgets the seqs of the written changes, which are only needed
+// during a sync.
+func (r *Redis) forgetDirty() {
+	r.qmtx.Lock()
+	defer r.qmtx.Unlock()
+	for key := range r.dirty {
+		if !r.isPending(key) {
+			delete(r.dirty, key)
+		}
+	}
+}
+
+// close writes the queued changes and closes the connection, if any.
+func (r *Redis) close() error {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	<-r.stopped
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// redisHash returns the hash of the given value as stored in <prefix>hashes.
+func redisHash(value []byte) string {
+	h := fnv.New64a()
+	h.Write(value)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// version returns the current version. The caller must hold mtx.
+func (r *Redis) version() (int64, error) {
+	replies, err := r.do(redisCommand("GET", r.versionKey))
+	if err != nil {
+		return 0, err
+	}
+	return redisVersion(replies[0])
+}
+
+// redisVersion returns the version given by the reply to GET, which is 0 if
+// the key does not exist.
+func redisVersion(reply interface{}) (int64, error) {
+	if reply == nil {
+		return 0, nil
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply %v to GET", reply)
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+func redisCommand(args ...string) [][]byte {
+	cmd := make([][]byte, len(args))
+	for i, arg := range args {
+		cmd[i] = []byte(arg)
+	}
+	return cmd
+}
+
+// do sends the given commands in one round trip (pipelined) and returns their
+// replies, connecting first if needed. An error reply of any command is
+// returned as an error. After other errors, the connection is closed, so that
+// the next call reconnects. The caller must hold mtx.
+func (r *Redis) do(cmds ...[][]byte) ([]interface{}, error) {
+	if r.conn == nil {
+		if err := r.connect(); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := r.roundTrip(cmds)
+	if _, ok := err.(redisError); err != nil && !ok {
+		r.conn.Close()
+		r.conn = nil
+	}
+	return replies, err
+}
+
+func (r *Redis) connect() error {
+	conn, err := net.DialTimeout("tcp", r.address, redisTimeout)
+	if err != nil {
+		return err
+	}
+	r.conn, r.br = conn, bufio.NewReader(conn)
+	if r.password == "" {
+		return nil
+	}
+	if _, err := r.roundTrip([][][]byte{redisCommand("AUTH", r.password)}); err != nil {
+		conn.Close()
+		r.conn = nil
+		return fmt.Errorf("cannot authenticate: %s", err)
+	}
+	return nil
+}
+
+func (r *Redis) roundTrip(cmds [][][]byte) ([]interface{}, error) {
+	r.conn.SetDeadline(time.Now().Add(redisTimeout))
+	buf := &bytes.Buffer{}
+	for _, cmd := range cmds {
+		fmt.Fprintf(buf, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(buf, "$%d\r\n", len(arg))
+			buf.Write(arg)
+			buf.WriteString("\r\n")
+		}
+	}
+	if _, err := r.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		reply, err := readRedisReply(r.br)
+		if _, ok := err.(redisError); err != nil && !ok {
+			return nil, err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+// redisError is an error reply of Redis. The connection can still be used
+// after it.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readRedisReply reads one reply in the Redis serialization protocol (RESP).
+// Simple strings result in a string, integers in an int64, bulk strings in a
+// []byte, arrays in an []interface{}, and null bulk strings or arrays in nil.
+func readRedisReply(br *bufio.Reader) (interface{}, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply line %q", line)
+	}
+	typ, payload := line[0], line[1:len(line)-2]
+	switch typ {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			elem, err := readRedisReply(br)
+			if e, ok := err.(redisError); ok {
+				elem, err = e, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = elem
+		}
+		return elems, nil
+	}
+	return nil, errors.New("unknown reply type " + strconv.Quote(string(typ)))
+}
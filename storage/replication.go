@@ -0,0 +1,219 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+// encodeChange encodes the given record as a change for ApplyReplicated. Each
+// change is a self-contained gob stream, so that changes can be sent and
+// applied independently of each other.
+func encodeChange(rec walRecord) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(rec); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeChange(change []byte) (walRecord, error) {
+	var rec walRecord
+	if err := gob.NewDecoder(bytes.NewReader(change)).Decode(&rec); err != nil {
+		return walRecord{}, err
+	}
+	if rec.Labels["job"] == "" {
+		return walRecord{}, errors.New("change without job label")
+	}
+	return rec, nil
+}
+
+// deletionRetention is how long deletions are remembered for replication, so
+// that an older change of the deleted group arriving late (or a snapshot of a
+// peer that has not seen the deletion yet) does not bring the group back. It
+// should be well beyond the time for changes to reach all peers, including the
+// anti-entropy interval.
+const deletionRetention = time.Hour
+
+// groupChange is the last change of a group, remembered for replication.
+type groupChange struct {
+	at      time.Time
+	deleted map[string]string // The labels of the group if it was deleted.
+}
+
+// recordChange remembers the given change of the group with the given
+// grouping key. The caller must hold the write lock.
+func (dms *DiskMetricStore) recordChange(key string, rec walRecord) {
+	c := groupChange{at: rec.Changed}
+	if rec.Deleted {
+		c.deleted = rec.Labels
+	}
+	dms.lastChanges[key] = c
+}
+
+// forgetDeletions forgets the deletions older than deletionRetention and the
+// changes of groups not stored anymore otherwise (like the groups restored
+// over). The caller must hold the write lock.
+func (dms *DiskMetricStore) forgetDeletions(now time.Time) {
+	for key, c := range dms.lastChanges {
+		if _, ok := dms.metricFamilies[key]; ok {
+			continue
+		}
+		if c.deleted == nil || now.Sub(c.at) > deletionRetention {
+			delete(dms.lastChanges, key)
+		}
+	}
+}
+
+// replicateGroup passes the given record on to the replication hook, if any.
+// The caller must hold the write lock.
+func (dms *DiskMetricStore) replicateGroup(rec walRecord) {
+	if dms.replicate == nil {
+		return
+	}
+	change, err := encodeChange(rec)
+	if err != nil {
+		logging.Error("Error encoding group for replication.", "group", FormatGroup(rec.Labels), "err", err)
+		return
+	}
+	dms.replicate(change)
+}
+
+// ApplyReplicated implements the MetricStore interface. Changes older than the
+// last change of the same group (by the time of the change where it
+// originated) are ignored, so that the last writer wins no matter in which
+// order changes arrive. Changes that would not have been accepted as a push,
+// like invalid ones or those beyond the limits of the store, are logged,
+// counted as rejected pushes, and ignored, too.
+func (dms *DiskMetricStore) ApplyReplicated(changes [][]byte) error {
+	recs := make([]walRecord, len(changes))
+	groups := make([]MetricGroup, len(changes))
+	for i, change := range changes {
+		rec, err := decodeChange(change)
+		if err != nil {
+			return fmt.Errorf("cannot decode change %d: %s", i, err)
+		}
+		if !rec.Deleted {
+			if groups[i], err = recordGroup(rec); err != nil {
+				return fmt.Errorf("cannot decode change %d: %s", i, err)
+			}
+		}
+		recs[i] = rec
+	}
+
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	for i, rec := range recs {
+		key := GroupingKeyFor(rec.Labels)
+		if last, ok := dms.lastChanges[key]; ok && rec.Changed.Before(last.at) {
+			continue
+		}
+		var group *MetricGroup
+		if !rec.Deleted {
+			if reason, err := dms.checkReplicated(groups[i]); err != nil {
+				rejectedWriteRequests.WithLabelValues(reason).Inc()
+				logging.Warn("Ignoring replicated change.", "group", FormatGroup(rec.Labels), "reason", reason, "err", err)
+				continue
+			}
+			group = &groups[i]
+		}
+		dms.replaceGroup(key, group)
+		dms.recordChange(key, rec)
+		// Not replicated again, which would send the change back and
+		// forth between the peers forever.
+		if dms.wal != nil && dms.routing.file(rec.Labels, dms.persistenceFile) != "" {
+			dms.wal.append(rec)
+		}
+	}
+	dms.evict()
+	if dms.pool != nil {
+		dms.pool.maybeRebuild(dms.metricFamilies)
+	}
+	dms.setSizeGauges()
+	atomic.AddUint64(&dms.version, 1)
+	return nil
+}
+
+// checkReplicated returns an error (and the reason as for rejected pushes) if
+// the given group would not have been accepted as a push replacing the stored
+// group. The caller must hold the lock.
+func (dms *DiskMetricStore) checkReplicated(group MetricGroup) (string, error) {
+	req := WriteRequest{
+		Labels:         group.Labels,
+		MetricFamilies: make(map[string]*dto.MetricFamily, len(group.Metrics)),
+		Replace:        true,
+	}
+	for name, tmf := range group.Metrics {
+		req.MetricFamilies[name] = tmf.MetricFamily
+	}
+	if err := validateWriteRequest(req); err != nil {
+		return "invalid", err
+	}
+	if dms.nonFinite == NonFiniteReject {
+		if err := checkFinite(req.MetricFamilies); err != nil {
+			return "non_finite", err
+		}
+	}
+	if dms.maxLabels > 0 {
+		if err := dms.checkLabelCount(req.MetricFamilies, req.Labels); err != nil {
+			return "too_many_labels", err
+		}
+	}
+	if err := dms.checkLimits(req); err == ErrTooManyGroups {
+		return "too_many_groups", err
+	} else if err != nil {
+		return "too_many_metric_families", err
+	}
+	return "", nil
+}
+
+// ReplicationSnapshot implements the MetricStore interface. It includes the
+// deletions remembered for replication (see deletionRetention), so that peers
+// applying it catch up on deletions they have missed.
+func (dms *DiskMetricStore) ReplicationSnapshot() [][]byte {
+	dms.lock.RLock()
+	defer dms.lock.RUnlock()
+	changes := make([][]byte, 0, len(dms.metricFamilies))
+	for key, group := range dms.metricFamilies {
+		rec := groupRecord(group)
+		rec.Changed = dms.lastChanges[key].at
+		change, err := encodeChange(rec)
+		if err != nil {
+			logging.Error("Error encoding group for replication.", "group", FormatGroup(group.Labels), "err", err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	for key, c := range dms.lastChanges {
+		if _, ok := dms.metricFamilies[key]; ok || c.deleted == nil {
+			continue
+		}
+		change, err := encodeChange(walRecord{Labels: c.deleted, Deleted: true, Changed: c.at})
+		if err != nil {
+			logging.Error("Error encoding deletion for replication.", "group", FormatGroup(c.deleted), "err", err)
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
@@ -0,0 +1,102 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// PersistenceRouting routes groups to separate persistence files by the value
+// of one of their grouping labels. Each file is written and restored
+// independently, while the groups of all files are exposed together.
+type PersistenceRouting struct {
+	// Label is the grouping label whose value selects the file, e.g. "job".
+	Label string
+	// Files maps label values to the file the groups with that value are
+	// persisted to. Groups with any other value are persisted to the
+	// persistence file passed to NewDiskMetricStore (or not at all if that
+	// is empty).
+	Files map[string]string
+}
+
+// ParsePersistenceRouting parses a PersistenceRouting of the form
+// "<label>:<value>=<file>,<value>=<file>,...", e.g.
+// "job:tenant-a=/mnt/a/pushgateway.db,tenant-b=/mnt/b/pushgateway.db". The
+// empty string results in nil, i.e. no routing.
+func ParsePersistenceRouting(s string) (*PersistenceRouting, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid persistence routing %q, must be of the form '<label>:<value>=<file>,...'", s)
+	}
+	r := &PersistenceRouting{Label: parts[0], Files: map[string]string{}}
+	if !labelNameRE.MatchString(r.Label) {
+		return nil, fmt.Errorf("cannot route persistence by invalid label name %q", r.Label)
+	}
+	for _, route := range strings.Split(parts[1], ",") {
+		vf := strings.SplitN(route, "=", 2)
+		if len(vf) != 2 || vf[0] == "" || vf[1] == "" {
+			return nil, fmt.Errorf("invalid persistence route %q, must be of the form '<value>=<file>'", route)
+		}
+		if _, ok := r.Files[vf[0]]; ok {
+			return nil, fmt.Errorf("duplicate persistence route for %s %q", r.Label, vf[0])
+		}
+		r.Files[vf[0]] = vf[1]
+	}
+	return r, nil
+}
+
+// file returns the file the group with the given grouping labels is persisted
+// to, defaulting to defaultFile (also for groups without the routing label).
+func (r *PersistenceRouting) file(labels map[string]string, defaultFile string) string {
+	if r == nil {
+		return defaultFile
+	}
+	value, ok := labels[r.Label]
+	if !ok {
+		return defaultFile
+	}
+	if f, ok := r.Files[value]; ok {
+		return f
+	}
+	return defaultFile
+}
+
+// files returns all files of the routing plus defaultFile (if not empty),
+// sorted and without duplicates.
+func (r *PersistenceRouting) files(defaultFile string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	add := func(f string) {
+		if f != "" && !seen[f] {
+			seen[f] = true
+			result = append(result, f)
+		}
+	}
+	add(defaultFile)
+	if r != nil {
+		for _, f := range r.Files {
+			add(f)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,311 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/logging"
+)
+
+var walWriteErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "pushgateway",
+	Name:      "wal_write_errors_total",
+	Help:      "Total number of changes of groups that could not be written to the write-ahead log.",
+})
+
+func init() {
+	prometheus.MustRegister(walWriteErrors)
+}
+
+// walRecord is the state of a group after a change, as recorded in the
+// writeAheadLog. Replaying a record sets the group to that state, no matter
+// its previous state, so replaying a record more than once does no harm.
+type walRecord struct {
+	Labels  map[string]string
+	Deleted bool
+	// The metric families (serialized as protobuf) and the timestamps of
+	// their last push, in the same order. Empty if Deleted.
+	MetricFamilies [][]byte
+	Timestamps     []time.Time
+	State          persistedGroupState
+	// Changed is the time of the change at the DiskMetricStore it
+	// originated from. Only set for replication, see ApplyReplicated.
+	Changed time.Time
+}
+
+// writeAheadLog records every change of a persisted group (see
+// DiskMetricStoreOptions.WriteAheadLog) in a segment file, named like the
+// prefix followed by a dot and a sequence number. With each persist, a new
+// segment is started, and the older segments are removed once the persist has
+// succeeded. It is not safe for concurrent use; the DiskMetricStore only uses
+// it with its write lock held.
+type writeAheadLog struct {
+	prefix  string
+	seq     uint64 // Of the current segment.
+	f       *os.File
+	e       *gob.Encoder
+	records int  // In the current segment.
+	failed  bool // Whether writing to the current segment failed.
+}
+
+// openWriteAheadLog returns a writeAheadLog with a new segment, numbered after
+// the existing ones, and the names of the existing segments in order.
+func openWriteAheadLog(prefix string) (*writeAheadLog, []string, error) {
+	existing, err := walSegments(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := &writeAheadLog{prefix: prefix}
+	if len(existing) > 0 {
+		w.seq = existing[len(existing)-1].seq
+	}
+	if err := w.startSegment(); err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, len(existing))
+	for i, s := range existing {
+		names[i] = s.name
+	}
+	return w, names, nil
+}
+
+type walSegment struct {
+	name string
+	seq  uint64
+}
+
+type walSegmentsBySeq []walSegment
+
+func (s walSegmentsBySeq) Len() int           { return len(s) }
+func (s walSegmentsBySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s walSegmentsBySeq) Less(i, j int) bool { return s[i].seq < s[j].seq }
+
+// walSegments returns the existing segments with the given prefix, sorted by
+// their sequence number.
+func walSegments(prefix string) ([]walSegment, error) {
+	dir, base := filepath.Split(prefix)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []walSegment
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), base+".") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimPrefix(fi.Name(), base+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, walSegment{filepath.Join(dir, fi.Name()), seq})
+	}
+	sort.Sort(walSegmentsBySeq(segments))
+	return segments, nil
+}
+
+func (w *writeAheadLog) startSegment() error {
+	name := fmt.Sprintf("%s.%08d", w.prefix, w.seq+1)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	w.seq++
+	w.f, w.e, w.records, w.failed = f, gob.NewEncoder(f), 0, false
+	return nil
+}
+
+// closeSegment syncs and closes the given segment, removing it if it has no
+// records.
+func closeSegment(f *os.File, records int) error {
+	if f == nil {
+		return nil
+	}
+	err := f.Sync()
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if records == 0 && err == nil {
+		if rErr := os.Remove(f.Name()); !os.IsNotExist(rErr) {
+			err = rErr
+		}
+	}
+	return err
+}
+
+// rotate starts a new segment and returns the names of all older segments,
+// which can be removed (see removeSegments) once the state of the store at
+// the time of the call has been persisted. If no new segment can be started,
+// the current one is kept and an error is returned.
+func (w *writeAheadLog) rotate() ([]string, error) {
+	f, records := w.f, w.records
+	if err := w.startSegment(); err != nil {
+		return nil, err
+	}
+	if err := closeSegment(f, records); err != nil {
+		logging.Error("Error closing write-ahead log segment.", "err", err)
+	}
+	segments, err := walSegments(w.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range segments {
+		if s.seq < w.seq {
+			names = append(names, s.name)
+		}
+	}
+	return names, nil
+}
+
+// removeSegments removes the given segments, logging errors.
+func removeSegments(names []string) {
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logging.Error("Error removing write-ahead log segment.", "file", name, "err", err)
+		}
+	}
+}
+
+// Close closes the current segment, see closeSegment.
+func (w *writeAheadLog) Close() error {
+	f := w.f
+	w.f, w.e = nil, nil
+	return closeSegment(f, w.records)
+}
+
+// append records the given state of a group. Errors are logged (once per
+// segment) and counted, as the change has already happened in memory.
+func (w *writeAheadLog) append(r walRecord) {
+	err := io.ErrClosedPipe
+	if w.e != nil {
+		err = w.e.Encode(r)
+	}
+	if err != nil {
+		walWriteErrors.Inc()
+		if !w.failed {
+			logging.Error("Error writing to write-ahead log, changes are only persisted with the next persist.", "err", err)
+			w.failed = true
+		}
+		return
+	}
+	w.records++
+}
+
+// groupRecord returns the walRecord for the given state of a group.
+func groupRecord(group MetricGroup) walRecord {
+	r := walRecord{
+		Labels: group.Labels,
+		State:  persistedGroupState{Expiration: group.Expiration, LastPushFailure: group.LastPushFailure, LastPushInfo: group.LastPushInfo, LastEmptyPush: group.LastEmptyPush},
+	}
+	for _, name := range sortedNames(group.Metrics) {
+		tmf := group.Metrics[name]
+		buf, err := proto.Marshal(tmf.MetricFamily)
+		if err != nil {
+			// Cannot happen for a metric family that has been
+			// unmarshaled or validated before.
+			logging.Error("Error marshaling metric family for the write-ahead log.", "name", name, "err", err)
+			continue
+		}
+		r.MetricFamilies = append(r.MetricFamilies, buf)
+		r.Timestamps = append(r.Timestamps, tmf.Timestamp)
+	}
+	return r
+}
+
+// replayWAL applies the records in the given segments to groups, in order. A
+// segment ending with an incomplete record (as left behind by a crash) is
+// replayed up to that record. Other errors abort the replay.
+func replayWAL(segments []string, groups GroupingKeyToMetricGroup) error {
+	for _, name := range segments {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		n, err := replayWALSegment(f, groups)
+		f.Close()
+		if err == io.ErrUnexpectedEOF {
+			logging.Warn("Write-ahead log segment ends with an incomplete record.", "file", name, "replayed_records", n)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot replay write-ahead log segment '%s': %s", name, err)
+		}
+	}
+	return nil
+}
+
+func replayWALSegment(r io.Reader, groups GroupingKeyToMetricGroup) (int, error) {
+	d := gob.NewDecoder(r)
+	for n := 0; ; n++ {
+		var rec walRecord
+		if err := d.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		key := GroupingKeyFor(rec.Labels)
+		if rec.Deleted {
+			delete(groups, key)
+			continue
+		}
+		group, err := recordGroup(rec)
+		if err != nil {
+			return n, fmt.Errorf("record %d: %s", n, err)
+		}
+		groups[key] = group
+	}
+}
+
+// recordGroup returns the group recorded by the given record, which must not
+// be a deletion.
+func recordGroup(rec walRecord) (MetricGroup, error) {
+	if len(rec.MetricFamilies) != len(rec.Timestamps) {
+		return MetricGroup{}, fmt.Errorf("%d metric families, but %d timestamps", len(rec.MetricFamilies), len(rec.Timestamps))
+	}
+	names := make(NameToTimestampedMetricFamilyMap, len(rec.MetricFamilies))
+	for i, buf := range rec.MetricFamilies {
+		mf := &dto.MetricFamily{}
+		if err := proto.Unmarshal(buf, mf); err != nil {
+			return MetricGroup{}, err
+		}
+		names[mf.GetName()] = TimestampedMetricFamily{MetricFamily: mf, Timestamp: rec.Timestamps[i]}
+	}
+	return MetricGroup{
+		Labels:          rec.Labels,
+		Metrics:         names,
+		Expiration:      rec.State.Expiration,
+		LastPushFailure: rec.State.LastPushFailure,
+		LastPushInfo:    rec.State.LastPushInfo,
+		LastEmptyPush:   rec.State.LastEmptyPush,
+	}, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prometheus/pushgateway/handler"
+)
+
+// webConfig is the content of the web configuration file given by
+// -web.config.file. Its keys resemble the web configuration of Prometheus,
+// but it is JSON, and the password hashes are unsalted SHA-256 rather than
+// bcrypt, so that it is not compatible.
+type webConfig struct {
+	// TLSServerConfig, if set, replaces the -web.tls-* flags.
+	TLSServerConfig *tlsServerConfig `json:"tls_server_config"`
+	// BasicAuthUsers maps user names to the hex-encoded SHA-256 hashes of
+	// their passwords. If not empty, all requests require the credentials
+	// of one of the users.
+	BasicAuthUsers map[string]string `json:"basic_auth_users"`
+}
+
+// tlsServerConfig configures the HTTPS server like the -web.tls-* flags.
+type tlsServerConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+	// ClientAuthType is one of the names in clientAuthTypes.
+	ClientAuthType string   `json:"client_auth_type"`
+	MinVersion     string   `json:"min_version"`
+	CipherSuites   []string `json:"cipher_suites"`
+}
+
+// clientAuthTypes maps the client authentication types of the web
+// configuration to their values. With VerifyClientCertIfGiven, changing
+// requests still require a verified client certificate (like with
+// -web.tls-client-ca-file).
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// loadWebConfig reads the web configuration file. An empty file name results
+// in the empty configuration.
+func loadWebConfig(file string) (*webConfig, error) {
+	cfg := &webConfig{}
+	if file == "" {
+		return cfg, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %s", file, err)
+	}
+	if err := handler.CheckBasicAuthUsers(cfg.BasicAuthUsers); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// checkAuthentication checks that the web configuration and the configuration
+// do not configure conflicting authentication methods.
+func checkAuthentication(webCfg *webConfig, cfg *config) error {
+	if len(webCfg.BasicAuthUsers) > 0 && len(cfg.Tokens) > 0 {
+		return errors.New("API tokens cannot be combined with basic authentication, as both use the Authorization header")
+	}
+	return nil
+}
+
+// tlsConfig returns the TLS configuration for the server, see loadTLSConfig.
+// The certificate and key are required. The client authentication type
+// defaults to VerifyClientCertIfGiven with a client CA file and to
+// NoClientCert otherwise.
+func (c *tlsServerConfig) tlsConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("tls_server_config requires cert_file and key_file")
+	}
+	minVersion := c.MinVersion
+	if minVersion == "" {
+		minVersion = "TLS12"
+	}
+	authType := c.ClientAuthType
+	if authType == "" {
+		authType = "NoClientCert"
+		if c.ClientCAFile != "" {
+			authType = "VerifyClientCertIfGiven"
+		}
+	}
+	clientAuth, ok := clientAuthTypes[authType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q, must be one of NoClientCert, VerifyClientCertIfGiven, RequireAndVerifyClientCert", authType)
+	}
+	switch {
+	case clientAuth == tls.NoClientCert && c.ClientCAFile != "":
+		return nil, errors.New("client_ca_file cannot be used with client_auth_type NoClientCert")
+	case clientAuth != tls.NoClientCert && c.ClientCAFile == "":
+		return nil, fmt.Errorf("client_auth_type %s requires client_ca_file", authType)
+	}
+	return loadTLSConfig(c.CertFile, c.KeyFile, c.ClientCAFile, minVersion, strings.Join(c.CipherSuites, ","), clientAuth)
+}